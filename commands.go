@@ -0,0 +1,494 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"goNotes/internal"
+	"goNotes/internal/cfg"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// runCommand runs a CLI subcommand against the profile database instead of
+// starting the server.
+func runCommand(args []string) error {
+	switch args[0] {
+	case "export":
+		return runExport(args[1:])
+	case "import":
+		return runImport(args[1:])
+	case "backup":
+		return runBackup(args[1:])
+	case "restore":
+		return runRestore(args[1:])
+	case "migrate":
+		return runMigrate(args[1:])
+	case "user":
+		return runUser(args[1:])
+	case "token":
+		return runToken(args[1:])
+	case "rekey":
+		return runRekey(args[1:])
+	case "storage":
+		return runStorage(args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	output := flags.String("o", "goNotes-export-"+time.Now().Format("2006-01-02")+".zip", "Output ZIP file, or - for stdout")
+	userName := flags.String("user", "", "Account whose notes to export; defaults to the first account")
+	flags.Parse(args)
+
+	service := openNotesService()
+	defer service.DB.Close()
+	ctx, err := userContext(service, *userName)
+	if err != nil {
+		return err
+	}
+
+	if *output == "-" {
+		return service.Export(ctx, os.Stdout)
+	}
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := service.Export(ctx, file); err != nil {
+		file.Close()
+		os.Remove(*output)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported notes to %s\n", *output)
+	return nil
+}
+
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", internal.ImportFormatMarkdown, "Source format: markdown, keep or telegram")
+	userName := flags.String("user", "", "Account to import the notes into; defaults to the first account")
+	flags.Parse(args)
+	args = flags.Args()
+	if len(args) != 1 {
+		return errors.New("usage: goNotes import [-format markdown|keep|telegram] [-user name] <folder or ZIP file>")
+	}
+	info, err := os.Stat(args[0])
+	if err != nil {
+		return err
+	}
+	var source fs.FS
+	if info.IsDir() {
+		source = os.DirFS(args[0])
+	} else {
+		archive, err := zip.OpenReader(args[0])
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+		source = archive
+	}
+
+	service := openNotesService()
+	defer service.DB.Close()
+	ctx, err := userContext(service, *userName)
+	if err != nil {
+		return err
+	}
+
+	result, err := service.Import(ctx, *format, source)
+	for _, failure := range result.Errors {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", failure.Path, failure.Error)
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d notes, %d files failed\n", result.Imported, len(result.Errors))
+	return err
+}
+
+func runBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	output := flags.String("o", "", "Output ZIP file; by default a timestamped archive in the backup directory")
+	flags.Parse(args)
+
+	config := cfg.LoadConfig()
+	service := openNotesService()
+	defer service.DB.Close()
+
+	if *output == "" {
+		name, err := service.BackupToDir(context.Background(), config.GetBackupDir(), config.BackupKeep)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Backup written to %s\n", name)
+		return nil
+	}
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := service.Backup(context.Background(), file); err != nil {
+		file.Close()
+		os.Remove(*output)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Backup written to %s\n", *output)
+	return nil
+}
+
+func runRestore(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: goNotes restore <backup ZIP>; stop the server first")
+	}
+	var secret []byte
+	if config := cfg.LoadConfig(); config.EncryptDatabase {
+		var err error
+		if secret, err = config.GetUploadsSecret(); err != nil {
+			return err
+		}
+	}
+	previous, err := internal.RestoreBackup(args[0], cfg.GetProfilePath(), secret)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Restored %s into %s\n", args[0], cfg.GetProfilePath())
+	if previous != "" {
+		fmt.Fprintf(os.Stderr, "The previous data was moved to %s\n", previous)
+	}
+	return nil
+}
+
+func runMigrate(args []string) error {
+	if len(args) != 1 || (args[0] != "status" && args[0] != "up") {
+		return errors.New("usage: goNotes migrate status|up")
+	}
+	var database *sql.DB
+	if args[0] == "up" {
+		// openNotesService applies the pending migrations.
+		service := openNotesService()
+		backfillAttachmentMetadata(service)
+		database = service.DB
+	} else {
+		config := cfg.LoadConfig()
+		database = openDB(config, openUploadsKey(config, filepath.Join(cfg.GetProfilePath(), "uploads")))
+	}
+	defer database.Close()
+
+	statuses, err := internal.MigrationStatuses(context.Background(), database)
+	if err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		appliedAt := "pending"
+		if status.AppliedAt != "" {
+			appliedAt = "applied " + status.AppliedAt
+		}
+		fmt.Printf("%3d  %-24s %s\n", status.Version, status.Name, appliedAt)
+	}
+	return nil
+}
+
+const userUsage = "usage: goNotes user add|passwd|remove <name>, or goNotes user list"
+
+func runUser(args []string) error {
+	if len(args) == 0 {
+		return errors.New(userUsage)
+	}
+	service := openNotesService()
+	defer service.DB.Close()
+	ctx := context.Background()
+
+	if args[0] == "list" {
+		users, err := service.ListUsers(ctx)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			fmt.Printf("%3d  %-24s created %s\n", user.ID, user.Name, user.CreatedAt)
+		}
+		return nil
+	}
+	if len(args) != 2 {
+		return errors.New(userUsage)
+	}
+	name := args[1]
+	switch args[0] {
+	case "add":
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		user, err := service.CreateUser(ctx, name, password)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Created user %s (id %d)\n", user.Name, user.ID)
+		if user.ID == internal.DefaultOwnerID {
+			fmt.Fprintln(os.Stderr, "Existing notes now belong to this user, and the web UI requires login.")
+		}
+	case "passwd":
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if err := service.SetPassword(ctx, name, password); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Password changed for %s; existing sessions were signed out\n", name)
+	case "remove":
+		deleted, err := service.DeleteUser(ctx, name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Removed user %s and %d notes\n", name, deleted)
+	default:
+		return errors.New(userUsage)
+	}
+	return nil
+}
+
+const tokenUsage = "usage: goNotes token add [-user name] [-scope read|write|delete] [-tag name]... [-expires 90d] <name>, " +
+	"goNotes token list [-user name], or goNotes token revoke [-user name] <id or name>"
+
+// tagFlags collects a repeatable -tag flag.
+type tagFlags []string
+
+func (t *tagFlags) String() string { return strings.Join(*t, ",") }
+
+func (t *tagFlags) Set(value string) error {
+	*t = append(*t, value)
+	return nil
+}
+
+func runToken(args []string) error {
+	if len(args) == 0 {
+		return errors.New(tokenUsage)
+	}
+	flags := flag.NewFlagSet("token "+args[0], flag.ExitOnError)
+	userName := flags.String("user", "", "Account the token acts for; defaults to the first account")
+	scope := flags.String("scope", internal.ScopeRead, "Token scope: read, write or delete")
+	expires := flags.String("expires", "", "Token lifetime in days, such as 90d, or as a duration, such as 12h; never expires by default")
+	var tags tagFlags
+	flags.Var(&tags, "tag", "Limit the token to notes with this tag; may be repeated")
+	flags.Parse(args[1:])
+
+	service := openNotesService()
+	defer service.DB.Close()
+	ctx, err := userContext(service, *userName)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case args[0] == "list" && flags.NArg() == 0:
+		tokens, err := service.ListTokens(ctx)
+		if err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			expiresAt, lastUsedAt := "never", "never"
+			if token.ExpiresAt != nil {
+				expiresAt = *token.ExpiresAt
+			}
+			if token.LastUsedAt != nil {
+				lastUsedAt = *token.LastUsedAt
+			}
+			restriction := "all notes"
+			if len(token.Tags) > 0 {
+				restriction = "#" + strings.Join(token.Tags, " #")
+			}
+			fmt.Printf("%3d  %-24s %-6s %-20s expires %s, last used %s\n",
+				token.ID, token.Name, token.Scope, restriction, expiresAt, lastUsedAt)
+		}
+	case args[0] == "add" && flags.NArg() == 1:
+		lifetime, err := parseLifetime(*expires)
+		if err != nil {
+			return err
+		}
+		token, secret, err := service.CreateToken(ctx, internal.CreateTokenOptions{
+			Name:      flags.Arg(0),
+			Scope:     *scope,
+			Tags:      tags,
+			ExpiresIn: lifetime,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Created %s token %s (id %d); the secret is shown only once:\n", token.Scope, token.Name, token.ID)
+		fmt.Println(secret)
+	case args[0] == "revoke" && flags.NArg() == 1:
+		if err := service.RevokeToken(ctx, flags.Arg(0)); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Revoked token %s\n", flags.Arg(0))
+	default:
+		return errors.New(tokenUsage)
+	}
+	return nil
+}
+
+const rekeyUsage = "usage: goNotes rekey [-new-key-file path] [-decrypt]; stop the server first"
+
+// runRekey re-encrypts the uploads and an encrypted database under a new
+// key, or decrypts them.
+func runRekey(args []string) error {
+	flags := flag.NewFlagSet("rekey", flag.ExitOnError)
+	newKeyFile := flags.String("new-key-file", "", "File whose contents unlock the new key; by default a new passphrase is read from stdin")
+	decrypt := flags.Bool("decrypt", false, "Store the uploads and the database unencrypted and remove the uploads key")
+	flags.Parse(args)
+	if flags.NArg() != 0 || (*decrypt && *newKeyFile != "") {
+		return errors.New(rekeyUsage)
+	}
+
+	config := cfg.LoadConfig()
+	uploadsDir := filepath.Join(cfg.GetProfilePath(), "uploads")
+	var current, next []byte
+	var err error
+	if _, err := os.Stat(filepath.Join(uploadsDir, internal.UploadsKeyFileName)); err == nil {
+		if current, err = config.GetUploadsSecret(); err != nil {
+			return err
+		}
+	}
+	if !*decrypt {
+		if *newKeyFile != "" {
+			next, err = os.ReadFile(*newKeyFile)
+		} else {
+			var passphrase string
+			passphrase, err = readSecret("New uploads passphrase")
+			next = []byte(passphrase)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	database := filepath.Join(cfg.GetProfilePath(), "notes.db")
+	rewritten, err := internal.RekeyUploads(context.Background(), uploadsDir, openStorage(config, uploadsDir), database, current, next)
+	if err != nil {
+		return err
+	}
+	if *decrypt {
+		fmt.Fprintf(os.Stderr, "Decrypted %d files; turn EncryptUploads and EncryptDatabase off in the config\n", rewritten)
+	} else {
+		fmt.Fprintf(os.Stderr, "Encrypted %d files with a new key; unlock it with the new key file or passphrase from now on\n", rewritten)
+	}
+	return nil
+}
+
+const storageUsage = "usage: goNotes storage migrate [-from local|s3] [-to local|s3] [-delete]; stop the server first"
+
+// runStorage copies the stored files between storage backends.
+func runStorage(args []string) error {
+	if len(args) == 0 || args[0] != "migrate" {
+		return errors.New(storageUsage)
+	}
+	config := cfg.LoadConfig()
+	flags := flag.NewFlagSet("storage migrate", flag.ExitOnError)
+	from := flags.String("from", "local", "Storage to copy the files from")
+	to := flags.String("to", config.Storage, "Storage to copy the files to; defaults to Storage in the config")
+	remove := flags.Bool("delete", false, "Delete the files from the source once all of them are copied")
+	flags.Parse(args[1:])
+	if flags.NArg() != 0 || *from == *to {
+		return errors.New(storageUsage)
+	}
+
+	uploadsDir := filepath.Join(cfg.GetProfilePath(), "uploads")
+	source, err := newStorage(config, *from, uploadsDir)
+	if err != nil {
+		return err
+	}
+	target, err := newStorage(config, *to, uploadsDir)
+	if err != nil {
+		return err
+	}
+	copied, err := internal.CopyStorage(context.Background(), source, target, uploadsDir, *remove)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Copied %d files from %s to %s storage\n", copied, *from, *to)
+	if config.Storage != *to {
+		fmt.Fprintf(os.Stderr, "Set Storage to %q in the config to use them\n", *to)
+	}
+	return nil
+}
+
+// parseLifetime reads a token lifetime given in days, such as 90d, or as a
+// Go duration. An empty value means no expiry.
+func parseLifetime(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid lifetime %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	lifetime, err := time.ParseDuration(value)
+	if err != nil || lifetime <= 0 {
+		return 0, fmt.Errorf("invalid lifetime %q", value)
+	}
+	return lifetime, nil
+}
+
+// readPassword reads a password from the first line of stdin, so it can be
+// typed at the prompt or piped in by a script.
+func readPassword() (string, error) {
+	return readSecret("Password")
+}
+
+// readSecret prompts for a secret. On a terminal the typed text is not
+// echoed; piped input is read up to the end of the first line.
+func readSecret(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt+": ")
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		secret, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("read %s: %w", strings.ToLower(prompt), err)
+		}
+		return string(secret), nil
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", fmt.Errorf("read %s: %w", strings.ToLower(prompt), err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// userContext scopes CLI calls to the named account, or to the default
+// notebook when no name is given.
+func userContext(service *internal.NotesService, name string) (context.Context, error) {
+	ctx := context.Background()
+	if name == "" {
+		return ctx, nil
+	}
+	users, err := service.ListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if strings.EqualFold(user.Name, name) {
+			return internal.WithUser(ctx, user.ID), nil
+		}
+	}
+	return nil, fmt.Errorf("user %q not found", name)
+}
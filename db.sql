@@ -1,4 +1,50 @@
--- Основная таблица сообщений
+-- Схема после последней миграции из internal/migrations.go. При запуске
+-- goNotes применяет миграции, этот файл служит справочником и проверяется
+-- тестами на совпадение с результатом миграций.
+
+-- Применённые миграции схемы
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Учётные записи; данные, созданные до их появления, принадлежат пользователю 1
+CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+    password_hash TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Сессии входа; хранится только SHA-256 токена из cookie
+CREATE TABLE IF NOT EXISTS sessions (
+    token_hash TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    expires_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+
+-- Персональные токены доступа для API и MCP; хранится только SHA-256 секрета.
+-- scope: read, write или delete (каждый включает предыдущие), tags — через
+-- пробел, ограничивают токен заметками с одним из этих тегов
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    owner_id INTEGER NOT NULL DEFAULT 1,
+    name TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    scope TEXT NOT NULL DEFAULT 'read',
+    tags TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    expires_at DATETIME,
+    last_used_at DATETIME,
+    UNIQUE (owner_id, name)
+);
+
+-- Основная таблица сообщений, owner_id — владелец заметки
 CREATE TABLE IF NOT EXISTS messages (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     content TEXT,
@@ -10,24 +56,62 @@ CREATE TABLE IF NOT EXISTS messages (
     is_deleted INTEGER DEFAULT 0,
     is_expanded INTEGER DEFAULT 0,
     color TEXT DEFAULT '',
-    sort_order INTEGER DEFAULT 0
+    sort_order INTEGER DEFAULT 0,
+    version INTEGER DEFAULT 1,
+    owner_id INTEGER NOT NULL DEFAULT 1,
+    is_encrypted INTEGER NOT NULL DEFAULT 0
 );
 
--- Таблица вложений (привязана к сообщению)
+-- Таблица вложений (привязана к сообщению). file_path и thumbnail_path —
+-- имена в ссылках /files/, сами файлы лежат в blobs; у вложений до blobs
+-- blob_hash пуст, пока их не перенесёт MigrateLegacyUploads
 CREATE TABLE IF NOT EXISTS attachments (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     message_id INTEGER NOT NULL,
     file_path TEXT NOT NULL,
     thumbnail_path TEXT DEFAULT '',
     file_type TEXT, -- image, video, pdf и т.д.
+    blob_hash TEXT,
+    thumbnail_hash TEXT,
+    original_name TEXT NOT NULL DEFAULT '',
+    size INTEGER NOT NULL DEFAULT 0,
+    mime_type TEXT NOT NULL DEFAULT '', -- по содержимому, а не по расширению
+    width INTEGER, -- размер изображения с учётом ориентации EXIF
+    height INTEGER,
+    taken_at TEXT, -- время съёмки из EXIF, как его записала камера, без часового пояса
+    duration REAL, -- длительность аудио и видео в секундах
+    inspected INTEGER NOT NULL DEFAULT 0, -- 1, когда метаданные прочитаны из файла
     FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
 );
 
--- Таблицы тегов (остаются без изменений)
+-- Содержимое вложений и превью: файл <hash> в хранилище с SHA-256 содержимого
+-- (HMAC-SHA256 с ключом вложений, если они шифруются).
+-- ref_count считают триггеры на attachments; файл удаляется, когда он падает до нуля
+CREATE TABLE IF NOT EXISTS blobs (
+    hash TEXT PRIMARY KEY,
+    size INTEGER NOT NULL,
+    ref_count INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER IF NOT EXISTS attachments_blobs_insert AFTER INSERT ON attachments BEGIN
+    UPDATE blobs SET ref_count = ref_count + 1 WHERE hash IN (NEW.blob_hash, NEW.thumbnail_hash);
+END;
+CREATE TRIGGER IF NOT EXISTS attachments_blobs_delete AFTER DELETE ON attachments BEGIN
+    UPDATE blobs SET ref_count = ref_count - 1 WHERE hash IN (OLD.blob_hash, OLD.thumbnail_hash);
+END;
+CREATE TRIGGER IF NOT EXISTS attachments_blobs_update AFTER UPDATE OF blob_hash, thumbnail_hash ON attachments BEGIN
+    UPDATE blobs SET ref_count = ref_count - 1 WHERE hash IN (OLD.blob_hash, OLD.thumbnail_hash);
+    UPDATE blobs SET ref_count = ref_count + 1 WHERE hash IN (NEW.blob_hash, NEW.thumbnail_hash);
+END;
+
+-- Теги; имена уникальны в пределах владельца
 CREATE TABLE IF NOT EXISTS tags (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
-    name TEXT UNIQUE,
-    sort_order INTEGER DEFAULT 0
+    owner_id INTEGER NOT NULL DEFAULT 1,
+    name TEXT,
+    sort_order INTEGER DEFAULT 0,
+    UNIQUE (owner_id, name)
 );
 
 CREATE TABLE IF NOT EXISTS message_tags (
@@ -38,9 +122,97 @@ CREATE TABLE IF NOT EXISTS message_tags (
     FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
 );
 
+-- История содержимого заметок; последняя ревизия совпадает с текущим content
+CREATE TABLE IF NOT EXISTS message_revisions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    message_id INTEGER NOT NULL,
+    content TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_revisions_message_id ON message_revisions(message_id, id DESC);
+
+-- Ссылки [[note:ID]] и [[Заголовок]] между заметками
+CREATE TABLE IF NOT EXISTS message_links (
+    message_id INTEGER NOT NULL,
+    target_id INTEGER NOT NULL,
+    PRIMARY KEY (message_id, target_id),
+    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+    FOREIGN KEY (target_id) REFERENCES messages(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_links_target_id ON message_links(target_id);
+
+-- Публичные ссылки на отдельные заметки. Токен хранится открыто, чтобы ссылку
+-- можно было скопировать снова; password_hash пуст у ссылок без пароля
+CREATE TABLE IF NOT EXISTS shares (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    message_id INTEGER NOT NULL,
+    token TEXT NOT NULL UNIQUE,
+    password_hash TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    expires_at DATETIME,
+    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_shares_message_id ON shares(message_id);
+
+-- Ключи зашифрованных заметок: случайный ключ данных владельца, зашифрованный
+-- ключом из его парольной фразы (PBKDF2-SHA256 с солью salt)
+CREATE TABLE IF NOT EXISTS note_keys (
+    owner_id INTEGER PRIMARY KEY,
+    salt TEXT NOT NULL,
+    iterations INTEGER NOT NULL,
+    wrapped_key TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Журнал изменений для live-обновлений и возобновления потока событий
+CREATE TABLE IF NOT EXISTS changes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    action TEXT NOT NULL,
+    note_id INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    owner_id INTEGER NOT NULL DEFAULT 1
+);
+
+-- Ключи идемпотентности для безопасных повторов записи из офлайн-очереди;
+-- request_hash — хеш тела запроса, повтор с другим телом отклоняется
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    owner_id INTEGER NOT NULL DEFAULT 1,
+    key TEXT NOT NULL,
+    action TEXT NOT NULL,
+    note_id INTEGER NOT NULL DEFAULT 0,
+    processed INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    request_hash TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (owner_id, key)
+);
+
+-- Загрузки по частям: принятые received байт из size лежат в parts файлах
+-- .session-<id>-<n> в uploads/, пока загрузку не прикрепят к заметке
+CREATE TABLE IF NOT EXISTS upload_sessions (
+    id TEXT PRIMARY KEY,
+    owner_id INTEGER NOT NULL DEFAULT 1,
+    filename TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    received INTEGER NOT NULL DEFAULT 0,
+    parts INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
 -- Ускорение загрузки вложений
 CREATE INDEX IF NOT EXISTS idx_attachments_message_id ON attachments(message_id);
 
+-- Поиск заметки по имени файла для проверки владельца в /files/
+CREATE INDEX IF NOT EXISTS idx_attachments_file_path ON attachments(file_path);
+CREATE INDEX IF NOT EXISTS idx_attachments_thumbnail_path ON attachments(thumbnail_path);
+
+-- Поиск готового превью у вложений с тем же содержимым
+CREATE INDEX IF NOT EXISTS idx_attachments_blob_hash ON attachments(blob_hash);
+
 -- Ускорение фильтрации по тегам
 CREATE INDEX IF NOT EXISTS idx_message_tags_tag_id ON message_tags(tag_id);
 
@@ -50,6 +222,9 @@ CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at DESC);
 -- И индекс для быстрой фильтрации
 CREATE INDEX IF NOT EXISTS idx_messages_is_archived ON messages(is_archived);
 
+-- Выборка заметок владельца
+CREATE INDEX IF NOT EXISTS idx_messages_owner_id ON messages(owner_id);
+
 -- Ускорение выборки корзины
 CREATE INDEX IF NOT EXISTS idx_messages_is_deleted ON messages(is_deleted);
 
@@ -61,3 +236,8 @@ CREATE INDEX IF NOT EXISTS idx_messages_content_lower_fast ON messages(content_l
 
 -- Ускорение сортировки тегов в меню
 CREATE INDEX IF NOT EXISTS idx_tags_sort_order ON tags(sort_order DESC);
+
+-- Полнотекстовый индекс заметок, rowid совпадает с messages.id. Зашифрованные
+-- заметки в него не попадают; secure-delete стирает слова удалённых записей
+CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(content, tokenize = 'unicode61 remove_diacritics 2');
+INSERT INTO messages_fts (messages_fts, rank) VALUES ('secure-delete', 1);
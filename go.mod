@@ -4,6 +4,10 @@ go 1.25.5
 
 require (
 	github.com/modelcontextprotocol/go-sdk v1.7.0
+	github.com/yuin/goldmark v1.8.6
+	golang.org/x/term v0.40.0
+	// Pinned for the encrypted database VFS; see databaseVFSModules in
+	// internal/database_vfs.go before changing.
 	modernc.org/sqlite v1.42.2
 )
 
@@ -29,7 +33,8 @@ require (
 	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
 	golang.org/x/exp v0.0.0-20250620022241-b7579e27df2b // indirect
 	golang.org/x/sys v0.41.0 // indirect
-	modernc.org/libc v1.66.10 // indirect
+	// Pinned together with modernc.org/sqlite.
+	modernc.org/libc v1.66.10
 	modernc.org/mathutil v1.7.1 // indirect
 	modernc.org/memory v1.11.0 // indirect
 )
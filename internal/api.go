@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"archive/zip"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,6 +12,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/NYTimes/gziphandler"
 )
@@ -17,23 +20,156 @@ import (
 type ActionAny[T any] func() (T, error)
 
 type JsonFailResponse struct {
-	Error string `json:"error"`
+	Error   string      `json:"error"`
+	Current *MessageDTO `json:"current,omitempty"`
 }
 
 type JsonSuccessResponse struct {
 	Result any `json:"result"`
 }
 
-func HandleApi(router *Router, service *NotesService) {
+func HandleApi(router *Router, service *NotesService, auth *Auth) {
 	apiRouter := NewRouter()
 	gzipHandler := gziphandler.GzipHandler(apiRouter)
 
 	handleAction(apiRouter, service)
+	handleUploads(apiRouter, service)
 
 	apiRouter.Use(func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 	})
-	router.All("^/api/", gzipHandler.ServeHTTP)
+	handleAuth(router, auth)
+	// The event stream bypasses gzip so every event is flushed immediately.
+	router.Get("/api/events", auth.Require(handleEvents(service)))
+	// The export is already a compressed ZIP and is streamed as it is built.
+	router.Get("/api/export", auth.Require(handleExport(service)))
+	router.All("^/api/", auth.Require(gzipHandler.ServeHTTP))
+}
+
+// handleExport streams the notebook as a ZIP download. Errors after the first
+// byte can only be logged, because the status code has already been sent.
+func handleExport(service *NotesService) RouteHandler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := "goNotes-export-" + time.Now().Format("2006-01-02") + ".zip"
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		if err := service.Export(r.Context(), w); err != nil {
+			log.Printf("Export error: %v", err)
+		}
+	}
+}
+
+const (
+	eventsReplayBatch       = 500
+	eventsHeartbeatInterval = 25 * time.Second
+)
+
+// handleEvents streams committed changes as Server-Sent Events. A client
+// reconnecting with Last-Event-ID (or ?since=<id>) first receives the changes
+// it missed from the persisted change log, or a resync event when they were
+// pruned from it. Events on the bus only wake the stream up: changes are
+// always read from the log in ID order, because concurrent mutations may
+// publish their events in a different order than they committed.
+func handleEvents(service *NotesService) RouteHandler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok || service.Events == nil {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		cursor, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+		if cursor <= 0 {
+			cursor, _ = strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		}
+		if cursor <= 0 {
+			var err error
+			if cursor, err = service.lastChangeID(r.Context()); err != nil {
+				log.Printf("Events cursor error: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		events, unsubscribe := service.Events.Subscribe()
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "retry: 3000\n\n")
+
+		// replay writes the changes after cursor and reports whether the
+		// stream is still usable.
+		replay := func() bool {
+			for {
+				missed, err := service.ChangesSince(r.Context(), cursor, eventsReplayBatch)
+				if errors.Is(err, ErrResyncRequired) {
+					// The resync event carries the current cursor as its ID,
+					// so the client continues from there once it has
+					// reloaded everything.
+					if cursor, err = service.lastChangeID(r.Context()); err != nil {
+						log.Printf("Events cursor error: %v", err)
+						return false
+					}
+					if _, err := fmt.Fprintf(w, "event: resync\nid: %d\ndata: {}\n\n", cursor); err != nil {
+						return false
+					}
+					continue
+				}
+				if err != nil {
+					log.Printf("Events replay error: %v", err)
+					return false
+				}
+				for _, event := range missed {
+					if err := writeEvent(w, event); err != nil {
+						return false
+					}
+					cursor = event.ID
+				}
+				if len(missed) < eventsReplayBatch {
+					return true
+				}
+			}
+		}
+		if !replay() {
+			return
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(eventsHeartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event, ok := <-events:
+				if !ok {
+					// The client fell behind; it resumes with Last-Event-ID.
+					return
+				}
+				if event.ID <= cursor || event.OwnerID != ownerID(r.Context()) {
+					continue
+				}
+				if !replay() {
+					return
+				}
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w io.Writer, event NoteEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", event.ID, data)
+	return err
 }
 
 func handleAction(router *Router, service *NotesService) {
@@ -51,6 +187,8 @@ func handleAction(router *Router, service *NotesService) {
 			searchQuery := strings.TrimSpace(query.Get("q"))
 			onlyArchived := query.Get("archived") == "1"
 			onlyDeleted := query.Get("deleted") == "1"
+			sortMode := query.Get("sort")
+			offset, _ := strconv.Atoi(query.Get("offset"))
 
 			var tags []string
 			if tagsParam != "" {
@@ -74,6 +212,7 @@ func handleAction(router *Router, service *NotesService) {
 				ID: noteID, Query: searchQuery, Tags: tags, State: state, Limit: limit,
 				BeforeSortOrder: lastOrder, BeforeArchived: lastArchived,
 				GroupByArchived: noteID == 0 && tagsParam != "" && !onlyDeleted,
+				Sort:            sortMode, Offset: offset, Snippets: query.Get("snippets") == "1",
 			})
 			return result.Notes, err
 		})
@@ -88,15 +227,33 @@ func handleAction(router *Router, service *NotesService) {
 			if err := r.ParseMultipartForm(32 << 20); err != nil {
 				return sendMessageResponse{}, err
 			}
-			note, err := service.CreateNote(
-				r.Context(),
-				r.FormValue("content"),
-				newMultipartAttachments(r.MultipartForm.File["attachments"]),
-			)
+			note, err := service.CreateNote(r.Context(), CreateNoteOptions{
+				Content:        r.FormValue("content"),
+				Attachments:    newFormAttachments(r.MultipartForm),
+				IdempotencyKey: idempotencyKey(r, ""),
+			})
 			return sendMessageResponse{ID: note.ID}, err
 		})
 	})
 
+	router.Post("/api/import", func(w http.ResponseWriter, r *http.Request) {
+		apiCall(w, func() (ImportResult, error) {
+			if err := r.ParseMultipartForm(32 << 20); err != nil {
+				return ImportResult{}, err
+			}
+			file, header, err := r.FormFile("file")
+			if err != nil {
+				return ImportResult{}, errors.New("missing ZIP file")
+			}
+			defer file.Close()
+			archive, err := zip.NewReader(file, header.Size)
+			if err != nil {
+				return ImportResult{}, fmt.Errorf("read ZIP: %w", err)
+			}
+			return service.Import(r.Context(), r.FormValue("format"), archive)
+		})
+	})
+
 	router.Post("/api/messages/update", func(w http.ResponseWriter, r *http.Request) {
 		apiCall(w, func() (string, error) {
 			if err := r.ParseMultipartForm(32 << 20); err != nil {
@@ -110,11 +267,19 @@ func handleAction(router *Router, service *NotesService) {
 			if err != nil {
 				return "", err
 			}
+			var expectedVersion int64
+			if value := r.FormValue("version"); value != "" {
+				if expectedVersion, err = strconv.ParseInt(value, 10, 64); err != nil || expectedVersion <= 0 {
+					return "", fmt.Errorf("invalid version %q", value)
+				}
+			}
 			content := r.FormValue("content")
 			_, err = service.UpdateNote(r.Context(), id, UpdateNoteOptions{
 				Content:             &content,
-				Attachments:         newMultipartAttachments(r.MultipartForm.File["attachments"]),
+				Attachments:         newFormAttachments(r.MultipartForm),
 				DeleteAttachmentIDs: deleteAttachmentIDs,
+				ExpectedVersion:     expectedVersion,
+				IdempotencyKey:      idempotencyKey(r, ""),
 			})
 			return "ok", err
 		})
@@ -151,7 +316,7 @@ func handleAction(router *Router, service *NotesService) {
 			if err != nil || id <= 0 {
 				return "", errors.New("missing ID")
 			}
-			processed, err := service.TrashOrDelete(r.Context(), []int64{id})
+			processed, err := service.TrashOrDelete(r.Context(), []int64{id}, idempotencyKey(r, ""))
 			if err != nil {
 				return "", err
 			}
@@ -165,7 +330,8 @@ func handleAction(router *Router, service *NotesService) {
 	router.Post("/api/messages/batch-delete", func(w http.ResponseWriter, r *http.Request) {
 		apiCall(w, func() (string, error) {
 			var data struct {
-				IDs []int64 `json:"ids"`
+				IDs      []int64 `json:"ids"`
+				ClientID string  `json:"client_id"`
 			}
 			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 				return "", err
@@ -173,7 +339,7 @@ func handleAction(router *Router, service *NotesService) {
 			if len(data.IDs) == 0 {
 				return "ok", nil
 			}
-			_, err := service.TrashOrDelete(r.Context(), data.IDs)
+			_, err := service.TrashOrDelete(r.Context(), data.IDs, idempotencyKey(r, data.ClientID))
 			return "ok", err
 		})
 	})
@@ -280,6 +446,68 @@ func handleAction(router *Router, service *NotesService) {
 		})
 	})
 
+	router.Get("/api/messages/backlinks", func(w http.ResponseWriter, r *http.Request) {
+		apiCall(w, func() ([]MessageDTO, error) {
+			query := r.URL.Query()
+			id, _ := strconv.ParseInt(query.Get("id"), 10, 64)
+			limit, _ := strconv.Atoi(query.Get("limit"))
+			result, err := service.ListBacklinks(r.Context(), id, limit)
+			return result.Notes, err
+		})
+	})
+
+	router.Get("/api/messages/revisions", func(w http.ResponseWriter, r *http.Request) {
+		apiCall(w, func() ([]RevisionDTO, error) {
+			id, _ := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+			return service.ListRevisions(r.Context(), id)
+		})
+	})
+
+	router.Get("/api/messages/revisions/get", func(w http.ResponseWriter, r *http.Request) {
+		apiCall(w, func() (RevisionDTO, error) {
+			query := r.URL.Query()
+			id, _ := strconv.ParseInt(query.Get("id"), 10, 64)
+			revisionID, _ := strconv.ParseInt(query.Get("revision_id"), 10, 64)
+			return service.GetRevision(r.Context(), id, revisionID)
+		})
+	})
+
+	router.Get("/api/messages/revisions/diff", func(w http.ResponseWriter, r *http.Request) {
+		apiCall(w, func() (RevisionDiff, error) {
+			query := r.URL.Query()
+			id, _ := strconv.ParseInt(query.Get("id"), 10, 64)
+			from, _ := strconv.ParseInt(query.Get("from"), 10, 64)
+			to, _ := strconv.ParseInt(query.Get("to"), 10, 64)
+			return service.DiffRevisions(r.Context(), id, from, to)
+		})
+	})
+
+	router.Post("/api/messages/revisions/restore", func(w http.ResponseWriter, r *http.Request) {
+		apiCall(w, func() (string, error) {
+			var data struct {
+				ID         int64 `json:"id"`
+				RevisionID int64 `json:"revision_id"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				return "", err
+			}
+			_, err := service.RestoreRevision(r.Context(), data.ID, data.RevisionID)
+			return "ok", err
+		})
+	})
+
+	router.Get("/api/sync", func(w http.ResponseWriter, r *http.Request) {
+		apiCall(w, func() (SyncResult, error) {
+			query := r.URL.Query()
+			since, err := strconv.ParseInt(query.Get("since"), 10, 64)
+			if err != nil && query.Get("since") != "" {
+				return SyncResult{}, fmt.Errorf("invalid sync cursor %q", query.Get("since"))
+			}
+			limit, _ := strconv.Atoi(query.Get("limit"))
+			return service.Sync(r.Context(), SyncOptions{Since: since, Snapshot: query.Get("snapshot"), Limit: limit})
+		})
+	})
+
 	router.Get("/api/tags/list", func(w http.ResponseWriter, r *http.Request) {
 		apiCall(w, func() ([]string, error) {
 			return service.ListTags(r.Context())
@@ -297,6 +525,173 @@ func handleAction(router *Router, service *NotesService) {
 			return "ok", service.ReorderTags(r.Context(), data.Names)
 		})
 	})
+
+	router.Get("/api/tokens/list", func(w http.ResponseWriter, r *http.Request) {
+		apiCall(w, func() ([]APIToken, error) {
+			return service.ListTokens(r.Context())
+		})
+	})
+
+	router.Post("/api/tokens/create", func(w http.ResponseWriter, r *http.Request) {
+		apiCall(w, func() (createTokenResponse, error) {
+			var data struct {
+				Name          string   `json:"name"`
+				Scope         string   `json:"scope"`
+				Tags          []string `json:"tags"`
+				ExpiresInDays int      `json:"expires_in_days"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				return createTokenResponse{}, err
+			}
+			token, secret, err := service.CreateToken(r.Context(), CreateTokenOptions{
+				Name:      data.Name,
+				Scope:     data.Scope,
+				Tags:      data.Tags,
+				ExpiresIn: time.Duration(data.ExpiresInDays) * 24 * time.Hour,
+			})
+			return createTokenResponse{Token: token, Secret: secret}, err
+		})
+	})
+
+	router.Post("/api/tokens/revoke", func(w http.ResponseWriter, r *http.Request) {
+		apiCall(w, func() (string, error) {
+			var data struct {
+				ID   int64  `json:"id"`
+				Name string `json:"name"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				return "", err
+			}
+			idOrName := data.Name
+			if data.ID != 0 {
+				idOrName = strconv.FormatInt(data.ID, 10)
+			}
+			return "ok", service.RevokeToken(r.Context(), idOrName)
+		})
+	})
+
+	router.Get("/api/shares/list", func(w http.ResponseWriter, r *http.Request) {
+		apiCall(w, func() ([]Share, error) {
+			var noteID int64
+			if value := r.URL.Query().Get("note_id"); value != "" {
+				var err error
+				if noteID, err = strconv.ParseInt(value, 10, 64); err != nil {
+					return nil, err
+				}
+			}
+			return service.ListShares(r.Context(), noteID)
+		})
+	})
+
+	router.Post("/api/shares/create", func(w http.ResponseWriter, r *http.Request) {
+		apiCall(w, func() (Share, error) {
+			var data struct {
+				NoteID        int64  `json:"note_id"`
+				Password      string `json:"password"`
+				ExpiresInDays int    `json:"expires_in_days"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				return Share{}, err
+			}
+			return service.CreateShare(r.Context(), CreateShareOptions{
+				NoteID:    data.NoteID,
+				Password:  data.Password,
+				ExpiresIn: time.Duration(data.ExpiresInDays) * 24 * time.Hour,
+			})
+		})
+	})
+
+	router.Post("/api/shares/revoke", func(w http.ResponseWriter, r *http.Request) {
+		apiCall(w, func() (string, error) {
+			var data struct {
+				ID int64 `json:"id"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				return "", err
+			}
+			return "ok", service.RevokeShare(r.Context(), data.ID)
+		})
+	})
+
+	router.Get("/api/encryption/status", func(w http.ResponseWriter, r *http.Request) {
+		apiCall(w, func() (EncryptionStatus, error) {
+			return service.EncryptionStatus(r.Context())
+		})
+	})
+
+	router.Post("/api/encryption/setup", func(w http.ResponseWriter, r *http.Request) {
+		apiCall(w, func() (string, error) {
+			var data struct {
+				Passphrase string `json:"passphrase"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				return "", err
+			}
+			return "ok", service.SetupEncryption(r.Context(), data.Passphrase)
+		})
+	})
+
+	router.Post("/api/encryption/unlock", func(w http.ResponseWriter, r *http.Request) {
+		apiCall(w, func() (string, error) {
+			var data struct {
+				Passphrase string `json:"passphrase"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				return "", err
+			}
+			return "ok", service.UnlockNotes(r.Context(), data.Passphrase)
+		})
+	})
+
+	router.Post("/api/encryption/lock", func(w http.ResponseWriter, r *http.Request) {
+		apiCall(w, func() (string, error) {
+			service.LockNotes(r.Context())
+			return "ok", nil
+		})
+	})
+
+	router.Post("/api/encryption/passphrase", func(w http.ResponseWriter, r *http.Request) {
+		apiCall(w, func() (string, error) {
+			var data struct {
+				Passphrase    string `json:"passphrase"`
+				NewPassphrase string `json:"new_passphrase"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				return "", err
+			}
+			return "ok", service.ChangePassphrase(r.Context(), data.Passphrase, data.NewPassphrase)
+		})
+	})
+
+	router.Post("/api/messages/set-encrypted", func(w http.ResponseWriter, r *http.Request) {
+		apiCall(w, func() (MessageDTO, error) {
+			var data struct {
+				ID        int64 `json:"id"`
+				Encrypted bool  `json:"encrypted"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				return MessageDTO{}, err
+			}
+			return service.SetEncrypted(r.Context(), data.ID, data.Encrypted)
+		})
+	})
+}
+
+// createTokenResponse carries the secret of a new token, which is never shown
+// again.
+type createTokenResponse struct {
+	Token  APIToken `json:"token"`
+	Secret string   `json:"secret"`
+}
+
+// newFormAttachments returns the files of a note form followed by the
+// finished resumable uploads named in its uploads field.
+func newFormAttachments(form *multipart.Form) []NewAttachment {
+	attachments := newMultipartAttachments(form.File["attachments"])
+	for _, id := range form.Value["uploads"] {
+		attachments = append(attachments, NewAttachment{Upload: strings.TrimSpace(id)})
+	}
+	return attachments
 }
 
 func newMultipartAttachments(headers []*multipart.FileHeader) []NewAttachment {
@@ -313,6 +708,160 @@ func newMultipartAttachments(headers []*multipart.FileHeader) []NewAttachment {
 	return attachments
 }
 
+const (
+	tusVersion     = "1.0.0"
+	tusContentType = "application/offset+octet-stream"
+)
+
+// handleUploads serves resumable uploads with the tus 1.0 protocol and its
+// creation, creation-with-upload, termination and expiration extensions, so
+// a large file survives a dropped connection. A finished upload is attached
+// by passing its ID in the uploads field of /api/messages/send or
+// /api/messages/update.
+func handleUploads(router *Router, service *NotesService) {
+	router.Options("/api/uploads", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,creation-with-upload,termination,expiration")
+		if service.MaxUploadSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(service.MaxUploadSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	router.Post("/api/uploads", func(w http.ResponseWriter, r *http.Request) {
+		if !checkTusVersion(w, r) {
+			return
+		}
+		size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || size < 0 {
+			http.Error(w, "Upload-Length is required", http.StatusBadRequest)
+			return
+		}
+		filename := parseTusMetadata(r.Header.Get("Upload-Metadata"))["filename"]
+		if _, err := attachmentName(filename); err != nil {
+			http.Error(w, "Upload-Metadata must include the filename", http.StatusBadRequest)
+			return
+		}
+		session, err := service.CreateUploadSession(r.Context(), filename, size)
+		if err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		// With creation-with-upload the body is the first chunk. If it fails
+		// the upload still exists, and the client resumes from its offset.
+		if r.Header.Get("Content-Type") == tusContentType {
+			if appended, err := service.AppendUploadSession(r.Context(), session.ID, 0, r.Body); err == nil {
+				session = appended
+			} else {
+				log.Printf("Upload %s error: %v", session.ID, err)
+			}
+		}
+		w.Header().Set("Location", "/api/uploads/"+session.ID)
+		writeUploadHeaders(w, session)
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	router.Head("^/api/uploads/", func(w http.ResponseWriter, r *http.Request) {
+		if !checkTusVersion(w, r) {
+			return
+		}
+		session, err := service.GetUploadSession(r.Context(), uploadSessionID(r))
+		if err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Length", strconv.FormatInt(session.Size, 10))
+		writeUploadHeaders(w, session)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	router.Patch("^/api/uploads/", func(w http.ResponseWriter, r *http.Request) {
+		if !checkTusVersion(w, r) {
+			return
+		}
+		if r.Header.Get("Content-Type") != tusContentType {
+			http.Error(w, "Content-Type must be "+tusContentType, http.StatusUnsupportedMediaType)
+			return
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "Upload-Offset is required", http.StatusBadRequest)
+			return
+		}
+		session, err := service.AppendUploadSession(r.Context(), uploadSessionID(r), offset, r.Body)
+		if err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		writeUploadHeaders(w, session)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	router.Delete("^/api/uploads/", func(w http.ResponseWriter, r *http.Request) {
+		if !checkTusVersion(w, r) {
+			return
+		}
+		if err := service.DeleteUploadSession(r.Context(), uploadSessionID(r)); err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		w.Header().Set("Tus-Resumable", tusVersion)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// checkTusVersion rejects requests for another tus version. Requests
+// without Tus-Resumable are accepted, so plain scripts need not send it.
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	if version := r.Header.Get("Tus-Resumable"); version != "" && version != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+func uploadSessionID(r *http.Request) string {
+	return strings.TrimPrefix(r.URL.Path, "/api/uploads/")
+}
+
+func writeUploadHeaders(w http.ResponseWriter, session UploadSession) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	expires := parseDBTime(session.UpdatedAt).Add(uploadSessionTTL)
+	w.Header().Set("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+}
+
+func writeUploadError(w http.ResponseWriter, err error) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	switch {
+	case errors.Is(err, ErrUploadNotFound):
+		http.Error(w, "Upload not found", http.StatusNotFound)
+	case errors.Is(err, ErrUploadOffset):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrUploadSize), errors.Is(err, ErrUploadTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		log.Printf("Upload error: %v", err)
+		http.Error(w, "Upload failed", http.StatusInternalServerError)
+	}
+}
+
+// parseTusMetadata decodes Upload-Metadata, comma-separated keys each
+// followed by a space and the base64 value.
+func parseTusMetadata(header string) map[string]string {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if key != "" && err == nil {
+			metadata[key] = string(decoded)
+		}
+	}
+	return metadata
+}
+
 func parseCommaSeparatedIDs(value string) ([]int64, error) {
 	if value == "" {
 		return nil, nil
@@ -329,6 +878,19 @@ func parseCommaSeparatedIDs(value string) ([]int64, error) {
 	return ids, nil
 }
 
+// idempotencyKey reads the key a retrying client attached to a write: the
+// Idempotency-Key header, a client_id from a JSON body, or a client_id form or
+// query field, in that order.
+func idempotencyKey(r *http.Request, bodyClientID string) string {
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		return key
+	}
+	if bodyClientID != "" {
+		return bodyClientID
+	}
+	return r.FormValue("client_id")
+}
+
 func apiCall[T any](w http.ResponseWriter, action ActionAny[T]) {
 	result, err := action()
 	err = writeApiResult(w, result, err)
@@ -341,8 +903,20 @@ func writeApiResult(w http.ResponseWriter, result any, err error) error {
 	statusCode := http.StatusOK
 	body := any(JsonSuccessResponse{Result: result})
 	if err != nil {
+		failure := JsonFailResponse{Error: err.Error()}
 		statusCode = http.StatusInternalServerError
-		body = JsonFailResponse{Error: err.Error()}
+		var conflict *ConflictError
+		if errors.As(err, &conflict) {
+			statusCode = http.StatusConflict
+			failure.Current = &conflict.Note
+		} else if errors.Is(err, ErrNoteLocked) {
+			statusCode = http.StatusLocked
+		} else if errors.Is(err, ErrIdempotencyKeyReused) {
+			statusCode = http.StatusUnprocessableEntity
+		} else if errors.Is(err, ErrResyncRequired) {
+			statusCode = http.StatusGone
+		}
+		body = failure
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"io"
 	"mime/multipart"
@@ -23,10 +24,19 @@ func newTestAPIRouter(t *testing.T) (*Router, *NotesService) {
 	t.Helper()
 	service := newTestNotesService(t)
 	router := NewRouter()
-	HandleApi(router, service)
+	HandleApi(router, service, newTestAuth(t, service, AuthSession))
 	return router, service
 }
 
+func newTestAuth(t *testing.T, service *NotesService, mode string) *Auth {
+	t.Helper()
+	auth, err := NewAuth(service, AuthOptions{Mode: mode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
 func multipartAPIRequest(t *testing.T, path string, fields map[string]string, uploads []testUpload) *http.Request {
 	t.Helper()
 	var body bytes.Buffer
@@ -62,6 +72,11 @@ func jsonAPIRequest(t *testing.T, method, path, body string) *http.Request {
 
 func callAPI(t *testing.T, router *Router, request *http.Request) *httptest.ResponseRecorder {
 	t.Helper()
+	// Requests come from this machine unless a test gives another address,
+	// because a server without accounts serves no one else.
+	if request.RemoteAddr == "192.0.2.1:1234" {
+		request.RemoteAddr = "127.0.0.1:1234"
+	}
 	response := httptest.NewRecorder()
 	router.ServeHTTP(response, request)
 	return response
@@ -101,7 +116,7 @@ func TestHTTPAPINoteLifecycleUsesNotesService(t *testing.T) {
 	if len(note.Attachments) != 1 || len(note.Tags) != 1 || note.Tags[0] != "work" {
 		t.Fatalf("unexpected created note: %+v", note)
 	}
-	attachmentPath := filepath.Join(service.UploadsDir, note.Attachments[0].FilePath)
+	attachmentPath := filepath.Join(service.UploadsDir, note.Attachments[0].storedFile)
 
 	response = callAPI(t, router, multipartAPIRequest(t, "/api/messages/update", map[string]string{
 		"id":                 strconv.FormatInt(created.ID, 10),
@@ -147,11 +162,11 @@ func TestHTTPAPINoteLifecycleUsesNotesService(t *testing.T) {
 
 func TestHTTPAPITagCursorGroupsArchivedAfterActive(t *testing.T) {
 	router, service := newTestAPIRouter(t)
-	active, err := service.CreateNote(t.Context(), "Active #shared", nil)
+	active, err := service.CreateNote(t.Context(), CreateNoteOptions{Content: "Active #shared"})
 	if err != nil {
 		t.Fatal(err)
 	}
-	archived, err := service.CreateNote(t.Context(), "Archived #shared", nil)
+	archived, err := service.CreateNote(t.Context(), CreateNoteOptions{Content: "Archived #shared"})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -172,3 +187,126 @@ func TestHTTPAPITagCursorGroupsArchivedAfterActive(t *testing.T) {
 		t.Fatalf("second tag page = %+v, want archived note %d", secondPage, archived.ID)
 	}
 }
+
+func TestHTTPAPIRevisionsRestore(t *testing.T) {
+	router, service := newTestAPIRouter(t)
+	note, err := service.CreateNote(t.Context(), CreateNoteOptions{Content: "original"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strconv.FormatInt(note.ID, 10)
+	decodeAPIResult[string](t, callAPI(t, router, multipartAPIRequest(t, "/api/messages/update", map[string]string{
+		"id": id, "content": "replaced",
+	}, nil)))
+
+	revisions := decodeAPIResult[[]RevisionDTO](t, callAPI(t, router,
+		httptest.NewRequest(http.MethodGet, "/api/messages/revisions?id="+id, nil)))
+	if len(revisions) != 2 {
+		t.Fatalf("revisions = %+v", revisions)
+	}
+	original := strconv.FormatInt(revisions[1].ID, 10)
+	diff := decodeAPIResult[RevisionDiff](t, callAPI(t, router,
+		httptest.NewRequest(http.MethodGet, "/api/messages/revisions/diff?id="+id+"&from="+original, nil)))
+	if len(diff.Lines) != 2 || diff.Lines[0].Op != DiffDelete || diff.Lines[1].Text != "replaced" {
+		t.Fatalf("diff = %+v", diff)
+	}
+	decodeAPIResult[string](t, callAPI(t, router, jsonAPIRequest(t, http.MethodPost, "/api/messages/revisions/restore",
+		`{"id":`+id+`,"revision_id":`+original+`}`)))
+	if restored, err := service.GetNote(t.Context(), note.ID); err != nil || restored.Content != "original" {
+		t.Fatalf("restored note = %+v, %v", restored, err)
+	}
+}
+
+func TestHTTPAPIUpdateConflictReturns409(t *testing.T) {
+	router, service := newTestAPIRouter(t)
+	note, err := service.CreateNote(t.Context(), CreateNoteOptions{Content: "v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := map[string]string{
+		"id":      strconv.FormatInt(note.ID, 10),
+		"content": "from tab A",
+		"version": strconv.FormatInt(note.Version, 10),
+	}
+	decodeAPIResult[string](t, callAPI(t, router, multipartAPIRequest(t, "/api/messages/update", fields, nil)))
+
+	fields["content"] = "from tab B"
+	response := callAPI(t, router, multipartAPIRequest(t, "/api/messages/update", fields, nil))
+	if response.Code != http.StatusConflict {
+		t.Fatalf("stale update status = %d, body = %s", response.Code, response.Body.String())
+	}
+	var failure JsonFailResponse
+	if err := json.Unmarshal(response.Body.Bytes(), &failure); err != nil {
+		t.Fatal(err)
+	}
+	if failure.Current == nil || failure.Current.Content != "from tab A" || failure.Current.Version != note.Version+1 {
+		t.Fatalf("conflict response = %+v", failure)
+	}
+}
+
+func TestHTTPAPIResumableUpload(t *testing.T) {
+	router, service := newTestAPIRouter(t)
+	video := bytes.Repeat([]byte("frame "), 20000)
+	tusRequest := func(method, path string, headers map[string]string, body []byte) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, bytes.NewReader(body))
+		request.Header.Set("Tus-Resumable", "1.0.0")
+		for name, value := range headers {
+			request.Header.Set(name, value)
+		}
+		return callAPI(t, router, request)
+	}
+	service.MaxUploadSize = int64(len(video))
+	response := tusRequest(http.MethodOptions, "/api/uploads", nil, nil)
+	if response.Header().Get("Tus-Max-Size") != strconv.Itoa(len(video)) {
+		t.Fatalf("options headers = %v", response.Header())
+	}
+	response = tusRequest(http.MethodPost, "/api/uploads", map[string]string{
+		"Upload-Length":   strconv.Itoa(len(video) + 1),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("clip.mp4")),
+	}, nil)
+	if response.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized upload status = %d", response.Code)
+	}
+
+	response = tusRequest(http.MethodPost, "/api/uploads", map[string]string{
+		"Upload-Length":   strconv.Itoa(len(video)),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("clip.mp4")),
+		"Content-Type":    "application/offset+octet-stream",
+	}, video[:50000])
+	location := response.Header().Get("Location")
+	if response.Code != http.StatusCreated || response.Header().Get("Upload-Offset") != "50000" || !strings.HasPrefix(location, "/api/uploads/") {
+		t.Fatalf("create status = %d, headers = %v", response.Code, response.Header())
+	}
+
+	chunk := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"}
+	if response := tusRequest(http.MethodPatch, location, chunk, video[:50000]); response.Code != http.StatusConflict {
+		t.Fatalf("stale offset status = %d", response.Code)
+	}
+	response = tusRequest(http.MethodHead, location, nil, nil)
+	if response.Code != http.StatusOK || response.Header().Get("Upload-Offset") != "50000" ||
+		response.Header().Get("Upload-Length") != strconv.Itoa(len(video)) {
+		t.Fatalf("head status = %d, headers = %v", response.Code, response.Header())
+	}
+	chunk["Upload-Offset"] = "50000"
+	if response := tusRequest(http.MethodPatch, location, chunk, video[50000:]); response.Code != http.StatusNoContent ||
+		response.Header().Get("Upload-Offset") != strconv.Itoa(len(video)) {
+		t.Fatalf("patch status = %d, headers = %v", response.Code, response.Header())
+	}
+
+	created := decodeAPIResult[struct {
+		ID int64 `json:"id"`
+	}](t, callAPI(t, router, multipartAPIRequest(t, "/api/messages/send", map[string]string{
+		"content": "Long video",
+		"uploads": strings.TrimPrefix(location, "/api/uploads/"),
+	}, nil)))
+	note, err := service.GetNote(t.Context(), created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(note.Attachments) != 1 || note.Attachments[0].OriginalName != "clip.mp4" || note.Attachments[0].Size != int64(len(video)) {
+		t.Fatalf("attachments = %+v", note.Attachments)
+	}
+	if response := tusRequest(http.MethodHead, location, nil, nil); response.Code != http.StatusNotFound {
+		t.Fatalf("attached upload status = %d", response.Code)
+	}
+}
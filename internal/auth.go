@@ -0,0 +1,528 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authentication modes of the web UI, /api and /files.
+const (
+	// AuthSession signs in with a goNotes account through the login form
+	// and keeps the session in a cookie.
+	AuthSession = "session"
+	// AuthBasic checks goNotes accounts with HTTP Basic on every request.
+	AuthBasic = "basic"
+	// AuthProxy trusts the user name a reverse proxy puts in a header.
+	AuthProxy = "proxy"
+	// AuthNone serves everyone without authentication.
+	AuthNone = "none"
+)
+
+const (
+	sessionCookieName  = "gonotes_session"
+	csrfCookieName     = "gonotes_csrf"
+	csrfHeaderName     = "X-CSRF-Token"
+	defaultProxyHeader = "X-Forwarded-User"
+	basicCacheLifetime = 5 * time.Minute
+)
+
+type AuthOptions struct {
+	// Mode is one of the Auth* modes; empty means AuthSession.
+	Mode string
+	// ProxyHeader carries the user name in AuthProxy mode, by default
+	// X-Forwarded-User.
+	ProxyHeader string
+	// TrustedProxies lists the addresses and CIDR ranges whose ProxyHeader is
+	// believed, by default loopback only.
+	TrustedProxies []string
+}
+
+// Auth guards the HTTP endpoints of the browser UI. Until the first account
+// exists, the session and basic modes serve only requests made on this
+// machine, so a fresh server exposed to the network does not give its
+// notebook away.
+type Auth struct {
+	service     *NotesService
+	mode        string
+	proxyHeader string
+	trusted     []netip.Prefix
+
+	// basicCache remembers recently checked Basic credentials, so that not
+	// every request pays for a password hash. A hit still compares the
+	// stored hash, because `goNotes user` changes passwords and deletes
+	// accounts from another process.
+	basicMu    sync.Mutex
+	basicCache map[[sha256.Size]byte]basicCacheEntry
+}
+
+type basicCacheEntry struct {
+	user    User
+	hash    string
+	expires time.Time
+}
+
+// authError rejects a request that could not be authenticated.
+type authError struct {
+	status  int
+	message string
+}
+
+func (e *authError) Error() string {
+	return e.message
+}
+
+var (
+	errAuthRequired     = &authError{http.StatusUnauthorized, "authentication required"}
+	errLocalOnly        = &authError{http.StatusUnauthorized, "goNotes has no accounts and only serves this machine; create one with `goNotes user add`"}
+	errUntrustedProxy   = &authError{http.StatusForbidden, "request did not come through a trusted proxy"}
+	errUnknownProxyUser = &authError{http.StatusForbidden, "the proxy user has no goNotes account"}
+	errCSRF             = &authError{http.StatusForbidden, "missing or invalid CSRF token"}
+	errTokenScope       = &authError{http.StatusForbidden, "the access token does not allow this action"}
+)
+
+type authStatus struct {
+	Mode string `json:"mode"`
+	// AccountsEnabled is false while the server has no accounts and runs as a
+	// single-user notebook.
+	AccountsEnabled bool `json:"accounts_enabled"`
+	// LoginRequired is set when the request is not authenticated and the
+	// rest of the API would reject it.
+	LoginRequired bool  `json:"login_required"`
+	User          *User `json:"user"`
+}
+
+func NewAuth(service *NotesService, options AuthOptions) (*Auth, error) {
+	auth := &Auth{
+		service:     service,
+		mode:        options.Mode,
+		proxyHeader: options.ProxyHeader,
+		basicCache:  map[[sha256.Size]byte]basicCacheEntry{},
+	}
+	switch auth.mode {
+	case "":
+		auth.mode = AuthSession
+	case AuthSession, AuthBasic, AuthProxy, AuthNone:
+	default:
+		return nil, fmt.Errorf("unknown auth mode %q", options.Mode)
+	}
+	if auth.proxyHeader == "" {
+		auth.proxyHeader = defaultProxyHeader
+	}
+	trusted := options.TrustedProxies
+	if len(trusted) == 0 {
+		trusted = []string{"127.0.0.0/8", "::1"}
+	}
+	for _, entry := range trusted {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				return nil, fmt.Errorf("trusted proxy %q is neither an address nor a CIDR range", entry)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		auth.trusted = append(auth.trusted, prefix.Masked())
+	}
+	return auth, nil
+}
+
+func (a *Auth) Mode() string {
+	return a.mode
+}
+
+// Require guards an /api handler. It rejects forged browser requests and
+// requests without valid credentials, and scopes the rest to the notebook
+// of their user.
+func (a *Auth) Require(next RouteHandler) RouteHandler {
+	return a.guard(next, true)
+}
+
+// RequireFiles guards attachment downloads like Require, answering with
+// plain text errors.
+func (a *Auth) RequireFiles(next RouteHandler) RouteHandler {
+	return a.guard(next, false)
+}
+
+// RequireUI guards the static web UI. In session mode the UI carries its own
+// login form and no notes, so it is served to everyone.
+func (a *Auth) RequireUI(next RouteHandler) RouteHandler {
+	if a.mode == AuthSession {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ensureCSRFCookie(w, r)
+			next(w, r)
+		}
+	}
+	return a.guard(next, false)
+}
+
+func (a *Auth) guard(next RouteHandler, api bool) RouteHandler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if secret, ok := bearerToken(r); ok {
+			a.serveWithToken(w, r, secret, next, api)
+			return
+		}
+		if err := checkCSRF(r); err != nil {
+			a.deny(w, err, api)
+			return
+		}
+		user, err := a.identify(r)
+		if err != nil {
+			a.deny(w, err, api)
+			return
+		}
+		ensureCSRFCookie(w, r)
+		if user != nil {
+			r = r.WithContext(WithUser(r.Context(), user.ID))
+		}
+		next(w, r)
+	}
+}
+
+// serveWithToken serves a request made with an access token in every auth
+// mode. Browsers never send tokens on their own, so there is no CSRF check.
+// Reading needs the read scope, anything else at least write.
+func (a *Auth) serveWithToken(w http.ResponseWriter, r *http.Request, secret string, next RouteHandler, api bool) {
+	token, err := a.service.TokenAuth(r.Context(), secret)
+	if err != nil {
+		a.deny(w, err, api)
+		return
+	}
+	scope := ScopeWrite
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		scope = ScopeRead
+	}
+	if !token.Allows(scope) {
+		a.deny(w, errTokenScope, api)
+		return
+	}
+	next(w, r.WithContext(withToken(WithUser(r.Context(), token.OwnerID), token)))
+}
+
+// identify returns the user a request acts for, or nil for the default
+// notebook of a server without accounts.
+func (a *Auth) identify(r *http.Request) (*User, error) {
+	if a.mode == AuthNone {
+		return nil, nil
+	}
+	ctx := r.Context()
+	hasUsers, err := a.service.HasUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.mode == AuthProxy {
+		if !a.fromTrustedProxy(r) {
+			return nil, errUntrustedProxy
+		}
+		name := strings.TrimSpace(r.Header.Get(a.proxyHeader))
+		if name == "" {
+			return nil, errAuthRequired
+		}
+		if !hasUsers {
+			return nil, nil
+		}
+		user, err := a.service.userByName(ctx, name)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errUnknownProxyUser
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &user, nil
+	}
+
+	if !hasUsers {
+		if !isLocalRequest(r) {
+			return nil, errLocalOnly
+		}
+		return nil, nil
+	}
+	if a.mode == AuthBasic {
+		name, password, ok := r.BasicAuth()
+		if !ok {
+			return nil, errAuthRequired
+		}
+		user, err := a.basicUser(ctx, name, password)
+		if errors.Is(err, ErrInvalidCredentials) {
+			log.Printf("Failed login for %q from %s", name, r.RemoteAddr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &user, nil
+	}
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil, errAuthRequired
+	}
+	user, err := a.service.SessionUser(ctx, cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (a *Auth) basicUser(ctx context.Context, name, password string) (User, error) {
+	key := sha256.Sum256([]byte(name + "\x00" + password))
+	now := time.Now()
+	a.basicMu.Lock()
+	entry, ok := a.basicCache[key]
+	a.basicMu.Unlock()
+	if ok && now.Before(entry.expires) {
+		hash, err := a.service.passwordHash(ctx, entry.user.ID)
+		if err != nil {
+			return User{}, err
+		}
+		if hash == entry.hash {
+			return entry.user, nil
+		}
+	}
+	user, hash, err := a.service.authenticate(ctx, name, password)
+	if err != nil {
+		a.basicMu.Lock()
+		delete(a.basicCache, key)
+		a.basicMu.Unlock()
+		return User{}, err
+	}
+	a.basicMu.Lock()
+	defer a.basicMu.Unlock()
+	for cached, entry := range a.basicCache {
+		if now.After(entry.expires) {
+			delete(a.basicCache, cached)
+		}
+	}
+	a.basicCache[key] = basicCacheEntry{user: user, hash: hash, expires: now.Add(basicCacheLifetime)}
+	return user, nil
+}
+
+func (a *Auth) fromTrustedProxy(r *http.Request) bool {
+	addr, ok := remoteAddr(r)
+	if !ok {
+		return false
+	}
+	for _, prefix := range a.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// deny answers a rejected request. Errors other than authentication
+// failures are reported as server errors.
+func (a *Auth) deny(w http.ResponseWriter, err error, api bool) {
+	status := http.StatusUnauthorized
+	var rejected *authError
+	if errors.As(err, &rejected) {
+		status = rejected.status
+	} else if !errors.Is(err, ErrInvalidCredentials) {
+		log.Printf("Auth error: %v", err)
+		if api {
+			writeApiResult(w, nil, err)
+		} else {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if a.mode == AuthBasic && status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="goNotes", charset="UTF-8"`)
+	}
+	if api {
+		writeAuthError(w, status, err.Error())
+	} else {
+		http.Error(w, err.Error(), status)
+	}
+}
+
+// handleAuth registers the login endpoints. They sit outside Require, so a
+// signed-out browser can reach them.
+func handleAuth(router *Router, auth *Auth) {
+	service := auth.service
+
+	router.Get("/api/auth/me", func(w http.ResponseWriter, r *http.Request) {
+		ensureCSRFCookie(w, r)
+		apiCall(w, func() (authStatus, error) {
+			status := authStatus{Mode: auth.mode}
+			if auth.mode == AuthNone {
+				return status, nil
+			}
+			enabled, err := service.HasUsers(r.Context())
+			if err != nil {
+				return authStatus{}, err
+			}
+			status.AccountsEnabled = enabled
+			user, err := auth.identify(r)
+			var rejected *authError
+			if errors.Is(err, ErrInvalidCredentials) || errors.As(err, &rejected) {
+				status.LoginRequired = true
+				return status, nil
+			}
+			status.User = user
+			return status, err
+		})
+	})
+
+	router.Post("/api/auth/login", func(w http.ResponseWriter, r *http.Request) {
+		if err := checkCSRF(r); err != nil {
+			auth.deny(w, err, true)
+			return
+		}
+		if auth.mode != AuthSession {
+			writeApiResult(w, nil, fmt.Errorf("password login is disabled in %s auth mode", auth.mode))
+			return
+		}
+		var data struct {
+			Name     string `json:"name"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeApiResult(w, nil, err)
+			return
+		}
+		user, err := service.Authenticate(r.Context(), data.Name, data.Password)
+		if errors.Is(err, ErrInvalidCredentials) {
+			log.Printf("Failed login for %q from %s", data.Name, r.RemoteAddr)
+			writeAuthError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if err != nil {
+			writeApiResult(w, nil, err)
+			return
+		}
+		token, expires, err := service.CreateSession(r.Context(), user.ID)
+		if err != nil {
+			writeApiResult(w, nil, err)
+			return
+		}
+		http.SetCookie(w, sessionCookie(r, token, expires))
+		writeApiResult(w, user, nil)
+	})
+
+	router.Post("/api/auth/logout", func(w http.ResponseWriter, r *http.Request) {
+		if err := checkCSRF(r); err != nil {
+			auth.deny(w, err, true)
+			return
+		}
+		apiCall(w, func() (string, error) {
+			if cookie, err := r.Cookie(sessionCookieName); err == nil {
+				if err := service.DeleteSession(r.Context(), cookie.Value); err != nil {
+					return "", err
+				}
+			}
+			http.SetCookie(w, sessionCookie(r, "", time.Unix(0, 0)))
+			return "ok", nil
+		})
+	})
+}
+
+func writeAuthError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(JsonFailResponse{Error: message})
+}
+
+// checkCSRF protects state-changing requests with a double-submit token: the
+// UI copies the readable CSRF cookie into the X-CSRF-Token header, which a
+// page on another origin cannot do. Browsers mark their requests with Origin
+// or Sec-Fetch-Site; requests without both come from scripts and other
+// clients that cannot be driven by a foreign page, so they need no token.
+func checkCSRF(r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return nil
+	}
+	if r.Header.Get("Origin") == "" && r.Header.Get("Sec-Fetch-Site") == "" {
+		return nil
+	}
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil || cookie.Value == "" {
+		return errCSRF
+	}
+	if subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.Header.Get(csrfHeaderName))) != 1 {
+		return errCSRF
+	}
+	return nil
+}
+
+// ensureCSRFCookie issues the token the UI sends back with every change.
+func ensureCSRFCookie(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(csrfCookieName); err == nil && cookie.Value != "" {
+		return
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    base64.RawURLEncoding.EncodeToString(raw),
+		Path:     "/",
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// sessionCookie builds the session cookie. It holds a random token whose
+// hash is the session's key in the database, so it cannot be forged.
+func sessionCookie(r *http.Request, token string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// isSecureRequest reports whether the request arrived over HTTPS, directly or
+// through a TLS-terminating proxy.
+func isSecureRequest(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// isLocalRequest reports whether a request was made on this machine. Requests
+// forwarded by a local reverse proxy come from elsewhere.
+func isLocalRequest(r *http.Request) bool {
+	addr, ok := remoteAddr(r)
+	if !ok || !addr.IsLoopback() {
+		return false
+	}
+	for _, header := range []string{"Forwarded", "X-Forwarded-For", "X-Real-Ip"} {
+		if r.Header.Get(header) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+func remoteAddr(r *http.Request) (netip.Addr, bool) {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr().Unmap(), true
+}
@@ -0,0 +1,231 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func newTestAuthRouter(t *testing.T, options AuthOptions) (*Router, *NotesService) {
+	t.Helper()
+	service := newTestNotesService(t)
+	auth, err := NewAuth(service, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+	HandleApi(router, service, auth)
+	router.Get("^/files/", auth.RequireFiles(func(w http.ResponseWriter, r *http.Request) {
+		owned, err := service.OwnsFile(r.Context(), strings.TrimPrefix(r.URL.Path, "/files/"))
+		if err != nil || !owned {
+			http.Error(w, "File not found", http.StatusNotFound)
+		}
+	}))
+	return router, service
+}
+
+func TestNewAuthValidatesOptions(t *testing.T) {
+	service := newTestNotesService(t)
+	if _, err := NewAuth(service, AuthOptions{Mode: "magic"}); err == nil {
+		t.Fatal("unknown mode accepted")
+	}
+	if _, err := NewAuth(service, AuthOptions{Mode: AuthProxy, TrustedProxies: []string{"proxy.local"}}); err == nil {
+		t.Fatal("host name accepted as a trusted proxy")
+	}
+	auth, err := NewAuth(service, AuthOptions{})
+	if err != nil || auth.Mode() != AuthSession {
+		t.Fatalf("default mode = %v, %v", auth, err)
+	}
+}
+
+func TestAuthWithoutAccountsServesOnlyThisMachine(t *testing.T) {
+	for _, mode := range []string{AuthSession, AuthBasic} {
+		t.Run(mode, func(t *testing.T) {
+			router, _ := newTestAuthRouter(t, AuthOptions{Mode: mode})
+			for _, c := range []struct {
+				remote, forwarded string
+				want              int
+			}{
+				{"127.0.0.1:5000", "", http.StatusOK},
+				{"[::1]:5000", "", http.StatusOK},
+				{"127.0.0.1:5000", "203.0.113.7", http.StatusUnauthorized},
+				{"203.0.113.7:5000", "", http.StatusUnauthorized},
+			} {
+				request := jsonAPIRequest(t, http.MethodGet, "/api/messages/list", "")
+				request.RemoteAddr = c.remote
+				if c.forwarded != "" {
+					request.Header.Set("X-Forwarded-For", c.forwarded)
+				}
+				if response := callAPI(t, router, request); response.Code != c.want {
+					t.Errorf("%s forwarded for %q: status %d, want %d", c.remote, c.forwarded, response.Code, c.want)
+				}
+			}
+
+			request := jsonAPIRequest(t, http.MethodGet, "/api/auth/me", "")
+			request.RemoteAddr = "203.0.113.7:5000"
+			status := decodeAPIResult[authStatus](t, callAPI(t, router, request))
+			if status.AccountsEnabled || !status.LoginRequired || status.Mode != mode {
+				t.Fatalf("me from another host = %+v", status)
+			}
+		})
+	}
+
+	router, _ := newTestAuthRouter(t, AuthOptions{Mode: AuthNone})
+	request := jsonAPIRequest(t, http.MethodGet, "/api/messages/list", "")
+	request.RemoteAddr = "203.0.113.7:5000"
+	if response := callAPI(t, router, request); response.Code != http.StatusOK {
+		t.Fatalf("none mode rejected a remote request: status %d", response.Code)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	router, service := newTestAuthRouter(t, AuthOptions{Mode: AuthBasic})
+	alice, err := service.CreateUser(context.Background(), "alice", "alice-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	note, err := service.CreateNote(WithUser(context.Background(), alice.ID), CreateNoteOptions{
+		Content:     "Alice's photo",
+		Attachments: []NewAttachment{{Filename: "photo.txt", Data: []byte("pixels")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.CreateUser(context.Background(), "bob", "bob-password"); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path, name, password string) *http.Response {
+		t.Helper()
+		request := jsonAPIRequest(t, http.MethodGet, path, "")
+		if name != "" {
+			request.SetBasicAuth(name, password)
+		}
+		return callAPI(t, router, request).Result()
+	}
+	response := get("/api/messages/list", "", "")
+	if response.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(response.Header.Get("WWW-Authenticate"), "Basic ") {
+		t.Fatalf("no credentials: status %d, challenge %q", response.StatusCode, response.Header.Get("WWW-Authenticate"))
+	}
+	if response := get("/api/messages/list", "alice", "wrong-password"); response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("wrong password: status %d", response.StatusCode)
+	}
+	for range 2 {
+		if response := get("/api/messages/list", "alice", "alice-password"); response.StatusCode != http.StatusOK {
+			t.Fatalf("alice: status %d", response.StatusCode)
+		}
+	}
+
+	file := "/files/" + note.Attachments[0].FilePath
+	if response := get(file, "", ""); response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("file without credentials: status %d", response.StatusCode)
+	}
+	if response := get(file, "alice", "alice-password"); response.StatusCode != http.StatusOK {
+		t.Fatalf("alice's file: status %d", response.StatusCode)
+	}
+	if response := get(file, "bob", "bob-password"); response.StatusCode != http.StatusNotFound {
+		t.Fatalf("bob read alice's file: status %d", response.StatusCode)
+	}
+
+	if err := service.SetPassword(context.Background(), "alice", "new-password"); err != nil {
+		t.Fatal(err)
+	}
+	if response := get("/api/messages/list", "alice", "alice-password"); response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("old password after SetPassword: status %d", response.StatusCode)
+	}
+	if response := get("/api/messages/list", "alice", "new-password"); response.StatusCode != http.StatusOK {
+		t.Fatalf("new password: status %d", response.StatusCode)
+	}
+	if response := get("/api/messages/list", "bob", "bob-password"); response.StatusCode != http.StatusOK {
+		t.Fatalf("bob: status %d", response.StatusCode)
+	}
+	if _, err := service.DeleteUser(context.Background(), "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if response := get("/api/messages/list", "bob", "bob-password"); response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("deleted user: status %d", response.StatusCode)
+	}
+}
+
+func TestProxyAuth(t *testing.T) {
+	router, service := newTestAuthRouter(t, AuthOptions{Mode: AuthProxy, ProxyHeader: "Remote-User", TrustedProxies: []string{"10.0.0.0/8"}})
+
+	call := func(remote, user string) int {
+		t.Helper()
+		request := jsonAPIRequest(t, http.MethodGet, "/api/messages/list", "")
+		request.RemoteAddr = remote
+		if user != "" {
+			request.Header.Set("Remote-User", user)
+		}
+		return callAPI(t, router, request).Code
+	}
+	if code := call("10.1.2.3:5000", "anyone"); code != http.StatusOK {
+		t.Fatalf("proxy user without accounts: status %d", code)
+	}
+	if _, err := service.CreateUser(context.Background(), "alice", "alice-password"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		remote, user string
+		want         int
+	}{
+		{"10.1.2.3:5000", "alice", http.StatusOK},
+		{"10.1.2.3:5000", "mallory", http.StatusForbidden},
+		{"10.1.2.3:5000", "", http.StatusUnauthorized},
+		{"127.0.0.1:5000", "alice", http.StatusForbidden},
+		{"203.0.113.7:5000", "alice", http.StatusForbidden},
+	} {
+		if code := call(c.remote, c.user); code != c.want {
+			t.Errorf("%s as %q: status %d, want %d", c.remote, c.user, code, c.want)
+		}
+	}
+}
+
+func TestCSRFProtection(t *testing.T) {
+	router, _ := newTestAuthRouter(t, AuthOptions{Mode: AuthSession})
+
+	response := callAPI(t, router, jsonAPIRequest(t, http.MethodGet, "/api/auth/me", ""))
+	var token *http.Cookie
+	for _, cookie := range response.Result().Cookies() {
+		if cookie.Name == csrfCookieName && !cookie.HttpOnly {
+			token = cookie
+		}
+	}
+	if token == nil {
+		t.Fatal("no readable CSRF cookie issued")
+	}
+
+	post := func(origin string, cookie *http.Cookie, header string) int {
+		t.Helper()
+		request := jsonAPIRequest(t, http.MethodPost, "/api/messages/use", `{"id":1}`)
+		if origin != "" {
+			request.Header.Set("Origin", origin)
+		}
+		if cookie != nil {
+			request.AddCookie(cookie)
+		}
+		if header != "" {
+			request.Header.Set(csrfHeaderName, header)
+		}
+		return callAPI(t, router, request).Code
+	}
+	if code := post("https://evil.example", token, ""); code != http.StatusForbidden {
+		t.Fatalf("cross-site post without token: status %d", code)
+	}
+	if code := post("https://evil.example", token, "guessed"); code != http.StatusForbidden {
+		t.Fatalf("cross-site post with a wrong token: status %d", code)
+	}
+	if code := post("http://example.com", token, token.Value); code == http.StatusForbidden {
+		t.Fatal("post with the token rejected")
+	}
+	if code := post("", nil, ""); code == http.StatusForbidden {
+		t.Fatal("non-browser post rejected")
+	}
+
+	request := jsonAPIRequest(t, http.MethodPost, "/api/auth/login", `{"name":"alice","password":"alice-password"}`)
+	request.Header.Set("Sec-Fetch-Site", "cross-site")
+	if response := callAPI(t, router, request); response.Code != http.StatusForbidden {
+		t.Fatalf("cross-site login: status %d", response.Code)
+	}
+}
@@ -0,0 +1,463 @@
+package internal
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	backupManifestName    = "manifest.json"
+	backupDatabaseName    = "notes.db"
+	backupUploadsDir      = "uploads"
+	backupManifestVersion = 1
+	backupFilePrefix      = "goNotes-backup-"
+	backupTimeLayout      = "20060102-150405"
+)
+
+// BackupManifest lists every file of a backup archive with its checksum so a
+// restore can reject damaged or tampered archives before touching a profile.
+type BackupManifest struct {
+	Version   int          `json:"version"`
+	CreatedAt time.Time    `json:"created_at"`
+	Files     []BackupFile `json:"files"`
+}
+
+type BackupFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// backupState pauses the removal of stored files while backups run: files
+// unreferenced after the snapshot was taken are still part of the backup.
+type backupState struct {
+	mu      sync.Mutex
+	running int
+	// deferred holds the files whose removal waits for the running backups.
+	deferred []string
+}
+
+// deferRemoval queues names for removal after the running backups and
+// reports whether any backup runs.
+func (b *backupState) deferRemoval(names []string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.running == 0 {
+		return false
+	}
+	b.deferred = append(b.deferred, names...)
+	return true
+}
+
+func (b *backupState) start() {
+	b.mu.Lock()
+	b.running++
+	b.mu.Unlock()
+}
+
+// finish ends a backup and returns the files to remove once no other backup
+// runs.
+func (b *backupState) finish() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.running--
+	if b.running > 0 {
+		return nil
+	}
+	deferred := b.deferred
+	b.deferred = nil
+	return deferred
+}
+
+// Backup writes a consistent snapshot of the database and the stored files
+// it references to w as a ZIP archive. VACUUM INTO copies the database inside
+// a read transaction, so the server keeps serving while the backup runs;
+// stored files are not removed until it finishes. A referenced file missing
+// from Storage fails the backup.
+func (s *NotesService) Backup(ctx context.Context, w io.Writer) error {
+	s.backups.start()
+	defer func() {
+		if deferred := s.backups.finish(); len(deferred) > 0 {
+			s.removeStoredFiles(deferred)
+		}
+	}()
+
+	snapshot, err := os.CreateTemp("", "goNotes-snapshot-*.db")
+	if err != nil {
+		return err
+	}
+	snapshotPath := snapshot.Name()
+	snapshot.Close()
+	// VACUUM INTO refuses to overwrite an existing file.
+	os.Remove(snapshotPath)
+	defer os.Remove(snapshotPath)
+	if _, err := s.DB.ExecContext(ctx, "VACUUM INTO ?", snapshotPath); err != nil {
+		return fmt.Errorf("snapshot database: %w", err)
+	}
+
+	archive := zip.NewWriter(w)
+	manifest := BackupManifest{Version: backupManifestVersion, CreatedAt: time.Now().UTC()}
+	add := func(name string, file io.Reader, method uint16) error {
+		target, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: manifest.CreatedAt})
+		if err != nil {
+			return err
+		}
+		hash := sha256.New()
+		size, err := io.Copy(io.MultiWriter(target, hash), file)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, BackupFile{Path: name, Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))})
+		return nil
+	}
+	addFile := func(name, source string, method uint16) error {
+		file, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return add(name, file, method)
+	}
+	if err := addFile(backupDatabaseName, snapshotPath, zip.Deflate); err != nil {
+		return err
+	}
+	keyFile := filepath.Join(s.UploadsDir, UploadsKeyFileName)
+	if err := addFile(backupUploadsDir+"/"+UploadsKeyFileName, keyFile, zip.Deflate); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// The stored files are read from Storage, so a backup of a profile with
+	// S3 storage carries the bucket too.
+	blobs, legacy, err := snapshotFiles(ctx, snapshotPath, s.UploadsKey)
+	if err != nil {
+		return fmt.Errorf("list files of the snapshot: %w", err)
+	}
+	addObject := func(name string) error {
+		object, err := s.Storage.Open(ctx, name)
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+		return add(backupUploadsDir+"/"+name, newObjectReader(object), zip.Store)
+	}
+	for _, name := range blobs {
+		if err := addObject(name); err != nil {
+			return fmt.Errorf("back up file %s: %w", name, err)
+		}
+	}
+	// MigrateLegacyUploads leaves attachments whose file was already missing
+	// without a blob, so a missing legacy file does not fail the backup.
+	for _, name := range legacy {
+		err := addObject(name)
+		if errors.Is(err, os.ErrNotExist) {
+			log.Printf("Backup: file %s is missing", name)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("back up file %s: %w", name, err)
+		}
+	}
+
+	target, err := archive.Create(backupManifestName)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(target)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// snapshotFiles returns the stored files referenced by the database at
+// path: blobs by hash, and the files of attachments stored before blobs by
+// name. VACUUM INTO writes the snapshot through the VFS of the database, so
+// the snapshot of an encrypted database is encrypted with key.
+func snapshotFiles(ctx context.Context, path string, key *UploadsKey) (blobs, legacy []string, err error) {
+	db, err := openDatabaseFile(path, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer db.Close()
+	query := func(query string) ([]string, error) {
+		rows, err := db.QueryContext(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var names []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return nil, err
+			}
+			names = append(names, name)
+		}
+		return names, rows.Err()
+	}
+	if blobs, err = query("SELECT hash FROM blobs WHERE ref_count > 0 ORDER BY hash"); err != nil {
+		return nil, nil, err
+	}
+	legacy, err = query(`
+		SELECT file_path FROM attachments WHERE blob_hash IS NULL
+		UNION
+		SELECT thumbnail_path FROM attachments WHERE blob_hash IS NULL AND thumbnail_path IS NOT NULL AND thumbnail_path != ''
+		ORDER BY 1`)
+	return blobs, legacy, err
+}
+
+// BackupToDir writes a timestamped backup archive into dir and then removes
+// the oldest archives so that at most keep remain. keep <= 0 keeps all.
+func (s *NotesService) BackupToDir(ctx context.Context, dir string, keep int) (string, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+	name := filepath.Join(dir, backupFilePrefix+time.Now().Format(backupTimeLayout)+".zip")
+	temp, err := os.CreateTemp(dir, ".backup-*.zip")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(temp.Name())
+	if err := s.Backup(ctx, temp); err != nil {
+		temp.Close()
+		return "", err
+	}
+	if err := temp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(temp.Name(), name); err != nil {
+		return "", err
+	}
+	return name, pruneBackups(dir, keep)
+}
+
+func pruneBackups(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), backupFilePrefix) && strings.HasSuffix(entry.Name(), ".zip") {
+			backups = append(backups, entry.Name())
+		}
+	}
+	// Timestamped names sort chronologically.
+	sort.Strings(backups)
+	for len(backups) > keep {
+		if err := os.Remove(filepath.Join(dir, backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// RunScheduledBackups writes a backup into dir every interval until ctx is
+// done. Failures are logged and retried at the next tick.
+func (s *NotesService) RunScheduledBackups(ctx context.Context, dir string, interval time.Duration, keep int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			name, err := s.BackupToDir(ctx, dir, keep)
+			if err != nil {
+				log.Printf("Scheduled backup error: %v", err)
+				continue
+			}
+			log.Printf("Backup written to %s", name)
+		}
+	}
+}
+
+// RestoreBackup validates a backup archive and restores it into profileDir.
+// Every file is extracted into a staging directory and checked against the
+// manifest, and the database must pass an integrity check, before anything
+// in the profile changes; secret unlocks the uploads key of the backup when
+// its database is encrypted. An existing database and uploads directory are
+// moved aside into a pre-restore directory, never deleted. The server must
+// not be running on the profile.
+func RestoreBackup(archivePath, profileDir string, secret []byte) (string, error) {
+	archive, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer archive.Close()
+	manifest, err := readBackupManifest(&archive.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	staging, err := os.MkdirTemp(profileDir, ".restore-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(staging)
+	if err := extractBackup(&archive.Reader, manifest, staging); err != nil {
+		return "", err
+	}
+	key, err := backupDatabaseKey(staging, secret)
+	if err != nil {
+		return "", err
+	}
+	if err := checkDatabaseIntegrity(filepath.Join(staging, backupDatabaseName), key); err != nil {
+		return "", err
+	}
+
+	previous := filepath.Join(profileDir, "pre-restore-"+time.Now().Format(backupTimeLayout))
+	for _, name := range []string{backupDatabaseName, backupDatabaseName + "-wal", backupDatabaseName + "-shm", backupUploadsDir} {
+		current := filepath.Join(profileDir, name)
+		if _, err := os.Stat(current); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.MkdirAll(previous, 0750); err != nil {
+			return "", err
+		}
+		if err := os.Rename(current, filepath.Join(previous, name)); err != nil {
+			return "", err
+		}
+	}
+	for _, name := range []string{backupDatabaseName, backupUploadsDir} {
+		if err := os.Rename(filepath.Join(staging, name), filepath.Join(profileDir, name)); err != nil {
+			return "", err
+		}
+	}
+	if _, err := os.Stat(previous); err != nil {
+		previous = ""
+	}
+	return previous, nil
+}
+
+func readBackupManifest(archive *zip.Reader) (BackupManifest, error) {
+	var manifest BackupManifest
+	file, err := archive.Open(backupManifestName)
+	if err != nil {
+		return manifest, fmt.Errorf("not a goNotes backup: %w", err)
+	}
+	defer file.Close()
+	if err := json.NewDecoder(file).Decode(&manifest); err != nil {
+		return manifest, fmt.Errorf("read backup manifest: %w", err)
+	}
+	if manifest.Version != backupManifestVersion {
+		return manifest, fmt.Errorf("unsupported backup version %d", manifest.Version)
+	}
+	return manifest, nil
+}
+
+func extractBackup(archive *zip.Reader, manifest BackupManifest, staging string) error {
+	expected := make(map[string]BackupFile, len(manifest.Files))
+	for _, file := range manifest.Files {
+		expected[file.Path] = file
+	}
+	if _, ok := expected[backupDatabaseName]; !ok {
+		return errors.New("backup does not contain a database")
+	}
+	if err := os.Mkdir(filepath.Join(staging, backupUploadsDir), 0755); err != nil {
+		return err
+	}
+	for _, entry := range archive.File {
+		if entry.Name == backupManifestName {
+			continue
+		}
+		want, ok := expected[entry.Name]
+		if !ok {
+			return fmt.Errorf("backup contains unlisted file %q", entry.Name)
+		}
+		delete(expected, entry.Name)
+		if entry.Name != backupDatabaseName && path.Dir(entry.Name) != backupUploadsDir {
+			return fmt.Errorf("backup contains unexpected path %q", entry.Name)
+		}
+		if err := extractBackupFile(entry, want, filepath.Join(staging, filepath.FromSlash(entry.Name))); err != nil {
+			return err
+		}
+	}
+	if len(expected) > 0 {
+		missing := make([]string, 0, len(expected))
+		for name := range expected {
+			missing = append(missing, name)
+		}
+		sort.Strings(missing)
+		return fmt.Errorf("backup is missing %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func extractBackupFile(entry *zip.File, want BackupFile, target string) error {
+	source, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), source)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("extract %q: %w", entry.Name, err)
+	}
+	if size != want.Size || hex.EncodeToString(hash.Sum(nil)) != want.SHA256 {
+		return fmt.Errorf("checksum mismatch for %q", entry.Name)
+	}
+	return nil
+}
+
+// backupDatabaseKey unlocks the uploads key of an extracted backup with
+// secret when its database is encrypted, and returns nil otherwise.
+func backupDatabaseKey(staging string, secret []byte) (*UploadsKey, error) {
+	encrypted, err := IsEncryptedDatabase(filepath.Join(staging, backupDatabaseName))
+	if err != nil || !encrypted {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, errors.New("the backup database is encrypted; set EncryptDatabase and the uploads secret in the config")
+	}
+	keys, err := loadUploadsKey(filepath.Join(staging, backupUploadsDir), secret)
+	if err != nil {
+		return nil, fmt.Errorf("unlock the uploads key of the backup: %w", err)
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("the backup database is encrypted, but the backup has no %s", UploadsKeyFileName)
+	}
+	return newUploadsKey(keys)
+}
+
+func checkDatabaseIntegrity(name string, key *UploadsKey) error {
+	database, err := openDatabaseFile(name, key)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+	var result string
+	if err := database.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return fmt.Errorf("check database: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("database integrity check failed: %s", result)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	ctx := context.Background()
+	service := newTestNotesService(t)
+	note, err := service.CreateNote(ctx, CreateNoteOptions{
+		Content:     "backed up",
+		Attachments: []NewAttachment{{Filename: "doc.txt", Data: []byte("attachment")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backups := t.TempDir()
+	var archivePath string
+	for range 3 {
+		if archivePath, err = service.BackupToDir(ctx, backups, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := os.ReadDir(backups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Archives written within one second share a name, so only check that
+	// retention never leaves more than keep archives behind.
+	if len(entries) == 0 || len(entries) > 2 {
+		t.Fatalf("backup dir has %d entries, want 1-2", len(entries))
+	}
+
+	profile := t.TempDir()
+	if err := os.WriteFile(filepath.Join(profile, "notes.db"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	previous, err := RestoreBackup(archivePath, profile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old, err := os.ReadFile(filepath.Join(previous, "notes.db")); err != nil || string(old) != "old" {
+		t.Fatalf("previous database was not kept: %q, %v", old, err)
+	}
+	restored, err := sql.Open("sqlite", filepath.Join(profile, "notes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	var content string
+	if err := restored.QueryRow("SELECT content FROM messages WHERE id = ?", note.ID).Scan(&content); err != nil || content != "backed up" {
+		t.Fatalf("restored content = %q, %v", content, err)
+	}
+	data, err := os.ReadFile(filepath.Join(profile, "uploads", note.Attachments[0].storedFile))
+	if err != nil || string(data) != "attachment" {
+		t.Fatalf("restored attachment = %q, %v", data, err)
+	}
+}
+
+func TestRestoreRejectsTamperedBackup(t *testing.T) {
+	service := newTestNotesService(t)
+	if _, err := service.CreateNote(t.Context(), CreateNoteOptions{
+		Content:     "original",
+		Attachments: []NewAttachment{{Filename: "doc.txt", Data: []byte("genuine")}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var original bytes.Buffer
+	if err := service.Backup(t.Context(), &original); err != nil {
+		t.Fatal(err)
+	}
+
+	// Copy the archive, replacing the attachment content but keeping the
+	// manifest.
+	source, err := zip.NewReader(bytes.NewReader(original.Bytes()), int64(original.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tampered bytes.Buffer
+	writer := zip.NewWriter(&tampered)
+	for _, file := range source.File {
+		target, err := writer.Create(file.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(file.Name, "uploads/") {
+			io.WriteString(target, "forged!")
+			continue
+		}
+		reader, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(target, reader)
+		reader.Close()
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archivePath := filepath.Join(t.TempDir(), "tampered.zip")
+	if err := os.WriteFile(archivePath, tampered.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	profile := t.TempDir()
+	if _, err := RestoreBackup(archivePath, profile, nil); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("restore error = %v, want checksum mismatch", err)
+	}
+	if entries, _ := os.ReadDir(profile); len(entries) != 0 {
+		t.Fatalf("failed restore changed the profile: %v", entries)
+	}
+}
+
+func TestBackupFailsOnMissingFile(t *testing.T) {
+	ctx := context.Background()
+	service := newTestNotesService(t)
+	note, err := service.CreateNote(ctx, CreateNoteOptions{
+		Content:     "lost",
+		Attachments: []NewAttachment{{Filename: "doc.txt", Data: []byte("gone")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := note.Attachments[0].storedFile
+	if err := os.Remove(filepath.Join(service.UploadsDir, hash)); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.Backup(ctx, io.Discard); err == nil || !strings.Contains(err.Error(), hash) {
+		t.Fatalf("backup error = %v, want missing %s", err, hash)
+	}
+}
+
+func TestBackupDefersFileRemoval(t *testing.T) {
+	ctx := context.Background()
+	service := newTestNotesService(t)
+	note, err := service.CreateNote(ctx, CreateNoteOptions{
+		Content:     "deleted during a backup",
+		Attachments: []NewAttachment{{Filename: "doc.txt", Data: []byte("still needed")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(service.UploadsDir, note.Attachments[0].storedFile)
+
+	if _, err := service.MoveToTrash(ctx, []int64{note.ID}); err != nil {
+		t.Fatal(err)
+	}
+	service.backups.start()
+	if _, err := service.DeletePermanently(ctx, []int64{note.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("file removed while a backup runs: %v", err)
+	}
+	// A backup finishing while another one runs keeps the removal queued.
+	if err := service.Backup(ctx, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("file removed while a backup runs: %v", err)
+	}
+	service.removeStoredFiles(service.backups.finish())
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("file after the backups = %v, want removed", err)
+	}
+}
+
+func TestPruneBackupsKeepsNewest(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"goNotes-backup-20240101-000000.zip",
+		"goNotes-backup-20240102-000000.zip",
+		"goNotes-backup-20240103-000000.zip",
+		"unrelated.zip",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pruneBackups(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if got := strings.Join(names, ","); got != "goNotes-backup-20240102-000000.zip,goNotes-backup-20240103-000000.zip,unrelated.zip" {
+		t.Fatalf("remaining files = %s", got)
+	}
+}
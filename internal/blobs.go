@@ -0,0 +1,360 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Attachments are stored as content-addressed blobs: the file in the uploads
+// directory is named by the SHA-256 of its content, or by its HMAC-SHA256
+// under the name key when uploads are encrypted, and triggers on
+// attachments count the attachments and previews using each blob, so
+// identical uploads share one file and it is removed only once nothing
+// references it. file_path stays the name in /files/ links; for new
+// attachments it is the hash followed by the original filename.
+
+var reBlobHash = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+func isBlobHash(name string) bool {
+	return reBlobHash.MatchString(name)
+}
+
+// attachmentName returns the base name of an uploaded file, which browsers
+// may send with a client-side path.
+func attachmentName(name string) (string, error) {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "" || name == "." || name == "/" {
+		return "", errors.New("invalid attachment filename")
+	}
+	return name, nil
+}
+
+// attachmentMimeType guesses the MIME type of an attachment from its name.
+func attachmentMimeType(name string) string {
+	if mimeType := mime.TypeByExtension(filepath.Ext(name)); mimeType != "" {
+		return mimeType
+	}
+	return "application/octet-stream"
+}
+
+// attachmentColumns selects an attachment aliased as a for scanAttachment.
+const attachmentColumns = `a.id, a.file_path, a.thumbnail_path, a.file_type, a.original_name, a.size, a.mime_type,
+	a.width, a.height, a.taken_at, a.duration,
+	COALESCE(a.blob_hash, a.file_path), COALESCE(a.thumbnail_hash, a.thumbnail_path, '')`
+
+func scanAttachment(attachment *AttachmentDTO, dest ...any) []any {
+	return append(dest,
+		&attachment.ID, &attachment.FilePath, &attachment.ThumbnailPath, &attachment.FileType,
+		&attachment.OriginalName, &attachment.Size, &attachment.MimeType,
+		&attachment.Width, &attachment.Height, &attachment.TakenAt, &attachment.Duration,
+		&attachment.storedFile, &attachment.storedThumbnail,
+	)
+}
+
+// attachmentFile is the stored content of an attachment.
+type attachmentFile struct {
+	filePath, blobHash           string
+	thumbnailPath, thumbnailHash string
+	meta                         attachmentMeta
+}
+
+// storeAttachmentFile stores src as the blob of an attachment named name.
+// When inspect is set, which it is for content that is not encrypted, the
+// metadata of the file is read and images get a preview. Files written by
+// this call are appended to created, so they can be removed if tx is rolled
+// back.
+func (s *NotesService) storeAttachmentFile(ctx context.Context, tx *sql.Tx, src io.Reader, name string, inspect bool, created *[]string) (attachmentFile, error) {
+	hash, _, isNew, err := s.storeBlob(ctx, tx, src)
+	if err != nil {
+		return attachmentFile{}, err
+	}
+	if isNew {
+		*created = append(*created, hash)
+	}
+	file := attachmentFile{filePath: hash + "_" + name, blobHash: hash, meta: attachmentMeta{mimeType: attachmentMimeType(name)}}
+	if !inspect {
+		return file, nil
+	}
+	if source, err := s.openUpload(ctx, hash); err == nil {
+		file.meta = inspectAttachment(source, name)
+		source.Close()
+	}
+	if isImage(name) {
+		if preview, isNew, err := s.storeThumbnail(ctx, tx, hash); err == nil {
+			file.thumbnailPath, file.thumbnailHash = "thumb_"+file.filePath, preview
+			if isNew {
+				*created = append(*created, preview)
+			}
+		}
+	}
+	return file, nil
+}
+
+// storeBlob copies src into the blob store within tx and returns its hash
+// and size. isNew reports whether this call wrote the file. The file is
+// spooled in UploadsDir, as its name is known only once it is read.
+func (s *NotesService) storeBlob(ctx context.Context, tx *sql.Tx, src io.Reader) (hash string, size int64, isNew bool, err error) {
+	if err := os.MkdirAll(s.UploadsDir, 0755); err != nil {
+		return "", 0, false, err
+	}
+	temp, err := os.CreateTemp(s.UploadsDir, ".blob-*")
+	if err != nil {
+		return "", 0, false, err
+	}
+	defer os.Remove(temp.Name())
+	hasher := s.UploadsKey.blobHasher()
+	counter := new(byteCounter)
+	err = copyUpload(temp, io.TeeReader(src, io.MultiWriter(hasher, counter)), s.UploadsKey)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", 0, false, err
+	}
+	hash, size = hex.EncodeToString(hasher.Sum(nil)), int64(*counter)
+
+	// The insert takes the database write lock, which collectBlobs holds
+	// while it removes files, so the file checked below stays in place.
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO blobs (hash, size) VALUES (?, ?) ON CONFLICT (hash) DO NOTHING", hash, size,
+	); err != nil {
+		return "", 0, false, err
+	}
+	exists, err := s.Storage.Exists(ctx, hash)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if exists {
+		return hash, size, false, nil
+	}
+	if err := s.Storage.Put(ctx, hash, temp.Name()); err != nil {
+		return "", 0, false, err
+	}
+	return hash, size, true, nil
+}
+
+// storeThumbnail returns the blob of a preview of the image blob hash,
+// reusing the preview of another attachment with the same content.
+func (s *NotesService) storeThumbnail(ctx context.Context, tx *sql.Tx, hash string) (string, bool, error) {
+	var existing string
+	err := tx.QueryRowContext(ctx,
+		"SELECT thumbnail_hash FROM attachments WHERE blob_hash = ? AND thumbnail_hash IS NOT NULL LIMIT 1", hash,
+	).Scan(&existing)
+	if err == nil {
+		return existing, false, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", false, err
+	}
+	source, err := s.openUpload(ctx, hash)
+	if err != nil {
+		return "", false, err
+	}
+	defer source.Close()
+	var preview bytes.Buffer
+	if err := generateThumbnail(source, &preview); err != nil {
+		return "", false, err
+	}
+	thumbnail, _, isNew, err := s.storeBlob(ctx, tx, &preview)
+	return thumbnail, isNew, err
+}
+
+// countingReadCloser counts the bytes read, which is the size of an
+// attachment before it is encrypted.
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// removeStoredFiles removes files that may no longer be needed after a
+// commit or rollback: blobs only once nothing references them, and files of
+// attachments stored before blobs by name. While a backup runs the removal
+// waits for it to finish, as its snapshot may still reference the files.
+func (s *NotesService) removeStoredFiles(names []string) {
+	if s.backups.deferRemoval(names) {
+		return
+	}
+	var blobs []string
+	for _, name := range names {
+		switch {
+		case name == "":
+		case isBlobHash(name):
+			blobs = append(blobs, name)
+		default:
+			if err := s.Storage.Delete(context.Background(), name); err != nil {
+				log.Printf("Remove %s: %v", name, err)
+			}
+		}
+	}
+	if len(blobs) == 0 {
+		return
+	}
+	if err := s.collectBlobs(context.Background(), blobs); err != nil {
+		log.Printf("Remove unreferenced files: %v", err)
+	}
+}
+
+// discardStoredFiles rolls tx back and removes the files it stored. The
+// rollback comes first, as collecting the blobs needs the write lock.
+func (s *NotesService) discardStoredFiles(tx *sql.Tx, created []string) {
+	_ = tx.Rollback()
+	s.removeStoredFiles(created)
+}
+
+// collectBlobs removes every blob without references, and the files of
+// candidates that have no blob row because the transaction storing them was
+// rolled back.
+func (s *NotesService) collectBlobs(ctx context.Context, candidates []string) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Deleting first takes the write lock, so no upload can start using a
+	// blob between this check and the removal of its file.
+	rows, err := tx.QueryContext(ctx, "DELETE FROM blobs WHERE ref_count <= 0 RETURNING hash")
+	if err != nil {
+		return err
+	}
+	var unreferenced []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return err
+		}
+		unreferenced = append(unreferenced, hash)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	for _, hash := range candidates {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM blobs WHERE hash = ?)", hash).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			unreferenced = append(unreferenced, hash)
+		}
+	}
+	for _, hash := range unreferenced {
+		if err := s.Storage.Delete(ctx, hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// MigrateLegacyUploads moves attachments stored before blobs into the blob
+// store. Their file_path is kept, so links in note content keep working;
+// attachments whose file is missing are left as they are.
+func (s *NotesService) MigrateLegacyUploads(ctx context.Context) (int, error) {
+	rows, err := s.DB.QueryContext(ctx, "SELECT id, file_path, thumbnail_path FROM attachments WHERE blob_hash IS NULL ORDER BY id")
+	if err != nil {
+		return 0, err
+	}
+	type legacyAttachment struct {
+		id              int64
+		file, thumbnail string
+	}
+	var legacy []legacyAttachment
+	for rows.Next() {
+		var attachment legacyAttachment
+		if err := rows.Scan(&attachment.id, &attachment.file, &attachment.thumbnail); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		legacy = append(legacy, attachment)
+	}
+	if err := rows.Close(); err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, attachment := range legacy {
+		err := s.migrateLegacyUpload(ctx, attachment.id, attachment.file, attachment.thumbnail)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return moved, fmt.Errorf("attachment %d: %w", attachment.id, err)
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+func (s *NotesService) migrateLegacyUpload(ctx context.Context, id int64, file, thumbnail string) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var created []string
+	store := func(name string) (string, int64, error) {
+		source, err := s.openUpload(ctx, name)
+		if err != nil {
+			return "", 0, err
+		}
+		defer source.Close()
+		hash, size, isNew, err := s.storeBlob(ctx, tx, source)
+		if isNew {
+			created = append(created, hash)
+		}
+		return hash, size, err
+	}
+
+	hash, size, err := store(file)
+	if err != nil {
+		s.discardStoredFiles(tx, created)
+		return err
+	}
+	var thumbnailHash *string
+	if thumbnail != "" {
+		preview, _, err := store(thumbnail)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.discardStoredFiles(tx, created)
+			return err
+		}
+		if err == nil {
+			thumbnailHash = &preview
+		}
+	}
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE attachments SET blob_hash = ?, thumbnail_hash = ?, size = ?, mime_type = ? WHERE id = ?",
+		hash, thumbnailHash, size, attachmentMimeType(file), id,
+	); err != nil {
+		s.discardStoredFiles(tx, created)
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		s.discardStoredFiles(tx, created)
+		return err
+	}
+	s.removeStoredFiles([]string{file, thumbnail})
+	return nil
+}
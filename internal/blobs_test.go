@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func blobRefCount(t *testing.T, service *NotesService, hash string) int {
+	t.Helper()
+	var count int
+	if err := service.DB.QueryRow("SELECT COALESCE((SELECT ref_count FROM blobs WHERE hash = ?), 0)", hash).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestIdenticalUploadsShareOneBlob(t *testing.T) {
+	service := newTestNotesService(t)
+	ctx := context.Background()
+	var picture bytes.Buffer
+	if err := png.Encode(&picture, image.NewGray(image.Rect(0, 0, 800, 600))); err != nil {
+		t.Fatal(err)
+	}
+	var notes []MessageDTO
+	for _, name := range []string{"photo.png", "copy.png"} {
+		note, err := service.CreateNote(ctx, CreateNoteOptions{
+			Content:     "Shared photo",
+			Attachments: []NewAttachment{{Filename: name, Data: picture.Bytes()}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		notes = append(notes, note)
+	}
+	first, second := notes[0].Attachments[0], notes[1].Attachments[0]
+	if first.storedFile != second.storedFile || first.storedThumbnail != second.storedThumbnail {
+		t.Fatalf("identical uploads stored twice: %+v, %+v", first, second)
+	}
+	if !strings.HasPrefix(first.FilePath, first.storedFile+"_") || second.OriginalName != "copy.png" {
+		t.Fatalf("attachment names = %q, %q", first.FilePath, second.OriginalName)
+	}
+	if first.Size != int64(picture.Len()) || first.MimeType != "image/png" {
+		t.Fatalf("size = %d, MIME type = %q", first.Size, first.MimeType)
+	}
+	if count := blobRefCount(t, service, first.storedFile); count != 2 {
+		t.Fatalf("ref_count = %d, want 2", count)
+	}
+	entries, err := os.ReadDir(service.UploadsDir)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("uploads dir has %d files, want the image and its preview: %v", len(entries), err)
+	}
+
+	if _, err := service.UpdateNote(ctx, notes[0].ID, UpdateNoteOptions{DeleteAttachmentIDs: []int64{first.ID}}); err != nil {
+		t.Fatal(err)
+	}
+	if count := blobRefCount(t, service, first.storedFile); count != 1 {
+		t.Fatalf("ref_count after one delete = %d, want 1", count)
+	}
+	opened, err := service.OpenFile(ctx, second.FilePath)
+	if err != nil {
+		t.Fatalf("blob of the other note was removed: %v", err)
+	}
+	opened.Close()
+
+	if _, err := service.MoveToTrash(ctx, []int64{notes[1].ID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.DeletePermanently(ctx, []int64{notes[1].ID}); err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range []string{first.storedFile, first.storedThumbnail} {
+		if _, err := os.Stat(filepath.Join(service.UploadsDir, hash)); !os.IsNotExist(err) {
+			t.Fatalf("unreferenced blob %s still exists: %v", hash, err)
+		}
+	}
+	var blobs int
+	if err := service.DB.QueryRow("SELECT COUNT(*) FROM blobs").Scan(&blobs); err != nil || blobs != 0 {
+		t.Fatalf("blobs left = %d, %v", blobs, err)
+	}
+}
+
+func TestMigrateLegacyUploads(t *testing.T) {
+	service := newTestNotesService(t)
+	ctx := context.Background()
+	note, err := service.CreateNote(ctx, CreateNoteOptions{Content: "Old note"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyName := "0123456789abcdef0123456789abcdef_report.txt"
+	if err := os.MkdirAll(service.UploadsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(service.UploadsDir, legacyName), []byte("legacy report"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.DB.Exec(`
+		INSERT INTO attachments (message_id, file_path, thumbnail_path, file_type, original_name) VALUES
+			(?, ?, '', 'document', 'report.txt'),
+			(?, 'fedcba9876543210fedcba9876543210_missing.txt', '', 'document', 'missing.txt')`,
+		note.ID, legacyName, note.ID,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := service.MigrateLegacyUploads(ctx)
+	if err != nil || moved != 1 {
+		t.Fatalf("moved = %d, %v", moved, err)
+	}
+	if _, err := os.Stat(filepath.Join(service.UploadsDir, legacyName)); !os.IsNotExist(err) {
+		t.Fatalf("legacy file left after the move: %v", err)
+	}
+	migrated, err := service.GetNote(ctx, note.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attachment := migrated.Attachments[0]
+	if attachment.FilePath != legacyName || !isBlobHash(attachment.storedFile) || attachment.Size != int64(len("legacy report")) {
+		t.Fatalf("migrated attachment = %+v", attachment)
+	}
+	opened, err := service.OpenFile(ctx, legacyName)
+	if err != nil {
+		t.Fatalf("old link no longer opens: %v", err)
+	}
+	opened.Close()
+	if moved, err := service.MigrateLegacyUploads(ctx); err != nil || moved != 0 {
+		t.Fatalf("second run moved %d, %v", moved, err)
+	}
+}
@@ -3,6 +3,7 @@ package cfg
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"log"
 	"os"
 	"path/filepath"
@@ -19,6 +20,40 @@ type Config struct {
 	Name       string
 	UploadsDir string
 	MCPToken   string `json:"-"`
+	// BackupIntervalHours enables scheduled backups into BackupDir, keeping
+	// the newest BackupKeep archives. Zero disables them.
+	BackupIntervalHours int
+	BackupDir           string
+	BackupKeep          int
+	// AuthMode protects the web UI, /api and /files: "session" signs in with
+	// a goNotes account, "basic" checks the same accounts with HTTP Basic,
+	// "proxy" trusts the user name in AuthProxyHeader from one of
+	// AuthTrustedProxies, and "none" turns authentication off.
+	AuthMode           string
+	AuthProxyHeader    string
+	AuthTrustedProxies []string
+	// EncryptUploads stores attachments encrypted at rest. The key is
+	// unlocked with the contents of UploadsKeyFile or, without one, with the
+	// GONOTES_UPLOADS_PASSPHRASE environment variable.
+	EncryptUploads bool
+	UploadsKeyFile string
+	// EncryptDatabase also encrypts notes.db, its WAL and journals with the
+	// uploads key. It needs EncryptUploads.
+	EncryptDatabase bool
+	// Storage keeps attachments in the uploads directory of the profile
+	// ("local") or in an S3-compatible bucket ("s3"). The S3 secret key may
+	// come from the GONOTES_S3_SECRET_ACCESS_KEY environment variable instead.
+	Storage           string
+	S3Endpoint        string
+	S3Region          string
+	S3Bucket          string
+	S3Prefix          string
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+	S3PathStyle       bool
+	// MaxUploadMB bounds the size of a resumable upload, from the web UI or
+	// MCP, in MiB.
+	MaxUploadMB int
 }
 
 var APP_ID = "com.rndnm.gonotes"
@@ -37,9 +72,13 @@ func (s *Config) GetBrowserAddress() string {
 
 func getNewConfig() Config {
 	var config = Config{
-		Port:       80,
-		Name:       "Notes",
-		UploadsDir: "uploads",
+		Port:        80,
+		Name:        "Notes",
+		UploadsDir:  "uploads",
+		BackupKeep:  7,
+		AuthMode:    "session",
+		Storage:     "local",
+		MaxUploadMB: 4096,
 	}
 	return config
 }
@@ -70,6 +109,18 @@ func LoadConfig() Config {
 	if config.UploadsDir == "" {
 		config.UploadsDir = newConfig.UploadsDir
 	}
+	if config.BackupKeep == 0 {
+		config.BackupKeep = newConfig.BackupKeep
+	}
+	if config.AuthMode == "" {
+		config.AuthMode = newConfig.AuthMode
+	}
+	if config.Storage == "" {
+		config.Storage = newConfig.Storage
+	}
+	if config.MaxUploadMB <= 0 {
+		config.MaxUploadMB = newConfig.MaxUploadMB
+	}
 	if token := os.Getenv("MCP_TOKEN"); token != "" {
 		config.MCPToken = token
 	}
@@ -87,6 +138,34 @@ func SaveConfig(config Config) error {
 	return nil
 }
 
+// GetBackupDir returns the scheduled backup directory, by default the
+// backups folder of the profile.
+func (s *Config) GetBackupDir() string {
+	if s.BackupDir == "" {
+		return filepath.Join(GetProfilePath(), "backups")
+	}
+	return s.BackupDir
+}
+
+// GetUploadsSecret returns the secret that unlocks the uploads key.
+func (s *Config) GetUploadsSecret() ([]byte, error) {
+	if s.UploadsKeyFile != "" {
+		return os.ReadFile(s.UploadsKeyFile)
+	}
+	if passphrase := os.Getenv("GONOTES_UPLOADS_PASSPHRASE"); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	return nil, errors.New("set UploadsKeyFile or GONOTES_UPLOADS_PASSPHRASE to unlock the uploads")
+}
+
+// GetS3SecretAccessKey returns the secret key of the S3 storage.
+func (s *Config) GetS3SecretAccessKey() string {
+	if key := os.Getenv("GONOTES_S3_SECRET_ACCESS_KEY"); key != "" {
+		return key
+	}
+	return s.S3SecretAccessKey
+}
+
 func getConfigPath() string {
 	place := GetProfilePath()
 	return filepath.Join(place, "config.json")
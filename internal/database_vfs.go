@@ -0,0 +1,995 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"unsafe"
+
+	"modernc.org/libc"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Encrypted databases are opened through a SQLite VFS that wraps the default
+// one: every file SQLite writes through it, the database as well as its WAL,
+// journals and temporary files, is stored as databaseMagic and the ID of the
+// uploads data key, followed by databaseBlockSize blocks, each sealed with
+// AES-256-GCM under a random nonce stored in front of it and bound to its
+// index. Pages of the default 4096 byte size map to whole blocks, so SQLite
+// writes rarely need to read a block first. Locks and the shared memory of
+// WAL mode are left to the default VFS; neither holds note content.
+const (
+	databaseMagic       = "GNOTESDB"
+	databaseHeaderBytes = len(databaseMagic) + uploadKeyIDBytes
+	databaseBlockSize   = 4096
+	databaseNonceBytes  = 12
+	databaseSealedBlock = databaseNonceBytes + databaseBlockSize + uploadTagBytes
+)
+
+// sqliteMagic starts every unencrypted SQLite database.
+const sqliteMagic = "SQLite format 3\x00"
+
+// IsEncryptedDatabase reports whether the database at path is encrypted. A
+// missing or empty file is not.
+func IsEncryptedDatabase(path string) (bool, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	header := make([]byte, len(databaseMagic))
+	n, err := io.ReadFull(file, header)
+	if n == 0 && err == io.EOF {
+		return false, nil
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	if string(header[:n]) == databaseMagic {
+		return true, nil
+	}
+	if !bytes.HasPrefix([]byte(sqliteMagic), header[:n]) {
+		return false, fmt.Errorf("%s is not a SQLite database", path)
+	}
+	return false, nil
+}
+
+// RekeyDatabase rewrites the database at path with the current data key of
+// to, or as a plain SQLite file when to is nil. from opens the database when
+// it is encrypted. The database must be closed; a WAL or journal left beside
+// it is folded in first, and the new file replaces it atomically.
+func RekeyDatabase(path string, from, to *UploadsKey) error {
+	if err := checkpointDatabase(path, from); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, suffix := range []string{"-wal", "-journal"} {
+		if info, err := os.Stat(path + suffix); err == nil && info.Size() > 0 {
+			return fmt.Errorf("%s%s is still there; is the server running?", path, suffix)
+		}
+	}
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	reader, err := newDatabaseReader(source, info.Size(), from)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), ".rekey-*.db")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	var writer io.Writer = temp
+	var sealer *databaseWriter
+	if to != nil {
+		if sealer, err = newDatabaseWriter(temp, to); err != nil {
+			temp.Close()
+			return err
+		}
+		writer = sealer
+	}
+	_, err = io.Copy(writer, reader)
+	if err == nil && sealer != nil {
+		err = sealer.Close()
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temp.Name(), info.Mode().Perm())
+	}
+	if err != nil {
+		return err
+	}
+	// The shared memory index of WAL mode holds no pages and is rebuilt
+	// from the WAL, which is empty now.
+	os.Remove(path + "-shm")
+	return os.Rename(temp.Name(), path)
+}
+
+// openDatabaseFile opens the database at path, through the VFS of key when
+// it is encrypted.
+func openDatabaseFile(path string, key *UploadsKey) (*sql.DB, error) {
+	encrypted, err := IsEncryptedDatabase(path)
+	if err != nil {
+		return nil, err
+	}
+	if !encrypted {
+		return sql.Open("sqlite", path)
+	}
+	vfs, err := RegisterDatabaseVFS(key)
+	if err != nil {
+		return nil, err
+	}
+	return sql.Open("sqlite", path+"?vfs="+vfs)
+}
+
+// checkpointDatabase opens the database at path once, which copies its WAL
+// into it or rolls back an interrupted transaction.
+func checkpointDatabase(path string, key *UploadsKey) error {
+	db, err := openDatabaseFile(path, key)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// databaseCipher seals and opens the blocks of one encrypted file.
+type databaseCipher struct {
+	aead cipher.AEAD
+}
+
+// newDatabaseHeader returns the header of files encrypted with the current
+// data key of key, and the cipher of that key.
+func newDatabaseHeader(key *UploadsKey) ([]byte, databaseCipher, error) {
+	id, err := hex.DecodeString(key.current)
+	if err != nil {
+		return nil, databaseCipher{}, err
+	}
+	return append([]byte(databaseMagic), id...), databaseCipher{aead: key.aeads[key.current]}, nil
+}
+
+// parseDatabaseHeader returns the cipher of a file starting with header.
+func parseDatabaseHeader(header []byte, key *UploadsKey) (databaseCipher, error) {
+	if len(header) < databaseHeaderBytes || string(header[:len(databaseMagic)]) != databaseMagic {
+		return databaseCipher{}, errors.New("database is not encrypted")
+	}
+	if key == nil {
+		return databaseCipher{}, errors.New("database is encrypted, but no uploads key is configured")
+	}
+	id := hex.EncodeToString(header[len(databaseMagic):databaseHeaderBytes])
+	aead, ok := key.aeads[id]
+	if !ok {
+		return databaseCipher{}, fmt.Errorf("database is encrypted with unknown uploads key %s", id)
+	}
+	return databaseCipher{aead: aead}, nil
+}
+
+func databaseBlockOffset(index int64) int64 {
+	return int64(databaseHeaderBytes) + index*databaseSealedBlock
+}
+
+// databaseSize returns the plaintext size of an encrypted file of physical
+// bytes.
+func databaseSize(physical int64) int64 {
+	if physical <= int64(databaseHeaderBytes) {
+		return 0
+	}
+	sealed := physical - int64(databaseHeaderBytes)
+	size := sealed / databaseSealedBlock * databaseBlockSize
+	if last := sealed % databaseSealedBlock; last > databaseNonceBytes+uploadTagBytes {
+		size += last - databaseNonceBytes - uploadTagBytes
+	}
+	return size
+}
+
+// seal encrypts plain as block index into dst, which must hold
+// databaseSealedBlock bytes, and returns the sealed block.
+func (c databaseCipher) seal(dst, plain []byte, index int64) ([]byte, error) {
+	nonce := dst[:databaseNonceBytes]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	var aad [8]byte
+	binary.BigEndian.PutUint64(aad[:], uint64(index))
+	return c.aead.Seal(nonce, nonce, plain, aad[:]), nil
+}
+
+// open decrypts sealed block index into dst.
+func (c databaseCipher) open(dst, sealed []byte, index int64) ([]byte, error) {
+	if len(sealed) < databaseNonceBytes+uploadTagBytes {
+		return nil, errors.New("encrypted database block is truncated")
+	}
+	var aad [8]byte
+	binary.BigEndian.PutUint64(aad[:], uint64(index))
+	return c.aead.Open(dst[:0], sealed[:databaseNonceBytes], sealed[databaseNonceBytes:], aad[:])
+}
+
+// newDatabaseReader returns a reader of the plaintext of a database file of
+// size bytes, encrypted or not.
+func newDatabaseReader(file io.ReaderAt, size int64, key *UploadsKey) (io.Reader, error) {
+	header := make([]byte, databaseHeaderBytes)
+	if n, _ := file.ReadAt(header, 0); n < len(databaseMagic) || string(header[:len(databaseMagic)]) != databaseMagic {
+		return io.NewSectionReader(file, 0, size), nil
+	}
+	c, err := parseDatabaseHeader(header, key)
+	if err != nil {
+		return nil, err
+	}
+	return &databaseReader{file: file, cipher: c, size: databaseSize(size)}, nil
+}
+
+type databaseReader struct {
+	file   io.ReaderAt
+	cipher databaseCipher
+	size   int64
+	index  int64
+	plain  []byte
+}
+
+func (r *databaseReader) Read(p []byte) (int, error) {
+	if len(r.plain) == 0 {
+		if r.index*databaseBlockSize >= r.size {
+			return 0, io.EOF
+		}
+		sealed := make([]byte, databaseSealedBlock)
+		n, err := r.file.ReadAt(sealed, databaseBlockOffset(r.index))
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if r.plain, err = r.cipher.open(nil, sealed[:n], r.index); err != nil {
+			return 0, fmt.Errorf("decrypt database block %d: %w", r.index, err)
+		}
+		r.index++
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// databaseWriter encrypts a database written to it from the start.
+type databaseWriter struct {
+	w      io.Writer
+	cipher databaseCipher
+	index  int64
+	buf    []byte
+	sealed []byte
+}
+
+func newDatabaseWriter(w io.Writer, key *UploadsKey) (*databaseWriter, error) {
+	header, c, err := newDatabaseHeader(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &databaseWriter{w: w, cipher: c, buf: make([]byte, 0, databaseBlockSize), sealed: make([]byte, databaseSealedBlock)}, nil
+}
+
+func (d *databaseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), databaseBlockSize-len(d.buf))
+		d.buf = append(d.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(d.buf) == databaseBlockSize {
+			if err := d.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close writes the last, partial block.
+func (d *databaseWriter) Close() error {
+	if len(d.buf) == 0 {
+		return nil
+	}
+	return d.flush()
+}
+
+func (d *databaseWriter) flush() error {
+	sealed, err := d.cipher.seal(d.sealed, d.buf, d.index)
+	if err != nil {
+		return err
+	}
+	d.index++
+	d.buf = d.buf[:0]
+	_, err = d.w.Write(sealed)
+	return err
+}
+
+// The VFS itself. SQLite calls it with C memory allocated by the transpiled
+// library, and Go functions stand in for C function pointers the same way
+// they do in modernc.org/sqlite/vfs.
+
+// databaseVFS is a registered VFS encrypting files with key.
+type databaseVFS struct {
+	name string
+	key  *UploadsKey
+	base uintptr
+}
+
+// databaseFileHeader starts the sqlite3_file of the VFS; the file of the
+// default VFS follows it.
+type databaseFileHeader struct {
+	sqlite3.Tsqlite3_file
+	handle uintptr
+}
+
+const databaseFileHeaderBytes = int32(unsafe.Sizeof(databaseFileHeader{}))
+
+type databaseFile struct {
+	vfs    *databaseVFS
+	base   uintptr
+	main   bool
+	path   string
+	lock   *sync.RWMutex
+	cipher databaseCipher
+	header []byte
+	// buf is C memory for one sealed block and a file size, as the default
+	// VFS reads and writes C memory only.
+	buf   uintptr
+	plain []byte
+}
+
+var databaseVFSs struct {
+	sync.Mutex
+	byKey   map[*UploadsKey]*databaseVFS
+	vfss    map[uintptr]*databaseVFS
+	files   map[uintptr]*databaseFile
+	next    uintptr
+	methods uintptr
+	// locks serialize block updates of a file across its handles, so no
+	// read sees a block half rewritten.
+	locks map[string]*databaseLock
+}
+
+type databaseLock struct {
+	sync.RWMutex
+	users int
+}
+
+// The VFS relies on the memory layout and calling convention of the
+// transpiled SQLite and libc, which no API promises to keep, so it is only
+// used with the versions it was checked against. go.mod pins them; update
+// these together with it, and only once the tests pass.
+var databaseVFSModules = map[string]string{
+	"modernc.org/sqlite": "v1.42.2",
+	"modernc.org/libc":   "v1.66.10",
+}
+
+// databaseVFSCheck runs checkDatabaseVFS once per process.
+var databaseVFSCheck = sync.OnceValue(checkDatabaseVFS)
+
+// RegisterDatabaseVFS registers a SQLite VFS that encrypts new files with
+// the current data key of key and opens files encrypted with any of its
+// keys. It returns the name to pass as the vfs parameter of a database DSN.
+// It fails rather than risk a database written in plaintext or corrupted
+// when the SQLite build is not the pinned one or the VFS fails its self-test.
+func RegisterDatabaseVFS(key *UploadsKey) (string, error) {
+	if key == nil {
+		return "", errors.New("encrypting the database needs an uploads key")
+	}
+	if err := databaseVFSCheck(); err != nil {
+		return "", fmt.Errorf("database encryption is unavailable: %w", err)
+	}
+	return registerDatabaseVFS(key)
+}
+
+// checkDatabaseVFS checks the module versions the binary was built with and
+// then round-trips a throwaway database through the VFS under a throwaway
+// key: it has to read back what it wrote, and the files on disk must hold
+// neither the rows nor the SQLite header.
+func checkDatabaseVFS() error {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return errors.New("the binary has no module information")
+	}
+	for path, want := range databaseVFSModules {
+		got := ""
+		for _, dep := range info.Deps {
+			if dep.Path == path {
+				got = dep.Version
+				if dep.Replace != nil {
+					got = dep.Replace.Version
+				}
+			}
+		}
+		if got != want {
+			return fmt.Errorf("built with %s %q, but the VFS supports only %s", path, got, want)
+		}
+	}
+
+	id := make([]byte, uploadKeyIDBytes)
+	data := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	if _, err := rand.Read(data); err != nil {
+		return err
+	}
+	key, err := newUploadsKey(&uploadsKeys{current: hex.EncodeToString(id), dataKeys: map[string][]byte{hex.EncodeToString(id): data}})
+	if err != nil {
+		return err
+	}
+	vfs, err := registerDatabaseVFS(key)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "gonotes-vfs-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "check.db")
+	const marker = "gonotes vfs self-test"
+	roundTrip := func(write bool) error {
+		db, err := sql.Open("sqlite", path+"?vfs="+vfs+"&_pragma=journal_mode(WAL)")
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		if write {
+			if _, err := db.Exec("CREATE TABLE t (v TEXT)"); err != nil {
+				return err
+			}
+			for i := range 64 {
+				if _, err := db.Exec("INSERT INTO t VALUES (?)", fmt.Sprintf("%s %d %0512d", marker, i, i)); err != nil {
+					return err
+				}
+			}
+		}
+		var count int
+		if err := db.QueryRow("SELECT count(*) FROM t WHERE v LIKE ?", marker+" %").Scan(&count); err != nil {
+			return err
+		}
+		if count != 64 {
+			return fmt.Errorf("read back %d of 64 rows", count)
+		}
+		var integrity string
+		if err := db.QueryRow("PRAGMA integrity_check").Scan(&integrity); err != nil {
+			return err
+		}
+		if integrity != "ok" {
+			return fmt.Errorf("integrity check: %s", integrity)
+		}
+		return nil
+	}
+	if err := roundTrip(true); err != nil {
+		return fmt.Errorf("self-test: %w", err)
+	}
+	if err := roundTrip(false); err != nil {
+		return fmt.Errorf("self-test after reopening: %w", err)
+	}
+	for _, suffix := range []string{"", "-wal"} {
+		raw, err := os.ReadFile(path + suffix)
+		if os.IsNotExist(err) && suffix != "" {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(raw) > 0 && !bytes.HasPrefix(raw, []byte(databaseMagic)) ||
+			bytes.Contains(raw, []byte(marker)) || bytes.Contains(raw, []byte(sqliteMagic)) {
+			return fmt.Errorf("self-test: check.db%s was written in plaintext", suffix)
+		}
+	}
+	return nil
+}
+
+func registerDatabaseVFS(key *UploadsKey) (string, error) {
+	registry := &databaseVFSs
+	registry.Lock()
+	defer registry.Unlock()
+	if v, ok := registry.byKey[key]; ok {
+		return v.name, nil
+	}
+	if registry.byKey == nil {
+		registry.byKey = map[*UploadsKey]*databaseVFS{}
+		registry.vfss = map[uintptr]*databaseVFS{}
+		registry.files = map[uintptr]*databaseFile{}
+		registry.locks = map[string]*databaseLock{}
+	}
+
+	tls := libc.NewTLS()
+	defer tls.Close()
+	base := sqlite3.Xsqlite3_vfs_find(tls, 0)
+	if base == 0 {
+		return "", errors.New("SQLite has no default VFS")
+	}
+	if registry.methods == 0 {
+		registry.methods = newDatabaseIOMethods(tls)
+		if registry.methods == 0 {
+			return "", errors.New("out of memory")
+		}
+	}
+	registry.next++
+	handle := registry.next
+	v := &databaseVFS{name: fmt.Sprintf("gonotes-encrypted-%d", handle), key: key, base: base}
+	name := cString(tls, v.name)
+	vfs := sqlite3.Xsqlite3_malloc64(tls, uint64(unsafe.Sizeof(sqlite3.Tsqlite3_vfs{})))
+	if name == 0 || vfs == 0 {
+		return "", errors.New("out of memory")
+	}
+	cvfs := (*sqlite3.Tsqlite3_vfs)(cPointer(vfs))
+	*cvfs = *(*sqlite3.Tsqlite3_vfs)(cPointer(base))
+	cvfs.FszOsFile += databaseFileHeaderBytes
+	cvfs.FpNext = 0
+	cvfs.FzName = name
+	cvfs.FpAppData = handle
+	cvfs.FxOpen = cFunc(databaseVFSOpen)
+	if rc := sqlite3.Xsqlite3_vfs_register(tls, vfs, 0); rc != sqlite3.SQLITE_OK {
+		return "", fmt.Errorf("register VFS %s: error %d", v.name, rc)
+	}
+	registry.byKey[key] = v
+	registry.vfss[handle] = v
+	return v.name, nil
+}
+
+func newDatabaseIOMethods(tls *libc.TLS) uintptr {
+	p := sqlite3.Xsqlite3_malloc64(tls, uint64(unsafe.Sizeof(sqlite3.Tsqlite3_io_methods{})))
+	if p == 0 {
+		return 0
+	}
+	// Version 2 leaves out xFetch, so SQLite never maps the ciphertext.
+	*(*sqlite3.Tsqlite3_io_methods)(cPointer(p)) = sqlite3.Tsqlite3_io_methods{
+		FiVersion:               2,
+		FxClose:                 cFunc(databaseFileClose),
+		FxRead:                  cFunc(databaseFileRead),
+		FxWrite:                 cFunc(databaseFileWrite),
+		FxTruncate:              cFunc(databaseFileTruncate),
+		FxSync:                  cFunc(databaseFileSync),
+		FxFileSize:              cFunc(databaseFileSize),
+		FxLock:                  cFunc(databaseFileLock),
+		FxUnlock:                cFunc(databaseFileUnlock),
+		FxCheckReservedLock:     cFunc(databaseFileCheckReservedLock),
+		FxFileControl:           cFunc(databaseFileControl),
+		FxSectorSize:            cFunc(databaseFileSectorSize),
+		FxDeviceCharacteristics: cFunc(databaseFileDeviceCharacteristics),
+		FxShmMap:                cFunc(databaseFileShmMap),
+		FxShmLock:               cFunc(databaseFileShmLock),
+		FxShmBarrier:            cFunc(databaseFileShmBarrier),
+		FxShmUnmap:              cFunc(databaseFileShmUnmap),
+	}
+	return p
+}
+
+// cPointer converts the address of C memory, which the Go garbage collector
+// does not manage, to a pointer.
+func cPointer(p uintptr) unsafe.Pointer {
+	return *(*unsafe.Pointer)(unsafe.Pointer(&p))
+}
+
+// cFunc returns a Go function as the function pointer of the transpiled
+// SQLite. Only top-level functions may be passed.
+func cFunc[F any](fn F) uintptr {
+	return *(*uintptr)(unsafe.Pointer(&fn))
+}
+
+// goFunc returns a function pointer of the transpiled SQLite as a Go function.
+func goFunc[F any](p uintptr) F {
+	return *(*F)(unsafe.Pointer(&p))
+}
+
+func cBytes(p uintptr, n int) []byte {
+	return unsafe.Slice((*byte)(cPointer(p)), n)
+}
+
+func cString(tls *libc.TLS, s string) uintptr {
+	p := sqlite3.Xsqlite3_malloc64(tls, uint64(len(s)+1))
+	if p != 0 {
+		copy(cBytes(p, len(s)+1), s+"\x00")
+	}
+	return p
+}
+
+func baseMethods(file uintptr) *sqlite3.Tsqlite3_io_methods {
+	return (*sqlite3.Tsqlite3_io_methods)(cPointer((*sqlite3.Tsqlite3_file)(cPointer(file)).FpMethods))
+}
+
+func databaseFileOf(file uintptr) *databaseFile {
+	handle := (*databaseFileHeader)(cPointer(file)).handle
+	databaseVFSs.Lock()
+	defer databaseVFSs.Unlock()
+	return databaseVFSs.files[handle]
+}
+
+func databaseVFSOpen(tls *libc.TLS, pVfs, zName, pFile uintptr, flags int32, pOutFlags uintptr) int32 {
+	header := (*databaseFileHeader)(cPointer(pFile))
+	header.FpMethods = 0
+	databaseVFSs.Lock()
+	v := databaseVFSs.vfss[(*sqlite3.Tsqlite3_vfs)(cPointer(pVfs)).FpAppData]
+	databaseVFSs.Unlock()
+	base := pFile + uintptr(databaseFileHeaderBytes)
+	open := goFunc[func(*libc.TLS, uintptr, uintptr, uintptr, int32, uintptr) int32]((*sqlite3.Tsqlite3_vfs)(cPointer(v.base)).FxOpen)
+	if rc := open(tls, v.base, zName, base, flags, pOutFlags); rc != sqlite3.SQLITE_OK {
+		return rc
+	}
+	f := &databaseFile{vfs: v, base: base, main: flags&sqlite3.SQLITE_OPEN_MAIN_DB != 0, plain: make([]byte, databaseBlockSize)}
+	if zName != 0 {
+		f.path = libc.GoString(zName)
+	}
+	f.buf = sqlite3.Xsqlite3_malloc64(tls, databaseSealedBlock+8)
+	rc := int32(sqlite3.SQLITE_NOMEM)
+	if f.buf != 0 {
+		rc = f.openHeader(tls)
+	}
+	if rc != sqlite3.SQLITE_OK {
+		goFunc[func(*libc.TLS, uintptr) int32](baseMethods(base).FxClose)(tls, base)
+		sqlite3.Xsqlite3_free(tls, f.buf)
+		return rc
+	}
+
+	databaseVFSs.Lock()
+	databaseVFSs.next++
+	header.handle = databaseVFSs.next
+	databaseVFSs.files[header.handle] = f
+	f.lock = &sync.RWMutex{}
+	if f.path != "" {
+		lock := databaseVFSs.locks[f.path]
+		if lock == nil {
+			lock = &databaseLock{}
+			databaseVFSs.locks[f.path] = lock
+		}
+		lock.users++
+		f.lock = &lock.RWMutex
+	}
+	header.FpMethods = databaseVFSs.methods
+	databaseVFSs.Unlock()
+	return sqlite3.SQLITE_OK
+}
+
+// openHeader reads the key of an existing file. New files are encrypted
+// with the current key once the first block is written.
+func (f *databaseFile) openHeader(tls *libc.TLS) int32 {
+	physical, rc := f.physicalSize(tls)
+	if rc != sqlite3.SQLITE_OK {
+		return rc
+	}
+	if physical == 0 {
+		return f.useCurrentKey()
+	}
+	if physical < int64(databaseHeaderBytes) {
+		return sqlite3.SQLITE_NOTADB
+	}
+	if rc := f.baseRead(tls, 0, databaseHeaderBytes); rc != sqlite3.SQLITE_OK {
+		return rc
+	}
+	c, err := parseDatabaseHeader(cBytes(f.buf, databaseHeaderBytes), f.vfs.key)
+	if err != nil {
+		return sqlite3.SQLITE_NOTADB
+	}
+	f.cipher = c
+	return sqlite3.SQLITE_OK
+}
+
+func (f *databaseFile) useCurrentKey() int32 {
+	header, c, err := newDatabaseHeader(f.vfs.key)
+	if err != nil {
+		return sqlite3.SQLITE_IOERR
+	}
+	f.header, f.cipher = header, c
+	return sqlite3.SQLITE_OK
+}
+
+func (f *databaseFile) physicalSize(tls *libc.TLS) (int64, int32) {
+	size := f.buf + databaseSealedBlock
+	rc := goFunc[func(*libc.TLS, uintptr, uintptr) int32](baseMethods(f.base).FxFileSize)(tls, f.base, size)
+	return *(*int64)(cPointer(size)), rc
+}
+
+func (f *databaseFile) baseRead(tls *libc.TLS, offset int64, n int) int32 {
+	return goFunc[func(*libc.TLS, uintptr, uintptr, int32, int64) int32](baseMethods(f.base).FxRead)(tls, f.base, f.buf, int32(n), offset)
+}
+
+func (f *databaseFile) baseWrite(tls *libc.TLS, offset int64, n int) int32 {
+	return goFunc[func(*libc.TLS, uintptr, uintptr, int32, int64) int32](baseMethods(f.base).FxWrite)(tls, f.base, f.buf, int32(n), offset)
+}
+
+func (f *databaseFile) baseTruncate(tls *libc.TLS, size int64) int32 {
+	return goFunc[func(*libc.TLS, uintptr, int64) int32](baseMethods(f.base).FxTruncate)(tls, f.base, size)
+}
+
+// readBlock decrypts block index into f.plain. A block past the end of the
+// file is empty. Blocks of a WAL or journal that fail to decrypt, as a
+// write torn by a crash leaves them, read as zeros, which the checksums of
+// SQLite reject like any torn write; in the database they are an error.
+func (f *databaseFile) readBlock(tls *libc.TLS, physical, index int64) ([]byte, int32) {
+	offset := databaseBlockOffset(index)
+	n := min(physical-offset, databaseSealedBlock)
+	if n <= 0 {
+		return f.plain[:0], sqlite3.SQLITE_OK
+	}
+	if rc := f.baseRead(tls, offset, int(n)); rc != sqlite3.SQLITE_OK {
+		return nil, rc
+	}
+	plain, err := f.cipher.open(f.plain, cBytes(f.buf, int(n)), index)
+	if err != nil {
+		if f.main {
+			return nil, sqlite3.SQLITE_IOERR_DATA
+		}
+		plain = f.plain[:max(n-databaseNonceBytes-uploadTagBytes, 0)]
+		clear(plain)
+	}
+	return plain, sqlite3.SQLITE_OK
+}
+
+// writeBlock encrypts plain as block index.
+func (f *databaseFile) writeBlock(tls *libc.TLS, plain []byte, index int64) int32 {
+	sealed, err := f.cipher.seal(cBytes(f.buf, databaseSealedBlock), plain, index)
+	if err != nil {
+		return sqlite3.SQLITE_IOERR_WRITE
+	}
+	return f.baseWrite(tls, databaseBlockOffset(index), len(sealed))
+}
+
+func (f *databaseFile) read(tls *libc.TLS, p []byte, offset int64) int32 {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	physical, rc := f.physicalSize(tls)
+	if rc != sqlite3.SQLITE_OK {
+		return rc
+	}
+	for len(p) > 0 {
+		index, within := offset/databaseBlockSize, int(offset%databaseBlockSize)
+		plain, rc := f.readBlock(tls, physical, index)
+		if rc != sqlite3.SQLITE_OK {
+			return rc
+		}
+		want := min(len(p), databaseBlockSize-within)
+		n := 0
+		if within < len(plain) {
+			n = copy(p[:want], plain[within:])
+		}
+		if n < want {
+			clear(p[n:])
+			return sqlite3.SQLITE_IOERR_SHORT_READ
+		}
+		p, offset = p[n:], offset+int64(n)
+	}
+	return sqlite3.SQLITE_OK
+}
+
+func (f *databaseFile) write(tls *libc.TLS, p []byte, offset int64) int32 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.writeLocked(tls, p, offset)
+}
+
+func (f *databaseFile) writeLocked(tls *libc.TLS, p []byte, offset int64) int32 {
+	physical, rc := f.prepareWrite(tls)
+	if rc != sqlite3.SQLITE_OK {
+		return rc
+	}
+	// Blocks before the written range must be whole, so a gap is filled
+	// with zeros as a plain file reads in a hole.
+	if size := databaseSize(physical); offset > size {
+		zeros := make([]byte, databaseBlockSize)
+		for size < offset {
+			n := min(offset-size, databaseBlockSize-size%databaseBlockSize)
+			if physical, rc = f.writeRange(tls, physical, zeros[:n], size); rc != sqlite3.SQLITE_OK {
+				return rc
+			}
+			size += n
+		}
+	}
+	_, rc = f.writeRange(tls, physical, p, offset)
+	return rc
+}
+
+// prepareWrite writes the header of a new file and returns the physical
+// size of the file.
+func (f *databaseFile) prepareWrite(tls *libc.TLS) (int64, int32) {
+	physical, rc := f.physicalSize(tls)
+	if rc != sqlite3.SQLITE_OK || physical > 0 {
+		return physical, rc
+	}
+	if f.header == nil {
+		if rc := f.useCurrentKey(); rc != sqlite3.SQLITE_OK {
+			return 0, rc
+		}
+	}
+	copy(cBytes(f.buf, len(f.header)), f.header)
+	if rc := f.baseWrite(tls, 0, len(f.header)); rc != sqlite3.SQLITE_OK {
+		return 0, rc
+	}
+	return int64(len(f.header)), sqlite3.SQLITE_OK
+}
+
+// writeRange writes p at offset, which is at most the size of the file, and
+// returns the new physical size.
+func (f *databaseFile) writeRange(tls *libc.TLS, physical int64, p []byte, offset int64) (int64, int32) {
+	for len(p) > 0 {
+		index, within := offset/databaseBlockSize, int(offset%databaseBlockSize)
+		n := min(len(p), databaseBlockSize-within)
+		plain := p[:n]
+		if n < databaseBlockSize {
+			existing, rc := f.readBlock(tls, physical, index)
+			if rc != sqlite3.SQLITE_OK {
+				return physical, rc
+			}
+			plain = f.plain[:max(len(existing), within+n)]
+			clear(plain[len(existing):])
+			copy(plain[within:], p[:n])
+		}
+		if rc := f.writeBlock(tls, plain, index); rc != sqlite3.SQLITE_OK {
+			return physical, rc
+		}
+		physical = max(physical, databaseBlockOffset(index)+int64(databaseNonceBytes+len(plain)+uploadTagBytes))
+		p, offset = p[n:], offset+int64(n)
+	}
+	return physical, sqlite3.SQLITE_OK
+}
+
+func (f *databaseFile) truncate(tls *libc.TLS, size int64) int32 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	physical, rc := f.physicalSize(tls)
+	if rc != sqlite3.SQLITE_OK {
+		return rc
+	}
+	current := databaseSize(physical)
+	switch {
+	case size == 0:
+		// An emptied WAL or journal starts over with the current key.
+		f.header = nil
+		if rc := f.useCurrentKey(); rc != sqlite3.SQLITE_OK {
+			return rc
+		}
+		return f.baseTruncate(tls, 0)
+	case size >= current:
+		if size == current {
+			return sqlite3.SQLITE_OK
+		}
+		return f.writeLocked(tls, nil, size)
+	}
+	index, within := (size-1)/databaseBlockSize, int((size-1)%databaseBlockSize)+1
+	if within < databaseBlockSize {
+		plain, rc := f.readBlock(tls, physical, index)
+		if rc != sqlite3.SQLITE_OK {
+			return rc
+		}
+		if rc := f.writeBlock(tls, plain[:within], index); rc != sqlite3.SQLITE_OK {
+			return rc
+		}
+	}
+	return f.baseTruncate(tls, databaseBlockOffset(index)+int64(databaseNonceBytes+within+uploadTagBytes))
+}
+
+func databaseFileClose(tls *libc.TLS, pFile uintptr) int32 {
+	f := databaseFileOf(pFile)
+	rc := goFunc[func(*libc.TLS, uintptr) int32](baseMethods(f.base).FxClose)(tls, f.base)
+	sqlite3.Xsqlite3_free(tls, f.buf)
+	header := (*databaseFileHeader)(cPointer(pFile))
+	databaseVFSs.Lock()
+	delete(databaseVFSs.files, header.handle)
+	if lock := databaseVFSs.locks[f.path]; f.path != "" && lock != nil {
+		if lock.users--; lock.users == 0 {
+			delete(databaseVFSs.locks, f.path)
+		}
+	}
+	databaseVFSs.Unlock()
+	header.FpMethods = 0
+	return rc
+}
+
+func databaseFileRead(tls *libc.TLS, pFile, zBuf uintptr, iAmt int32, iOfst int64) int32 {
+	return databaseFileOf(pFile).read(tls, cBytes(zBuf, int(iAmt)), iOfst)
+}
+
+func databaseFileWrite(tls *libc.TLS, pFile, zBuf uintptr, iAmt int32, iOfst int64) int32 {
+	return databaseFileOf(pFile).write(tls, cBytes(zBuf, int(iAmt)), iOfst)
+}
+
+func databaseFileTruncate(tls *libc.TLS, pFile uintptr, size int64) int32 {
+	return databaseFileOf(pFile).truncate(tls, size)
+}
+
+func databaseFileSize(tls *libc.TLS, pFile, pSize uintptr) int32 {
+	f := databaseFileOf(pFile)
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	physical, rc := f.physicalSize(tls)
+	if rc == sqlite3.SQLITE_OK {
+		*(*int64)(cPointer(pSize)) = databaseSize(physical)
+	}
+	return rc
+}
+
+func databaseFileControl(tls *libc.TLS, pFile uintptr, op int32, pArg uintptr) int32 {
+	switch op {
+	case sqlite3.SQLITE_FCNTL_SIZE_HINT, sqlite3.SQLITE_FCNTL_CHUNK_SIZE:
+		// The default VFS would grow the file with zeros that are no
+		// valid blocks.
+		return sqlite3.SQLITE_OK
+	}
+	base := databaseFileOf(pFile).base
+	return goFunc[func(*libc.TLS, uintptr, int32, uintptr) int32](baseMethods(base).FxFileControl)(tls, base, op, pArg)
+}
+
+func databaseFileSectorSize(tls *libc.TLS, pFile uintptr) int32 {
+	return databaseBlockSize
+}
+
+// databaseFileDeviceCharacteristics drops the guarantees about writes the
+// default VFS makes for the disk, as a write here rewrites whole blocks.
+func databaseFileDeviceCharacteristics(tls *libc.TLS, pFile uintptr) int32 {
+	base := databaseFileOf(pFile).base
+	characteristics := goFunc[func(*libc.TLS, uintptr) int32](baseMethods(base).FxDeviceCharacteristics)(tls, base)
+	const atomicWrites = sqlite3.SQLITE_IOCAP_ATOMIC | sqlite3.SQLITE_IOCAP_ATOMIC512 | sqlite3.SQLITE_IOCAP_ATOMIC1K |
+		sqlite3.SQLITE_IOCAP_ATOMIC2K | sqlite3.SQLITE_IOCAP_ATOMIC4K | sqlite3.SQLITE_IOCAP_ATOMIC8K |
+		sqlite3.SQLITE_IOCAP_ATOMIC16K | sqlite3.SQLITE_IOCAP_ATOMIC32K | sqlite3.SQLITE_IOCAP_ATOMIC64K
+	return characteristics &^ (atomicWrites | sqlite3.SQLITE_IOCAP_SAFE_APPEND |
+		sqlite3.SQLITE_IOCAP_POWERSAFE_OVERWRITE | sqlite3.SQLITE_IOCAP_BATCH_ATOMIC)
+}
+
+func databaseFileSync(tls *libc.TLS, pFile uintptr, flags int32) int32 {
+	base := databaseFileOf(pFile).base
+	return goFunc[func(*libc.TLS, uintptr, int32) int32](baseMethods(base).FxSync)(tls, base, flags)
+}
+
+func databaseFileLock(tls *libc.TLS, pFile uintptr, lock int32) int32 {
+	base := databaseFileOf(pFile).base
+	return goFunc[func(*libc.TLS, uintptr, int32) int32](baseMethods(base).FxLock)(tls, base, lock)
+}
+
+func databaseFileUnlock(tls *libc.TLS, pFile uintptr, lock int32) int32 {
+	base := databaseFileOf(pFile).base
+	return goFunc[func(*libc.TLS, uintptr, int32) int32](baseMethods(base).FxUnlock)(tls, base, lock)
+}
+
+func databaseFileCheckReservedLock(tls *libc.TLS, pFile, pResOut uintptr) int32 {
+	base := databaseFileOf(pFile).base
+	return goFunc[func(*libc.TLS, uintptr, uintptr) int32](baseMethods(base).FxCheckReservedLock)(tls, base, pResOut)
+}
+
+func databaseFileShmMap(tls *libc.TLS, pFile uintptr, iPg, pgsz, bExtend int32, pp uintptr) int32 {
+	base := databaseFileOf(pFile).base
+	return goFunc[func(*libc.TLS, uintptr, int32, int32, int32, uintptr) int32](baseMethods(base).FxShmMap)(tls, base, iPg, pgsz, bExtend, pp)
+}
+
+func databaseFileShmLock(tls *libc.TLS, pFile uintptr, offset, n, flags int32) int32 {
+	base := databaseFileOf(pFile).base
+	return goFunc[func(*libc.TLS, uintptr, int32, int32, int32) int32](baseMethods(base).FxShmLock)(tls, base, offset, n, flags)
+}
+
+func databaseFileShmBarrier(tls *libc.TLS, pFile uintptr) {
+	base := databaseFileOf(pFile).base
+	goFunc[func(*libc.TLS, uintptr)](baseMethods(base).FxShmBarrier)(tls, base)
+}
+
+func databaseFileShmUnmap(tls *libc.TLS, pFile uintptr, deleteFlag int32) int32 {
+	base := databaseFileOf(pFile).base
+	return goFunc[func(*libc.TLS, uintptr, int32) int32](baseMethods(base).FxShmUnmap)(tls, base, deleteFlag)
+}
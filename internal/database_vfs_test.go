@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openEncryptedTestDB(t *testing.T, path string, key *UploadsKey) *sql.DB {
+	t.Helper()
+	vfs, err := RegisterDatabaseVFS(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	database, err := sql.Open("sqlite", path+"?vfs="+vfs+"&_pragma=journal_mode(WAL)&_pragma=foreign_keys(ON)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateDB(database); err != nil {
+		database.Close()
+		t.Fatal(err)
+	}
+	return database
+}
+
+func TestEncryptedDatabase(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	key, err := OpenUploadsKey(dir, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "notes.db")
+	database := openEncryptedTestDB(t, path, key)
+	service := NewNotesService(database, filepath.Join(dir, "uploads"))
+	content := "Meeting notes " + strings.Repeat("confidential ", 2000)
+	created, err := service.CreateNote(ctx, CreateNoteOptions{Content: content})
+	if err != nil {
+		database.Close()
+		t.Fatal(err)
+	}
+	for _, suffix := range []string{"", "-wal"} {
+		raw, err := os.ReadFile(path + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(raw, []byte("confidential")) || bytes.Contains(raw, []byte(sqliteMagic)) {
+			t.Fatalf("notes.db%s holds plaintext", suffix)
+		}
+	}
+	if err := database.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if encrypted, err := IsEncryptedDatabase(path); err != nil || !encrypted {
+		t.Fatalf("IsEncryptedDatabase = %v, %v", encrypted, err)
+	}
+
+	database = openEncryptedTestDB(t, path, key)
+	note, err := NewNotesService(database, filepath.Join(dir, "uploads")).GetNote(ctx, created.ID)
+	database.Close()
+	if err != nil || note.Content != content {
+		t.Fatalf("note after reopening = %q, %v", note.Content, err)
+	}
+
+	plain, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = plain.QueryRow("SELECT count(*) FROM messages").Scan(new(int))
+	plain.Close()
+	if err == nil {
+		t.Fatal("encrypted database opened without the key")
+	}
+}
+
+func TestRekeyDatabase(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "notes.db")
+	plain, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateDB(plain); err != nil {
+		t.Fatal(err)
+	}
+	created, err := NewNotesService(plain, filepath.Join(dir, "uploads")).CreateNote(ctx, CreateNoteOptions{Content: "Plain start"})
+	plain.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := OpenUploadsKey(dir, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RekeyDatabase(path, nil, first); err != nil {
+		t.Fatal(err)
+	}
+	storage := NewLocalStorage(filepath.Join(dir, "uploads"))
+	if _, err := RekeyUploads(ctx, dir, storage, path, []byte("correct horse"), []byte("battery staple")); err != nil {
+		t.Fatal(err)
+	}
+	second, err := OpenUploadsKey(dir, []byte("battery staple"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenUploadsKey(dir, []byte("correct horse")); err == nil {
+		t.Fatal("old secret still unlocks the key")
+	}
+	database := openEncryptedTestDB(t, path, second)
+	note, err := NewNotesService(database, filepath.Join(dir, "uploads")).GetNote(ctx, created.ID)
+	database.Close()
+	if err != nil || note.Content != "Plain start" {
+		t.Fatalf("note after rekey = %q, %v", note.Content, err)
+	}
+
+	if _, err := RekeyUploads(ctx, dir, storage, path, []byte("battery staple"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if encrypted, err := IsEncryptedDatabase(path); err != nil || encrypted {
+		t.Fatalf("IsEncryptedDatabase after decrypting = %v, %v", encrypted, err)
+	}
+	plain, err = sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	var got string
+	if err := plain.QueryRow("SELECT content FROM messages WHERE id = ?", created.ID).Scan(&got); err != nil || got != "Plain start" {
+		t.Fatalf("decrypted note = %q, %v", got, err)
+	}
+}
+
+func TestBackupOfEncryptedDatabase(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	uploads := filepath.Join(dir, "uploads")
+	key, err := OpenUploadsKey(uploads, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	database := openEncryptedTestDB(t, filepath.Join(dir, "notes.db"), key)
+	defer database.Close()
+	service := NewNotesService(database, uploads)
+	service.UploadsKey = key
+	note, err := service.CreateNote(ctx, CreateNoteOptions{
+		Content:     "confidential plan",
+		Attachments: []NewAttachment{{Filename: "plan.txt", Data: []byte("attachment")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archivePath := filepath.Join(t.TempDir(), "backup.zip")
+	archive, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := service.Backup(ctx, archive); err != nil {
+		t.Fatal(err)
+	}
+	archive.Close()
+
+	profile := t.TempDir()
+	if _, err := RestoreBackup(archivePath, profile, nil); err == nil {
+		t.Fatal("restored an encrypted backup without the secret")
+	}
+	if _, err := RestoreBackup(archivePath, profile, []byte("correct horse")); err != nil {
+		t.Fatal(err)
+	}
+	restoredDB := filepath.Join(profile, "notes.db")
+	raw, err := os.ReadFile(restoredDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("confidential")) {
+		t.Fatal("backup holds the database in plaintext")
+	}
+	restoredKey, err := OpenUploadsKey(filepath.Join(profile, "uploads"), []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := openEncryptedTestDB(t, restoredDB, restoredKey)
+	defer restored.Close()
+	var content string
+	if err := restored.QueryRow("SELECT content FROM messages WHERE id = ?", note.ID).Scan(&content); err != nil || content != "confidential plan" {
+		t.Fatalf("restored content = %q, %v", content, err)
+	}
+}
+
+func TestDatabaseVFSCheck(t *testing.T) {
+	if err := checkDatabaseVFS(); err != nil {
+		t.Fatal(err)
+	}
+	pinned := databaseVFSModules["modernc.org/sqlite"]
+	databaseVFSModules["modernc.org/sqlite"] = "v1.0.0"
+	defer func() { databaseVFSModules["modernc.org/sqlite"] = pinned }()
+	if err := checkDatabaseVFS(); err == nil || !strings.Contains(err.Error(), "modernc.org/sqlite") {
+		t.Fatalf("check with another SQLite version = %v", err)
+	}
+}
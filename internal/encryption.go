@@ -0,0 +1,660 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Encrypted notes keep AES-256-GCM ciphertext in messages.content and in
+// their attachment files, which are sealed in chunks like encrypted uploads
+// so they can be read in ranges. Each notebook has one random data key, stored in
+// note_keys wrapped with a key derived from the owner's passphrase. Unlocking
+// keeps the data key in memory until it has been idle for UnlockTimeout, so
+// this is encryption at rest with a passphrase-unlocked server key, not
+// end-to-end encryption: the server decrypts notes while they are unlocked.
+const (
+	UnlockTimeout       = 30 * time.Minute
+	noteKeyBytes        = 32
+	encryptedPrefix     = "gnenc1:"
+	encryptedFileHeader = "GNENC1\n"
+	// encryptedFileMagic starts chunked attachment files; files starting
+	// with encryptedFileHeader were sealed whole by earlier versions.
+	encryptedFileMagic = "GNENC2\n"
+)
+
+// ErrNoteLocked is returned instead of the content of an encrypted note when
+// the call cannot decrypt it.
+var ErrNoteLocked = errors.New("encrypted note is locked")
+
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+type EncryptionStatus struct {
+	// Configured reports whether the notebook has a passphrase.
+	Configured bool `json:"configured"`
+	Unlocked   bool `json:"unlocked"`
+}
+
+type unlockedKey struct {
+	key      []byte
+	lastUsed time.Time
+}
+
+// keyring holds the data keys of unlocked notebooks.
+type keyring struct {
+	mu   sync.Mutex
+	keys map[int64]unlockedKey
+}
+
+func (k *keyring) get(owner int64) []byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	entry, ok := k.keys[owner]
+	if !ok {
+		return nil
+	}
+	if time.Since(entry.lastUsed) > UnlockTimeout {
+		delete(k.keys, owner)
+		return nil
+	}
+	entry.lastUsed = time.Now()
+	k.keys[owner] = entry
+	return entry.key
+}
+
+func (k *keyring) set(owner int64, key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.keys == nil {
+		k.keys = map[int64]unlockedKey{}
+	}
+	k.keys[owner] = unlockedKey{key: key, lastUsed: time.Now()}
+}
+
+func (k *keyring) remove(owner int64) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.keys, owner)
+}
+
+type noDecryptionKey struct{}
+
+// withoutDecryption marks calls that must never see the content of encrypted
+// notes, such as MCP tools and public share pages.
+func withoutDecryption(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noDecryptionKey{}, true)
+}
+
+// mayDecrypt reports whether a call may use the unlocked key of its notebook.
+// Agents and scripts with access tokens never can.
+func mayDecrypt(ctx context.Context) bool {
+	if _, ok := tokenFrom(ctx); ok {
+		return false
+	}
+	return ctx.Value(noDecryptionKey{}) == nil
+}
+
+// noteKey returns the data key for the encrypted notes of the call.
+func (s *NotesService) noteKey(ctx context.Context) ([]byte, error) {
+	if !mayDecrypt(ctx) {
+		return nil, fmt.Errorf("%w: encrypted notes cannot be read or changed through MCP or access tokens", ErrNoteLocked)
+	}
+	key := s.keys.get(ownerID(ctx))
+	if key == nil {
+		return nil, fmt.Errorf("%w: unlock encrypted notes with your passphrase first", ErrNoteLocked)
+	}
+	return key, nil
+}
+
+func (s *NotesService) EncryptionStatus(ctx context.Context) (EncryptionStatus, error) {
+	var status EncryptionStatus
+	err := s.DB.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM note_keys WHERE owner_id = ?)", ownerID(ctx)).Scan(&status.Configured)
+	status.Unlocked = status.Configured && mayDecrypt(ctx) && s.keys.get(ownerID(ctx)) != nil
+	return status, err
+}
+
+// SetupEncryption creates the data key of the notebook, protected by
+// passphrase, and unlocks it.
+func (s *NotesService) SetupEncryption(ctx context.Context, passphrase string) error {
+	if err := requireKeyManagement(ctx); err != nil {
+		return err
+	}
+	key := make([]byte, noteKeyBytes)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	salt, wrapped, err := wrapNoteKey(key, passphrase)
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.ExecContext(ctx,
+		"INSERT INTO note_keys (owner_id, salt, iterations, wrapped_key) VALUES (?, ?, ?, ?)",
+		ownerID(ctx), salt, passwordIterations, wrapped,
+	)
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return errors.New("encryption is already set up; change the passphrase instead")
+	}
+	if err != nil {
+		return err
+	}
+	s.keys.set(ownerID(ctx), key)
+	return nil
+}
+
+// UnlockNotes makes the encrypted notes of the calling user readable until
+// they are locked or idle for UnlockTimeout.
+func (s *NotesService) UnlockNotes(ctx context.Context, passphrase string) error {
+	if err := requireKeyManagement(ctx); err != nil {
+		return err
+	}
+	key, err := s.unwrapNoteKey(ctx, passphrase)
+	if err != nil {
+		return err
+	}
+	s.keys.set(ownerID(ctx), key)
+	return nil
+}
+
+func (s *NotesService) LockNotes(ctx context.Context) {
+	s.keys.remove(ownerID(ctx))
+}
+
+// ChangePassphrase rewraps the data key; encrypted notes stay as they are.
+func (s *NotesService) ChangePassphrase(ctx context.Context, oldPassphrase, newPassphrase string) error {
+	if err := requireKeyManagement(ctx); err != nil {
+		return err
+	}
+	key, err := s.unwrapNoteKey(ctx, oldPassphrase)
+	if err != nil {
+		return err
+	}
+	salt, wrapped, err := wrapNoteKey(key, newPassphrase)
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.ExecContext(ctx,
+		"UPDATE note_keys SET salt = ?, iterations = ?, wrapped_key = ? WHERE owner_id = ?",
+		salt, passwordIterations, wrapped, ownerID(ctx),
+	)
+	return err
+}
+
+// SetEncrypted encrypts or decrypts a note with its attachments. Encrypting
+// drops the note's revision history, tags, links and search index entry, so
+// no plaintext copy is left in the database; decrypting rebuilds them.
+// Attachments are rewritten under new names and the old files removed.
+func (s *NotesService) SetEncrypted(ctx context.Context, id int64, encrypted bool) (MessageDTO, error) {
+	key, err := s.noteKey(ctx)
+	if err != nil {
+		return MessageDTO{}, err
+	}
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return MessageDTO{}, err
+	}
+	defer tx.Rollback()
+
+	var content string
+	var isEncrypted bool
+	filter, filterArgs := noteFilter(ctx, "")
+	if err := tx.QueryRowContext(ctx,
+		"SELECT COALESCE(content, ''), is_encrypted FROM messages WHERE id = ? AND "+filter, append([]any{id}, filterArgs...)...,
+	).Scan(&content, &isEncrypted); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return MessageDTO{}, fmt.Errorf("note %d not found", id)
+		}
+		return MessageDTO{}, err
+	}
+	if isEncrypted == encrypted {
+		if err := tx.Rollback(); err != nil {
+			return MessageDTO{}, err
+		}
+		return s.GetNote(ctx, id)
+	}
+	if encrypted {
+		if err := requireShareless(ctx, tx, id); err != nil {
+			return MessageDTO{}, err
+		}
+	} else if content, err = decryptContent(key, content); err != nil {
+		return MessageDTO{}, fmt.Errorf("note %d: %w", id, err)
+	}
+
+	transform := func(file StoredFile) (io.ReadCloser, error) { return encryptedSource(key, file) }
+	if !encrypted {
+		transform = func(file StoredFile) (io.ReadCloser, error) { return openEncryptedFile(key, file) }
+	}
+	content, created, replaced, err := s.rewriteAttachments(ctx, tx, id, content, transform, !encrypted)
+	if err != nil {
+		s.discardStoredFiles(tx, created)
+		return MessageDTO{}, err
+	}
+
+	if encrypted {
+		err = storeEncryptedNote(ctx, tx, id, key, content)
+	} else {
+		err = storeDecryptedNote(ctx, tx, id, ownerID(ctx), content)
+	}
+	if err != nil {
+		s.discardStoredFiles(tx, created)
+		return MessageDTO{}, err
+	}
+	events, err := recordChanges(ctx, tx, ChangeUpdated, []int64{id})
+	if err != nil {
+		s.discardStoredFiles(tx, created)
+		return MessageDTO{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		s.discardStoredFiles(tx, created)
+		return MessageDTO{}, err
+	}
+	s.publish(events)
+	s.removeStoredFiles(replaced)
+	return s.GetNote(ctx, id)
+}
+
+// storeEncryptedNote replaces the content of a note with ciphertext and
+// removes everything derived from the plaintext.
+func storeEncryptedNote(ctx context.Context, tx *sql.Tx, id int64, key []byte, content string) error {
+	ciphertext, err := encryptContent(key, content)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE messages SET content = ?, content_lower = '', is_encrypted = 1, version = version + 1 WHERE id = ?",
+		ciphertext, id,
+	); err != nil {
+		return err
+	}
+	for _, query := range []string{
+		"DELETE FROM message_tags WHERE message_id = ?",
+		"DELETE FROM message_links WHERE message_id = ?",
+		"DELETE FROM message_revisions WHERE message_id = ?",
+	} {
+		if _, err := tx.ExecContext(ctx, query, id); err != nil {
+			return err
+		}
+	}
+	return removeFromSearchIndex(ctx, tx, []int64{id})
+}
+
+func storeDecryptedNote(ctx context.Context, tx *sql.Tx, id, owner int64, content string) error {
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE messages SET content = ?, content_lower = ?, is_encrypted = 0, version = version + 1 WHERE id = ?",
+		content, strings.ToLower(content), id,
+	); err != nil {
+		return err
+	}
+	if err := syncMessageTags(ctx, tx, id, content); err != nil {
+		return err
+	}
+	if err := syncMessageLinks(ctx, tx, owner, id, content); err != nil {
+		return err
+	}
+	if err := syncSearchIndex(ctx, tx, id, content); err != nil {
+		return err
+	}
+	return insertRevision(ctx, tx, id, content)
+}
+
+// updateEncryptedContent stores edited content of an encrypted note. Tags,
+// links, the search index and revisions stay empty for encrypted notes.
+func updateEncryptedContent(ctx context.Context, tx *sql.Tx, id int64, key []byte, content string) error {
+	ciphertext, err := encryptContent(key, content)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		"UPDATE messages SET content = ? WHERE id = ?",
+		ciphertext, id,
+	)
+	return err
+}
+
+// requireShareless keeps notes with public share links from being encrypted,
+// because the links would silently stop working.
+func requireShareless(ctx context.Context, tx *sql.Tx, id int64) error {
+	var shared bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM shares WHERE message_id = ?)", id).Scan(&shared); err != nil {
+		return err
+	}
+	if shared {
+		return fmt.Errorf("note %d has public share links; revoke them before encrypting it", id)
+	}
+	return nil
+}
+
+// rewriteAttachments stores copies of the attachments of a note, read
+// through transform, as new blobs and points the attachment records and /files/ links in
+// content at them. It returns the new content, the created files and the
+// replaced files, which the caller removes after committing. Thumbnails are
+// dropped, and made again from the new files when thumbnails is set.
+func (s *NotesService) rewriteAttachments(ctx context.Context, tx *sql.Tx, noteID int64, content string, transform func(StoredFile) (io.ReadCloser, error), thumbnails bool) (string, []string, []string, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, file_path, original_name, COALESCE(blob_hash, file_path), COALESCE(thumbnail_hash, thumbnail_path, '')
+		FROM attachments WHERE message_id = ? ORDER BY id`, noteID)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	type storedAttachment struct {
+		id                            int64
+		file, name, stored, thumbnail string
+	}
+	var attachments []storedAttachment
+	for rows.Next() {
+		var attachment storedAttachment
+		if err := rows.Scan(&attachment.id, &attachment.file, &attachment.name, &attachment.stored, &attachment.thumbnail); err != nil {
+			rows.Close()
+			return "", nil, nil, err
+		}
+		attachments = append(attachments, attachment)
+	}
+	if err := rows.Close(); err != nil {
+		return "", nil, nil, err
+	}
+
+	var created, replaced []string
+	for _, attachment := range attachments {
+		stored, err := s.openUpload(ctx, attachment.stored)
+		if err != nil {
+			return "", created, nil, err
+		}
+		source, err := transform(stored)
+		if err != nil {
+			return "", created, nil, fmt.Errorf("attachment %s: %w", attachment.file, err)
+		}
+		if attachment.name == "" {
+			attachment.name = attachment.file
+		}
+		file, err := s.storeAttachmentFile(ctx, tx, source, attachment.name, thumbnails, &created)
+		if closeErr := source.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return "", created, nil, fmt.Errorf("attachment %s: %w", attachment.file, err)
+		}
+		// Metadata read from the content is dropped while it is encrypted.
+		meta, mimeType := file.meta, ""
+		if thumbnails {
+			mimeType = meta.mimeType
+		}
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE attachments SET file_path = ?, blob_hash = ?, thumbnail_path = ?, thumbnail_hash = NULLIF(?, ''),
+				mime_type = COALESCE(NULLIF(?, ''), mime_type), width = ?, height = ?, taken_at = ?, duration = ?, inspected = ?
+			WHERE id = ?`, file.filePath, file.blobHash, file.thumbnailPath, file.thumbnailHash,
+			mimeType, meta.width, meta.height, meta.takenAt, meta.duration, thumbnails, attachment.id,
+		); err != nil {
+			return "", created, nil, err
+		}
+		content = strings.ReplaceAll(content, "/files/"+attachment.file, "/files/"+file.filePath)
+		replaced = append(replaced, attachment.stored, attachment.thumbnail)
+	}
+	return content, created, replaced, nil
+}
+
+// revealNotes decrypts the encrypted notes the call may read and blanks the
+// content of the rest, marking them locked.
+func (s *NotesService) revealNotes(ctx context.Context, notes []MessageDTO) {
+	var key []byte
+	for i := range notes {
+		if notes[i].IsEncrypted == 0 {
+			continue
+		}
+		if key == nil {
+			key, _ = s.noteKey(ctx)
+		}
+		content, err := decryptContent(key, notes[i].Content)
+		if key == nil || err != nil {
+			notes[i].Content = ""
+			notes[i].Snippets = nil
+			notes[i].Locked = true
+			continue
+		}
+		notes[i].Content = content
+	}
+}
+
+func requireKeyManagement(ctx context.Context) error {
+	if !mayDecrypt(ctx) {
+		return errors.New("encrypted notes cannot be managed through MCP or access tokens")
+	}
+	return nil
+}
+
+func wrapNoteKey(key []byte, passphrase string) (string, string, error) {
+	if len(passphrase) < minPasswordLength {
+		return "", "", fmt.Errorf("passphrase must be at least %d characters", minPasswordLength)
+	}
+	salt := make([]byte, passwordSaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return "", "", err
+	}
+	wrappingKey, err := pbkdf2.Key(sha256.New, passphrase, salt, passwordIterations, noteKeyBytes)
+	if err != nil {
+		return "", "", err
+	}
+	wrapped, err := encryptBytes(wrappingKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(wrapped), nil
+}
+
+func (s *NotesService) unwrapNoteKey(ctx context.Context, passphrase string) ([]byte, error) {
+	var encodedSalt, encodedKey string
+	var iterations int
+	err := s.DB.QueryRowContext(ctx,
+		"SELECT salt, iterations, wrapped_key FROM note_keys WHERE owner_id = ?", ownerID(ctx),
+	).Scan(&encodedSalt, &iterations, &encodedKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.New("encryption is not set up")
+	}
+	if err != nil {
+		return nil, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(encodedSalt)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, err
+	}
+	wrappingKey, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, noteKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	key, err := decryptBytes(wrappingKey, wrapped)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
+
+func encryptContent(key []byte, content string) (string, error) {
+	sealed, err := encryptBytes(key, []byte(content))
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptContent(key []byte, stored string) (string, error) {
+	encoded, ok := strings.CutPrefix(stored, encryptedPrefix)
+	if !ok {
+		return "", errors.New("content is not encrypted")
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	content, err := decryptBytes(key, sealed)
+	return string(content), err
+}
+
+// openEncryptedFile returns a reader of the plaintext of an attachment file
+// of an encrypted note. Chunked files are decrypted as they are read; files
+// sealed whole by earlier versions are decrypted in memory. The reader
+// closes file, which is closed on errors too.
+func openEncryptedFile(key []byte, file StoredFile) (io.ReadSeekCloser, error) {
+	object, err := newStoredObject(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	magic := make([]byte, len(encryptedFileMagic))
+	if _, err := object.ReadAt(magic, 0); err != nil && err != io.EOF {
+		file.Close()
+		return nil, err
+	}
+	switch string(magic) {
+	case encryptedFileHeader:
+		data, err := io.ReadAll(io.NewSectionReader(object, 0, object.size))
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		if data, err = decryptFile(key, data); err != nil {
+			return nil, err
+		}
+		return nopSeekCloser{bytes.NewReader(data)}, nil
+	case encryptedFileMagic:
+	default:
+		file.Close()
+		return nil, errors.New("file is not encrypted")
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	reader, err := newUploadReader(object, aead, len(encryptedFileMagic)+uploadPrefixBytes)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// decryptFile opens an attachment sealed whole by earlier versions.
+func decryptFile(key, data []byte) ([]byte, error) {
+	sealed, ok := bytes.CutPrefix(data, []byte(encryptedFileHeader))
+	if !ok {
+		return nil, errors.New("file is not encrypted")
+	}
+	return decryptBytes(key, sealed)
+}
+
+// encryptedSource returns a reader of source encrypted with key. The file
+// is encrypted in the background as it is read; Close stops it and closes
+// source, which is closed on errors too.
+func encryptedSource(key []byte, source io.ReadCloser) (io.ReadCloser, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+	reader, writer := io.Pipe()
+	encrypted := &pipeSource{PipeReader: reader, done: make(chan struct{})}
+	go func() {
+		defer close(encrypted.done)
+		encrypter, err := newUploadWriter(writer, aead, []byte(encryptedFileMagic))
+		if err == nil {
+			_, err = io.Copy(encrypter, source)
+		}
+		if err == nil {
+			err = encrypter.Close()
+		}
+		encrypted.closeErr = source.Close()
+		writer.CloseWithError(err)
+	}()
+	return encrypted, nil
+}
+
+// pipeSource is the reading end of a pipe filled by a goroutine; Close
+// waits for the goroutine and returns its close error.
+type pipeSource struct {
+	*io.PipeReader
+	done     chan struct{}
+	closeErr error
+}
+
+func (p *pipeSource) Close() error {
+	p.PipeReader.Close()
+	<-p.done
+	return p.closeErr
+}
+
+// storedObject reads an opened stored file at offsets, so the chunks of an
+// encrypted attachment can be decrypted from the plaintext of an upload.
+type storedObject struct {
+	file StoredFile
+	size int64
+}
+
+func newStoredObject(file StoredFile) (*storedObject, error) {
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	return &storedObject{file: file, size: size}, nil
+}
+
+func (o *storedObject) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := o.file.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(o.file, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (o *storedObject) Close() error       { return o.file.Close() }
+func (o *storedObject) Size() int64        { return o.size }
+func (o *storedObject) ModTime() time.Time { return o.file.ModTime }
+
+// encryptBytes seals data with AES-256-GCM under a random nonce, which it
+// puts in front of the ciphertext.
+func encryptBytes(key, data []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+func decryptBytes(key, sealed []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,236 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedNoteRoundTrip(t *testing.T) {
+	service := newTestNotesService(t)
+	ctx := context.Background()
+	note, err := service.CreateNote(ctx, CreateNoteOptions{
+		Content:     "Bank PIN 4321 #secret",
+		Attachments: []NewAttachment{{Filename: "scan.txt", Data: []byte("passport number")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.SetEncrypted(ctx, note.ID, true); !errors.Is(err, ErrNoteLocked) {
+		t.Fatalf("encrypt before setup: %v", err)
+	}
+	if err := service.SetupEncryption(ctx, "short"); err == nil {
+		t.Fatal("short passphrase accepted")
+	}
+	if err := service.SetupEncryption(ctx, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := service.SetEncrypted(ctx, note.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted.IsEncrypted != 1 || encrypted.Content != note.Content || len(encrypted.Tags) != 0 {
+		t.Fatalf("encrypted note = %+v", encrypted)
+	}
+	var stored, lower string
+	if err := service.DB.QueryRow("SELECT content, content_lower FROM messages WHERE id = ?", note.ID).Scan(&stored, &lower); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, encryptedPrefix) || strings.Contains(stored, "4321") || lower != "" {
+		t.Fatalf("stored content = %q, content_lower = %q", stored, lower)
+	}
+	var indexed, revisions int
+	if err := service.DB.QueryRow("SELECT COUNT(*) FROM messages_fts WHERE messages_fts MATCH '4321'").Scan(&indexed); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.DB.QueryRow("SELECT COUNT(*) FROM message_revisions WHERE message_id = ?", note.ID).Scan(&revisions); err != nil {
+		t.Fatal(err)
+	}
+	if indexed != 0 || revisions != 0 {
+		t.Fatalf("encrypted note left %d index entries and %d revisions", indexed, revisions)
+	}
+	if tags, err := service.ListTags(ctx); err != nil || len(tags) != 0 {
+		t.Fatalf("tags of encrypted notes = %v, %v", tags, err)
+	}
+	file := encrypted.Attachments[0].FilePath
+	if file == note.Attachments[0].FilePath {
+		t.Fatalf("attachment was not rewritten: %s", file)
+	}
+	if _, err := os.Stat(filepath.Join(service.UploadsDir, note.Attachments[0].storedFile)); !os.IsNotExist(err) {
+		t.Fatalf("plaintext attachment left on disk: %v", err)
+	}
+	onDisk, err := os.ReadFile(filepath.Join(service.UploadsDir, encrypted.Attachments[0].storedFile))
+	if err != nil || bytes.Contains(onDisk, []byte("passport")) {
+		t.Fatalf("attachment on disk = %q, %v", onDisk, err)
+	}
+	opened, err := service.OpenFile(ctx, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(opened)
+	opened.Close()
+	if string(data) != "passport number" || !opened.Encrypted {
+		t.Fatalf("unlocked file = %q", data)
+	}
+
+	updated, err := service.UpdateNote(ctx, note.ID, UpdateNoteOptions{AppendContent: "Card CVV 999 #money"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(updated.Content, "Card CVV 999 #money") || len(updated.Tags) != 0 {
+		t.Fatalf("updated encrypted note = %+v", updated)
+	}
+	if added, err := service.AddTags(ctx, []int64{note.ID}, []string{"later"}); err != nil || added != 0 {
+		t.Fatalf("tags added to an encrypted note: %d, %v", added, err)
+	}
+
+	service.LockNotes(ctx)
+	if _, err := service.GetNote(ctx, note.ID); !errors.Is(err, ErrNoteLocked) {
+		t.Fatalf("locked note: %v", err)
+	}
+	if _, _, err := service.GetAttachment(ctx, note.ID, encrypted.Attachments[0].ID); !errors.Is(err, ErrNoteLocked) {
+		t.Fatalf("locked attachment: %v", err)
+	}
+	if _, err := service.OpenFile(ctx, file); !errors.Is(err, ErrNoteLocked) {
+		t.Fatalf("locked file: %v", err)
+	}
+	if _, err := service.UpdateNote(ctx, note.ID, UpdateNoteOptions{AppendContent: "more"}); !errors.Is(err, ErrNoteLocked) {
+		t.Fatalf("update of a locked note: %v", err)
+	}
+	result, err := service.ListNotes(ctx, ListNotesOptions{})
+	if err != nil || len(result.Notes) != 1 || !result.Notes[0].Locked || result.Notes[0].Content != "" {
+		t.Fatalf("locked list = %+v, %v", result.Notes, err)
+	}
+
+	if err := service.UnlockNotes(ctx, "wrong horse"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("wrong passphrase: %v", err)
+	}
+	if err := service.ChangePassphrase(ctx, "correct horse", "battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.UnlockNotes(ctx, "battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := service.SetEncrypted(ctx, note.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted.IsEncrypted != 0 || len(decrypted.Tags) != 2 || decrypted.Attachments[0].FilePath == file {
+		t.Fatalf("decrypted note = %+v", decrypted)
+	}
+	found, err := service.ListNotes(ctx, ListNotesOptions{Query: "4321"})
+	if err != nil || len(found.Notes) != 1 {
+		t.Fatalf("search after decrypting = %+v, %v", found.Notes, err)
+	}
+	_, data, err = service.GetAttachment(ctx, note.ID, decrypted.Attachments[0].ID)
+	if err != nil || string(data) != "passport number" {
+		t.Fatalf("decrypted attachment = %q, %v", data, err)
+	}
+}
+
+func TestEncryptedAttachmentsAreReadInChunks(t *testing.T) {
+	service := newTestNotesService(t)
+	ctx := context.Background()
+	if err := service.SetupEncryption(ctx, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("0123456789abcdef"), 3*uploadChunkSize/16+5)
+	note, err := service.CreateNote(ctx, CreateNoteOptions{
+		Content:     "large",
+		Attachments: []NewAttachment{{Filename: "large.bin", Data: content}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := service.SetEncrypted(ctx, note.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onDisk, err := os.ReadFile(filepath.Join(service.UploadsDir, encrypted.Attachments[0].storedFile))
+	if err != nil || !bytes.HasPrefix(onDisk, []byte(encryptedFileMagic)) {
+		t.Fatalf("attachment on disk starts with %q, %v", onDisk[:min(len(onDisk), 8)], err)
+	}
+	offset, length := int64(uploadChunkSize-10), int64(uploadChunkSize+20)
+	chunk, err := service.ReadAttachmentChunk(ctx, note.ID, encrypted.Attachments[0].ID, offset, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunk.Size != int64(len(content)) || !bytes.Equal(chunk.Data, content[offset:offset+length]) {
+		t.Fatalf("chunk of %d bytes at %d of %d does not match", len(chunk.Data), chunk.Offset, chunk.Size)
+	}
+}
+
+func TestOpenEncryptedFileReadsWholeSealedFiles(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, noteKeyBytes)
+	sealed, err := encryptBytes(key, []byte("sealed whole"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := append([]byte(encryptedFileHeader), sealed...)
+	reader, err := openEncryptedFile(key, StoredFile{ReadSeekCloser: nopSeekCloser{bytes.NewReader(legacy)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(reader); err != nil || string(data) != "sealed whole" {
+		t.Fatalf("legacy file = %q, %v", data, err)
+	}
+	plain := StoredFile{ReadSeekCloser: nopSeekCloser{strings.NewReader("not encrypted")}}
+	if _, err := openEncryptedFile(key, plain); err == nil {
+		t.Fatal("plaintext file opened as encrypted")
+	}
+}
+
+func TestEncryptedNotesStayLockedForTokensAndMCP(t *testing.T) {
+	service := newTestNotesService(t)
+	router := NewRouter()
+	HandleMCP(router, service, "legacy-secret", "test")
+	ctx := context.Background()
+	if err := service.SetupEncryption(ctx, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	note, err := service.CreateNote(ctx, CreateNoteOptions{Content: "Diary entry"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.SetEncrypted(ctx, note.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	token, _, err := service.CreateToken(ctx, CreateTokenOptions{Name: "agent", Scope: ScopeWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenCtx := withToken(ctx, token)
+	if _, err := service.GetNote(tokenCtx, note.ID); !errors.Is(err, ErrNoteLocked) {
+		t.Fatalf("token read an unlocked note: %v", err)
+	}
+	if _, err := service.UpdateNote(tokenCtx, note.ID, UpdateNoteOptions{AppendContent: "x"}); !errors.Is(err, ErrNoteLocked) {
+		t.Fatalf("token changed an unlocked note: %v", err)
+	}
+	if err := service.UnlockNotes(tokenCtx, "correct horse"); err == nil {
+		t.Fatal("token unlocked encrypted notes")
+	}
+	synced, err := service.Sync(ctx, SyncOptions{})
+	if err != nil || len(synced.Notes) != 1 || !synced.Notes[0].Locked {
+		t.Fatalf("sync = %+v, %v", synced.Notes, err)
+	}
+	if _, err := service.CreateShare(ctx, CreateShareOptions{NoteID: note.ID}); err == nil {
+		t.Fatal("encrypted note shared")
+	}
+
+	response := mcpRequest(t, router, "legacy-secret", `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{
+		"name":"note_get","arguments":{"id":`+fmt.Sprint(note.ID)+`}
+	}}`)
+	body := response.Body.String()
+	if response.Code != http.StatusOK || !strings.Contains(body, "encrypted note is locked") || strings.Contains(body, "Diary entry") {
+		t.Fatalf("MCP note_get: status %d, body %s", response.Code, body)
+	}
+}
@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	ChangeCreated    = "created"
+	ChangeUpdated    = "updated"
+	ChangeTrashed    = "trashed"
+	ChangeRestored   = "restored"
+	ChangeArchived   = "archived"
+	ChangeUnarchived = "unarchived"
+	ChangeDeleted    = "deleted"
+	ChangeReordered  = "reordered"
+	// ChangeTagsReordered is not tied to a note; its NoteID is zero.
+	ChangeTagsReordered = "tags_reordered"
+)
+
+// changeRetention is how long the change log keeps a row. A client whose
+// cursor is older has to resync from a snapshot.
+const changeRetention = 90 * 24 * time.Hour
+
+// ErrResyncRequired is returned for a cursor older than the oldest change
+// still in the log: the changes after it were pruned, so the client has to
+// start over from a snapshot.
+var ErrResyncRequired = errors.New("changes after this cursor were pruned; resync from a snapshot")
+
+// eventBufferSize is how far a subscriber may fall behind before it is
+// disconnected. Clients then resume from the persisted change log.
+const eventBufferSize = 256
+
+// NoteEvent is one row of the persisted change log. ID is a cursor that
+// increases monotonically across all changes.
+type NoteEvent struct {
+	ID        int64  `json:"id"`
+	Action    string `json:"action"`
+	NoteID    int64  `json:"note_id"`
+	CreatedAt string `json:"created_at"`
+	// OwnerID is the user whose notebook changed; streams only deliver a
+	// user's own events.
+	OwnerID int64 `json:"-"`
+}
+
+// EventBus fans out committed changes to in-process subscribers such as open
+// /api/events streams.
+type EventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan NoteEvent]struct{}
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[chan NoteEvent]struct{})}
+}
+
+// Subscribe returns a channel of events published after the call and a
+// function releasing it. The channel is closed when the subscriber is
+// released or falls more than eventBufferSize events behind.
+func (b *EventBus) Subscribe() (<-chan NoteEvent, func()) {
+	ch := make(chan NoteEvent, eventBufferSize)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (b *EventBus) Publish(events ...NoteEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		for _, event := range events {
+			select {
+			case ch <- event:
+				continue
+			default:
+			}
+			delete(b.subscribers, ch)
+			close(ch)
+			break
+		}
+	}
+}
+
+// ChangesSince returns the caller's persisted changes with IDs greater than
+// cursor, oldest first. A tag-restricted token sees the changes of the notes
+// it can read and the deletions of notes that no longer exist. A cursor
+// older than the log gets ErrResyncRequired.
+func (s *NotesService) ChangesSince(ctx context.Context, cursor int64, limit int) ([]NoteEvent, error) {
+	if limit <= 0 {
+		limit = 500
+	}
+	// Change IDs are never reused, so every ID below the oldest kept row
+	// was pruned, or removed with its account.
+	var oldest int64
+	if err := s.DB.QueryRowContext(ctx, `
+		SELECT COALESCE((SELECT MIN(id) FROM changes), (SELECT seq + 1 FROM sqlite_sequence WHERE name = 'changes'), 1)`,
+	).Scan(&oldest); err != nil {
+		return nil, err
+	}
+	if cursor < oldest-1 {
+		return nil, ErrResyncRequired
+	}
+	scope := ""
+	args := []any{ownerID(ctx), cursor}
+	if len(restrictedTags(ctx)) > 0 {
+		filter, filterArgs := noteFilter(ctx, "")
+		scope = " AND (note_id IN (SELECT id FROM messages WHERE " + filter + ") OR note_id NOT IN (SELECT id FROM messages))"
+		args = append(args, filterArgs...)
+	}
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT id, action, note_id, created_at, owner_id FROM changes
+		WHERE owner_id = ? AND id > ?`+scope+` ORDER BY id LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []NoteEvent{}
+	for rows.Next() {
+		var event NoteEvent
+		if err := rows.Scan(&event.ID, &event.Action, &event.NoteID, &event.CreatedAt, &event.OwnerID); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// lastChangeID returns the ID of the newest change ever recorded, or zero.
+// It is read from the AUTOINCREMENT sequence, which still holds it after
+// the rows were pruned.
+func (s *NotesService) lastChangeID(ctx context.Context) (int64, error) {
+	var id int64
+	err := s.DB.QueryRowContext(ctx,
+		"SELECT COALESCE((SELECT seq FROM sqlite_sequence WHERE name = 'changes'), 0)",
+	).Scan(&id)
+	return id, err
+}
+
+// CollectChanges removes change log rows older than maxAge.
+func (s *NotesService) CollectChanges(ctx context.Context, maxAge time.Duration) (int64, error) {
+	res, err := s.DB.ExecContext(ctx,
+		"DELETE FROM changes WHERE created_at < ?", time.Now().Add(-maxAge).UTC().Format(time.DateTime),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// RunChangeLogCleanup prunes the change log now and every interval until
+// ctx is done.
+func (s *NotesService) RunChangeLogCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if removed, err := s.CollectChanges(ctx, changeRetention); err != nil {
+			log.Printf("Change log cleanup error: %v", err)
+		} else if removed > 0 {
+			log.Printf("Removed %d old change log rows", removed)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *NotesService) publish(events []NoteEvent) {
+	if s.Events != nil && len(events) > 0 {
+		s.Events.Publish(events...)
+	}
+}
+
+// recordChanges appends one change log row per note inside the mutation's
+// transaction. The returned events must be published after commit.
+func recordChanges(ctx context.Context, tx *sql.Tx, action string, noteIDs []int64) ([]NoteEvent, error) {
+	events := make([]NoteEvent, 0, len(noteIDs))
+	for _, id := range noteIDs {
+		event := NoteEvent{Action: action, NoteID: id, OwnerID: ownerID(ctx)}
+		if err := tx.QueryRowContext(ctx,
+			"INSERT INTO changes (action, note_id, owner_id) VALUES (?, ?, ?) RETURNING id, created_at",
+			action, id, event.OwnerID,
+		).Scan(&event.ID, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
@@ -0,0 +1,254 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMutationsRecordChanges(t *testing.T) {
+	ctx := context.Background()
+	service := newTestNotesService(t)
+	events, unsubscribe := service.Events.Subscribe()
+	defer unsubscribe()
+
+	note, err := service.CreateNote(ctx, CreateNoteOptions{Content: "draft"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := service.CreateNote(ctx, CreateNoteOptions{Content: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := "final"
+	steps := []func() error{
+		func() error { _, err := service.UpdateNote(ctx, note.ID, UpdateNoteOptions{Content: &content}); return err },
+		func() error { return service.SetColor(ctx, note.ID, "#f44336") },
+		func() error { _, err := service.SetArchived(ctx, []int64{note.ID}, true); return err },
+		func() error { return service.ReorderNotes(ctx, []int64{note.ID, other.ID}) },
+		func() error { _, err := service.MoveToTrash(ctx, []int64{note.ID}); return err },
+		func() error { _, err := service.Restore(ctx, []int64{note.ID}); return err },
+		func() error { _, err := service.TrashOrDelete(ctx, []int64{other.ID}, ""); return err },
+		func() error { _, err := service.TrashOrDelete(ctx, []int64{other.ID}, ""); return err },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	for len(events) > 0 {
+		event := <-events
+		got = append(got, event.Action+":"+strconv.FormatInt(event.NoteID, 10))
+	}
+	n, o := strconv.FormatInt(note.ID, 10), strconv.FormatInt(other.ID, 10)
+	want := []string{
+		"created:" + n, "created:" + o, "updated:" + n, "updated:" + n, "archived:" + n,
+		"reordered:" + n, "reordered:" + o, "trashed:" + n, "restored:" + n, "trashed:" + o, "deleted:" + o,
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("published events = %v, want %v", got, want)
+	}
+
+	logged, err := service.ChangesSince(ctx, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logged) != len(want) {
+		t.Fatalf("change log has %d rows, want %d", len(logged), len(want))
+	}
+	tail, err := service.ChangesSince(ctx, logged[len(logged)-2].ID, 0)
+	if err != nil || len(tail) != 1 || tail[0].Action != ChangeDeleted {
+		t.Fatalf("ChangesSince cursor = %+v, %v", tail, err)
+	}
+}
+
+func TestEventBusDropsSlowSubscribers(t *testing.T) {
+	bus := NewEventBus()
+	events, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+	for i := range eventBufferSize + 1 {
+		bus.Publish(NoteEvent{ID: int64(i + 1)})
+	}
+	received := 0
+	for range events {
+		received++
+	}
+	if received != eventBufferSize {
+		t.Fatalf("received %d buffered events before close, want %d", received, eventBufferSize)
+	}
+}
+
+func TestHTTPEventsStreamResumesFromLastEventID(t *testing.T) {
+	router, service := newTestAPIRouter(t)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	first, err := service.CreateNote(t.Context(), CreateNoteOptions{Content: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	missed, err := service.CreateNote(t.Context(), CreateNoteOptions{Content: "missed while offline"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := service.ChangesSince(t.Context(), 0, 0)
+	if err != nil || len(changes) != 2 || changes[0].NoteID != first.ID {
+		t.Fatalf("change log = %+v, %v", changes, err)
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Last-Event-ID", strconv.FormatInt(changes[0].ID, 10))
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if contentType := response.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", contentType)
+	}
+
+	reader := bufio.NewReader(response.Body)
+	nextEvent := func() NoteEvent {
+		t.Helper()
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, ok := strings.CutPrefix(strings.TrimSpace(line), "data: "); ok {
+				var event NoteEvent
+				if err := json.Unmarshal([]byte(data), &event); err != nil {
+					t.Fatal(err)
+				}
+				return event
+			}
+		}
+	}
+	if event := nextEvent(); event.NoteID != missed.ID || event.Action != ChangeCreated {
+		t.Fatalf("replayed event = %+v, want created %d", event, missed.ID)
+	}
+	live, err := service.CreateNote(t.Context(), CreateNoteOptions{Content: "live"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(); event.NoteID != live.ID {
+		t.Fatalf("live event = %+v, want note %d", event, live.ID)
+	}
+
+	// Two mutations commit in order but publish in reverse: the stream reads
+	// the log on the later event and still delivers both, oldest first.
+	bus := service.Events
+	service.Events = nil
+	earlier, err := service.CreateNote(t.Context(), CreateNoteOptions{Content: "committed first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	later, err := service.CreateNote(t.Context(), CreateNoteOptions{Content: "committed second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.Events = bus
+	logged, err := service.ChangesSince(t.Context(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus.Publish(logged[len(logged)-1])
+	for _, want := range []int64{earlier.ID, later.ID} {
+		if event := nextEvent(); event.NoteID != want {
+			t.Fatalf("reordered event = %+v, want note %d", event, want)
+		}
+	}
+}
+
+func TestPrunedChangeLogRequiresResync(t *testing.T) {
+	router, service := newTestAPIRouter(t)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	old, err := service.CreateNote(t.Context(), CreateNoteOptions{Content: "old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.CreateNote(t.Context(), CreateNoteOptions{Content: "also old"}); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := service.Sync(t.Context(), SyncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.DB.Exec("UPDATE changes SET created_at = datetime('now', '-100 days')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.UpdateNote(t.Context(), old.ID, UpdateNoteOptions{AppendContent: "recent"}); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := service.CollectChanges(t.Context(), changeRetention); err != nil || removed != 2 {
+		t.Fatalf("CollectChanges = %d, %v", removed, err)
+	}
+
+	if _, err := service.Sync(t.Context(), SyncOptions{Since: snapshot.Cursor - 1}); !errors.Is(err, ErrResyncRequired) {
+		t.Fatalf("sync from a pruned cursor: %v", err)
+	}
+	response := callAPI(t, router, httptest.NewRequest(http.MethodGet, "/api/sync?since=1", nil))
+	if response.Code != http.StatusGone {
+		t.Fatalf("HTTP sync from a pruned cursor: %d %s", response.Code, response.Body)
+	}
+	if next, err := service.Sync(t.Context(), SyncOptions{Since: snapshot.Cursor}); err != nil || len(next.Notes) != 1 {
+		t.Fatalf("sync from the oldest kept cursor = %+v, %v", next, err)
+	}
+
+	// Once every row is pruned, new snapshots still get the last change ID
+	// as their cursor.
+	if _, err := service.DB.Exec("DELETE FROM changes"); err != nil {
+		t.Fatal(err)
+	}
+	resynced, err := service.Sync(t.Context(), SyncOptions{})
+	if err != nil || resynced.Cursor != snapshot.Cursor+1 {
+		t.Fatalf("snapshot after pruning = %+v, %v", resynced, err)
+	}
+	if _, err := service.Sync(t.Context(), SyncOptions{Since: resynced.Cursor}); err != nil {
+		t.Fatalf("sync from the snapshot after pruning: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Last-Event-ID", "1")
+	stream, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+	reader := bufio.NewReader(stream.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line = strings.TrimSpace(line); strings.HasPrefix(line, "event:") || len(lines) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	want := []string{"event: resync", "id: " + strconv.FormatInt(resynced.Cursor, 10), "data: {}"}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("stream from a pruned cursor = %q, want %q", lines, want)
+	}
+}
@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// reUploadLink matches server-relative /files/ links at the start of a
+// Markdown or HTML link target, leaving absolute URLs to other sites alone.
+var reUploadLink = regexp.MustCompile(`(^|[\s(<"'])/files/`)
+
+const (
+	exportBatchSize       = 200
+	exportAttachmentsDir  = "attachments"
+	maxExportNameRunes    = 60
+	exportFrontMatterMark = "---"
+)
+
+// Export writes every note, including archived and trashed ones, to w as a ZIP
+// archive. Each note becomes a Markdown file with YAML front matter, and its
+// attachments are stored under attachments/ with links to /files/NAME in the
+// content rewritten to the relative path. Attachment files missing from the
+// uploads directory are skipped so one lost file does not abort the export.
+// Encrypted notes are exported as they are stored, with encrypted: true in
+// the front matter: the content is the ciphertext and their attachments stay
+// sealed with the notebook key, even while the notebook is unlocked, because
+// the archive itself is not encrypted.
+func (s *NotesService) Export(ctx context.Context, w io.Writer) error {
+	ctx = withoutDecryption(ctx)
+	archive := zip.NewWriter(w)
+	// Attachments of the same content share one blob, so the name of an
+	// attachment file already in the archive is only listed again.
+	written := make(map[string]bool)
+	var afterID int64
+	filter, filterArgs := noteFilter(ctx, "")
+	for {
+		notes, err := s.loadNotes(ctx,
+			"SELECT "+noteColumns+" FROM messages WHERE "+filter+" AND id > ? ORDER BY id LIMIT ?",
+			append(filterArgs, afterID, exportBatchSize)...)
+		if err != nil {
+			return err
+		}
+		for _, note := range notes {
+			if err := s.exportNote(ctx, archive, note, written); err != nil {
+				return fmt.Errorf("note %d: %w", note.ID, err)
+			}
+			afterID = note.ID
+		}
+		if len(notes) < exportBatchSize {
+			break
+		}
+	}
+	return archive.Close()
+}
+
+func (s *NotesService) exportNote(ctx context.Context, archive *zip.Writer, note MessageDTO, written map[string]bool) error {
+	modified := parseDBTime(note.UpdatedAt)
+	var attachments []string
+	for _, attachment := range note.Attachments {
+		name := filepath.Base(attachment.FilePath)
+		if written[name] {
+			attachments = append(attachments, exportAttachmentsDir+"/"+name)
+			continue
+		}
+		source, err := s.openUpload(ctx, attachment.storedFile)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		target, err := archive.CreateHeader(&zip.FileHeader{
+			Name: exportAttachmentsDir + "/" + name, Method: zip.Store, Modified: modified,
+		})
+		if err == nil {
+			_, err = io.Copy(target, source)
+		}
+		source.Close()
+		if err != nil {
+			return err
+		}
+		written[name] = true
+		attachments = append(attachments, exportAttachmentsDir+"/"+name)
+	}
+
+	var content string
+	if note.IsEncrypted == 1 {
+		if err := s.DB.QueryRowContext(ctx, "SELECT COALESCE(content, '') FROM messages WHERE id = ?", note.ID).Scan(&content); err != nil {
+			return err
+		}
+	} else {
+		content = reUploadLink.ReplaceAllString(note.Content, "${1}"+exportAttachmentsDir+"/")
+	}
+	target, err := archive.CreateHeader(&zip.FileHeader{
+		Name: exportFileName(note), Method: zip.Deflate, Modified: modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(target, renderFrontMatter(note, attachments)+content)
+	return err
+}
+
+// renderFrontMatter encodes string values as JSON, which is valid YAML and
+// keeps quoting and escaping of arbitrary tags and colors correct.
+func renderFrontMatter(note MessageDTO, attachments []string) string {
+	quote := func(value any) string {
+		data, _ := json.Marshal(value)
+		return string(data)
+	}
+	var b strings.Builder
+	b.WriteString(exportFrontMatterMark + "\n")
+	fmt.Fprintf(&b, "id: %d\n", note.ID)
+	fmt.Fprintf(&b, "created_at: %s\n", quote(note.CreatedAt))
+	fmt.Fprintf(&b, "updated_at: %s\n", quote(note.UpdatedAt))
+	fmt.Fprintf(&b, "used_at: %s\n", quote(note.UsedAt))
+	fmt.Fprintf(&b, "color: %s\n", quote(note.Color))
+	fmt.Fprintf(&b, "archived: %t\n", note.IsArchived == 1)
+	fmt.Fprintf(&b, "deleted: %t\n", note.IsDeleted == 1)
+	fmt.Fprintf(&b, "tags: %s\n", quote(note.Tags))
+	fmt.Fprintf(&b, "sort_order: %d\n", note.SortOrder)
+	if note.IsEncrypted == 1 {
+		b.WriteString("encrypted: true\n")
+	}
+	if len(attachments) > 0 {
+		fmt.Fprintf(&b, "attachments: %s\n", quote(attachments))
+	}
+	b.WriteString(exportFrontMatterMark + "\n")
+	return b.String()
+}
+
+// exportFileName builds "<id>-<title>.md" from the first line of the note,
+// keeping only letters and digits so the name is portable across file systems.
+// The ID prefix keeps names unique. Encrypted notes have no readable title
+// and are named by ID.
+func exportFileName(note MessageDTO) string {
+	var slug strings.Builder
+	dash := false
+	count := 0
+	for _, r := range noteTitle(note.Content) {
+		if count == maxExportNameRunes {
+			break
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && slug.Len() > 0 {
+				slug.WriteByte('-')
+			}
+			slug.WriteRune(unicode.ToLower(r))
+			dash = false
+			count++
+		} else {
+			dash = true
+		}
+	}
+	if slug.Len() == 0 {
+		return fmt.Sprintf("%d.md", note.ID)
+	}
+	return fmt.Sprintf("%d-%s.md", note.ID, slug.String())
+}
+
+func parseDBTime(value string) time.Time {
+	for _, layout := range []string{time.RFC3339, time.DateTime} {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return parsed
+		}
+	}
+	return time.Now()
+}
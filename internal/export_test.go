@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestExportWritesMarkdownWithFrontMatterAndAttachments(t *testing.T) {
+	ctx := context.Background()
+	service := newTestNotesService(t)
+	note, err := service.CreateNote(ctx, CreateNoteOptions{
+		Content:     "# Trip plan\nPack light #travel",
+		Attachments: []NewAttachment{{Filename: "map.txt", Data: []byte("route")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := note.Attachments[0].FilePath
+	content := note.Content + "\n[map](/files/" + stored + ") and https://example.com/files/keep"
+	if _, err := service.UpdateNote(ctx, note.ID, UpdateNoteOptions{Content: &content}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.CreateNote(ctx, CreateNoteOptions{Content: "!!!"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.SetColor(ctx, note.ID, "#f44336"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.SetArchived(ctx, []int64{note.ID}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var buffer bytes.Buffer
+	if err := service.Export(ctx, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, file := range archive.File {
+		reader, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[file.Name] = string(data)
+	}
+
+	if files["attachments/"+stored] != "route" {
+		t.Fatalf("attachment missing from export: %v", files)
+	}
+	if _, ok := files["2.md"]; !ok {
+		t.Fatalf("note without a usable title should be named by ID: %v", files)
+	}
+	markdown, ok := files["1-trip-plan.md"]
+	if !ok {
+		t.Fatalf("note file missing: %v", files)
+	}
+	for _, want := range []string{
+		"---\nid: 1\n",
+		`color: "#f44336"`,
+		"archived: true\n",
+		"deleted: false\n",
+		`tags: ["travel"]`,
+		`attachments: ["attachments/` + stored + `"]`,
+		"---\n# Trip plan\n",
+		"[map](attachments/" + stored + ")",
+		"https://example.com/files/keep",
+	} {
+		if !strings.Contains(markdown, want) {
+			t.Errorf("exported note does not contain %q:\n%s", want, markdown)
+		}
+	}
+}
+
+func TestExportKeepsEncryptedNotesSealed(t *testing.T) {
+	ctx := context.Background()
+	service := newTestNotesService(t)
+	note, err := service.CreateNote(ctx, CreateNoteOptions{
+		Content:     "Bank PIN 4321 #secret",
+		Attachments: []NewAttachment{{Filename: "scan.txt", Data: []byte("passport number")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := service.SetupEncryption(ctx, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.SetEncrypted(ctx, note.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var buffer bytes.Buffer
+	if err := service.Export(ctx, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, file := range archive.File {
+		reader, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[file.Name] = string(data)
+	}
+	markdown, ok := files["1.md"]
+	if !ok {
+		t.Fatalf("encrypted note missing from export: %v", files)
+	}
+	if !strings.Contains(markdown, "encrypted: true\n") || !strings.Contains(markdown, "---\n"+encryptedPrefix) {
+		t.Fatalf("encrypted note exported as:\n%s", markdown)
+	}
+	for name, data := range files {
+		if strings.Contains(data, "4321") || strings.Contains(data, "passport number") {
+			t.Fatalf("%s leaks plaintext: %q", name, data)
+		}
+	}
+
+	result, err := newTestNotesService(t).ImportMarkdown(ctx, archive)
+	if err != nil || result.Imported != 0 || len(result.Errors) != 1 {
+		t.Fatalf("import = %+v, %v", result, err)
+	}
+}
+
+func TestExportWritesSharedAttachmentOnce(t *testing.T) {
+	ctx := context.Background()
+	service := newTestNotesService(t)
+	scan := NewAttachment{Filename: "scan.txt", Data: []byte("same bytes")}
+	first, err := service.CreateNote(ctx, CreateNoteOptions{Content: "First", Attachments: []NewAttachment{scan, scan}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.CreateNote(ctx, CreateNoteOptions{Content: "Second", Attachments: []NewAttachment{scan}}); err != nil {
+		t.Fatal(err)
+	}
+	stored := first.Attachments[0].FilePath
+	if first.Attachments[1].FilePath != stored {
+		t.Fatalf("identical attachments stored as %q and %q", stored, first.Attachments[1].FilePath)
+	}
+
+	var buffer bytes.Buffer
+	if err := service.Export(ctx, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, file := range archive.File {
+		if seen[file.Name] {
+			t.Fatalf("duplicate archive entry %s", file.Name)
+		}
+		seen[file.Name] = true
+	}
+	if !seen["attachments/"+stored] {
+		t.Fatalf("attachment missing from export: %v", seen)
+	}
+
+	target := newTestNotesService(t)
+	result, err := target.ImportMarkdown(ctx, archive)
+	if err != nil || result.Imported != 2 || len(result.Errors) != 0 {
+		t.Fatalf("import = %+v, %v", result, err)
+	}
+	for _, id := range result.NoteIDs {
+		note, err := target.GetNote(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(note.Attachments) != 1 {
+			t.Fatalf("imported note = %+v", note)
+		}
+	}
+}
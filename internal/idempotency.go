@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	idempotentCreate = "create"
+	idempotentUpdate = "update"
+	idempotentDelete = "delete"
+
+	maxIdempotencyKeyLength = 200
+	idempotencyKeyRetention = "-30 days"
+)
+
+// ErrIdempotencyKeyReused is returned for a key sent again with a different
+// kind of write or a different payload than the request it was first used for.
+var ErrIdempotencyKeyReused = errors.New("idempotency key was already used for a different request")
+
+// idempotentResult is what a keyed write stored for replays: the note it
+// created or updated, or the number of notes a delete processed.
+type idempotentResult struct {
+	NoteID    int64
+	Processed int64
+}
+
+func normalizeIdempotencyKey(key string) (string, error) {
+	key = strings.TrimSpace(key)
+	if len(key) > maxIdempotencyKeyLength {
+		return "", fmt.Errorf("idempotency key is longer than %d bytes", maxIdempotencyKeyLength)
+	}
+	return key, nil
+}
+
+// idempotencyRequestHash fingerprints the payload of a keyed write, so a
+// replay can be told apart from a new request that reuses the key.
+func idempotencyRequestHash(payload any) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// attachmentFingerprint stands for a new attachment in a request hash. File
+// contents are represented by their SHA-256, and streamed files by their
+// upload session.
+type attachmentFingerprint struct {
+	Filename string `json:"filename"`
+	Data     string `json:"data,omitempty"`
+	Upload   string `json:"upload,omitempty"`
+	Ref      string `json:"ref,omitempty"`
+}
+
+func attachmentFingerprints(attachments []NewAttachment) []attachmentFingerprint {
+	fingerprints := make([]attachmentFingerprint, len(attachments))
+	for i, attachment := range attachments {
+		fingerprints[i] = attachmentFingerprint{Filename: attachment.Filename, Upload: attachment.Upload, Ref: attachment.Ref}
+		if attachment.Data != nil {
+			sum := sha256.Sum256(attachment.Data)
+			fingerprints[i].Data = hex.EncodeToString(sum[:])
+		}
+	}
+	return fingerprints
+}
+
+// lookupIdempotencyKey returns the stored result of an earlier write made
+// with key. Reusing a key for a different kind of write or with a different
+// payload is an error, because the client would otherwise silently get the
+// wrong result. Keys stored before request hashes were kept have an empty
+// hash and are only checked by action.
+func lookupIdempotencyKey(ctx context.Context, tx *sql.Tx, key, action, requestHash string) (idempotentResult, bool, error) {
+	var result idempotentResult
+	var storedAction, storedHash string
+	err := tx.QueryRowContext(ctx,
+		"SELECT action, request_hash, note_id, processed FROM idempotency_keys WHERE owner_id = ? AND key = ?", ownerID(ctx), key,
+	).Scan(&storedAction, &storedHash, &result.NoteID, &result.Processed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return idempotentResult{}, false, nil
+	}
+	if err != nil {
+		return idempotentResult{}, false, err
+	}
+	if storedAction != action {
+		return idempotentResult{}, false, fmt.Errorf("%w: key %q was used for a %s request", ErrIdempotencyKeyReused, key, storedAction)
+	}
+	if storedHash != "" && storedHash != requestHash {
+		return idempotentResult{}, false, fmt.Errorf("%w: key %q was used with a different payload", ErrIdempotencyKeyReused, key)
+	}
+	return result, true, nil
+}
+
+// storeIdempotencyKey records the result of a keyed write in the write's own
+// transaction, so a replay either sees the whole write or none of it. Keys
+// older than the retention window are pruned on the way.
+func storeIdempotencyKey(ctx context.Context, tx *sql.Tx, key, action, requestHash string, result idempotentResult) error {
+	if _, err := tx.ExecContext(ctx,
+		"DELETE FROM idempotency_keys WHERE created_at < datetime('now', ?)", idempotencyKeyRetention,
+	); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO idempotency_keys (owner_id, key, action, request_hash, note_id, processed) VALUES (?, ?, ?, ?, ?, ?)",
+		ownerID(ctx), key, action, requestHash, result.NoteID, result.Processed,
+	)
+	return err
+}
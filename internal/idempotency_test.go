@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestIdempotencyKeysMakeWritesReplayable(t *testing.T) {
+	ctx := context.Background()
+	service := newTestNotesService(t)
+
+	created, err := service.CreateNote(ctx, CreateNoteOptions{Content: "offline draft", IdempotencyKey: "create-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := service.CreateNote(ctx, CreateNoteOptions{Content: "offline draft", IdempotencyKey: "create-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.ID != created.ID {
+		t.Fatalf("replayed create returned note %d, want %d", replayed.ID, created.ID)
+	}
+
+	content := "edited offline"
+	if _, err := service.UpdateNote(ctx, created.ID, UpdateNoteOptions{AppendContent: " again", IdempotencyKey: "update-1"}); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := service.UpdateNote(ctx, created.ID, UpdateNoteOptions{AppendContent: " again", IdempotencyKey: "update-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Content != "offline draft\n again" || updated.Version != 2 {
+		t.Fatalf("replayed update applied twice: %+v", updated)
+	}
+	if _, err := service.UpdateNote(ctx, created.ID, UpdateNoteOptions{Content: &content, IdempotencyKey: "create-1"}); !errors.Is(err, ErrIdempotencyKeyReused) {
+		t.Fatalf("reusing a create key for an update: %v", err)
+	}
+	if _, err := service.UpdateNote(ctx, created.ID, UpdateNoteOptions{Content: &content, IdempotencyKey: "update-1"}); !errors.Is(err, ErrIdempotencyKeyReused) {
+		t.Fatalf("reusing an update key with other content: %v", err)
+	}
+	if _, err := service.CreateNote(ctx, CreateNoteOptions{Content: "another draft", IdempotencyKey: "create-1"}); !errors.Is(err, ErrIdempotencyKeyReused) {
+		t.Fatalf("reusing a create key with other content: %v", err)
+	}
+
+	other, err := service.CreateNote(ctx, CreateNoteOptions{Content: "keep me"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		processed, err := service.TrashOrDelete(ctx, []int64{created.ID}, "delete-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if processed != 1 {
+			t.Fatalf("processed = %d, want 1", processed)
+		}
+	}
+	if _, err := service.TrashOrDelete(ctx, []int64{other.ID}, "delete-1"); !errors.Is(err, ErrIdempotencyKeyReused) {
+		t.Fatalf("reusing a delete key for other notes: %v", err)
+	}
+	trashed, err := service.GetNote(ctx, created.ID)
+	if err != nil {
+		t.Fatalf("replayed delete removed the trashed note: %v", err)
+	}
+	if trashed.IsDeleted != 1 {
+		t.Fatalf("note is not in trash: %+v", trashed)
+	}
+
+	if note, err := service.GetNote(ctx, other.ID); err != nil || note.IsDeleted != 0 {
+		t.Fatalf("note of a rejected delete = %+v, %v", note, err)
+	}
+
+	result, err := service.ListNotes(ctx, ListNotesOptions{State: "trash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Notes) != 1 {
+		t.Fatalf("notes = %d, want 1", len(result.Notes))
+	}
+}
+
+func TestHTTPAPIIdempotencyKey(t *testing.T) {
+	router, service := newTestAPIRouter(t)
+	type sendResponse struct {
+		ID int64 `json:"id"`
+	}
+	send := func(request *http.Request) int64 {
+		return decodeAPIResult[sendResponse](t, callAPI(t, router, request)).ID
+	}
+
+	byHeader := multipartAPIRequest(t, "/api/messages/send", map[string]string{"content": "from header"}, nil)
+	byHeader.Header.Set("Idempotency-Key", "abc")
+	first := send(byHeader)
+	retry := multipartAPIRequest(t, "/api/messages/send", map[string]string{"content": "from header"}, nil)
+	retry.Header.Set("Idempotency-Key", "abc")
+	if id := send(retry); id != first {
+		t.Fatalf("header replay created note %d, want %d", id, first)
+	}
+
+	fields := map[string]string{"content": "from form", "client_id": "def"}
+	second := send(multipartAPIRequest(t, "/api/messages/send", fields, nil))
+	if id := send(multipartAPIRequest(t, "/api/messages/send", fields, nil)); id != second || id == first {
+		t.Fatalf("client_id replay created note %d, want %d", id, second)
+	}
+
+	body := `{"ids":[` + strconv.FormatInt(second, 10) + `],"client_id":"batch"}`
+	for range 2 {
+		callAPI(t, router, jsonAPIRequest(t, http.MethodPost, "/api/messages/batch-delete", body))
+	}
+	if _, err := service.GetNote(t.Context(), second); err != nil {
+		t.Fatalf("replayed batch delete removed the trashed note: %v", err)
+	}
+	reused := callAPI(t, router, jsonAPIRequest(t, http.MethodPost, "/api/messages/batch-delete",
+		`{"ids":[`+strconv.FormatInt(first, 10)+`],"client_id":"batch"}`))
+	if reused.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("batch delete reusing a key for other notes: %d %s", reused.Code, reused.Body)
+	}
+}
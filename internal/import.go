@@ -0,0 +1,417 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImportResult reports a Markdown import. A file that cannot be imported is
+// listed in Errors and does not stop the rest of the import.
+type ImportResult struct {
+	Imported int           `json:"imported"`
+	NoteIDs  []int64       `json:"note_ids"`
+	Errors   []ImportError `json:"errors"`
+}
+
+type ImportError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+func newImportResult() ImportResult {
+	return ImportResult{NoteIDs: []int64{}, Errors: []ImportError{}}
+}
+
+var errNoteEmpty = errors.New("note is empty")
+
+var (
+	reObsidianEmbed = regexp.MustCompile(`!\[\[([^\]|#]+)(?:#[^\]|]*)?(?:\|[^\]]*)?\]\]`)
+	reMarkdownLink  = regexp.MustCompile(`(!?)\[([^\]]*)\]\(([^)\s]+)\)`)
+	reNestedTag     = regexp.MustCompile(`(^|\s)#([\p{L}\p{N}_-]+(?:/[\p{L}\p{N}_-]+)+)`)
+)
+
+const (
+	ImportFormatMarkdown = "markdown"
+	ImportFormatKeep     = "keep"
+	ImportFormatTelegram = "telegram"
+)
+
+// importedNote is a parsed source note waiting to be created.
+type importedNote struct {
+	path    string
+	opts    CreateNoteOptions
+	deleted bool
+	pinned  bool
+}
+
+// Import creates notes from fsys using the importer for format. An empty
+// format means Markdown.
+func (s *NotesService) Import(ctx context.Context, format string, fsys fs.FS) (ImportResult, error) {
+	switch format {
+	case "", ImportFormatMarkdown:
+		return s.ImportMarkdown(ctx, fsys)
+	case ImportFormatKeep:
+		return s.ImportKeep(ctx, fsys)
+	case ImportFormatTelegram:
+		return s.ImportTelegram(ctx, fsys)
+	default:
+		return ImportResult{}, fmt.Errorf("unknown import format %q: use %s, %s or %s",
+			format, ImportFormatMarkdown, ImportFormatKeep, ImportFormatTelegram)
+	}
+}
+
+// ImportMarkdown creates notes from the Markdown files of a folder tree such
+// as an Obsidian vault or a goNotes export. Front matter keeps timestamps,
+// color, archived and trashed state and tags, Obsidian ![[embeds]] and
+// relative links to local files become attachments. Hidden folders like
+// .obsidian are skipped.
+func (s *NotesService) ImportMarkdown(ctx context.Context, fsys fs.FS) (ImportResult, error) {
+	result := newImportResult()
+	var markdown []string
+	modified := make(map[string]time.Time)
+	byName := make(map[string]string)
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			result.Errors = append(result.Errors, ImportError{Path: name, Error: err.Error()})
+			return nil
+		}
+		if name != "." && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		if strings.EqualFold(path.Ext(name), ".md") {
+			markdown = append(markdown, name)
+			if info, err := entry.Info(); err == nil {
+				modified[name] = info.ModTime()
+			}
+			return nil
+		}
+		if key := strings.ToLower(entry.Name()); byName[key] == "" {
+			byName[key] = name
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	var notes []importedNote
+	for _, name := range markdown {
+		note, err := readImportedNote(fsys, name, byName)
+		if err != nil {
+			result.Errors = append(result.Errors, ImportError{Path: name, Error: err.Error()})
+			continue
+		}
+		if note.opts.CreatedAt.IsZero() {
+			note.opts.CreatedAt = modified[name]
+		}
+		notes = append(notes, note)
+	}
+	return result, s.createImported(ctx, notes, &result)
+}
+
+// createImported creates parsed notes oldest first, so the newest end up on
+// top, with pinned notes after all others. Per-note failures are added to
+// result; only a failure that affects the whole import is returned.
+func (s *NotesService) createImported(ctx context.Context, notes []importedNote, result *ImportResult) error {
+	sort.SliceStable(notes, func(i, j int) bool {
+		if notes[i].pinned != notes[j].pinned {
+			return notes[j].pinned
+		}
+		return notes[i].opts.CreatedAt.Before(notes[j].opts.CreatedAt)
+	})
+	for _, note := range notes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		created, err := s.CreateNote(ctx, note.opts)
+		if err != nil {
+			result.Errors = append(result.Errors, ImportError{Path: note.path, Error: err.Error()})
+			continue
+		}
+		if note.deleted {
+			if _, err := s.MoveToTrash(ctx, []int64{created.ID}); err != nil {
+				result.Errors = append(result.Errors, ImportError{Path: note.path, Error: err.Error()})
+			}
+		}
+		result.Imported++
+		result.NoteIDs = append(result.NoteIDs, created.ID)
+	}
+	// Title links can point at notes imported later in the same run.
+	return s.relinkNotes(ctx, result.NoteIDs)
+}
+
+func readImportedNote(fsys fs.FS, name string, byName map[string]string) (importedNote, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return importedNote{}, err
+	}
+	meta, body, err := splitFrontMatter(normalizeNewlines(string(data)))
+	if err != nil {
+		return importedNote{}, err
+	}
+	note := importedNote{path: name}
+	for key, value := range meta {
+		switch key {
+		case "created_at", "created", "date":
+			note.opts.CreatedAt, err = parseImportTime(value.text)
+		case "updated_at", "updated", "modified":
+			note.opts.UpdatedAt, err = parseImportTime(value.text)
+		case "color":
+			note.opts.Color = value.text
+		case "archived":
+			note.opts.Archived, err = strconv.ParseBool(value.text)
+		case "deleted":
+			note.deleted, err = strconv.ParseBool(value.text)
+		case "encrypted":
+			var encrypted bool
+			if encrypted, err = strconv.ParseBool(value.text); err == nil && encrypted {
+				return importedNote{}, errors.New("the note was exported encrypted and its content cannot be read")
+			}
+		}
+		if err != nil {
+			return importedNote{}, fmt.Errorf("front matter %s: %w", key, err)
+		}
+	}
+
+	// Obsidian names notes by file; goNotes takes the title from the first
+	// line, so a heading keeps [[Title]] links resolving. goNotes exports
+	// carry an id and already start with the original content.
+	if _, ok := meta["id"]; !ok {
+		title := strings.TrimSuffix(path.Base(name), path.Ext(name))
+		if noteTitle(body) != title {
+			body = "# " + title + "\n\n" + body
+		}
+	}
+	body = reNestedTag.ReplaceAllStringFunc(body, func(tag string) string {
+		return strings.ReplaceAll(tag, "/", "-")
+	})
+	body = appendMissingTags(body, append(meta["tags"].list, meta["tag"].list...))
+
+	// Refs are private-use placeholders that CreateNote swaps for the URLs of
+	// the stored files.
+	var attachments []NewAttachment
+	refs := make(map[string]string)
+	attach := func(target string, linked bool) string {
+		if ref, ok := refs[target]; ok {
+			return ref
+		}
+		ref := fmt.Sprintf("\uE000%d\uE001", len(attachments))
+		refs[target] = ref
+		attachment := NewAttachment{
+			Filename: path.Base(target),
+			Open:     func() (io.ReadCloser, error) { return fsys.Open(target) },
+		}
+		if linked {
+			attachment.Ref = ref
+		}
+		attachments = append(attachments, attachment)
+		return ref
+	}
+	resolve := func(link string) string {
+		if unescaped, err := url.PathUnescape(link); err == nil {
+			link = unescaped
+		}
+		if candidate := path.Join(path.Dir(name), link); fs.ValidPath(candidate) && !strings.EqualFold(path.Ext(candidate), ".md") {
+			if info, err := fs.Stat(fsys, candidate); err == nil && !info.IsDir() {
+				return candidate
+			}
+		}
+		return byName[strings.ToLower(path.Base(link))]
+	}
+
+	body = reObsidianEmbed.ReplaceAllStringFunc(body, func(embed string) string {
+		target := strings.TrimSpace(reObsidianEmbed.FindStringSubmatch(embed)[1])
+		resolved := byName[strings.ToLower(path.Base(target))]
+		if resolved == "" {
+			return embed
+		}
+		ref := attach(resolved, true)
+		if isImage(resolved) {
+			return "![" + path.Base(target) + "](" + ref + ")"
+		}
+		return "[" + path.Base(target) + "](" + ref + ")"
+	})
+	body = reMarkdownLink.ReplaceAllStringFunc(body, func(link string) string {
+		parts := reMarkdownLink.FindStringSubmatch(link)
+		target := parts[3]
+		if strings.Contains(target, ":") || strings.HasPrefix(target, "/") || strings.HasPrefix(target, "#") {
+			return link
+		}
+		resolved := resolve(target)
+		if resolved == "" {
+			return link
+		}
+		ref := attach(resolved, true)
+		return parts[1] + "[" + parts[2] + "](" + ref + ")"
+	})
+	for _, listed := range meta["attachments"].list {
+		if resolved := resolve(listed); resolved != "" {
+			attach(resolved, false)
+		}
+	}
+
+	note.opts.Content = strings.TrimSpace(body)
+	note.opts.Attachments = attachments
+	if note.opts.Content == "" && len(attachments) == 0 {
+		return importedNote{}, errNoteEmpty
+	}
+	return note, nil
+}
+
+// frontMatterValue is a scalar or a list from YAML front matter.
+type frontMatterValue struct {
+	text string
+	list []string
+}
+
+// splitFrontMatter separates a leading YAML block from the Markdown body. It
+// understands the subset notes use in practice: scalars, quoted strings, flow
+// lists like [a, b] and block lists of "- item" lines. Nested maps are
+// ignored.
+func splitFrontMatter(content string) (map[string]frontMatterValue, string, error) {
+	meta := make(map[string]frontMatterValue)
+	if !strings.HasPrefix(content, "---\n") {
+		return meta, content, nil
+	}
+	rest := content[3:]
+	end := strings.Index(rest, "\n---")
+	if end < 0 {
+		return meta, content, nil
+	}
+	block := rest[min(1, end):end]
+	body := strings.TrimPrefix(rest[end+4:], "\n")
+
+	var listKey string
+	scanner := bufio.NewScanner(strings.NewReader(block))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "- ") && listKey != "" {
+			value := meta[listKey]
+			value.list = append(value.list, unquoteYAML(strings.TrimSpace(trimmed[2:])))
+			meta[listKey] = value
+			continue
+		}
+		if line != strings.TrimLeft(line, " \t") {
+			continue
+		}
+		key, raw, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, "", fmt.Errorf("invalid front matter line %q", line)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		raw = strings.TrimSpace(raw)
+		listKey = ""
+		switch {
+		case raw == "":
+			listKey = key
+			meta[key] = frontMatterValue{}
+		case strings.HasPrefix(raw, "[") && strings.HasSuffix(raw, "]"):
+			var list []string
+			for item := range strings.SplitSeq(raw[1:len(raw)-1], ",") {
+				if item = unquoteYAML(strings.TrimSpace(item)); item != "" {
+					list = append(list, item)
+				}
+			}
+			meta[key] = frontMatterValue{list: list}
+		default:
+			text := unquoteYAML(raw)
+			meta[key] = frontMatterValue{text: text, list: strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == ' ' })}
+		}
+	}
+	return meta, body, scanner.Err()
+}
+
+func unquoteYAML(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		var text string
+		if err := json.Unmarshal([]byte(value), &text); err == nil {
+			return text
+		}
+	}
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+	}
+	return value
+}
+
+func parseImportTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, time.DateTime, "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02T15:04", time.DateOnly} {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unsupported time %q", value)
+}
+
+// appendMissingTags adds front matter tags that the body does not already
+// contain as #hashtags on a final line.
+func appendMissingTags(body string, tags []string) string {
+	present := make(map[string]struct{})
+	for _, tag := range extractHashtags(body) {
+		present[tag] = struct{}{}
+	}
+	var missing []string
+	for _, tag := range tags {
+		tag = strings.Join(strings.Fields(strings.TrimPrefix(tag, "#")), "-")
+		tag = strings.ReplaceAll(tag, "/", "-")
+		if _, ok := present[strings.ToLower(tag)]; ok || tag == "" {
+			continue
+		}
+		present[strings.ToLower(tag)] = struct{}{}
+		missing = append(missing, "#"+tag)
+	}
+	if len(missing) == 0 {
+		return body
+	}
+	return strings.TrimRight(body, "\n") + "\n\n" + strings.Join(missing, " ")
+}
+
+// relinkNotes rebuilds the outgoing links of the given notes, resolving
+// titles against everything that exists now.
+func (s *NotesService) relinkNotes(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range ids {
+		var content string
+		if err := tx.QueryRowContext(ctx,
+			"SELECT COALESCE(content, '') FROM messages WHERE id = ? AND owner_id = ?", id, ownerID(ctx),
+		).Scan(&content); err != nil {
+			return err
+		}
+		if len(extractNoteLinks(content).Titles) == 0 {
+			continue
+		}
+		if err := syncMessageLinks(ctx, tx, ownerID(ctx), id, content); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// keepColors maps Google Keep colors onto the UI palette in
+// notes-ui/src/constants.ts. Keep's gray and the default color have no
+// counterpart and become no color.
+var keepColors = map[string]string{
+	"RED":      "#f44336",
+	"ORANGE":   "#ff9800",
+	"YELLOW":   "#ffeb3b",
+	"GREEN":    "#4caf50",
+	"TEAL":     "#00bcd4",
+	"BLUE":     "#2196f3",
+	"CERULEAN": "#3f51b5",
+	"PURPLE":   "#9c27b0",
+	"PINK":     "#9c27b0",
+	"BROWN":    "#795548",
+}
+
+// keepNote is the subset of a Google Keep Takeout note file goNotes uses.
+type keepNote struct {
+	Color                   string `json:"color"`
+	IsTrashed               bool   `json:"isTrashed"`
+	IsPinned                bool   `json:"isPinned"`
+	IsArchived              bool   `json:"isArchived"`
+	Title                   string `json:"title"`
+	TextContent             string `json:"textContent"`
+	CreatedTimestampUsec    int64  `json:"createdTimestampUsec"`
+	UserEditedTimestampUsec int64  `json:"userEditedTimestampUsec"`
+	ListContent             []struct {
+		Text      string `json:"text"`
+		IsChecked bool   `json:"isChecked"`
+	} `json:"listContent"`
+	Labels []struct {
+		Name string `json:"name"`
+	} `json:"labels"`
+	Attachments []struct {
+		FilePath string `json:"filePath"`
+	} `json:"attachments"`
+	Annotations []struct {
+		Title string `json:"title"`
+		URL   string `json:"url"`
+	} `json:"annotations"`
+}
+
+// ImportKeep creates notes from a Google Keep Takeout folder or ZIP. Every
+// Keep note is a JSON file next to its media files. Labels become hashtags,
+// checklists become Markdown task lists, and pinned notes are created last so
+// they stay on top.
+func (s *NotesService) ImportKeep(ctx context.Context, fsys fs.FS) (ImportResult, error) {
+	result := newImportResult()
+	var notes []importedNote
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			result.Errors = append(result.Errors, ImportError{Path: name, Error: err.Error()})
+			return nil
+		}
+		if entry.IsDir() || !strings.EqualFold(path.Ext(name), ".json") {
+			return nil
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			result.Errors = append(result.Errors, ImportError{Path: name, Error: err.Error()})
+			return nil
+		}
+		var source keepNote
+		if err := json.Unmarshal(data, &source); err != nil || source.CreatedTimestampUsec == 0 && source.UserEditedTimestampUsec == 0 {
+			// Takeout ZIPs also contain JSON that is not a note.
+			return nil
+		}
+		note, err := convertKeepNote(fsys, name, source)
+		if err != nil {
+			result.Errors = append(result.Errors, ImportError{Path: name, Error: err.Error()})
+			return nil
+		}
+		notes = append(notes, note)
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	return result, s.createImported(ctx, notes, &result)
+}
+
+func convertKeepNote(fsys fs.FS, name string, source keepNote) (importedNote, error) {
+	var parts []string
+	if title := strings.TrimSpace(source.Title); title != "" {
+		parts = append(parts, "# "+title)
+	}
+	if text := strings.TrimSpace(normalizeNewlines(source.TextContent)); text != "" {
+		parts = append(parts, text)
+	}
+	if len(source.ListContent) > 0 {
+		items := make([]string, len(source.ListContent))
+		for i, item := range source.ListContent {
+			mark := " "
+			if item.IsChecked {
+				mark = "x"
+			}
+			items[i] = "- [" + mark + "] " + strings.TrimSpace(item.Text)
+		}
+		parts = append(parts, strings.Join(items, "\n"))
+	}
+	for _, annotation := range source.Annotations {
+		if annotation.URL == "" || strings.Contains(source.TextContent, annotation.URL) {
+			continue
+		}
+		label := strings.TrimSpace(annotation.Title)
+		if label == "" {
+			label = annotation.URL
+		}
+		parts = append(parts, "["+label+"]("+annotation.URL+")")
+	}
+	var labels []string
+	for _, label := range source.Labels {
+		labels = append(labels, label.Name)
+	}
+	content := strings.TrimSpace(appendMissingTags(strings.Join(parts, "\n\n"), labels))
+
+	var attachments []NewAttachment
+	for _, attachment := range source.Attachments {
+		target, err := findKeepMedia(fsys, path.Join(path.Dir(name), attachment.FilePath))
+		if err != nil {
+			return importedNote{}, err
+		}
+		attachments = append(attachments, NewAttachment{
+			Filename: path.Base(target),
+			Open:     func() (io.ReadCloser, error) { return fsys.Open(target) },
+		})
+	}
+	if content == "" && len(attachments) == 0 {
+		return importedNote{}, errNoteEmpty
+	}
+
+	createdAt := time.UnixMicro(source.CreatedTimestampUsec)
+	if source.CreatedTimestampUsec == 0 {
+		createdAt = time.UnixMicro(source.UserEditedTimestampUsec)
+	}
+	var updatedAt time.Time
+	if source.UserEditedTimestampUsec != 0 {
+		updatedAt = time.UnixMicro(source.UserEditedTimestampUsec)
+	}
+	return importedNote{
+		path: name,
+		opts: CreateNoteOptions{
+			Content:     content,
+			Attachments: attachments,
+			CreatedAt:   createdAt,
+			UpdatedAt:   updatedAt,
+			Color:       keepColors[source.Color],
+			Archived:    source.IsArchived,
+		},
+		deleted: source.IsTrashed,
+		pinned:  source.IsPinned,
+	}, nil
+}
+
+// findKeepMedia locates an attachment file. Takeout sometimes records
+// ".jpeg" for files it saved as ".jpg" and the other way around.
+func findKeepMedia(fsys fs.FS, name string) (string, error) {
+	_, err := fs.Stat(fsys, name)
+	if err == nil {
+		return name, nil
+	}
+	base := strings.TrimSuffix(name, path.Ext(name))
+	for _, ext := range []string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".3gp", ".m4a"} {
+		if _, statErr := fs.Stat(fsys, base+ext); statErr == nil {
+			return base + ext, nil
+		}
+	}
+	return "", err
+}
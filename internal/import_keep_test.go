@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestImportKeepTakeout(t *testing.T) {
+	ctx := context.Background()
+	service := newTestNotesService(t)
+	takeout := fstest.MapFS{
+		"Takeout/Keep/Groceries.json": {Data: []byte(`{
+			"color": "GREEN", "isTrashed": false, "isPinned": true, "isArchived": false,
+			"title": "Groceries", "textContent": "",
+			"listContent": [{"text": "Milk", "isChecked": true}, {"text": "Bread", "isChecked": false}],
+			"labels": [{"name": "Home"}, {"name": "Weekly shop"}],
+			"createdTimestampUsec": 1600000000000000, "userEditedTimestampUsec": 1600000500000000
+		}`)},
+		"Takeout/Keep/Photo.json": {Data: []byte(`{
+			"color": "DEFAULT", "isTrashed": false, "isPinned": false, "isArchived": true,
+			"title": "", "textContent": "Sunset",
+			"attachments": [{"filePath": "sunset.jpeg", "mimetype": "image/jpeg"}],
+			"annotations": [{"title": "Map", "url": "https://maps.example/x"}],
+			"createdTimestampUsec": 1500000000000000, "userEditedTimestampUsec": 1500000000000000
+		}`)},
+		"Takeout/Keep/Old.json": {Data: []byte(`{
+			"color": "RED", "isTrashed": true, "title": "Old", "textContent": "gone",
+			"createdTimestampUsec": 1700000000000000, "userEditedTimestampUsec": 1700000000000000
+		}`)},
+		"Takeout/Keep/Missing.json": {Data: []byte(`{
+			"textContent": "lost photo", "attachments": [{"filePath": "nowhere.png"}],
+			"createdTimestampUsec": 1400000000000000
+		}`)},
+		"Takeout/Keep/sunset.jpg":      {Data: []byte("jpg bytes")},
+		"Takeout/archive_browser.json": {Data: []byte(`{"unrelated": true}`)},
+	}
+
+	result, err := service.ImportKeep(ctx, takeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 3 || len(result.Errors) != 1 || result.Errors[0].Path != "Takeout/Keep/Missing.json" {
+		t.Fatalf("import result = %+v", result)
+	}
+
+	photo, err := service.GetNote(ctx, result.NoteIDs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if photo.Content != "Sunset\n\n[Map](https://maps.example/x)" || photo.IsArchived != 1 || photo.Color != "" {
+		t.Fatalf("photo note = %+v", photo)
+	}
+	if len(photo.Attachments) != 1 || photo.Attachments[0].FileType != "image" {
+		t.Fatalf("photo attachments = %+v", photo.Attachments)
+	}
+
+	trashed, err := service.GetNote(ctx, result.NoteIDs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trashed.IsDeleted != 1 || trashed.Color != "#f44336" {
+		t.Fatalf("trashed note = %+v", trashed)
+	}
+
+	groceries, err := service.GetNote(ctx, result.NoteIDs[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Groceries\n\n- [x] Milk\n- [ ] Bread\n\n#Home #Weekly-shop"
+	if groceries.Content != want {
+		t.Fatalf("groceries content = %q, want %q", groceries.Content, want)
+	}
+	if groceries.Color != "#4caf50" || !strings.HasPrefix(groceries.CreatedAt, "2020-09-13") {
+		t.Fatalf("groceries metadata = %+v", groceries)
+	}
+	if groceries.SortOrder <= trashed.SortOrder {
+		t.Fatal("pinned note should be created after newer unpinned notes")
+	}
+}
@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const telegramResultFile = "result.json"
+
+// telegramExport covers both a single chat export, which has messages at the
+// top level, and a full account export, which lists chats.
+type telegramExport struct {
+	Type     string            `json:"type"`
+	Messages []telegramMessage `json:"messages"`
+	Chats    struct {
+		List []struct {
+			Type     string            `json:"type"`
+			Messages []telegramMessage `json:"messages"`
+		} `json:"list"`
+	} `json:"chats"`
+}
+
+type telegramMessage struct {
+	ID            int64            `json:"id"`
+	Type          string           `json:"type"`
+	DateUnix      string           `json:"date_unixtime"`
+	EditedUnix    string           `json:"edited_unixtime"`
+	Text          json.RawMessage  `json:"text"`
+	TextEntities  []telegramEntity `json:"text_entities"`
+	Photo         string           `json:"photo"`
+	File          string           `json:"file"`
+	ForwardedFrom string           `json:"forwarded_from"`
+}
+
+type telegramEntity struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	Href     string `json:"href"`
+	Language string `json:"language"`
+}
+
+// ImportTelegram creates notes from a Telegram Desktop JSON export, one note
+// per message of the Saved Messages chat. Entity formatting becomes Markdown,
+// and photos, voice messages and files become attachments. Media that was
+// not included in the export is reported as an error while the text of the
+// message is still imported.
+func (s *NotesService) ImportTelegram(ctx context.Context, fsys fs.FS) (ImportResult, error) {
+	result := newImportResult()
+	var notes []importedNote
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			result.Errors = append(result.Errors, ImportError{Path: name, Error: err.Error()})
+			return nil
+		}
+		if entry.IsDir() || path.Base(name) != telegramResultFile {
+			return nil
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			result.Errors = append(result.Errors, ImportError{Path: name, Error: err.Error()})
+			return nil
+		}
+		var export telegramExport
+		if err := json.Unmarshal(data, &export); err != nil {
+			result.Errors = append(result.Errors, ImportError{Path: name, Error: err.Error()})
+			return nil
+		}
+		messages := export.Messages
+		for _, chat := range export.Chats.List {
+			if chat.Type == "saved_messages" {
+				messages = append(messages, chat.Messages...)
+			}
+		}
+		for _, message := range messages {
+			if message.Type != "message" {
+				continue
+			}
+			note, missing := convertTelegramMessage(fsys, path.Dir(name), message)
+			label := fmt.Sprintf("%s#%d", name, message.ID)
+			for _, file := range missing {
+				result.Errors = append(result.Errors, ImportError{Path: label, Error: "file not included in the export: " + file})
+			}
+			if note.opts.Content == "" && len(note.opts.Attachments) == 0 {
+				if len(missing) == 0 {
+					result.Errors = append(result.Errors, ImportError{Path: label, Error: errNoteEmpty.Error()})
+				}
+				continue
+			}
+			note.path = label
+			notes = append(notes, note)
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	return result, s.createImported(ctx, notes, &result)
+}
+
+// convertTelegramMessage builds a note from a message and returns the media
+// paths the export left out.
+func convertTelegramMessage(fsys fs.FS, dir string, message telegramMessage) (importedNote, []string) {
+	entities := message.TextEntities
+	if entities == nil {
+		entities = parseTelegramText(message.Text)
+	}
+	content := strings.TrimSpace(telegramMarkdown(entities))
+	if message.ForwardedFrom != "" {
+		content = strings.TrimSpace("> Forwarded from " + message.ForwardedFrom + "\n\n" + content)
+	}
+
+	var attachments []NewAttachment
+	var missing []string
+	for _, media := range []string{message.Photo, message.File} {
+		if media == "" {
+			continue
+		}
+		target := path.Join(dir, media)
+		if !fs.ValidPath(target) {
+			missing = append(missing, media)
+			continue
+		}
+		if info, err := fs.Stat(fsys, target); err != nil || info.IsDir() {
+			missing = append(missing, media)
+			continue
+		}
+		attachments = append(attachments, NewAttachment{
+			Filename: path.Base(target),
+			Open:     func() (io.ReadCloser, error) { return fsys.Open(target) },
+		})
+	}
+
+	note := importedNote{opts: CreateNoteOptions{Content: content, Attachments: attachments}}
+	if unix, err := strconv.ParseInt(message.DateUnix, 10, 64); err == nil {
+		note.opts.CreatedAt = time.Unix(unix, 0)
+	}
+	if unix, err := strconv.ParseInt(message.EditedUnix, 10, 64); err == nil {
+		note.opts.UpdatedAt = time.Unix(unix, 0)
+	}
+	return note, missing
+}
+
+// parseTelegramText reads the older "text" field, which is either a string
+// or a list mixing plain strings and entity objects.
+func parseTelegramText(raw json.RawMessage) []telegramEntity {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return []telegramEntity{{Type: "plain", Text: text}}
+	}
+	var parts []json.RawMessage
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return nil
+	}
+	entities := make([]telegramEntity, 0, len(parts))
+	for _, part := range parts {
+		var entity telegramEntity
+		if err := json.Unmarshal(part, &text); err == nil {
+			entity = telegramEntity{Type: "plain", Text: text}
+		} else if err := json.Unmarshal(part, &entity); err != nil {
+			continue
+		}
+		entities = append(entities, entity)
+	}
+	return entities
+}
+
+// telegramMarkdown converts Telegram entities to goNotes Markdown. Spoilers
+// use the ||hidden text|| syntax of the note renderer.
+func telegramMarkdown(entities []telegramEntity) string {
+	var b strings.Builder
+	startLine := func() {
+		if b.Len() > 0 && !strings.HasSuffix(b.String(), "\n") {
+			b.WriteString("\n")
+		}
+	}
+	for _, entity := range entities {
+		text := entity.Text
+		switch entity.Type {
+		case "bold":
+			b.WriteString(wrapMarkdown(text, "**"))
+		case "italic":
+			b.WriteString(wrapMarkdown(text, "_"))
+		case "strikethrough":
+			b.WriteString(wrapMarkdown(text, "~~"))
+		case "spoiler":
+			b.WriteString(wrapMarkdown(text, "||"))
+		case "code":
+			b.WriteString(wrapMarkdown(text, "`"))
+		case "pre":
+			startLine()
+			b.WriteString("```" + entity.Language + "\n" + strings.TrimSuffix(text, "\n") + "\n```\n")
+		case "text_link":
+			b.WriteString("[" + text + "](" + entity.Href + ")")
+		case "blockquote":
+			startLine()
+			for line := range strings.SplitSeq(strings.TrimSuffix(text, "\n"), "\n") {
+				b.WriteString("> " + line + "\n")
+			}
+		default:
+			// plain, link, hashtag, mention, email and the rest already read
+			// correctly as text; hashtags become goNotes tags.
+			b.WriteString(text)
+		}
+	}
+	return b.String()
+}
+
+// wrapMarkdown puts marker around text, keeping surrounding whitespace
+// outside the markers so the Markdown stays valid.
+func wrapMarkdown(text, marker string) string {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return text
+	}
+	start := strings.Index(text, trimmed)
+	return text[:start] + marker + trimmed + marker + text[start+len(trimmed):]
+}
@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+)
+
+func TestTelegramMarkdown(t *testing.T) {
+	entities := parseTelegramText([]byte(`[
+		"Buy ", {"type": "bold", "text": "milk "}, "and ",
+		{"type": "text_link", "text": "bread", "href": "https://shop.example"},
+		" ", {"type": "hashtag", "text": "#food"}, " ", {"type": "spoiler", "text": "secret"},
+		{"type": "pre", "text": "go test ./...", "language": "sh"},
+		{"type": "blockquote", "text": "one\ntwo"}
+	]`))
+	got := telegramMarkdown(entities)
+	want := "Buy **milk** and [bread](https://shop.example) #food ||secret||\n```sh\ngo test ./...\n```\n> one\n> two\n"
+	if got != want {
+		t.Fatalf("markdown = %q, want %q", got, want)
+	}
+}
+
+func TestImportTelegramSavedMessages(t *testing.T) {
+	ctx := context.Background()
+	service := newTestNotesService(t)
+	export := fstest.MapFS{
+		"Telegram/result.json": {Data: []byte(`{"about": "", "chats": {"list": [
+			{"type": "personal_chat", "messages": [
+				{"id": 1, "type": "message", "date_unixtime": "1600000000", "text": "not mine"}
+			]},
+			{"type": "saved_messages", "messages": [
+				{"id": 2, "type": "service", "date_unixtime": "1600000001", "text": ""},
+				{"id": 3, "type": "message", "date_unixtime": "1600000100", "edited_unixtime": "1600000200",
+				 "text": "", "text_entities": [{"type": "plain", "text": "Idea "}, {"type": "italic", "text": "later"}, {"type": "plain", "text": " #todo"}]},
+				{"id": 4, "type": "message", "date_unixtime": "1600000300", "photo": "photos/photo_1.jpg", "text": ""},
+				{"id": 5, "type": "message", "date_unixtime": "1600000400", "media_type": "voice_message",
+				 "file": "(File not included. Change data exporting settings to download.)", "text": ""}
+			]}
+		]}}`)},
+		"Telegram/photos/photo_1.jpg": {Data: []byte("jpg")},
+	}
+
+	result, err := service.ImportTelegram(ctx, export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 2 || len(result.Errors) != 1 || result.Errors[0].Path != "Telegram/result.json#5" {
+		t.Fatalf("import result = %+v", result)
+	}
+	idea, err := service.GetNote(ctx, result.NoteIDs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idea.Content != "Idea _later_ #todo" || len(idea.Tags) != 1 || idea.Tags[0] != "todo" {
+		t.Fatalf("idea note = %+v", idea)
+	}
+	photo, err := service.GetNote(ctx, result.NoteIDs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(photo.Attachments) != 1 || photo.Attachments[0].FileType != "image" {
+		t.Fatalf("photo attachments = %+v", photo.Attachments)
+	}
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestImportMarkdownFromObsidianVault(t *testing.T) {
+	ctx := context.Background()
+	service := newTestNotesService(t)
+	vault := fstest.MapFS{
+		".obsidian/workspace.json": {Data: []byte("{}")},
+		"Projects/Garden.md": {Data: []byte("---\ncreated: 2021-04-01T09:30:00Z\ntags:\n  - outdoor\n  - plans/2021\n---\n" +
+			"Beds along the fence #garden/veg\n![[bed layout.png|300]]\n[seed list](../files/seeds.txt)\n[[Shopping]]\n")},
+		"Shopping.md":           {Data: []byte("---\ndate: 2022-02-02\ncolor: \"#4caf50\"\narchived: true\n---\n# Shopping\nSeeds\n")},
+		"Broken.md":             {Data: []byte("---\ncreated: yesterday\n---\ntext")},
+		"assets/bed layout.png": {Data: []byte("not really a png")},
+		"files/seeds.txt":       {Data: []byte("tomato")},
+	}
+
+	result, err := service.ImportMarkdown(ctx, vault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 2 || len(result.Errors) != 1 || result.Errors[0].Path != "Broken.md" {
+		t.Fatalf("import result = %+v", result)
+	}
+
+	garden, err := service.GetNote(ctx, result.NoteIDs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	shopping, err := service.GetNote(ctx, result.NoteIDs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(garden.Content, "# Garden\n\nBeds along the fence #garden-veg") {
+		t.Fatalf("garden content = %q", garden.Content)
+	}
+	if strings.Join(garden.Tags, ",") != "garden-veg,outdoor,plans-2021" {
+		t.Fatalf("garden tags = %v", garden.Tags)
+	}
+	if len(garden.Attachments) != 2 {
+		t.Fatalf("garden attachments = %+v", garden.Attachments)
+	}
+	for _, attachment := range garden.Attachments {
+		if !strings.Contains(garden.Content, "(/files/"+attachment.FilePath+")") {
+			t.Fatalf("content does not link %s: %q", attachment.FilePath, garden.Content)
+		}
+	}
+	if len(garden.Links) != 1 || garden.Links[0] != shopping.ID {
+		t.Fatalf("garden links = %v, want [%d]", garden.Links, shopping.ID)
+	}
+	if !strings.HasPrefix(garden.CreatedAt, "2021-04-01") {
+		t.Fatalf("garden created_at = %q", garden.CreatedAt)
+	}
+	if shopping.Color != "#4caf50" || shopping.IsArchived != 1 || !strings.HasPrefix(shopping.CreatedAt, "2022-02-02") {
+		t.Fatalf("shopping metadata = %+v", shopping)
+	}
+	if shopping.SortOrder <= garden.SortOrder {
+		t.Fatal("newer note should sort above older note")
+	}
+}
+
+func TestImportMarkdownRestoresExport(t *testing.T) {
+	ctx := context.Background()
+	source := newTestNotesService(t)
+	note, err := source.CreateNote(ctx, CreateNoteOptions{
+		Content:     "Receipt #tax",
+		Attachments: []NewAttachment{{Filename: "receipt.pdf", Data: []byte("pdf")}},
+		CreatedAt:   time.Date(2020, 5, 6, 7, 8, 9, 0, time.UTC),
+		Color:       "#2196f3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.MoveToTrash(ctx, []int64{note.ID}); err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	if err := source.Export(ctx, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := newTestNotesService(t)
+	result, err := target.ImportMarkdown(ctx, archive)
+	if err != nil || result.Imported != 1 || len(result.Errors) != 0 {
+		t.Fatalf("import = %+v, %v", result, err)
+	}
+	restored, err := target.GetNote(ctx, result.NoteIDs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Content != "Receipt #tax" || restored.Color != "#2196f3" || restored.IsDeleted != 1 {
+		t.Fatalf("restored note = %+v", restored)
+	}
+	if !strings.HasPrefix(restored.CreatedAt, "2020-05-06") || len(restored.Attachments) != 1 {
+		t.Fatalf("restored metadata = %+v", restored)
+	}
+}
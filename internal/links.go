@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var reNoteLink = regexp.MustCompile(`\[\[([^\[\]|\n]+)(?:\|[^\[\]\n]*)?\]\]`)
+
+// noteLinkRefs holds references parsed from note content: exact note IDs from
+// [[note:123]] and titles from [[Some title]]. An optional |label suffix is
+// ignored.
+type noteLinkRefs struct {
+	IDs    []int64
+	Titles []string
+}
+
+// extractNoteLinks parses wiki links the same way extractHashtags parses tags,
+// skipping code blocks and inline code.
+func extractNoteLinks(text string) noteLinkRefs {
+	var refs noteLinkRefs
+	seenIDs := make(map[int64]struct{})
+	seenTitles := make(map[string]struct{})
+	for _, m := range reNoteLink.FindAllStringSubmatch(stripCode(text), -1) {
+		target := strings.TrimSpace(m[1])
+		if rawID, ok := strings.CutPrefix(target, "note:"); ok {
+			id, err := strconv.ParseInt(strings.TrimSpace(rawID), 10, 64)
+			if err != nil || id <= 0 {
+				continue
+			}
+			if _, ok := seenIDs[id]; !ok {
+				seenIDs[id] = struct{}{}
+				refs.IDs = append(refs.IDs, id)
+			}
+			continue
+		}
+		key := strings.ToLower(target)
+		if target == "" {
+			continue
+		}
+		if _, ok := seenTitles[key]; !ok {
+			seenTitles[key] = struct{}{}
+			refs.Titles = append(refs.Titles, target)
+		}
+	}
+	return refs
+}
+
+// ListBacklinks returns notes outside the trash that link to the given note.
+func (s *NotesService) ListBacklinks(ctx context.Context, id int64, limit int) (ListNotesResult, error) {
+	if id <= 0 {
+		return ListNotesResult{}, errors.New("note id must be positive")
+	}
+	return s.ListNotes(ctx, ListNotesOptions{LinksTo: id, State: "all", Limit: limit})
+}
+
+// noteTitle returns the first non-empty line of content without Markdown
+// heading markers; [[Title]] links resolve against it.
+func noteTitle(content string) string {
+	for line := range strings.SplitSeq(content, "\n") {
+		line = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "#"))
+		if line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+// syncMessageLinks rebuilds the outgoing links of a note. Links to missing
+// notes or to notes of other owners are dropped, and a title resolves to the
+// most recent note outside the trash whose title matches when the content is
+// saved. Owner 0 skips the owner check for migrations that predate accounts.
+func syncMessageLinks(ctx context.Context, tx *sql.Tx, owner, noteID int64, content string) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM message_links WHERE message_id = ?", noteID); err != nil {
+		return err
+	}
+	refs := extractNoteLinks(content)
+	targets := refs.IDs
+	for _, title := range refs.Titles {
+		id, err := findNoteByTitle(ctx, tx, owner, title)
+		if err != nil {
+			return err
+		}
+		if id > 0 {
+			targets = append(targets, id)
+		}
+	}
+	for _, target := range targets {
+		if target == noteID {
+			continue
+		}
+		query := "INSERT OR IGNORE INTO message_links (message_id, target_id) SELECT ?, id FROM messages WHERE id = ?"
+		args := []any{noteID, target}
+		if owner > 0 {
+			query += " AND owner_id = ?"
+			args = append(args, owner)
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func findNoteByTitle(ctx context.Context, tx *sql.Tx, owner int64, title string) (int64, error) {
+	// The title goes into a single phrase as is, with embedded quotes
+	// doubled, so quotes or a trailing * in it are not read as query syntax.
+	if !strings.ContainsFunc(title, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) {
+		return 0, nil
+	}
+	match := searchTerm{Text: title}.matchExpr()
+	ownerClause := ""
+	args := []any{match}
+	if owner > 0 {
+		ownerClause = "owner_id = ? AND "
+		args = append(args, owner)
+	}
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, COALESCE(content, '') FROM messages
+		WHERE id IN (SELECT rowid FROM messages_fts WHERE messages_fts MATCH ?) AND `+ownerClause+`is_deleted = 0
+		ORDER BY sort_order DESC, id DESC`, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var content string
+		if err := rows.Scan(&id, &content); err != nil {
+			return 0, err
+		}
+		if strings.EqualFold(noteTitle(content), title) {
+			return id, nil
+		}
+	}
+	return 0, rows.Err()
+}
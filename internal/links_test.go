@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestExtractNoteLinks(t *testing.T) {
+	refs := extractNoteLinks("See [[note:12]], [[note: 7|the plan]] and [[Trip Ideas]].\n" +
+		"`[[note:99]]` and [[note:12]] again, [[note:abc]], [[trip ideas]]\n```\n[[note:5]]\n```")
+	if !reflect.DeepEqual(refs.IDs, []int64{12, 7}) {
+		t.Fatalf("IDs = %v", refs.IDs)
+	}
+	if !reflect.DeepEqual(refs.Titles, []string{"Trip Ideas"}) {
+		t.Fatalf("Titles = %q", refs.Titles)
+	}
+}
+
+func TestNoteLinksAndBacklinks(t *testing.T) {
+	ctx := context.Background()
+	service := newTestNotesService(t)
+	target, err := service.CreateNote(ctx, CreateNoteOptions{Content: "# Trip ideas\nLisbon, Porto"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byID, err := service.CreateNote(ctx, CreateNoteOptions{Content: "Budget for [[note:" + strconv.FormatInt(target.ID, 10) + "]] and [[note:99999]]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byTitle, err := service.CreateNote(ctx, CreateNoteOptions{Content: "Packing list for [[trip ideas|the trip]]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(byID.Links, []int64{target.ID}) || !reflect.DeepEqual(byTitle.Links, []int64{target.ID}) {
+		t.Fatalf("outgoing links = %v and %v, want [%d]", byID.Links, byTitle.Links, target.ID)
+	}
+
+	note, err := service.GetNote(ctx, target.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(note.Backlinks, []int64{byID.ID, byTitle.ID}) {
+		t.Fatalf("backlinks = %v", note.Backlinks)
+	}
+	result, err := service.ListBacklinks(ctx, target.ID, 0)
+	if err != nil || len(result.Notes) != 2 || result.Notes[0].ID != byTitle.ID {
+		t.Fatalf("ListBacklinks = %+v, %v", result, err)
+	}
+
+	plain := "Budget without links"
+	if _, err := service.UpdateNote(ctx, byID.ID, UpdateNoteOptions{Content: &plain}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.MoveToTrash(ctx, []int64{byTitle.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if note, err := service.GetNote(ctx, target.ID); err != nil || len(note.Backlinks) != 0 {
+		t.Fatalf("backlinks after unlink and trash = %v, %v", note.Backlinks, err)
+	}
+}
+
+func TestNoteLinkToQuotedTitle(t *testing.T) {
+	ctx := context.Background()
+	service := newTestNotesService(t)
+	target, err := service.CreateNote(ctx, CreateNoteOptions{Content: `"-Draft"` + "\nSteps of the plan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := service.CreateNote(ctx, CreateNoteOptions{Content: `See [["-draft"]]`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(source.Links, []int64{target.ID}) {
+		t.Fatalf("links = %v, want [%d]", source.Links, target.ID)
+	}
+}
@@ -1,28 +1,40 @@
 package internal
 
 import (
+	"bytes"
 	"context"
 	"crypto/subtle"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/modelcontextprotocol/go-sdk/mcp"
 )
 
+// defaultMCPChunkBytes is the length attachment_read_chunk reads when the
+// client does not ask for one.
+const defaultMCPChunkBytes = 1 << 20
+
 type mcpAttachmentInput struct {
-	Filename   string `json:"filename" jsonschema:"Original filename including its extension"`
-	DataBase64 string `json:"data_base64" jsonschema:"File bytes encoded as standard base64"`
+	Filename   string `json:"filename,omitempty" jsonschema:"Original filename including its extension"`
+	DataBase64 string `json:"data_base64,omitempty" jsonschema:"File bytes encoded as standard base64"`
+	UploadID   string `json:"upload_id,omitempty" jsonschema:"ID of a finished upload from upload_create, attached instead of filename and data_base64"`
 }
 
 type mcpListNotesInput struct {
-	Query           string   `json:"query,omitempty" jsonschema:"Case-insensitive words that must all occur in the note"`
+	Query           string   `json:"query,omitempty" jsonschema:"Full-text query. Words must all occur in the note; use \"exact phrase\", prefix* and -excluded words"`
 	Tags            []string `json:"tags,omitempty" jsonschema:"Tags that must all be present; omit the leading #"`
 	State           string   `json:"state,omitempty" jsonschema:"One of active, archived, all, or trash. Defaults to active when browsing and all when searching or filtering by tags."`
 	Limit           int      `json:"limit,omitempty" jsonschema:"Maximum notes to return, from 1 to 100; defaults to 20"`
 	BeforeSortOrder int      `json:"before_sort_order,omitempty" jsonschema:"Pagination cursor returned as next_sort_order by the previous call"`
+	Sort            string   `json:"sort,omitempty" jsonschema:"recent (default) or relevance; relevance ranks query matches best first"`
+	Offset          int      `json:"offset,omitempty" jsonschema:"Pagination offset returned as next_offset by the previous relevance-sorted call"`
+	Snippets        bool     `json:"snippets,omitempty" jsonschema:"Return short excerpts with match offsets instead of full note content; use note_get to read a whole note"`
 }
 
 type mcpGetNoteInput struct {
@@ -34,9 +46,32 @@ type mcpGetAttachmentInput struct {
 	AttachmentID int64 `json:"attachment_id" jsonschema:"Exact attachment ID from note_get"`
 }
 
+type mcpReadChunkInput struct {
+	NoteID       int64 `json:"note_id" jsonschema:"Exact note ID"`
+	AttachmentID int64 `json:"attachment_id" jsonschema:"Exact attachment ID from note_get"`
+	Offset       int64 `json:"offset,omitempty" jsonschema:"Byte offset to read from; defaults to 0"`
+	Length       int64 `json:"length,omitempty" jsonschema:"Maximum bytes to read, at most 32 MiB; defaults to 1 MiB"`
+}
+
+type mcpUploadCreateInput struct {
+	Filename string `json:"filename" jsonschema:"Original filename including its extension"`
+	Size     int64  `json:"size" jsonschema:"Total file size in bytes"`
+}
+
+type mcpUploadAppendInput struct {
+	UploadID   string `json:"upload_id" jsonschema:"Upload ID from upload_create"`
+	Offset     int64  `json:"offset" jsonschema:"Byte offset of this chunk; must equal the offset of the upload"`
+	DataBase64 string `json:"data_base64" jsonschema:"Chunk bytes encoded as standard base64, at most 32 MiB decoded"`
+}
+
+type mcpUploadGetInput struct {
+	UploadID string `json:"upload_id" jsonschema:"Upload ID from upload_create"`
+}
+
 type mcpCreateNoteInput struct {
-	Content     string               `json:"content" jsonschema:"Complete goNotes Markdown content. Put tags in the content as #tags; wrap visually hidden text as ||hidden text||."`
-	Attachments []mcpAttachmentInput `json:"attachments,omitempty" jsonschema:"Optional files to attach"`
+	Content        string               `json:"content" jsonschema:"Complete goNotes Markdown content. Put tags in the content as #tags; wrap visually hidden text as ||hidden text||."`
+	Attachments    []mcpAttachmentInput `json:"attachments,omitempty" jsonschema:"Optional files to attach"`
+	IdempotencyKey string               `json:"idempotency_key,omitempty" jsonschema:"Optional unique key for this note; retrying with the same key returns the already created note instead of a duplicate"`
 }
 
 type mcpUpdateNoteInput struct {
@@ -45,6 +80,7 @@ type mcpUpdateNoteInput struct {
 	AppendContent       string               `json:"append_content,omitempty" jsonschema:"Text to append on a new line instead of replacing content"`
 	Attachments         []mcpAttachmentInput `json:"attachments,omitempty" jsonschema:"Optional new files to attach"`
 	DeleteAttachmentIDs []int64              `json:"delete_attachment_ids,omitempty" jsonschema:"IDs of existing attachments to remove"`
+	ExpectedVersion     int64                `json:"expected_version,omitempty" jsonschema:"Version from the note you read; the update fails with the current content if the note changed since"`
 }
 
 type mcpIDsInput struct {
@@ -79,10 +115,53 @@ type mcpReorderTagsInput struct {
 	Names []string `json:"names" jsonschema:"All tag names being reordered, in desired top-to-bottom order"`
 }
 
+type mcpBacklinksInput struct {
+	ID    int64 `json:"id" jsonschema:"Exact note ID"`
+	Limit int   `json:"limit,omitempty" jsonschema:"Maximum notes to return, from 1 to 100; defaults to 20"`
+}
+
+type mcpNoteHistoryInput struct {
+	ID         int64 `json:"id" jsonschema:"Exact note ID"`
+	RevisionID int64 `json:"revision_id,omitempty" jsonschema:"Optional revision ID to read in full and diff against the current content"`
+}
+
+type mcpNoteRevertInput struct {
+	ID         int64 `json:"id" jsonschema:"Exact note ID"`
+	RevisionID int64 `json:"revision_id" jsonschema:"Revision ID from note_history to restore"`
+}
+
+type mcpShareCreateInput struct {
+	NoteID        int64  `json:"note_id" jsonschema:"Exact note ID"`
+	Password      string `json:"password,omitempty" jsonschema:"Optional password of at least 8 characters the recipient must enter"`
+	ExpiresInDays int    `json:"expires_in_days,omitempty" jsonschema:"Days until the link stops working; omit for a link that never expires"`
+}
+
+type mcpSharesListInput struct {
+	NoteID int64 `json:"note_id,omitempty" jsonschema:"Optional note ID to list only the links of that note"`
+}
+
+type mcpShareRevokeInput struct {
+	ID int64 `json:"id" jsonschema:"Share ID from shares_list or note_share"`
+}
+
+type mcpShareOutput struct {
+	Share Share `json:"share"`
+}
+
+type mcpSharesOutput struct {
+	Shares []Share `json:"shares"`
+}
+
 type mcpNoteOutput struct {
 	Note MessageDTO `json:"note"`
 }
 
+type mcpNoteHistoryOutput struct {
+	Revisions []RevisionDTO `json:"revisions"`
+	Revision  *RevisionDTO  `json:"revision,omitempty"`
+	Diff      *RevisionDiff `json:"diff,omitempty"`
+}
+
 type mcpStatusOutput struct {
 	Status   string `json:"status"`
 	Affected int64  `json:"affected,omitempty"`
@@ -97,12 +176,81 @@ type mcpAttachmentOutput struct {
 	DataBase64 string        `json:"data_base64"`
 }
 
+type mcpChunkOutput struct {
+	Attachment AttachmentDTO `json:"attachment"`
+	Offset     int64         `json:"offset"`
+	Length     int           `json:"length"`
+	Size       int64         `json:"size"`
+	EOF        bool          `json:"eof"`
+	DataBase64 string        `json:"data_base64"`
+}
+
+type mcpUploadOutput struct {
+	Upload UploadSession `json:"upload"`
+}
+
+// mcpToolScopes maps every tool that changes notes to the token scope it
+// needs. Tools missing here only read.
+var mcpToolScopes = map[string]string{
+	"note_create":              ScopeWrite,
+	"note_update":              ScopeWrite,
+	"note_revert":              ScopeWrite,
+	"notes_set_archived":       ScopeWrite,
+	"notes_move_to_trash":      ScopeWrite,
+	"notes_restore":            ScopeWrite,
+	"notes_delete_permanently": ScopeDelete,
+	"notes_add_tags":           ScopeWrite,
+	"note_set_color":           ScopeWrite,
+	"notes_reorder":            ScopeWrite,
+	"note_mark_used":           ScopeWrite,
+	"note_set_expanded":        ScopeWrite,
+	"tags_reorder":             ScopeWrite,
+	"note_share":               ScopeWrite,
+	"upload_create":            ScopeWrite,
+	"upload_append":            ScopeWrite,
+	"share_revoke":             ScopeWrite,
+}
+
+// mcpToolset selects the tools an MCP client is offered.
+type mcpToolset struct {
+	scope         string
+	tagRestricted bool
+}
+
+var fullMCPToolset = mcpToolset{scope: ScopeDelete}
+
+// hidden lists the tools the toolset does not offer. Tag order is shared by
+// the whole notebook, so tag-restricted tokens cannot change it.
+func (t mcpToolset) hidden() []string {
+	var names []string
+	for name, scope := range mcpToolScopes {
+		if scopeLevels[t.scope] < scopeLevels[scope] || (t.tagRestricted && name == "tags_reorder") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
 // HandleMCP mounts a bearer-token protected Streamable HTTP MCP endpoint on
-// the running goNotes server.
-func HandleMCP(router *Router, service *NotesService, token, version string) {
-	server := newMCPServer(service, version)
+// the running goNotes server. Access tokens act on the notebook of their
+// owner and are only offered the tools their scope allows. The legacy token
+// from MCP_TOKEN, if set, acts on the default notebook with every tool.
+func HandleMCP(router *Router, service *NotesService, legacyToken, version string) {
+	var mu sync.Mutex
+	servers := map[mcpToolset]*mcp.Server{}
 	handler := mcp.NewStreamableHTTPHandler(
-		func(*http.Request) *mcp.Server { return server },
+		func(r *http.Request) *mcp.Server {
+			toolset := fullMCPToolset
+			if token, ok := tokenFrom(r.Context()); ok {
+				toolset = mcpToolset{scope: token.Scope, tagRestricted: len(token.Tags) > 0}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if servers[toolset] == nil {
+				servers[toolset] = newMCPServer(service, version, toolset)
+			}
+			return servers[toolset]
+		},
 		&mcp.StreamableHTTPOptions{
 			Stateless:                    true,
 			JSONResponse:                 true,
@@ -110,14 +258,14 @@ func HandleMCP(router *Router, service *NotesService, token, version string) {
 			PropagateRequestCancellation: true,
 		},
 	)
-	router.All("/mcp", requireBearerToken(token, handler).ServeHTTP)
+	router.All("/mcp", requireBearerToken(service, legacyToken, handler).ServeHTTP)
 }
 
-func newMCPServer(service *NotesService, version string) *mcp.Server {
+func newMCPServer(service *NotesService, version string, toolset mcpToolset) *mcp.Server {
 	server := mcp.NewServer(
 		&mcp.Implementation{Name: "goNotes", Version: version},
 		&mcp.ServerOptions{Instructions: strings.TrimSpace(`
-goNotes stores Markdown notes whose hashtags are part of their content. It also supports custom spoiler syntax: wrap text as ||hidden text|| to mask it in the UI until clicked. This is visual concealment only, not encryption; the text remains stored as plaintext and visible through MCP. Preserve this syntax when editing notes and use it when the user asks to hide content. Always use notes_list or note_get to resolve exact IDs before changing existing notes. Never guess an ID. Prefer note_update with append_content when the user asks to add information. Moving to trash is reversible; notes_delete_permanently is irreversible and only affects notes already in trash, so obtain explicit user confirmation immediately before calling it. Attachments are sent as base64 and are limited to 32 MiB decoded per tool call.`)},
+goNotes stores Markdown notes whose hashtags are part of their content. It also supports custom spoiler syntax: wrap text as ||hidden text|| to mask it in the UI until clicked. This is visual concealment only, not encryption; the text remains stored as plaintext and visible through MCP. Preserve this syntax when editing notes and use it when the user asks to hide content. Link to another note with [[note:ID]] or [[Title]], where Title is the first line of the target note. Always use notes_list or note_get to resolve exact IDs before changing existing notes. Never guess an ID. Prefer note_update with append_content when the user asks to add information. Every content change is kept in note_history, and note_revert undoes an unwanted replacement. Notes with is_encrypted set are encrypted at rest with a passphrase-unlocked server key: MCP cannot read or change their content, so they are listed with locked set and empty content, and note_get returns an error for them. Moving to trash is reversible; notes_delete_permanently is irreversible and only affects notes already in trash, so obtain explicit user confirmation immediately before calling it. Attachments are sent as base64 and are limited to 32 MiB decoded per tool call; read larger ones with attachment_read_chunk and send them with upload_create and upload_append, then attach them by upload_id.`)},
 	)
 
 	mcp.AddTool(server, readOnlyTool("notes_list", "Search and list notes with tag, state, and cursor filters."),
@@ -127,17 +275,24 @@ goNotes stores Markdown notes whose hashtags are part of their content. It also
 			}
 			output, err := service.ListNotes(ctx, ListNotesOptions{
 				Query: input.Query, Tags: input.Tags, State: input.State, Limit: input.Limit,
-				BeforeSortOrder: input.BeforeSortOrder,
+				BeforeSortOrder: input.BeforeSortOrder, Sort: input.Sort, Offset: input.Offset,
+				Snippets: input.Snippets,
 			})
 			return nil, output, err
 		})
 
-	mcp.AddTool(server, readOnlyTool("note_get", "Get one note by its exact ID, including notes in trash and all attachment metadata."),
+	mcp.AddTool(server, readOnlyTool("note_get", "Get one note by its exact ID, including notes in trash and attachment metadata: original name, size, MIME type, image dimensions and capture date, and audio or video duration in seconds."),
 		func(ctx context.Context, _ *mcp.CallToolRequest, input mcpGetNoteInput) (*mcp.CallToolResult, mcpNoteOutput, error) {
 			note, err := service.GetNote(ctx, input.ID)
 			return nil, mcpNoteOutput{Note: note}, err
 		})
 
+	mcp.AddTool(server, readOnlyTool("note_backlinks", "List notes that link to a note with [[note:ID]] or [[Title]]. Outgoing links are in the links field of note_get."),
+		func(ctx context.Context, _ *mcp.CallToolRequest, input mcpBacklinksInput) (*mcp.CallToolResult, ListNotesResult, error) {
+			output, err := service.ListBacklinks(ctx, input.ID, min(input.Limit, 100))
+			return nil, output, err
+		})
+
 	mcp.AddTool(server, readOnlyTool("attachment_get", "Read an attachment by its note ID and attachment ID. Returns up to 32 MiB as standard base64."),
 		func(ctx context.Context, _ *mcp.CallToolRequest, input mcpGetAttachmentInput) (*mcp.CallToolResult, mcpAttachmentOutput, error) {
 			attachment, data, err := service.GetAttachment(ctx, input.NoteID, input.AttachmentID)
@@ -147,17 +302,60 @@ goNotes stores Markdown notes whose hashtags are part of their content. It also
 			}, err
 		})
 
+	mcp.AddTool(server, readOnlyTool("attachment_read_chunk", "Read part of an attachment from a byte offset, for files too large for attachment_get. Returns the chunk as standard base64, the total size, and eof once the end is reached."),
+		func(ctx context.Context, _ *mcp.CallToolRequest, input mcpReadChunkInput) (*mcp.CallToolResult, mcpChunkOutput, error) {
+			if input.Length == 0 {
+				input.Length = defaultMCPChunkBytes
+			}
+			chunk, err := service.ReadAttachmentChunk(ctx, input.NoteID, input.AttachmentID, input.Offset, input.Length)
+			if err != nil {
+				return nil, mcpChunkOutput{}, err
+			}
+			end := chunk.Offset + int64(len(chunk.Data))
+			return nil, mcpChunkOutput{
+				Attachment: chunk.Attachment, Offset: chunk.Offset, Length: len(chunk.Data), Size: chunk.Size,
+				EOF: end == chunk.Size, DataBase64: base64.StdEncoding.EncodeToString(chunk.Data),
+			}, nil
+		})
+
+	mcp.AddTool(server, writeTool("upload_create", "Start a resumable upload of a file of the given size, up to the server's maximum upload size. Send its bytes in order with upload_append, then attach it with upload_id in note_create or note_update.", false, false),
+		func(ctx context.Context, _ *mcp.CallToolRequest, input mcpUploadCreateInput) (*mcp.CallToolResult, mcpUploadOutput, error) {
+			upload, err := service.CreateUploadSession(ctx, input.Filename, input.Size)
+			return nil, mcpUploadOutput{Upload: upload}, err
+		})
+
+	mcp.AddTool(server, writeTool("upload_append", "Append the next chunk of a resumable upload at its current offset. If a call fails or its result is lost, use upload_get to find the offset to resume from.", false, false),
+		func(ctx context.Context, _ *mcp.CallToolRequest, input mcpUploadAppendInput) (*mcp.CallToolResult, mcpUploadOutput, error) {
+			data, err := base64.StdEncoding.DecodeString(input.DataBase64)
+			if err != nil {
+				return nil, mcpUploadOutput{}, fmt.Errorf("chunk has invalid base64 data: %w", err)
+			}
+			if len(data) > maxIntegrationAttachmentBytes {
+				return nil, mcpUploadOutput{}, fmt.Errorf("chunk exceeds the %d MiB decoded limit", maxIntegrationAttachmentBytes>>20)
+			}
+			upload, err := service.AppendUploadSession(ctx, input.UploadID, input.Offset, bytes.NewReader(data))
+			return nil, mcpUploadOutput{Upload: upload}, err
+		})
+
+	mcp.AddTool(server, readOnlyTool("upload_get", "Get the offset and size of a resumable upload."),
+		func(ctx context.Context, _ *mcp.CallToolRequest, input mcpUploadGetInput) (*mcp.CallToolResult, mcpUploadOutput, error) {
+			upload, err := service.GetUploadSession(ctx, input.UploadID)
+			return nil, mcpUploadOutput{Upload: upload}, err
+		})
+
 	mcp.AddTool(server, writeTool("note_create", "Create a Markdown note, optionally with attachments. Hashtags in content become goNotes tags.", false, false),
 		func(ctx context.Context, _ *mcp.CallToolRequest, input mcpCreateNoteInput) (*mcp.CallToolResult, mcpNoteOutput, error) {
 			attachments, err := decodeMCPAttachments(input.Attachments)
 			if err != nil {
 				return nil, mcpNoteOutput{}, err
 			}
-			note, err := service.CreateNote(ctx, input.Content, attachments)
+			note, err := service.CreateNote(ctx, CreateNoteOptions{
+				Content: input.Content, Attachments: attachments, IdempotencyKey: input.IdempotencyKey,
+			})
 			return nil, mcpNoteOutput{Note: note}, err
 		})
 
-	mcp.AddTool(server, writeTool("note_update", "Replace or append note content and add or remove attachments. Use either content or append_content, not both.", true, false),
+	mcp.AddTool(server, writeTool("note_update", "Replace or append note content and add or remove attachments. Use either content or append_content, not both. Pass expected_version when replacing content to avoid overwriting concurrent edits.", true, false),
 		func(ctx context.Context, _ *mcp.CallToolRequest, input mcpUpdateNoteInput) (*mcp.CallToolResult, mcpNoteOutput, error) {
 			attachments, err := decodeMCPAttachments(input.Attachments)
 			if err != nil {
@@ -165,8 +363,33 @@ goNotes stores Markdown notes whose hashtags are part of their content. It also
 			}
 			note, err := service.UpdateNote(ctx, input.ID, UpdateNoteOptions{
 				Content: input.Content, AppendContent: input.AppendContent, Attachments: attachments,
-				DeleteAttachmentIDs: input.DeleteAttachmentIDs,
+				DeleteAttachmentIDs: input.DeleteAttachmentIDs, ExpectedVersion: input.ExpectedVersion,
 			})
+			var conflict *ConflictError
+			if errors.As(err, &conflict) {
+				return nil, mcpNoteOutput{}, fmt.Errorf("%w; merge your change into the current content and retry with expected_version %d:\n%s",
+					err, conflict.Note.Version, conflict.Note.Content)
+			}
+			return nil, mcpNoteOutput{Note: note}, err
+		})
+
+	mcp.AddTool(server, readOnlyTool("note_history", "List saved revisions of a note, newest first. With revision_id, also return that revision's content and a line diff from it to the current content."),
+		func(ctx context.Context, _ *mcp.CallToolRequest, input mcpNoteHistoryInput) (*mcp.CallToolResult, mcpNoteHistoryOutput, error) {
+			revisions, err := service.ListRevisions(ctx, input.ID)
+			if err != nil || input.RevisionID == 0 {
+				return nil, mcpNoteHistoryOutput{Revisions: revisions}, err
+			}
+			revision, err := service.GetRevision(ctx, input.ID, input.RevisionID)
+			if err != nil {
+				return nil, mcpNoteHistoryOutput{}, err
+			}
+			diff, err := service.DiffRevisions(ctx, input.ID, input.RevisionID, 0)
+			return nil, mcpNoteHistoryOutput{Revisions: revisions, Revision: &revision, Diff: &diff}, err
+		})
+
+	mcp.AddTool(server, writeTool("note_revert", "Restore note content from a revision listed by note_history. The current content stays available as a revision.", true, true),
+		func(ctx context.Context, _ *mcp.CallToolRequest, input mcpNoteRevertInput) (*mcp.CallToolResult, mcpNoteOutput, error) {
+			note, err := service.RestoreRevision(ctx, input.ID, input.RevisionID)
 			return nil, mcpNoteOutput{Note: note}, err
 		})
 
@@ -236,6 +459,29 @@ goNotes stores Markdown notes whose hashtags are part of their content. It also
 			return nil, mcpStatusOutput{Status: "ok", Affected: int64(len(input.Names))}, err
 		})
 
+	mcp.AddTool(server, writeTool("note_share", "Create a public read-only link to one note and its attachments. Anyone with the link can read the note, so confirm with the user first. The returned path is relative to the goNotes server address.", false, false),
+		func(ctx context.Context, _ *mcp.CallToolRequest, input mcpShareCreateInput) (*mcp.CallToolResult, mcpShareOutput, error) {
+			share, err := service.CreateShare(ctx, CreateShareOptions{
+				NoteID:    input.NoteID,
+				Password:  input.Password,
+				ExpiresIn: time.Duration(input.ExpiresInDays) * 24 * time.Hour,
+			})
+			return nil, mcpShareOutput{Share: share}, err
+		})
+
+	mcp.AddTool(server, readOnlyTool("shares_list", "List public share links, newest first, optionally only those of one note."),
+		func(ctx context.Context, _ *mcp.CallToolRequest, input mcpSharesListInput) (*mcp.CallToolResult, mcpSharesOutput, error) {
+			shares, err := service.ListShares(ctx, input.NoteID)
+			return nil, mcpSharesOutput{Shares: shares}, err
+		})
+
+	mcp.AddTool(server, writeTool("share_revoke", "Revoke a public share link; it stops working immediately.", false, true),
+		func(ctx context.Context, _ *mcp.CallToolRequest, input mcpShareRevokeInput) (*mcp.CallToolResult, mcpStatusOutput, error) {
+			err := service.RevokeShare(ctx, input.ID)
+			return nil, mcpStatusOutput{Status: "ok", Affected: 1}, err
+		})
+
+	server.RemoveTools(toolset.hidden()...)
 	return server
 }
 
@@ -243,6 +489,10 @@ func decodeMCPAttachments(inputs []mcpAttachmentInput) ([]NewAttachment, error)
 	attachments := make([]NewAttachment, 0, len(inputs))
 	total := 0
 	for _, input := range inputs {
+		if input.UploadID != "" {
+			attachments = append(attachments, NewAttachment{Upload: input.UploadID})
+			continue
+		}
 		if strings.TrimSpace(input.Filename) == "" {
 			return nil, errors.New("attachment filename is required")
 		}
@@ -259,16 +509,34 @@ func decodeMCPAttachments(inputs []mcpAttachmentInput) ([]NewAttachment, error)
 	return attachments, nil
 }
 
-func requireBearerToken(token string, next http.Handler) http.Handler {
-	expected := []byte("Bearer " + token)
+// requireBearerToken accepts the legacy token, when one is set, and access
+// tokens, whose owner and scope it puts into the request context. MCP calls
+// never decrypt encrypted notes, whichever token they use.
+func requireBearerToken(service *NotesService, legacyToken string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + legacyToken)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(withoutDecryption(r.Context()))
 		actual := []byte(r.Header.Get("Authorization"))
-		if len(actual) != len(expected) || subtle.ConstantTimeCompare(actual, expected) != 1 {
+		if legacyToken != "" && len(actual) == len(expected) && subtle.ConstantTimeCompare(actual, expected) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		err := ErrInvalidCredentials
+		var token APIToken
+		if secret, ok := bearerToken(r); ok {
+			token, err = service.TokenAuth(r.Context(), secret)
+		}
+		if err != nil {
+			if !errors.Is(err, ErrInvalidCredentials) {
+				log.Printf("MCP token error: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
 			w.Header().Set("WWW-Authenticate", `Bearer realm="goNotes MCP"`)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(withToken(WithUser(r.Context(), token.OwnerID), token)))
 	})
 }
 
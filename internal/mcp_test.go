@@ -37,7 +37,7 @@ func TestMCPRequiresBearerTokenAndListsTools(t *testing.T) {
 		t.Fatalf("authorized status = %d, body = %s", response.Code, response.Body.String())
 	}
 	body := response.Body.String()
-	for _, toolName := range []string{"notes_list", "note_create", "note_update", "attachment_get", "notes_delete_permanently"} {
+	for _, toolName := range []string{"notes_list", "note_create", "note_update", "attachment_get", "attachment_read_chunk", "upload_create", "upload_append", "notes_delete_permanently"} {
 		if !strings.Contains(body, `"name":"`+toolName+`"`) {
 			t.Errorf("tools/list response does not contain %q: %s", toolName, body)
 		}
@@ -50,7 +50,7 @@ func TestMCPRequiresBearerTokenAndListsTools(t *testing.T) {
 func TestHTTPAndMCPShareNotesService(t *testing.T) {
 	service := newTestNotesService(t)
 	router := NewRouter()
-	HandleApi(router, service)
+	HandleApi(router, service, newTestAuth(t, service, AuthSession))
 	HandleMCP(router, service, "test-secret", "test")
 
 	response := callAPI(t, router, multipartAPIRequest(t, "/api/messages/send", map[string]string{
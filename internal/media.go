@@ -0,0 +1,547 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/png"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// attachmentMeta is what the content of a file tells about it. Fields the
+// file does not have, or that cannot be read from its format, stay nil.
+type attachmentMeta struct {
+	mimeType      string
+	size          int64
+	width, height *int
+	// takenAt is the EXIF capture time as the camera recorded it, without a
+	// time zone.
+	takenAt *string
+	// duration of audio and video, in seconds.
+	duration *float64
+}
+
+// inspectAttachment reads the metadata of a file from its content. Only the
+// headers are read, and the end of Ogg files.
+func inspectAttachment(file io.ReadSeeker, name string) attachmentMeta {
+	head := readMediaAt(file, 0, 512)
+	meta := attachmentMeta{mimeType: sniffMimeType(head, name)}
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return meta
+	}
+	meta.size = size
+
+	var duration float64
+	var ok bool
+	switch meta.mimeType {
+	case "audio/mpeg":
+		duration, ok = mp3Duration(file, size)
+	case "audio/wave":
+		duration, ok = wavDuration(file, size)
+	case "audio/flac":
+		duration, ok = flacDuration(file)
+	case "audio/ogg":
+		duration, ok = oggDuration(file, size, head)
+	case "audio/mp4", "video/mp4", "video/quicktime", "video/3gpp":
+		duration, ok = mp4Duration(file, size)
+	case "video/webm", "video/x-matroska", "audio/webm":
+		duration, ok = matroskaDuration(file)
+	default:
+		if strings.HasPrefix(meta.mimeType, "image/") {
+			inspectImage(file, head, &meta)
+		}
+	}
+	if ok && duration > 0 && !math.IsInf(duration, 0) && !math.IsNaN(duration) {
+		duration = math.Round(duration*1000) / 1000
+		meta.duration = &duration
+	}
+	return meta
+}
+
+// BackfillAttachmentMetadata reads the metadata of attachments stored before
+// it was recorded. Attachments of encrypted notes are read when the note is
+// decrypted, and attachments whose file is missing are left as they are.
+func (s *NotesService) BackfillAttachmentMetadata(ctx context.Context) (int, error) {
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT a.id, a.original_name, COALESCE(a.blob_hash, a.file_path)
+		FROM attachments a JOIN messages m ON m.id = a.message_id
+		WHERE a.inspected = 0 AND m.is_encrypted = 0 ORDER BY a.id`)
+	if err != nil {
+		return 0, err
+	}
+	type pendingAttachment struct {
+		id           int64
+		name, stored string
+	}
+	var pending []pendingAttachment
+	for rows.Next() {
+		var attachment pendingAttachment
+		if err := rows.Scan(&attachment.id, &attachment.name, &attachment.stored); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, attachment)
+	}
+	if err := rows.Close(); err != nil {
+		return 0, err
+	}
+
+	inspected := 0
+	for _, attachment := range pending {
+		source, err := s.openUpload(ctx, attachment.stored)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return inspected, fmt.Errorf("attachment %d: %w", attachment.id, err)
+		}
+		meta := inspectAttachment(source, attachment.name)
+		source.Close()
+		// The note may have been encrypted meanwhile.
+		if _, err := s.DB.ExecContext(ctx, `
+			UPDATE attachments SET size = ?, mime_type = ?, width = ?, height = ?, taken_at = ?, duration = ?, inspected = 1
+			WHERE id = ? AND inspected = 0 AND message_id IN (SELECT id FROM messages WHERE is_encrypted = 0)`,
+			meta.size, meta.mimeType, meta.width, meta.height, meta.takenAt, meta.duration, attachment.id,
+		); err != nil {
+			return inspected, err
+		}
+		inspected++
+	}
+	return inspected, nil
+}
+
+// sniffMimeType detects the type of a file from its first bytes, refining
+// what net/http knows for audio and video containers. The extension of name
+// is used only for content no signature matches.
+func sniffMimeType(head []byte, name string) string {
+	mimeType := http.DetectContentType(head)
+	switch {
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		brand := string(head[8:12])
+		switch {
+		case brand == "M4A " || brand == "M4B ":
+			return "audio/mp4"
+		case brand == "qt  ":
+			return "video/quicktime"
+		case strings.HasPrefix(brand, "3g"):
+			return "video/3gpp"
+		case brand == "heic" || brand == "heix" || brand == "mif1":
+			return "image/heic"
+		}
+		return "video/mp4"
+	case mimeType == "application/ogg":
+		if bytes.Contains(head, []byte("\x80theora")) {
+			return "video/ogg"
+		}
+		return "audio/ogg"
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return "audio/flac"
+	case bytes.HasPrefix(head, []byte("\x1a\x45\xdf\xa3")) && mimeType != "video/webm":
+		return "video/x-matroska"
+	case mimeType != "application/octet-stream":
+		return mimeType
+	case len(head) >= 4 && mp3FrameHeader(binary.BigEndian.Uint32(head)).valid():
+		return "audio/mpeg"
+	case len(head) >= 2 && head[0] == 0xff && head[1]&0xf6 == 0xf0:
+		return "audio/aac"
+	}
+	return attachmentMimeType(name)
+}
+
+// readMediaAt reads up to n bytes at off; a short file gives fewer bytes.
+func readMediaAt(r io.ReadSeeker, off int64, n int) []byte {
+	if _, err := r.Seek(off, io.SeekStart); err != nil {
+		return nil
+	}
+	buf := make([]byte, n)
+	read, _ := io.ReadFull(r, buf)
+	return buf[:read]
+}
+
+// inspectImage records the size of an image as it is displayed, after its
+// EXIF orientation, and the EXIF capture time.
+func inspectImage(file io.ReadSeeker, head []byte, meta *attachmentMeta) {
+	width, height, ok := webpSize(head)
+	if !ok {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return
+		}
+		config, _, err := image.DecodeConfig(file)
+		if err != nil {
+			return
+		}
+		width, height = config.Width, config.Height
+	}
+	if _, err := file.Seek(0, io.SeekStart); err == nil {
+		if x, err := exif.Decode(file); err == nil {
+			if tag, err := x.Get(exif.Orientation); err == nil {
+				// Orientations 5 to 8 turn the image by 90 degrees.
+				if orientation, err := tag.Int(0); err == nil && orientation >= 5 && orientation <= 8 {
+					width, height = height, width
+				}
+			}
+			if taken, err := x.DateTime(); err == nil {
+				takenAt := taken.Format("2006-01-02 15:04:05")
+				meta.takenAt = &takenAt
+			}
+		}
+	}
+	meta.width, meta.height = &width, &height
+}
+
+// webpSize reads the canvas size of a WebP image, which image has no
+// decoder for.
+func webpSize(head []byte) (int, int, bool) {
+	if len(head) < 30 || string(head[0:4]) != "RIFF" || string(head[8:12]) != "WEBP" {
+		return 0, 0, false
+	}
+	uint24 := func(b []byte) int { return int(b[0]) | int(b[1])<<8 | int(b[2])<<16 }
+	switch string(head[12:16]) {
+	case "VP8X":
+		return 1 + uint24(head[24:27]), 1 + uint24(head[27:30]), true
+	case "VP8 ":
+		return int(binary.LittleEndian.Uint16(head[26:28]) & 0x3fff), int(binary.LittleEndian.Uint16(head[28:30]) & 0x3fff), true
+	case "VP8L":
+		bits := binary.LittleEndian.Uint32(head[21:25])
+		return 1 + int(bits&0x3fff), 1 + int(bits>>14&0x3fff), true
+	}
+	return 0, 0, false
+}
+
+// mp4Duration reads the duration from the movie header of MP4 and
+// QuickTime files.
+func mp4Duration(r io.ReadSeeker, size int64) (float64, bool) {
+	moov, moovSize, ok := findMP4Box(r, 0, size, "moov")
+	if !ok {
+		return 0, false
+	}
+	mvhd, _, ok := findMP4Box(r, moov, moov+moovSize, "mvhd")
+	if !ok {
+		return 0, false
+	}
+	b := readMediaAt(r, mvhd, 32)
+	if len(b) < 20 {
+		return 0, false
+	}
+	var timescale uint32
+	var duration uint64
+	if b[0] == 1 {
+		if len(b) < 32 {
+			return 0, false
+		}
+		timescale, duration = binary.BigEndian.Uint32(b[20:24]), binary.BigEndian.Uint64(b[24:32])
+	} else {
+		timescale, duration = binary.BigEndian.Uint32(b[12:16]), uint64(binary.BigEndian.Uint32(b[16:20]))
+	}
+	if timescale == 0 {
+		return 0, false
+	}
+	return float64(duration) / float64(timescale), true
+}
+
+// findMP4Box returns the offset and size of the payload of the first box of
+// kind between start and end.
+func findMP4Box(r io.ReadSeeker, start, end int64, kind string) (int64, int64, bool) {
+	for off := start; off+8 <= end; {
+		header := readMediaAt(r, off, 16)
+		if len(header) < 8 {
+			return 0, 0, false
+		}
+		boxSize, headerSize := int64(binary.BigEndian.Uint32(header[0:4])), int64(8)
+		switch boxSize {
+		case 0:
+			boxSize = end - off
+		case 1:
+			if len(header) < 16 {
+				return 0, 0, false
+			}
+			boxSize, headerSize = int64(binary.BigEndian.Uint64(header[8:16])), 16
+		}
+		if boxSize < headerSize {
+			return 0, 0, false
+		}
+		if string(header[4:8]) == kind {
+			return off + headerSize, boxSize - headerSize, true
+		}
+		off += boxSize
+	}
+	return 0, 0, false
+}
+
+// wavDuration divides the size of the data chunk by the byte rate.
+func wavDuration(r io.ReadSeeker, size int64) (float64, bool) {
+	var byteRate uint32
+	for off := int64(12); off+8 <= size; {
+		chunk := readMediaAt(r, off, 20)
+		if len(chunk) < 8 {
+			return 0, false
+		}
+		chunkSize := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+		switch string(chunk[0:4]) {
+		case "fmt ":
+			if len(chunk) < 20 {
+				return 0, false
+			}
+			byteRate = binary.LittleEndian.Uint32(chunk[16:20])
+		case "data":
+			if byteRate == 0 {
+				return 0, false
+			}
+			// Streamed files may leave the size unset.
+			chunkSize = min(chunkSize, size-off-8)
+			return float64(chunkSize) / float64(byteRate), true
+		}
+		off += 8 + chunkSize + chunkSize%2
+	}
+	return 0, false
+}
+
+// flacDuration reads the sample count of the STREAMINFO block.
+func flacDuration(r io.ReadSeeker) (float64, bool) {
+	info := readMediaAt(r, 8, 18)
+	if len(info) < 18 {
+		return 0, false
+	}
+	rate := uint32(info[10])<<12 | uint32(info[11])<<4 | uint32(info[12])>>4
+	samples := uint64(info[13]&0x0f)<<32 | uint64(binary.BigEndian.Uint32(info[14:18]))
+	if rate == 0 || samples == 0 {
+		return 0, false
+	}
+	return float64(samples) / float64(rate), true
+}
+
+// oggDuration divides the granule position of the last page by the sample
+// rate from the Vorbis or Opus header in the first page.
+func oggDuration(r io.ReadSeeker, size int64, head []byte) (float64, bool) {
+	if len(head) < 28 {
+		return 0, false
+	}
+	segments := int(head[26])
+	if len(head) < 27+segments+16 {
+		return 0, false
+	}
+	packet := head[27+segments:]
+	var rate, preSkip uint64
+	switch {
+	case bytes.HasPrefix(packet, []byte("\x01vorbis")):
+		rate = uint64(binary.LittleEndian.Uint32(packet[12:16]))
+	case bytes.HasPrefix(packet, []byte("OpusHead")):
+		rate, preSkip = 48000, uint64(binary.LittleEndian.Uint16(packet[10:12]))
+	default:
+		return 0, false
+	}
+	tailSize := min(size, 64<<10)
+	tail := readMediaAt(r, size-tailSize, int(tailSize))
+	last := bytes.LastIndex(tail, []byte("OggS"))
+	if rate == 0 || last < 0 || len(tail) < last+14 {
+		return 0, false
+	}
+	granule := binary.LittleEndian.Uint64(tail[last+6 : last+14])
+	if granule <= preSkip || granule == math.MaxUint64 {
+		return 0, false
+	}
+	return float64(granule-preSkip) / float64(rate), true
+}
+
+// mp3FrameHeader is the header of an MPEG audio frame.
+type mp3FrameHeader uint32
+
+func (h mp3FrameHeader) version() uint32 { return uint32(h) >> 19 & 3 }
+
+// valid reports whether h is a Layer III frame header, the only layer in
+// use for files.
+func (h mp3FrameHeader) valid() bool {
+	return uint32(h)>>21 == 0x7ff && h.version() != 1 && uint32(h)>>17&3 == 1 &&
+		h.bitrate() > 0 && h.sampleRate() > 0
+}
+
+func (h mp3FrameHeader) bitrate() int {
+	index := uint32(h) >> 12 & 0xf
+	if index == 0xf {
+		return 0
+	}
+	if h.version() == 3 {
+		return []int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320}[index] * 1000
+	}
+	return []int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160}[index] * 1000
+}
+
+func (h mp3FrameHeader) sampleRate() int {
+	index := uint32(h) >> 10 & 3
+	if index == 3 {
+		return 0
+	}
+	rate := []int{44100, 48000, 32000}[index]
+	switch h.version() {
+	case 2:
+		return rate / 2
+	case 0:
+		return rate / 4
+	}
+	return rate
+}
+
+// mp3Duration reads the frame count of a Xing or VBRI header, and otherwise
+// assumes a constant bitrate.
+func mp3Duration(r io.ReadSeeker, size int64) (float64, bool) {
+	start := int64(0)
+	if id3 := readMediaAt(r, 0, 10); len(id3) == 10 && string(id3[0:3]) == "ID3" {
+		start = 10 + (int64(id3[6])<<21 | int64(id3[7])<<14 | int64(id3[8])<<7 | int64(id3[9]))
+		if id3[5]&0x10 != 0 {
+			start += 10
+		}
+	}
+	frame := readMediaAt(r, start, 64)
+	if len(frame) < 4 {
+		return 0, false
+	}
+	header := mp3FrameHeader(binary.BigEndian.Uint32(frame))
+	if !header.valid() {
+		return 0, false
+	}
+	// The Xing header follows the side information, whose length depends on
+	// the version and the channel mode.
+	samplesPerFrame, sideInfo := 1152, 32
+	mono := uint32(header)>>6&3 == 3
+	switch {
+	case header.version() == 3 && mono:
+		sideInfo = 17
+	case header.version() != 3 && mono:
+		samplesPerFrame, sideInfo = 576, 9
+	case header.version() != 3:
+		samplesPerFrame, sideInfo = 576, 17
+	}
+	frames := uint32(0)
+	if xing := frame[min(4+sideInfo, len(frame)):]; len(xing) >= 12 &&
+		(string(xing[0:4]) == "Xing" || string(xing[0:4]) == "Info") && binary.BigEndian.Uint32(xing[4:8])&1 != 0 {
+		frames = binary.BigEndian.Uint32(xing[8:12])
+	} else if len(frame) >= 36+18 && string(frame[36:40]) == "VBRI" {
+		frames = binary.BigEndian.Uint32(frame[36+14 : 36+18])
+	}
+	if frames > 0 {
+		return float64(frames) * float64(samplesPerFrame) / float64(header.sampleRate()), true
+	}
+	return float64(size-start) * 8 / float64(header.bitrate()), true
+}
+
+// Matroska element IDs read by matroskaDuration.
+const (
+	mkvSegmentID    = 0x18538067
+	mkvInfoID       = 0x1549a966
+	mkvClusterID    = 0x1f43b675
+	mkvTimescaleID  = 0x2ad7b1
+	mkvDurationID   = 0x4489
+	ebmlUnknownSize = -1
+)
+
+// matroskaDuration reads the duration from the segment info of WebM and
+// Matroska files, which comes before the first cluster.
+func matroskaDuration(r io.ReadSeeker) (float64, bool) {
+	buf := readMediaAt(r, 0, 64<<10)
+	off := 0
+	for off < len(buf) {
+		id, size, n := readEBMLElement(buf[off:])
+		if n == 0 {
+			return 0, false
+		}
+		off += n
+		switch id {
+		case mkvSegmentID:
+			// Step into the segment.
+		case mkvInfoID:
+			if size == ebmlUnknownSize || off+size > len(buf) {
+				return 0, false
+			}
+			return matroskaInfoDuration(buf[off : off+size])
+		case mkvClusterID:
+			return 0, false
+		default:
+			if size == ebmlUnknownSize {
+				return 0, false
+			}
+			off += size
+		}
+	}
+	return 0, false
+}
+
+func matroskaInfoDuration(info []byte) (float64, bool) {
+	timescale, duration := uint64(1000000), -1.0
+	for off := 0; off < len(info); {
+		id, size, n := readEBMLElement(info[off:])
+		if n == 0 || size == ebmlUnknownSize || off+n+size > len(info) {
+			break
+		}
+		value := info[off+n : off+n+size]
+		switch {
+		case id == mkvTimescaleID && size <= 8:
+			timescale = 0
+			for _, b := range value {
+				timescale = timescale<<8 | uint64(b)
+			}
+		case id == mkvDurationID && size == 4:
+			duration = float64(math.Float32frombits(binary.BigEndian.Uint32(value)))
+		case id == mkvDurationID && size == 8:
+			duration = math.Float64frombits(binary.BigEndian.Uint64(value))
+		}
+		off += n + size
+	}
+	if duration < 0 {
+		return 0, false
+	}
+	return duration * float64(timescale) / 1e9, true
+}
+
+// readEBMLElement reads the ID and data size of the EBML element at the
+// start of b and returns the length of its header, or 0 if b is too short.
+func readEBMLElement(b []byte) (id uint64, size int, n int) {
+	id, idLength := readEBMLVint(b, true)
+	if idLength == 0 {
+		return 0, 0, 0
+	}
+	dataSize, sizeLength := readEBMLVint(b[idLength:], false)
+	if sizeLength == 0 {
+		return 0, 0, 0
+	}
+	if dataSize == 1<<(7*sizeLength)-1 {
+		return id, ebmlUnknownSize, idLength + sizeLength
+	}
+	if dataSize > math.MaxInt32 {
+		return 0, 0, 0
+	}
+	return id, int(dataSize), idLength + sizeLength
+}
+
+// readEBMLVint reads a variable-length integer. IDs keep their length
+// marker bit; sizes do not.
+func readEBMLVint(b []byte, keepMarker bool) (uint64, int) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, 0
+	}
+	length := 1
+	for mask := byte(0x80); b[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if len(b) < length {
+		return 0, 0
+	}
+	value := uint64(b[0])
+	if !keepMarker {
+		value &= uint64(0xff >> length)
+	}
+	for _, c := range b[1:length] {
+		value = value<<8 | uint64(c)
+	}
+	return value, length
+}
@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"testing"
+)
+
+// jpegWithExif encodes a JPEG with an EXIF block holding orientation and
+// the capture time.
+func jpegWithExif(t *testing.T, width, height int, orientation uint16, taken string) []byte {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	entry := func(tag, kind uint16, count, value uint32) {
+		tiff = binary.BigEndian.AppendUint16(tiff, tag)
+		tiff = binary.BigEndian.AppendUint16(tiff, kind)
+		tiff = binary.BigEndian.AppendUint32(tiff, count)
+		tiff = binary.BigEndian.AppendUint32(tiff, value)
+	}
+	// IFD0 at 8 with Orientation and the pointer to the EXIF IFD at 38,
+	// whose DateTimeOriginal string follows at 56.
+	tiff = binary.BigEndian.AppendUint16(tiff, 2)
+	entry(0x0112, 3, 1, uint32(orientation)<<16)
+	entry(0x8769, 4, 1, 38)
+	tiff = binary.BigEndian.AppendUint32(tiff, 0)
+	tiff = binary.BigEndian.AppendUint16(tiff, 1)
+	entry(0x9003, 2, 20, 56)
+	tiff = binary.BigEndian.AppendUint32(tiff, 0)
+	tiff = append(tiff, taken+"\x00"...)
+
+	app1 := append([]byte("Exif\x00\x00"), tiff...)
+	segment := append([]byte{0xff, 0xe1}, binary.BigEndian.AppendUint16(nil, uint16(len(app1)+2))...)
+	data := encoded.Bytes()
+	return append(append(append([]byte{}, data[:2]...), append(segment, app1...)...), data[2:]...)
+}
+
+func mp4Box(kind string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	return append(binary.BigEndian.AppendUint32(nil, uint32(8+len(body))), append([]byte(kind), body...)...)
+}
+
+func oggPage(granule uint64, packet []byte) []byte {
+	page := []byte("OggS\x00\x02")
+	page = binary.LittleEndian.AppendUint64(page, granule)
+	page = append(page, make([]byte, 12)...)
+	page = append(page, 1, byte(len(packet)))
+	return append(page, packet...)
+}
+
+func TestInspectAttachment(t *testing.T) {
+	var picture bytes.Buffer
+	if err := png.Encode(&picture, image.NewGray(image.Rect(0, 0, 30, 20))); err != nil {
+		t.Fatal(err)
+	}
+
+	wav := []byte("RIFF\x00\x00\x00\x00WAVEfmt \x10\x00\x00\x00\x01\x00\x01\x00")
+	wav = binary.LittleEndian.AppendUint32(wav, 8000)
+	wav = binary.LittleEndian.AppendUint32(wav, 16000)
+	wav = append(wav, 2, 0, 16, 0)
+	wav = append(append(wav, "data"...), binary.LittleEndian.AppendUint32(nil, 16000)...)
+	wav = append(wav, make([]byte, 16000)...)
+
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 2500)
+	m4a := append(mp4Box("ftyp", []byte("M4A \x00\x00\x00\x00M4A ")), mp4Box("moov", mp4Box("mvhd", mvhd))...)
+
+	// 100 MPEG-1 Layer III frames at 128 kbit/s and 44.1 kHz.
+	frame := make([]byte, 417)
+	binary.BigEndian.PutUint32(frame, 0xfffb9064)
+	mp3 := bytes.Repeat(frame, 100)
+
+	flac := append([]byte("fLaC\x80\x00\x00\x22"), make([]byte, 34)...)
+	flac[8+10], flac[8+11], flac[8+12] = 44100>>12, 44100>>4&0xff, 44100&0xf<<4
+	binary.BigEndian.PutUint32(flac[8+14:], 88200)
+
+	opusHead := append([]byte("OpusHead\x01\x01"), binary.LittleEndian.AppendUint16(nil, 312)...)
+	opusHead = append(binary.LittleEndian.AppendUint32(opusHead, 48000), 0, 0, 0)
+	opus := append(oggPage(0, opusHead), oggPage(3*48000+312, []byte("audio"))...)
+
+	info := []byte{0x2a, 0xd7, 0xb1, 0x83, 0x0f, 0x42, 0x40, 0x44, 0x89, 0x88}
+	info = binary.BigEndian.AppendUint64(info, math.Float64bits(1500))
+	webm := []byte{0x1a, 0x45, 0xdf, 0xa3, 0x87, 0x42, 0x82, 0x84, 'w', 'e', 'b', 'm',
+		0x18, 0x53, 0x80, 0x67, 0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x15, 0x49, 0xa9, 0x66, 0x80 | byte(len(info))}
+	webm = append(webm, info...)
+
+	webp := []byte("RIFF\x00\x00\x00\x00WEBPVP8L\x00\x00\x00\x00\x2f")
+	webp = append(binary.LittleEndian.AppendUint32(webp, 99|49<<14), make([]byte, 16)...)
+
+	for _, test := range []struct {
+		name          string
+		data          []byte
+		mimeType      string
+		width, height int
+		takenAt       string
+		duration      float64
+	}{
+		{name: "rotated.jpg", data: jpegWithExif(t, 80, 60, 6, "2024:05:01 10:20:30"), mimeType: "image/jpeg", width: 60, height: 80, takenAt: "2024-05-01 10:20:30"},
+		{name: "picture.dat", data: picture.Bytes(), mimeType: "image/png", width: 30, height: 20},
+		{name: "sticker.webp", data: webp, mimeType: "image/webp", width: 100, height: 50},
+		{name: "voice.wav", data: wav, mimeType: "audio/wave", duration: 1},
+		{name: "song.m4a", data: m4a, mimeType: "audio/mp4", duration: 2.5},
+		{name: "song.bin", data: mp3, mimeType: "audio/mpeg", duration: 2.606},
+		{name: "song.flac", data: flac, mimeType: "audio/flac", duration: 2},
+		{name: "voice.opus", data: opus, mimeType: "audio/ogg", duration: 3},
+		{name: "clip.webm", data: webm, mimeType: "video/webm", duration: 1.5},
+		{name: "photo.jpg", data: []byte("not a photo"), mimeType: "text/plain; charset=utf-8"},
+		{name: "archive.pdf", data: []byte{0, 1, 2, 3}, mimeType: "application/pdf"},
+	} {
+		meta := inspectAttachment(bytes.NewReader(test.data), test.name)
+		if meta.mimeType != test.mimeType || meta.size != int64(len(test.data)) {
+			t.Errorf("%s: MIME type = %q, size = %d", test.name, meta.mimeType, meta.size)
+		}
+		if test.width != 0 && (meta.width == nil || *meta.width != test.width || *meta.height != test.height) {
+			t.Errorf("%s: size = %v x %v, want %d x %d", test.name, meta.width, meta.height, test.width, test.height)
+		}
+		if test.width == 0 && meta.width != nil {
+			t.Errorf("%s: unexpected width %d", test.name, *meta.width)
+		}
+		if (test.takenAt == "") != (meta.takenAt == nil) || (meta.takenAt != nil && *meta.takenAt != test.takenAt) {
+			t.Errorf("%s: taken at %v, want %q", test.name, meta.takenAt, test.takenAt)
+		}
+		if (test.duration == 0) != (meta.duration == nil) || (meta.duration != nil && *meta.duration != test.duration) {
+			t.Errorf("%s: duration = %v, want %v", test.name, meta.duration, test.duration)
+		}
+	}
+}
+
+func TestAttachmentMetadata(t *testing.T) {
+	service := newTestNotesService(t)
+	ctx := context.Background()
+	note, err := service.CreateNote(ctx, CreateNoteOptions{
+		Content:     "Holiday",
+		Attachments: []NewAttachment{{Filename: "beach.jpg", Data: jpegWithExif(t, 80, 60, 1, "2023:08:15 18:45:00")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attachment := note.Attachments[0]
+	if attachment.Width == nil || *attachment.Width != 80 || *attachment.Height != 60 ||
+		attachment.TakenAt == nil || *attachment.TakenAt != "2023-08-15 18:45:00" || attachment.MimeType != "image/jpeg" {
+		t.Fatalf("new attachment = %+v", attachment)
+	}
+
+	// Rows from before the metadata columns are read once by the backfill.
+	if _, err := service.DB.Exec(`
+		UPDATE attachments SET mime_type = '', width = NULL, height = NULL, taken_at = NULL, inspected = 0`,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if inspected, err := service.BackfillAttachmentMetadata(ctx); err != nil || inspected != 1 {
+		t.Fatalf("inspected = %d, %v", inspected, err)
+	}
+	if inspected, err := service.BackfillAttachmentMetadata(ctx); err != nil || inspected != 0 {
+		t.Fatalf("second backfill inspected %d, %v", inspected, err)
+	}
+	backfilled, err := service.GetNote(ctx, note.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attachment = backfilled.Attachments[0]
+	if attachment.Width == nil || *attachment.Width != 80 || attachment.TakenAt == nil || attachment.MimeType != "image/jpeg" {
+		t.Fatalf("backfilled attachment = %+v", attachment)
+	}
+
+	// Encrypting a note drops what was read from its files, and decrypting
+	// it reads them again.
+	if err := service.SetupEncryption(ctx, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := service.SetEncrypted(ctx, note.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attachment := encrypted.Attachments[0]; attachment.Width != nil || attachment.TakenAt != nil {
+		t.Fatalf("encrypted attachment = %+v", attachment)
+	}
+	decrypted, err := service.SetEncrypted(ctx, note.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attachment := decrypted.Attachments[0]; attachment.Width == nil || *attachment.Height != 60 || attachment.TakenAt == nil {
+		t.Fatalf("decrypted attachment = %+v", attachment)
+	}
+}
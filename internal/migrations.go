@@ -1,76 +1,549 @@
 package internal
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"log"
 	"strings"
 )
 
-func MigrateDB(db *sql.DB) {
-	var err error
-	migrations := []string{
-		"ALTER TABLE messages ADD COLUMN is_archived INTEGER DEFAULT 0;",
-		"ALTER TABLE messages ADD COLUMN sort_order INTEGER DEFAULT 0; UPDATE messages SET sort_order = id WHERE sort_order = 0;",
-		"ALTER TABLE messages ADD COLUMN content_lower TEXT; UPDATE messages SET content_lower = LOWER(content) WHERE content_lower IS NULL; DROP INDEX IF EXISTS idx_messages_content_lower;",
-		"ALTER TABLE tags ADD COLUMN sort_order INTEGER DEFAULT 0; UPDATE tags SET sort_order = id WHERE sort_order = 0;",
-		"ALTER TABLE messages ADD COLUMN color TEXT DEFAULT '';",
-		"ALTER TABLE messages ADD COLUMN used_at DATETIME DEFAULT 0;",
-		"ALTER TABLE messages ADD COLUMN is_deleted INTEGER DEFAULT 0; CREATE INDEX IF NOT EXISTS idx_messages_is_deleted ON messages(is_deleted);",
-		"ALTER TABLE messages ADD COLUMN is_expanded INTEGER DEFAULT 0;",
-	}
-	for _, migration := range migrations {
-		_, err = db.Query(migration)
-		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
-			log.Printf("Migrate query error: %v", err)
+// migration is one numbered schema change. Each migration runs in its own
+// transaction and is recorded in schema_migrations, so it is applied exactly
+// once. Append new migrations at the end and never edit applied ones; db.sql
+// must describe the schema after the last migration.
+type migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{1, "base schema", migrateBaseSchema},
+	{2, "note revisions", execMigration(messageRevisionsSQL)},
+	{3, "full-text search index", migrateSearchIndex},
+	{4, "note links", migrateMessageLinks},
+	{5, "change log", execMigration(changesSQL)},
+	{6, "idempotency keys", execMigration(idempotencyKeysSQL)},
+	{7, "user accounts", execMigration(userAccountsSQL)},
+	{8, "attachment file lookup", execMigration(attachmentFilesSQL)},
+	{9, "access tokens", execMigration(apiTokensSQL)},
+	{10, "share links", execMigration(sharesSQL)},
+	{11, "encrypted notes", execMigration(encryptedNotesSQL)},
+	{12, "attachment blobs", execMigration(attachmentBlobsSQL)},
+	{13, "attachment metadata", execMigration(attachmentMetadataSQL)},
+	{14, "upload sessions", execMigration(uploadSessionsSQL)},
+	{15, "idempotency hashes", execMigration(idempotencyRequestHashSQL)},
+}
+
+// MigrationStatus describes a known migration. AppliedAt is empty while the
+// migration is pending.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt string
+}
+
+// MigrateDB applies all pending migrations in order and stops at the first
+// failure, leaving the database at the last successfully applied version.
+func MigrateDB(db *sql.DB) error {
+	ctx := context.Background()
+	statuses, err := MigrationStatuses(ctx, db)
+	if err != nil {
+		return err
+	}
+	for i, status := range statuses {
+		if status.AppliedAt != "" {
+			continue
+		}
+		if err := applyMigration(ctx, db, migrations[i]); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", status.Version, status.Name, err)
+		}
+		log.Printf("Applied migration %d: %s", status.Version, status.Name)
+	}
+	return nil
+}
+
+// MigrationStatuses lists every known migration with the time it was
+// applied. A database migrated by a newer goNotes is rejected, because this
+// binary does not know its schema.
+func MigrationStatuses(ctx context.Context, db *sql.DB) ([]MigrationStatus, error) {
+	if _, err := db.ExecContext(ctx, schemaMigrationsSQL); err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]string)
+	for rows.Next() {
+		var version int
+		var appliedAt string
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	latest := migrations[len(migrations)-1].Version
+	for version := range applied {
+		if version > latest {
+			return nil, fmt.Errorf("database schema version %d is newer than this goNotes supports (%d)", version, latest)
+		}
+	}
+	statuses := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		statuses[i] = MigrationStatus{Version: m.Version, Name: m.Name, AppliedAt: applied[m.Version]}
+	}
+	return statuses, nil
+}
+
+// applyMigration runs one migration on a dedicated connection with foreign
+// keys disabled, as SQLite requires for table rebuilds: dropping the old
+// table would otherwise cascade into attachments and tags.
+func applyMigration(ctx context.Context, db *sql.DB, m migration) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "PRAGMA foreign_keys = ON")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := m.Up(ctx, tx); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func execMigration(query string) func(context.Context, *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, query)
+		return err
+	}
+}
+
+// legacyMessageColumns lists the columns of messages at the base schema with
+// the value a rebuild uses when an older database lacks the column.
+var legacyMessageColumns = []struct {
+	Name     string
+	Fallback string
+}{
+	{"content", "NULL"},
+	{"content_lower", "LOWER(content)"},
+	{"updated_at", "CURRENT_TIMESTAMP"},
+	{"created_at", "CURRENT_TIMESTAMP"},
+	{"used_at", "CURRENT_TIMESTAMP"},
+	{"is_archived", "0"},
+	{"is_deleted", "0"},
+	{"is_expanded", "0"},
+	{"color", "''"},
+	{"sort_order", "id"},
+	{"version", "1"},
+}
+
+// migrateBaseSchema creates the schema goNotes had before versioned
+// migrations. Databases from that era may lack any of the columns added over
+// time, or still carry the old used_at default of 0; their messages table is
+// rebuilt with every column, keeping IDs so references stay valid.
+func migrateBaseSchema(ctx context.Context, tx *sql.Tx) error {
+	columns, err := tableColumns(ctx, tx, "messages")
+	if err != nil {
+		return err
+	}
+	if len(columns) > 0 {
+		rebuild := columns["used_at"] == "0" || columns["used_at"] == "'0'"
+		var selects []string
+		for _, column := range legacyMessageColumns {
+			_, exists := columns[column.Name]
+			switch {
+			case !exists:
+				rebuild = true
+				selects = append(selects, column.Fallback)
+			case column.Name == "content_lower":
+				selects = append(selects, "COALESCE(content_lower, LOWER(content))")
+			case column.Name == "used_at":
+				selects = append(selects, "CASE WHEN used_at IS NULL OR used_at = 0 OR used_at = '0' THEN CURRENT_TIMESTAMP ELSE used_at END")
+			default:
+				selects = append(selects, column.Name)
+			}
+		}
+		if rebuild {
+			names := make([]string, len(legacyMessageColumns))
+			for i, column := range legacyMessageColumns {
+				names[i] = column.Name
+			}
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf(messagesTableSQL, "messages_new")); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+				"INSERT INTO messages_new (id, %s) SELECT id, %s FROM messages",
+				strings.Join(names, ", "), strings.Join(selects, ", "),
+			)); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, "DROP TABLE messages; ALTER TABLE messages_new RENAME TO messages;"); err != nil {
+				return err
+			}
+			log.Println("Rebuilt the messages table from a legacy schema.")
+		}
+	}
+
+	tagColumns, err := tableColumns(ctx, tx, "tags")
+	if err != nil {
+		return err
+	}
+	if _, ok := tagColumns["sort_order"]; len(tagColumns) > 0 && !ok {
+		if _, err := tx.ExecContext(ctx,
+			"ALTER TABLE tags ADD COLUMN sort_order INTEGER DEFAULT 0; UPDATE tags SET sort_order = id;",
+		); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(messagesTableSQL, "IF NOT EXISTS messages")+baseSchemaSQL)
+	return err
+}
+
+// migrateSearchIndex creates the FTS5 index and fills it with notes written
+// before the index existed.
+func migrateSearchIndex(ctx context.Context, tx *sql.Tx) error {
+	exists, err := tableExists(ctx, tx, "messages_fts")
+	if err != nil || exists {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, searchIndexSQL); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO messages_fts (rowid, content)
+		SELECT id, COALESCE(content, '') FROM messages`)
+	if err != nil {
+		return err
+	}
+	if indexed, _ := res.RowsAffected(); indexed > 0 {
+		log.Printf("Indexed %d notes for full-text search.", indexed)
+	}
+	return nil
+}
+
+// migrateMessageLinks creates message_links and parses the links of notes
+// written before the table existed.
+func migrateMessageLinks(ctx context.Context, tx *sql.Tx) error {
+	exists, err := tableExists(ctx, tx, "message_links")
+	if err != nil || exists {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, messageLinksSQL); err != nil {
+		return err
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT id, COALESCE(content, '') FROM messages WHERE content LIKE '%[[%]]%'")
+	if err != nil {
+		return err
+	}
+	type noteContent struct {
+		id      int64
+		content string
+	}
+	var notes []noteContent
+	for rows.Next() {
+		var note noteContent
+		if err := rows.Scan(&note.id, &note.content); err != nil {
+			rows.Close()
+			return err
+		}
+		notes = append(notes, note)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	for _, note := range notes {
+		if err := syncMessageLinks(ctx, tx, 0, note.id, note.content); err != nil {
+			return err
 		}
 	}
+	if len(notes) > 0 {
+		log.Printf("Parsed note links in %d notes.", len(notes))
+	}
+	return nil
+}
+
+func tableExists(ctx context.Context, tx *sql.Tx, name string) (bool, error) {
+	var count int
+	err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", name).Scan(&count)
+	return count > 0, err
+}
 
-	var dfltValue sql.NullString
-	err = db.QueryRow("SELECT dflt_value FROM pragma_table_info('messages') WHERE name = 'used_at'").Scan(&dfltValue)
-
-	if err == nil && dfltValue.Valid && (dfltValue.String == "0" || dfltValue.String == "'0'") {
-		log.Println("Detected old default '0' for used_at. Recreating messages table...")
-
-		migrationSQL := `
-	PRAGMA foreign_keys=OFF;
-	BEGIN TRANSACTION;
-
-	CREATE TABLE messages_new (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		content TEXT,
-		content_lower TEXT,
-		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		used_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		is_archived INTEGER DEFAULT 0,
-		is_deleted INTEGER DEFAULT 0,
-		is_expanded INTEGER DEFAULT 0,
-		color TEXT DEFAULT '',
-		sort_order INTEGER DEFAULT 0
-	);
-
-	-- Переносим данные, исправляя 0 на текущее время
-	INSERT INTO messages_new (id, content, content_lower, updated_at, created_at, used_at, is_archived, is_deleted, is_expanded, color, sort_order)
-	SELECT id, content, content_lower, updated_at, created_at, 
-	       (CASE WHEN used_at = 0 OR used_at = '0' THEN CURRENT_TIMESTAMP ELSE used_at END), 
-	       is_archived, is_deleted, is_expanded, color, sort_order
-	FROM messages;
-
-	DROP TABLE messages;
-	ALTER TABLE messages_new RENAME TO messages;
-
-	-- Восстанавливаем индексы, так как они удалились вместе с таблицей
-	CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at DESC);
-	CREATE INDEX IF NOT EXISTS idx_messages_is_archived ON messages(is_archived);
-	CREATE INDEX IF NOT EXISTS idx_messages_is_deleted ON messages(is_deleted);
-	CREATE INDEX IF NOT EXISTS idx_messages_sort_order ON messages(sort_order DESC, id DESC);
-	CREATE INDEX IF NOT EXISTS idx_messages_content_lower_fast ON messages(content_lower);
-
-	COMMIT;
-	PRAGMA foreign_keys=ON;`
-		if _, err := db.Exec(migrationSQL); err != nil {
-			log.Fatalf("Table recreation failed: %v", err)
+// tableColumns maps the column names of a table to their default values. It
+// is empty when the table does not exist.
+func tableColumns(ctx context.Context, tx *sql.Tx, table string) (map[string]string, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT name, COALESCE(dflt_value, '') FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]string)
+	for rows.Next() {
+		var name, defaultValue string
+		if err := rows.Scan(&name, &defaultValue); err != nil {
+			return nil, err
 		}
-		log.Println("Messages table successfully recreated with CURRENT_TIMESTAMP default.")
+		columns[name] = defaultValue
 	}
+	return columns, rows.Err()
 }
+
+const schemaMigrationsSQL = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);`
+
+const messagesTableSQL = `
+CREATE TABLE %s (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    content TEXT,
+    content_lower TEXT,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    used_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    is_archived INTEGER DEFAULT 0,
+    is_deleted INTEGER DEFAULT 0,
+    is_expanded INTEGER DEFAULT 0,
+    color TEXT DEFAULT '',
+    sort_order INTEGER DEFAULT 0,
+    version INTEGER DEFAULT 1
+);`
+
+const baseSchemaSQL = `
+CREATE TABLE IF NOT EXISTS attachments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    message_id INTEGER NOT NULL,
+    file_path TEXT NOT NULL,
+    thumbnail_path TEXT DEFAULT '',
+    file_type TEXT,
+    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS tags (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT UNIQUE,
+    sort_order INTEGER DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS message_tags (
+    message_id INTEGER,
+    tag_id INTEGER,
+    PRIMARY KEY (message_id, tag_id),
+    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+    FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+);
+DROP INDEX IF EXISTS idx_messages_content_lower;
+CREATE INDEX IF NOT EXISTS idx_attachments_message_id ON attachments(message_id);
+CREATE INDEX IF NOT EXISTS idx_message_tags_tag_id ON message_tags(tag_id);
+CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_messages_is_archived ON messages(is_archived);
+CREATE INDEX IF NOT EXISTS idx_messages_is_deleted ON messages(is_deleted);
+CREATE INDEX IF NOT EXISTS idx_messages_sort_order ON messages(sort_order DESC, id DESC);
+CREATE INDEX IF NOT EXISTS idx_messages_content_lower_fast ON messages(content_lower);
+CREATE INDEX IF NOT EXISTS idx_tags_sort_order ON tags(sort_order DESC);`
+
+const messageRevisionsSQL = `
+CREATE TABLE IF NOT EXISTS message_revisions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    message_id INTEGER NOT NULL,
+    content TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_message_revisions_message_id ON message_revisions(message_id, id DESC);`
+
+const searchIndexSQL = `CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(content, tokenize = 'unicode61 remove_diacritics 2');`
+
+const messageLinksSQL = `
+CREATE TABLE IF NOT EXISTS message_links (
+    message_id INTEGER NOT NULL,
+    target_id INTEGER NOT NULL,
+    PRIMARY KEY (message_id, target_id),
+    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+    FOREIGN KEY (target_id) REFERENCES messages(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_message_links_target_id ON message_links(target_id);`
+
+const changesSQL = `
+CREATE TABLE IF NOT EXISTS changes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    action TEXT NOT NULL,
+    note_id INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);`
+
+const idempotencyKeysSQL = `
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key TEXT PRIMARY KEY,
+    action TEXT NOT NULL,
+    note_id INTEGER NOT NULL DEFAULT 0,
+    processed INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);`
+
+// userAccountsSQL adds accounts and gives every note, tag, change and
+// idempotency key an owner. Existing data belongs to user 1, the account
+// that CreateUser creates first.
+const userAccountsSQL = `
+CREATE TABLE users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+    password_hash TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE sessions (
+    token_hash TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    expires_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX idx_sessions_user_id ON sessions(user_id);
+
+ALTER TABLE messages ADD COLUMN owner_id INTEGER NOT NULL DEFAULT 1;
+CREATE INDEX idx_messages_owner_id ON messages(owner_id);
+ALTER TABLE changes ADD COLUMN owner_id INTEGER NOT NULL DEFAULT 1;
+
+CREATE TABLE tags_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    owner_id INTEGER NOT NULL DEFAULT 1,
+    name TEXT,
+    sort_order INTEGER DEFAULT 0,
+    UNIQUE (owner_id, name)
+);
+INSERT INTO tags_new (id, name, sort_order) SELECT id, name, sort_order FROM tags;
+DROP TABLE tags;
+ALTER TABLE tags_new RENAME TO tags;
+CREATE INDEX idx_tags_sort_order ON tags(sort_order DESC);
+
+CREATE TABLE idempotency_keys_new (
+    owner_id INTEGER NOT NULL DEFAULT 1,
+    key TEXT NOT NULL,
+    action TEXT NOT NULL,
+    note_id INTEGER NOT NULL DEFAULT 0,
+    processed INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (owner_id, key)
+);
+INSERT INTO idempotency_keys_new (key, action, note_id, processed, created_at)
+SELECT key, action, note_id, processed, created_at FROM idempotency_keys;
+DROP TABLE idempotency_keys;
+ALTER TABLE idempotency_keys_new RENAME TO idempotency_keys;`
+
+// attachmentFilesSQL lets /files/ find the note behind a stored file to check
+// its owner.
+const attachmentFilesSQL = `
+CREATE INDEX idx_attachments_file_path ON attachments(file_path);
+CREATE INDEX idx_attachments_thumbnail_path ON attachments(thumbnail_path);`
+
+const apiTokensSQL = `
+CREATE TABLE api_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    owner_id INTEGER NOT NULL DEFAULT 1,
+    name TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    scope TEXT NOT NULL DEFAULT 'read',
+    tags TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    expires_at DATETIME,
+    last_used_at DATETIME,
+    UNIQUE (owner_id, name)
+);`
+
+const sharesSQL = `
+CREATE TABLE shares (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    message_id INTEGER NOT NULL,
+    token TEXT NOT NULL UNIQUE,
+    password_hash TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    expires_at DATETIME,
+    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+);
+CREATE INDEX idx_shares_message_id ON shares(message_id);`
+
+// encryptedNotesSQL also makes the search index overwrite deleted entries, so
+// the words of a note do not linger in it after the note is encrypted.
+const encryptedNotesSQL = `
+ALTER TABLE messages ADD COLUMN is_encrypted INTEGER NOT NULL DEFAULT 0;
+CREATE TABLE note_keys (
+    owner_id INTEGER PRIMARY KEY,
+    salt TEXT NOT NULL,
+    iterations INTEGER NOT NULL,
+    wrapped_key TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO messages_fts (messages_fts, rank) VALUES ('secure-delete', 1);`
+
+// attachmentBlobsSQL adds the content-addressed blob store. Existing files
+// keep blob_hash NULL until MigrateLegacyUploads hashes them, since
+// migrations cannot read the uploads directory.
+const attachmentBlobsSQL = `
+CREATE TABLE blobs (
+    hash TEXT PRIMARY KEY,
+    size INTEGER NOT NULL,
+    ref_count INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+ALTER TABLE attachments ADD COLUMN blob_hash TEXT;
+ALTER TABLE attachments ADD COLUMN thumbnail_hash TEXT;
+ALTER TABLE attachments ADD COLUMN original_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE attachments ADD COLUMN size INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE attachments ADD COLUMN mime_type TEXT NOT NULL DEFAULT '';
+UPDATE attachments SET original_name = substr(file_path, instr(file_path, '_') + 1);
+CREATE INDEX idx_attachments_blob_hash ON attachments(blob_hash);
+CREATE TRIGGER attachments_blobs_insert AFTER INSERT ON attachments BEGIN
+    UPDATE blobs SET ref_count = ref_count + 1 WHERE hash IN (NEW.blob_hash, NEW.thumbnail_hash);
+END;
+CREATE TRIGGER attachments_blobs_delete AFTER DELETE ON attachments BEGIN
+    UPDATE blobs SET ref_count = ref_count - 1 WHERE hash IN (OLD.blob_hash, OLD.thumbnail_hash);
+END;
+CREATE TRIGGER attachments_blobs_update AFTER UPDATE OF blob_hash, thumbnail_hash ON attachments BEGIN
+    UPDATE blobs SET ref_count = ref_count - 1 WHERE hash IN (OLD.blob_hash, OLD.thumbnail_hash);
+    UPDATE blobs SET ref_count = ref_count + 1 WHERE hash IN (NEW.blob_hash, NEW.thumbnail_hash);
+END;`
+
+// attachmentMetadataSQL adds what is read from the content of attachments.
+// Existing rows keep inspected 0 until BackfillAttachmentMetadata reads
+// their files, since migrations cannot read the storage.
+const attachmentMetadataSQL = `
+ALTER TABLE attachments ADD COLUMN width INTEGER;
+ALTER TABLE attachments ADD COLUMN height INTEGER;
+ALTER TABLE attachments ADD COLUMN taken_at TEXT;
+ALTER TABLE attachments ADD COLUMN duration REAL;
+ALTER TABLE attachments ADD COLUMN inspected INTEGER NOT NULL DEFAULT 0;`
+
+const uploadSessionsSQL = `
+CREATE TABLE upload_sessions (
+    id TEXT PRIMARY KEY,
+    owner_id INTEGER NOT NULL DEFAULT 1,
+    filename TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    received INTEGER NOT NULL DEFAULT 0,
+    parts INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);`
+
+// idempotencyRequestHashSQL keeps a hash of the payload a key was used with.
+// Keys stored earlier keep an empty hash and are matched by action only.
+const idempotencyRequestHashSQL = `
+ALTER TABLE idempotency_keys ADD COLUMN request_hash TEXT NOT NULL DEFAULT '';`
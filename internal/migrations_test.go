@@ -0,0 +1,252 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// legacySchemas recreates the schemas older goNotes releases left behind,
+// from the first release to the last one before versioned migrations. Each
+// stage adds what the release added on top of the previous one.
+var legacySchemas = []struct {
+	name    string
+	upgrade string
+}{
+	{"original", `
+CREATE TABLE messages (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    content TEXT,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE attachments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    message_id INTEGER NOT NULL,
+    file_path TEXT NOT NULL,
+    thumbnail_path TEXT DEFAULT '',
+    file_type TEXT,
+    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+);
+CREATE TABLE tags (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT UNIQUE);
+CREATE TABLE message_tags (
+    message_id INTEGER,
+    tag_id INTEGER,
+    PRIMARY KEY (message_id, tag_id),
+    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+    FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+);`},
+	{"archive", `ALTER TABLE messages ADD COLUMN is_archived INTEGER DEFAULT 0;`},
+	{"manual order", `ALTER TABLE messages ADD COLUMN sort_order INTEGER DEFAULT 0; UPDATE messages SET sort_order = id;`},
+	{"search column", `
+ALTER TABLE messages ADD COLUMN content_lower TEXT;
+UPDATE messages SET content_lower = LOWER(content);
+CREATE INDEX idx_messages_content_lower ON messages(content_lower);`},
+	{"tag order", `ALTER TABLE tags ADD COLUMN sort_order INTEGER DEFAULT 0; UPDATE tags SET sort_order = id;`},
+	{"colors", `ALTER TABLE messages ADD COLUMN color TEXT DEFAULT '';`},
+	{"used_at zero default", `ALTER TABLE messages ADD COLUMN used_at DATETIME DEFAULT 0;`},
+	{"trash", `ALTER TABLE messages ADD COLUMN is_deleted INTEGER DEFAULT 0;`},
+	{"expanded", `ALTER TABLE messages ADD COLUMN is_expanded INTEGER DEFAULT 0;`},
+	{"used_at rebuilt", `
+PRAGMA foreign_keys = OFF;
+CREATE TABLE messages_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    content TEXT,
+    content_lower TEXT,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    used_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    is_archived INTEGER DEFAULT 0,
+    is_deleted INTEGER DEFAULT 0,
+    is_expanded INTEGER DEFAULT 0,
+    color TEXT DEFAULT '',
+    sort_order INTEGER DEFAULT 0
+);
+INSERT INTO messages_new (id, content, content_lower, updated_at, created_at, used_at, is_archived, is_deleted, is_expanded, color, sort_order)
+SELECT id, content, content_lower, updated_at, created_at, CASE WHEN used_at = 0 THEN created_at ELSE used_at END, is_archived, is_deleted, is_expanded, color, sort_order FROM messages;
+DROP TABLE messages;
+ALTER TABLE messages_new RENAME TO messages;
+PRAGMA foreign_keys = ON;
+DROP INDEX IF EXISTS idx_messages_content_lower;
+CREATE INDEX idx_attachments_message_id ON attachments(message_id);
+CREATE INDEX idx_message_tags_tag_id ON message_tags(tag_id);
+CREATE INDEX idx_messages_created_at ON messages(created_at DESC);
+CREATE INDEX idx_messages_is_archived ON messages(is_archived);
+CREATE INDEX idx_messages_is_deleted ON messages(is_deleted);
+CREATE INDEX idx_messages_sort_order ON messages(sort_order DESC, id DESC);
+CREATE INDEX idx_messages_content_lower_fast ON messages(content_lower);
+CREATE INDEX idx_tags_sort_order ON tags(sort_order DESC);`},
+	{"revisions, links, search index and change log", `
+ALTER TABLE messages ADD COLUMN version INTEGER DEFAULT 1;
+` + messageRevisionsSQL + messageLinksSQL + searchIndexSQL + changesSQL + `
+INSERT INTO messages_fts (rowid, content) SELECT id, COALESCE(content, '') FROM messages;`},
+	{"idempotency keys", idempotencyKeysSQL},
+}
+
+func openMigrationTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	database, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "notes.db")+"?_pragma=foreign_keys(ON)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = database.Close() })
+	return database
+}
+
+// schemaSnapshot describes every table and index with its columns, so two
+// databases can be compared regardless of the order columns were added in.
+func schemaSnapshot(t *testing.T, database *sql.DB) string {
+	t.Helper()
+	rows, err := database.Query(`
+		SELECT type, name, tbl_name FROM sqlite_master
+		WHERE name NOT LIKE 'sqlite_%' AND name != 'schema_migrations'
+		ORDER BY type, name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type object struct{ kind, name, table string }
+	var objects []object
+	for rows.Next() {
+		var o object
+		if err := rows.Scan(&o.kind, &o.name, &o.table); err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, o)
+	}
+	rows.Close()
+
+	var b strings.Builder
+	for _, o := range objects {
+		fmt.Fprintf(&b, "%s %s on %s\n", o.kind, o.name, o.table)
+		if o.kind != "table" {
+			continue
+		}
+		columns, err := database.Query(`
+			SELECT name, type, "notnull", COALESCE(dflt_value, ''), pk
+			FROM pragma_table_info(?) ORDER BY name`, o.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for columns.Next() {
+			var name, kind, defaultValue string
+			var notNull, pk int
+			if err := columns.Scan(&name, &kind, &notNull, &defaultValue, &pk); err != nil {
+				t.Fatal(err)
+			}
+			fmt.Fprintf(&b, "  %s %s notnull=%d default=%s pk=%d\n", name, kind, notNull, defaultValue, pk)
+		}
+		columns.Close()
+	}
+	return b.String()
+}
+
+func TestMigrationsMatchReferenceSchema(t *testing.T) {
+	schema, err := os.ReadFile("../db.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reference := openMigrationTestDB(t)
+	if _, err := reference.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	migrated := openMigrationTestDB(t)
+	if err := MigrateDB(migrated); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := schemaSnapshot(t, reference), schemaSnapshot(t, migrated); got != want {
+		t.Fatalf("migrated schema differs from db.sql\nmigrated:\n%s\ndb.sql:\n%s", got, want)
+	}
+}
+
+func TestMigrateDBUpgradesLegacySchemas(t *testing.T) {
+	fresh := openMigrationTestDB(t)
+	if err := MigrateDB(fresh); err != nil {
+		t.Fatal(err)
+	}
+	want := schemaSnapshot(t, fresh)
+
+	for stage := range legacySchemas {
+		t.Run(legacySchemas[stage].name, func(t *testing.T) {
+			ctx := context.Background()
+			database := openMigrationTestDB(t)
+			// Data is written at the original schema so every later stage
+			// upgrades it the way the release did.
+			for i, schema := range legacySchemas[:stage+1] {
+				if _, err := database.Exec(schema.upgrade); err != nil {
+					t.Fatalf("%s: %v", schema.name, err)
+				}
+				if i > 0 {
+					continue
+				}
+				if _, err := database.Exec(`
+					INSERT INTO messages (content) VALUES ('Legacy groceries #Home'), ('Second note');
+					INSERT INTO tags (name) VALUES ('home');
+					INSERT INTO message_tags (message_id, tag_id) VALUES (1, 1);
+					INSERT INTO attachments (message_id, file_path, file_type) VALUES (1, 'a_list.txt', 'file');`); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := MigrateDB(database); err != nil {
+				t.Fatal(err)
+			}
+			if got := schemaSnapshot(t, database); got != want {
+				t.Fatalf("upgraded schema differs from a fresh one\nupgraded:\n%s\nfresh:\n%s", got, want)
+			}
+
+			service := NewNotesService(database, t.TempDir())
+			note, err := service.GetNote(ctx, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if note.Content != "Legacy groceries #Home" || len(note.Attachments) != 1 || len(note.Tags) != 1 || note.Tags[0] != "home" {
+				t.Fatalf("note not preserved: %+v", note)
+			}
+			found, err := service.ListNotes(ctx, ListNotesOptions{Query: "groceries"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(found.Notes) != 1 || found.Notes[0].ID != 1 {
+				t.Fatalf("search after upgrade = %+v", found.Notes)
+			}
+			var badUsedAt int
+			if err := database.QueryRow("SELECT COUNT(*) FROM messages WHERE used_at IS NULL OR used_at = 0").Scan(&badUsedAt); err != nil {
+				t.Fatal(err)
+			}
+			if badUsedAt != 0 {
+				t.Fatalf("%d notes without used_at", badUsedAt)
+			}
+
+			if err := MigrateDB(database); err != nil {
+				t.Fatal(err)
+			}
+			statuses, err := MigrationStatuses(ctx, database)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, status := range statuses {
+				if status.AppliedAt == "" {
+					t.Fatalf("migration %d still pending", status.Version)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateDBRejectsNewerSchema(t *testing.T) {
+	database := openMigrationTestDB(t)
+	if err := MigrateDB(database); err != nil {
+		t.Fatal(err)
+	}
+	next := migrations[len(migrations)-1].Version + 1
+	if _, err := database.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, 'from the future')", next); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateDB(database); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Fatalf("MigrateDB error = %v, want a newer schema error", err)
+	}
+}
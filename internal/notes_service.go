@@ -8,18 +8,39 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 )
 
 const maxIntegrationAttachmentBytes = 32 << 20
 
+// DatabasePragmas are the connection parameters of notes.db. busy_timeout
+// makes a writer wait for another one to commit instead of failing with
+// SQLITE_BUSY.
+const DatabasePragmas = "_pragma=journal_mode(WAL)&_pragma=foreign_keys(ON)&_pragma=secure_delete(ON)&_pragma=busy_timeout(5000)"
+
+const noteColumns = `id, COALESCE(content, ''), created_at, updated_at, used_at,
+	is_archived, is_deleted, is_expanded, sort_order, color, version, is_encrypted`
+
 // NotesService exposes the notes domain without depending on an HTTP contract.
 // It lets integrations such as the remote MCP endpoint share the running app's
 // database and attachment storage.
 type NotesService struct {
-	DB         *sql.DB
+	DB *sql.DB
+	// UploadsDir holds the uploads key and the files being stored; Storage
+	// keeps the stored files, by default in UploadsDir too.
 	UploadsDir string
+	Storage    Storage
+	// Events receives every committed change; it may be nil.
+	Events *EventBus
+	// UploadsKey encrypts stored files at rest; it may be nil.
+	UploadsKey *UploadsKey
+	// MaxUploadSize bounds the size of resumable uploads; 0 allows any size.
+	MaxUploadSize int64
+
+	keys    keyring
+	backups backupState
 }
 
 type ListNotesOptions struct {
@@ -31,11 +52,36 @@ type ListNotesOptions struct {
 	BeforeSortOrder int
 	BeforeArchived  int
 	GroupByArchived bool
+	// LinksTo limits results to notes containing a link to this note ID.
+	LinksTo int64
+	// Sort is SortRecent (the default) or SortRelevance. Relevance ordering
+	// ranks full-text matches with bm25 and pages with Offset instead of the
+	// sort_order cursor.
+	Sort   string
+	Offset int
+	// Snippets replaces each note's content with excerpts around the query
+	// matches so long notes are not transferred in full.
+	Snippets bool
 }
 
 type ListNotesResult struct {
 	Notes         []MessageDTO `json:"notes"`
 	NextSortOrder *int         `json:"next_sort_order,omitempty"`
+	NextOffset    *int         `json:"next_offset,omitempty"`
+}
+
+// CreateNoteOptions describes a new note. A non-empty IdempotencyKey makes
+// retries of the same request return the originally created note.
+type CreateNoteOptions struct {
+	Content        string
+	Attachments    []NewAttachment
+	IdempotencyKey string
+	// Importers use the fields below to keep the original metadata. Zero
+	// timestamps mean now.
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Color     string
+	Archived  bool
 }
 
 type UpdateNoteOptions struct {
@@ -43,42 +89,207 @@ type UpdateNoteOptions struct {
 	AppendContent       string
 	Attachments         []NewAttachment
 	DeleteAttachmentIDs []int64
+	// ExpectedVersion rejects the update with a *ConflictError when the note
+	// was changed since the client read it. Zero skips the check.
+	ExpectedVersion int64
+	// IdempotencyKey makes a replayed update return the current note instead
+	// of applying the change again.
+	IdempotencyKey string
+}
+
+// ConflictError reports an update based on a stale note version. Note holds
+// the current server state so the client can merge its changes.
+type ConflictError struct {
+	ExpectedVersion int64
+	Note            MessageDTO
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("note %d was changed by another client: current version is %d, expected %d",
+		e.Note.ID, e.Note.Version, e.ExpectedVersion)
 }
 
 type NewAttachment struct {
 	Filename string
 	Data     []byte
 	Open     func() (io.ReadCloser, error)
+	// Ref, when set, is replaced in the content of a new note with the
+	// attachment's /files/ URL once the file is stored, so imported links to
+	// embedded files keep working.
+	Ref string
+	// Upload, when set, is the ID of a finished upload session whose file
+	// and name are attached instead of Filename and Data.
+	Upload string
 }
 
 func (s *NotesService) GetAttachment(ctx context.Context, noteID, attachmentID int64) (AttachmentDTO, []byte, error) {
+	attachment, file, err := s.openAttachment(ctx, noteID, attachmentID)
+	if err != nil {
+		return AttachmentDTO{}, nil, err
+	}
+	defer file.Close()
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return AttachmentDTO{}, nil, err
+	}
+	if size > maxIntegrationAttachmentBytes {
+		return AttachmentDTO{}, nil, fmt.Errorf("attachment exceeds the %d MiB integration limit; read it in chunks", maxIntegrationAttachmentBytes>>20)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return AttachmentDTO{}, nil, err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return AttachmentDTO{}, nil, err
+	}
+	return attachment, data, nil
+}
+
+// AttachmentChunk is a part of an attachment starting at Offset. Size is the
+// length of the whole file, so the chunk is the last one when Offset plus
+// the length of Data reaches it.
+type AttachmentChunk struct {
+	Attachment AttachmentDTO
+	Offset     int64
+	Size       int64
+	Data       []byte
+}
+
+// ReadAttachmentChunk reads up to length bytes of an attachment from offset,
+// at most maxIntegrationAttachmentBytes, so files of any size can be read
+// without loading them whole.
+func (s *NotesService) ReadAttachmentChunk(ctx context.Context, noteID, attachmentID, offset, length int64) (AttachmentChunk, error) {
+	if offset < 0 || length <= 0 {
+		return AttachmentChunk{}, errors.New("offset must not be negative and length must be positive")
+	}
+	attachment, file, err := s.openAttachment(ctx, noteID, attachmentID)
+	if err != nil {
+		return AttachmentChunk{}, err
+	}
+	defer file.Close()
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return AttachmentChunk{}, err
+	}
+	if offset > size {
+		return AttachmentChunk{}, fmt.Errorf("offset %d is past the end of the %d byte attachment", offset, size)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return AttachmentChunk{}, err
+	}
+	data := make([]byte, min(length, maxIntegrationAttachmentBytes, size-offset))
+	if _, err := io.ReadFull(file, data); err != nil {
+		return AttachmentChunk{}, err
+	}
+	return AttachmentChunk{Attachment: attachment, Offset: offset, Size: size, Data: data}, nil
+}
+
+// openAttachment opens the plaintext of an attachment of the calling user.
+func (s *NotesService) openAttachment(ctx context.Context, noteID, attachmentID int64) (AttachmentDTO, StoredFile, error) {
 	if noteID <= 0 || attachmentID <= 0 {
-		return AttachmentDTO{}, nil, errors.New("note id and attachment id must be positive")
+		return AttachmentDTO{}, StoredFile{}, errors.New("note id and attachment id must be positive")
 	}
 	var attachment AttachmentDTO
+	var encrypted bool
+	filter, filterArgs := noteFilter(ctx, "m.")
 	err := s.DB.QueryRowContext(ctx, `
-		SELECT id, file_path, thumbnail_path, file_type
-		FROM attachments WHERE id = ? AND message_id = ?`, attachmentID, noteID).Scan(
-		&attachment.ID, &attachment.FilePath, &attachment.ThumbnailPath, &attachment.FileType,
+		SELECT m.is_encrypted, `+attachmentColumns+`
+		FROM attachments a JOIN messages m ON m.id = a.message_id
+		WHERE a.id = ? AND a.message_id = ? AND `+filter, append([]any{attachmentID, noteID}, filterArgs...)...).Scan(
+		scanAttachment(&attachment, &encrypted)...,
 	)
 	if errors.Is(err, sql.ErrNoRows) {
-		return AttachmentDTO{}, nil, fmt.Errorf("attachment %d not found on note %d", attachmentID, noteID)
+		return AttachmentDTO{}, StoredFile{}, fmt.Errorf("attachment %d not found on note %d", attachmentID, noteID)
 	}
 	if err != nil {
-		return AttachmentDTO{}, nil, err
+		return AttachmentDTO{}, StoredFile{}, err
 	}
-	data, err := os.ReadFile(filepath.Join(s.UploadsDir, filepath.Base(attachment.FilePath)))
+	file, err := s.openStoredFile(ctx, attachment.storedFile, encrypted)
 	if err != nil {
-		return AttachmentDTO{}, nil, err
+		return AttachmentDTO{}, StoredFile{}, fmt.Errorf("attachment %d: %w", attachmentID, err)
+	}
+	return attachment, file, nil
+}
+
+// OwnsFile reports whether a stored upload, an attachment or its preview,
+// belongs to a note of the calling user.
+func (s *NotesService) OwnsFile(ctx context.Context, name string) (bool, error) {
+	var owned bool
+	filter, filterArgs := noteFilter(ctx, "m.")
+	err := s.DB.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM attachments a JOIN messages m ON m.id = a.message_id
+			WHERE (a.file_path = ? OR a.thumbnail_path = ?) AND `+filter+`
+		)`, append([]any{name, name}, filterArgs...)...).Scan(&owned)
+	return owned, err
+}
+
+// StoredFile is an opened upload. Files of encrypted notes are decrypted as
+// they are read and must not be cached by the client.
+type StoredFile struct {
+	io.ReadSeekCloser
+	ModTime   time.Time
+	Encrypted bool
+}
+
+// OpenFile opens a stored upload of the calling user, decrypting it when it
+// belongs to an encrypted note. Files of other users are reported as missing.
+func (s *NotesService) OpenFile(ctx context.Context, name string) (StoredFile, error) {
+	var encrypted bool
+	var stored string
+	filter, filterArgs := noteFilter(ctx, "m.")
+	err := s.DB.QueryRowContext(ctx, `
+		SELECT m.is_encrypted, CASE WHEN a.file_path = ? THEN COALESCE(a.blob_hash, a.file_path)
+			ELSE COALESCE(a.thumbnail_hash, a.thumbnail_path) END
+		FROM attachments a JOIN messages m ON m.id = a.message_id
+		WHERE (a.file_path = ? OR a.thumbnail_path = ?) AND `+filter+`
+		LIMIT 1`, append([]any{name, name, name}, filterArgs...)...).Scan(&encrypted, &stored)
+	if errors.Is(err, sql.ErrNoRows) {
+		return StoredFile{}, os.ErrNotExist
 	}
-	if len(data) > maxIntegrationAttachmentBytes {
-		return AttachmentDTO{}, nil, fmt.Errorf("attachment exceeds the %d MiB integration limit", maxIntegrationAttachmentBytes>>20)
+	if err != nil {
+		return StoredFile{}, err
 	}
-	return attachment, data, nil
+	file, err := s.openStoredFile(ctx, stored, encrypted)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return StoredFile{}, fmt.Errorf("file %s: %w", name, err)
+	}
+	return file, err
+}
+
+// openStoredFile opens a stored upload, decrypting it when it belongs to an
+// encrypted note.
+func (s *NotesService) openStoredFile(ctx context.Context, stored string, encrypted bool) (StoredFile, error) {
+	file, err := s.openUpload(ctx, stored)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	if !encrypted {
+		return file, nil
+	}
+	key, err := s.noteKey(ctx)
+	if err != nil {
+		file.Close()
+		return StoredFile{}, err
+	}
+	reader, err := openEncryptedFile(key, file)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	return StoredFile{ReadSeekCloser: reader, ModTime: file.ModTime, Encrypted: true}, nil
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
 }
 
+func (nopSeekCloser) Close() error { return nil }
+
 func NewNotesService(database *sql.DB, uploadsDir string) *NotesService {
-	return &NotesService{DB: database, UploadsDir: uploadsDir}
+	return &NotesService{
+		DB: database, UploadsDir: uploadsDir, Storage: NewLocalStorage(uploadsDir), Events: NewEventBus(),
+		MaxUploadSize: defaultMaxUploadSize,
+	}
 }
 
 func (s *NotesService) ListNotes(ctx context.Context, opts ListNotesOptions) (ListNotesResult, error) {
@@ -86,8 +297,8 @@ func (s *NotesService) ListNotes(ctx context.Context, opts ListNotesOptions) (Li
 		opts.Limit = 20
 	}
 
-	var clauses []string
-	var args []any
+	filter, args := noteFilter(ctx, "")
+	clauses := []string{filter}
 	state := opts.State
 	if state == "" {
 		state = "active"
@@ -111,10 +322,28 @@ func (s *NotesService) ListNotes(ctx context.Context, opts ListNotesOptions) (Li
 		clauses = append(clauses, "id = ?")
 		args = append(args, opts.ID)
 	}
+	if opts.LinksTo > 0 {
+		clauses = append(clauses, "id IN (SELECT message_id FROM message_links WHERE target_id = ?)")
+		args = append(args, opts.LinksTo)
+	}
 
-	for _, word := range strings.Fields(strings.TrimSpace(opts.Query)) {
-		clauses = append(clauses, "content_lower LIKE ?")
-		args = append(args, "%"+strings.ToLower(word)+"%")
+	sortMode := opts.Sort
+	if sortMode == "" {
+		sortMode = SortRecent
+	}
+	if sortMode != SortRecent && sortMode != SortRelevance {
+		return ListNotesResult{}, fmt.Errorf("invalid sort %q: use recent or relevance", opts.Sort)
+	}
+	search := parseSearchQuery(opts.Query)
+	includeMatch := search.includeMatch()
+	ranked := sortMode == SortRelevance && includeMatch != ""
+	if includeMatch != "" && !ranked {
+		clauses = append(clauses, "id IN (SELECT rowid FROM messages_fts WHERE messages_fts MATCH ?)")
+		args = append(args, includeMatch)
+	}
+	if excludeMatch := search.excludeMatch(); excludeMatch != "" {
+		clauses = append(clauses, "id NOT IN (SELECT rowid FROM messages_fts WHERE messages_fts MATCH ?)")
+		args = append(args, excludeMatch)
 	}
 
 	if len(opts.Tags) > 0 {
@@ -137,7 +366,7 @@ func (s *NotesService) ListNotes(ctx context.Context, opts ListNotesOptions) (Li
 		}
 	}
 
-	if opts.BeforeSortOrder > 0 {
+	if opts.BeforeSortOrder > 0 && !ranked {
 		if opts.GroupByArchived {
 			clauses = append(clauses, "(is_archived > ? OR (is_archived = ? AND sort_order < ?))")
 			args = append(args, opts.BeforeArchived, opts.BeforeArchived, opts.BeforeSortOrder)
@@ -147,18 +376,30 @@ func (s *NotesService) ListNotes(ctx context.Context, opts ListNotesOptions) (Li
 		}
 	}
 
-	args = append(args, opts.Limit+1)
+	fromSQL := "messages"
 	orderSQL := "sort_order DESC, id DESC"
+	if ranked {
+		fromSQL = `messages JOIN (
+			SELECT rowid AS search_id, bm25(messages_fts) AS search_rank
+			FROM messages_fts WHERE messages_fts MATCH ?
+		) ON search_id = id`
+		args = append([]any{includeMatch}, args...)
+		orderSQL = "search_rank ASC, " + orderSQL
+	}
 	if opts.GroupByArchived {
-		orderSQL = "is_archived ASC, sort_order DESC, id DESC"
+		orderSQL = "is_archived ASC, " + orderSQL
 	}
+	offset := 0
+	if ranked && opts.Offset > 0 {
+		offset = opts.Offset
+	}
+	args = append(args, opts.Limit+1, offset)
 	query := fmt.Sprintf(`
-		SELECT id, COALESCE(content, ''), created_at, updated_at, used_at,
-		       is_archived, is_deleted, is_expanded, sort_order, color
-		FROM messages
+		SELECT %s
+		FROM %s
 		WHERE %s
 		ORDER BY %s
-		LIMIT ?`, strings.Join(clauses, " AND "), orderSQL)
+		LIMIT ? OFFSET ?`, noteColumns, fromSQL, strings.Join(clauses, " AND "), orderSQL)
 
 	rows, err := s.DB.QueryContext(ctx, query, args...)
 	if err != nil {
@@ -170,14 +411,13 @@ func (s *NotesService) ListNotes(ctx context.Context, opts ListNotesOptions) (Li
 	ids := make([]int64, 0, opts.Limit)
 	for rows.Next() {
 		var note MessageDTO
-		if err := rows.Scan(
-			&note.ID, &note.Content, &note.CreatedAt, &note.UpdatedAt, &note.UsedAt,
-			&note.IsArchived, &note.IsDeleted, &note.IsExpanded, &note.SortOrder, &note.Color,
-		); err != nil {
+		if err := scanNote(rows, &note); err != nil {
 			return ListNotesResult{}, err
 		}
 		note.Tags = []string{}
 		note.Attachments = []AttachmentDTO{}
+		note.Links = []int64{}
+		note.Backlinks = []int64{}
 		notes = append(notes, note)
 		ids = append(ids, note.ID)
 	}
@@ -185,18 +425,34 @@ func (s *NotesService) ListNotes(ctx context.Context, opts ListNotesOptions) (Li
 		return ListNotesResult{}, err
 	}
 
-	var next *int
+	var result ListNotesResult
 	if len(notes) > opts.Limit {
-		nextValue := notes[opts.Limit-1].SortOrder
-		next = &nextValue
+		if ranked {
+			nextOffset := offset + opts.Limit
+			result.NextOffset = &nextOffset
+		} else {
+			nextValue := notes[opts.Limit-1].SortOrder
+			result.NextSortOrder = &nextValue
+		}
 		notes = notes[:opts.Limit]
 		ids = ids[:opts.Limit]
 	}
 	if err := s.populateRelations(ctx, notes, ids); err != nil {
 		return ListNotesResult{}, err
 	}
+	s.revealNotes(ctx, notes)
+	if opts.Snippets {
+		for i := range notes {
+			if notes[i].Locked {
+				continue
+			}
+			notes[i].Snippets = buildSnippets(notes[i].Content, search)
+			notes[i].Content = ""
+		}
+	}
 
-	return ListNotesResult{Notes: notes, NextSortOrder: next}, nil
+	result.Notes = notes
+	return result, nil
 }
 
 func (s *NotesService) GetNote(ctx context.Context, id int64) (MessageDTO, error) {
@@ -204,13 +460,10 @@ func (s *NotesService) GetNote(ctx context.Context, id int64) (MessageDTO, error
 		return MessageDTO{}, errors.New("note id must be positive")
 	}
 	var note MessageDTO
-	err := s.DB.QueryRowContext(ctx, `
-		SELECT id, COALESCE(content, ''), created_at, updated_at, used_at,
-		       is_archived, is_deleted, is_expanded, sort_order, color
-		FROM messages WHERE id = ?`, id).Scan(
-		&note.ID, &note.Content, &note.CreatedAt, &note.UpdatedAt, &note.UsedAt,
-		&note.IsArchived, &note.IsDeleted, &note.IsExpanded, &note.SortOrder, &note.Color,
-	)
+	filter, filterArgs := noteFilter(ctx, "")
+	err := scanNote(s.DB.QueryRowContext(ctx,
+		"SELECT "+noteColumns+" FROM messages WHERE id = ? AND "+filter, append([]any{id}, filterArgs...)...,
+	), &note)
 	if errors.Is(err, sql.ErrNoRows) {
 		return MessageDTO{}, fmt.Errorf("note %d not found", id)
 	}
@@ -219,6 +472,17 @@ func (s *NotesService) GetNote(ctx context.Context, id int64) (MessageDTO, error
 	}
 	note.Tags = []string{}
 	note.Attachments = []AttachmentDTO{}
+	note.Links = []int64{}
+	note.Backlinks = []int64{}
+	if note.IsEncrypted != 0 {
+		key, err := s.noteKey(ctx)
+		if err != nil {
+			return MessageDTO{}, fmt.Errorf("note %d: %w", id, err)
+		}
+		if note.Content, err = decryptContent(key, note.Content); err != nil {
+			return MessageDTO{}, fmt.Errorf("note %d: %w", id, err)
+		}
+	}
 	notes := []MessageDTO{note}
 	if err := s.populateRelations(ctx, notes, []int64{id}); err != nil {
 		return MessageDTO{}, err
@@ -226,21 +490,64 @@ func (s *NotesService) GetNote(ctx context.Context, id int64) (MessageDTO, error
 	return notes[0], nil
 }
 
-func (s *NotesService) CreateNote(ctx context.Context, content string, attachments []NewAttachment) (MessageDTO, error) {
-	content = normalizeNewlines(content)
+func (s *NotesService) CreateNote(ctx context.Context, opts CreateNoteOptions) (MessageDTO, error) {
+	content := normalizeNewlines(opts.Content)
+	if err := requireRestrictedTag(ctx, content); err != nil {
+		return MessageDTO{}, err
+	}
+	key, err := normalizeIdempotencyKey(opts.IdempotencyKey)
+	if err != nil {
+		return MessageDTO{}, err
+	}
+	var requestHash string
+	if key != "" {
+		if requestHash, err = idempotencyRequestHash(struct {
+			Content     string                  `json:"content"`
+			Attachments []attachmentFingerprint `json:"attachments"`
+			CreatedAt   time.Time               `json:"created_at"`
+			UpdatedAt   time.Time               `json:"updated_at"`
+			Color       string                  `json:"color"`
+			Archived    bool                    `json:"archived"`
+		}{content, attachmentFingerprints(opts.Attachments), opts.CreatedAt, opts.UpdatedAt, opts.Color, opts.Archived}); err != nil {
+			return MessageDTO{}, err
+		}
+	}
 	tx, err := s.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return MessageDTO{}, err
 	}
 	defer tx.Rollback()
 
+	if key != "" {
+		replay, found, err := lookupIdempotencyKey(ctx, tx, key, idempotentCreate, requestHash)
+		if err != nil {
+			return MessageDTO{}, err
+		}
+		if found {
+			if err := tx.Rollback(); err != nil {
+				return MessageDTO{}, err
+			}
+			return s.GetNote(ctx, replay.NoteID)
+		}
+	}
+
+	owner := ownerID(ctx)
 	var maxOrder int
-	if err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(sort_order), 0) FROM messages").Scan(&maxOrder); err != nil {
+	if err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(sort_order), 0) FROM messages WHERE owner_id = ?", owner).Scan(&maxOrder); err != nil {
 		return MessageDTO{}, err
 	}
-	res, err := tx.ExecContext(ctx,
-		"INSERT INTO messages (content, content_lower, sort_order) VALUES (?, ?, ?)",
-		content, strings.ToLower(content), maxOrder+1,
+	createdAt, updatedAt := dbTimeOrNil(opts.CreatedAt), dbTimeOrNil(opts.UpdatedAt)
+	if updatedAt == nil {
+		updatedAt = createdAt
+	}
+	archived := 0
+	if opts.Archived {
+		archived = 1
+	}
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO messages (owner_id, content, content_lower, sort_order, color, is_archived, created_at, updated_at, used_at)
+		VALUES (?, ?, ?, ?, ?, ?, COALESCE(?, CURRENT_TIMESTAMP), COALESCE(?, CURRENT_TIMESTAMP), COALESCE(?, CURRENT_TIMESTAMP))`,
+		owner, content, strings.ToLower(content), maxOrder+1, opts.Color, archived, createdAt, updatedAt, updatedAt,
 	)
 	if err != nil {
 		return MessageDTO{}, err
@@ -250,19 +557,48 @@ func (s *NotesService) CreateNote(ctx context.Context, content string, attachmen
 		return MessageDTO{}, err
 	}
 
-	createdFiles, err := s.addAttachments(ctx, tx, id, attachments)
+	createdFiles, err := s.addAttachments(ctx, tx, id, opts.Attachments, nil)
 	if err != nil {
-		s.removeStoredFiles(createdFiles)
+		s.discardStoredFiles(tx, createdFiles)
+		return MessageDTO{}, err
+	}
+	if content, err = linkAttachmentRefs(ctx, tx, id, content, opts.Attachments); err != nil {
+		s.discardStoredFiles(tx, createdFiles)
 		return MessageDTO{}, err
 	}
 	if err := syncMessageTags(ctx, tx, id, content); err != nil {
-		s.removeStoredFiles(createdFiles)
+		s.discardStoredFiles(tx, createdFiles)
+		return MessageDTO{}, err
+	}
+	if err := syncMessageLinks(ctx, tx, owner, id, content); err != nil {
+		s.discardStoredFiles(tx, createdFiles)
+		return MessageDTO{}, err
+	}
+	if err := syncSearchIndex(ctx, tx, id, content); err != nil {
+		s.discardStoredFiles(tx, createdFiles)
+		return MessageDTO{}, err
+	}
+	if err := insertRevision(ctx, tx, id, content); err != nil {
+		s.discardStoredFiles(tx, createdFiles)
+		return MessageDTO{}, err
+	}
+	events, err := recordChanges(ctx, tx, ChangeCreated, []int64{id})
+	if err != nil {
+		s.discardStoredFiles(tx, createdFiles)
 		return MessageDTO{}, err
 	}
+	if key != "" {
+		if err := storeIdempotencyKey(ctx, tx, key, idempotentCreate, requestHash, idempotentResult{NoteID: id}); err != nil {
+			s.discardStoredFiles(tx, createdFiles)
+			return MessageDTO{}, err
+		}
+	}
 	if err := tx.Commit(); err != nil {
-		s.removeStoredFiles(createdFiles)
+		s.discardStoredFiles(tx, createdFiles)
 		return MessageDTO{}, err
 	}
+	s.publish(events)
+	s.removeUploadSessionFiles(opts.Attachments)
 	return s.GetNote(ctx, id)
 }
 
@@ -276,6 +612,23 @@ func (s *NotesService) UpdateNote(ctx context.Context, id int64, opts UpdateNote
 	if opts.Content == nil && opts.AppendContent == "" && len(opts.Attachments) == 0 && len(opts.DeleteAttachmentIDs) == 0 {
 		return MessageDTO{}, errors.New("no note changes were provided")
 	}
+	key, err := normalizeIdempotencyKey(opts.IdempotencyKey)
+	if err != nil {
+		return MessageDTO{}, err
+	}
+	var requestHash string
+	if key != "" {
+		if requestHash, err = idempotencyRequestHash(struct {
+			NoteID              int64                   `json:"note_id"`
+			Content             *string                 `json:"content"`
+			AppendContent       string                  `json:"append_content"`
+			Attachments         []attachmentFingerprint `json:"attachments"`
+			DeleteAttachmentIDs []int64                 `json:"delete_attachment_ids"`
+			ExpectedVersion     int64                   `json:"expected_version"`
+		}{id, opts.Content, opts.AppendContent, attachmentFingerprints(opts.Attachments), opts.DeleteAttachmentIDs, opts.ExpectedVersion}); err != nil {
+			return MessageDTO{}, err
+		}
+	}
 
 	tx, err := s.DB.BeginTx(ctx, nil)
 	if err != nil {
@@ -283,13 +636,74 @@ func (s *NotesService) UpdateNote(ctx context.Context, id int64, opts UpdateNote
 	}
 	defer tx.Rollback()
 
-	var content string
-	if err := tx.QueryRowContext(ctx, "SELECT COALESCE(content, '') FROM messages WHERE id = ?", id).Scan(&content); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
+	// The version is bumped first with a conditional write, which takes the
+	// database write lock before anything is read. Of two clients updating
+	// the same version, the second waits for the first to commit, matches no
+	// row and gets a ConflictError.
+	filter, filterArgs := noteFilter(ctx, "")
+	bump := "UPDATE messages SET updated_at = CURRENT_TIMESTAMP, version = version + 1 WHERE id = ? AND " + filter
+	bumpArgs := append([]any{id}, filterArgs...)
+	if opts.ExpectedVersion > 0 {
+		bump += " AND version = ?"
+		bumpArgs = append(bumpArgs, opts.ExpectedVersion)
+	}
+	res, err := tx.ExecContext(ctx, bump, bumpArgs...)
+	if err != nil {
+		return MessageDTO{}, err
+	}
+	bumped, err := res.RowsAffected()
+	if err != nil {
+		return MessageDTO{}, err
+	}
+
+	if key != "" {
+		replay, found, err := lookupIdempotencyKey(ctx, tx, key, idempotentUpdate, requestHash)
+		if err != nil {
+			return MessageDTO{}, err
+		}
+		if found {
+			if replay.NoteID != id {
+				return MessageDTO{}, fmt.Errorf("%w: key %q was used for note %d", ErrIdempotencyKeyReused, key, replay.NoteID)
+			}
+			if err := tx.Rollback(); err != nil {
+				return MessageDTO{}, err
+			}
+			return s.GetNote(ctx, id)
+		}
+	}
+	if bumped == 0 {
+		if opts.ExpectedVersion == 0 {
 			return MessageDTO{}, fmt.Errorf("note %d not found", id)
 		}
+		if err := tx.Rollback(); err != nil {
+			return MessageDTO{}, err
+		}
+		current, err := s.GetNote(ctx, id)
+		if err != nil {
+			return MessageDTO{}, err
+		}
+		return MessageDTO{}, &ConflictError{ExpectedVersion: opts.ExpectedVersion, Note: current}
+	}
+
+	var content string
+	var encrypted bool
+	if err := tx.QueryRowContext(ctx,
+		"SELECT COALESCE(content, ''), is_encrypted FROM messages WHERE id = ?", id,
+	).Scan(&content, &encrypted); err != nil {
 		return MessageDTO{}, err
 	}
+	// Encrypted notes are changed only with the key, and their new content
+	// and files are encrypted as well.
+	var encryptionKey []byte
+	if encrypted {
+		if encryptionKey, err = s.noteKey(ctx); err != nil {
+			return MessageDTO{}, fmt.Errorf("note %d: %w", id, err)
+		}
+		if content, err = decryptContent(encryptionKey, content); err != nil {
+			return MessageDTO{}, fmt.Errorf("note %d: %w", id, err)
+		}
+	}
+	previousContent := content
 	contentChanged := false
 	if opts.Content != nil {
 		content = normalizeNewlines(*opts.Content)
@@ -304,14 +718,32 @@ func (s *NotesService) UpdateNote(ctx context.Context, id int64, opts UpdateNote
 	}
 
 	if contentChanged {
-		if _, err := tx.ExecContext(ctx,
-			"UPDATE messages SET content = ?, content_lower = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
-			content, strings.ToLower(content), id,
-		); err != nil {
+		if err := requireRestrictedTag(ctx, content); err != nil {
 			return MessageDTO{}, err
 		}
-		if err := syncMessageTags(ctx, tx, id, content); err != nil {
-			return MessageDTO{}, err
+		if encrypted {
+			if err := updateEncryptedContent(ctx, tx, id, encryptionKey, content); err != nil {
+				return MessageDTO{}, err
+			}
+		} else {
+			if _, err := tx.ExecContext(ctx,
+				"UPDATE messages SET content = ?, content_lower = ? WHERE id = ?",
+				content, strings.ToLower(content), id,
+			); err != nil {
+				return MessageDTO{}, err
+			}
+			if err := syncMessageTags(ctx, tx, id, content); err != nil {
+				return MessageDTO{}, err
+			}
+			if err := syncMessageLinks(ctx, tx, ownerID(ctx), id, content); err != nil {
+				return MessageDTO{}, err
+			}
+			if err := syncSearchIndex(ctx, tx, id, content); err != nil {
+				return MessageDTO{}, err
+			}
+			if err := recordRevision(ctx, tx, id, previousContent, content); err != nil {
+				return MessageDTO{}, err
+			}
 		}
 	}
 
@@ -319,46 +751,73 @@ func (s *NotesService) UpdateNote(ctx context.Context, id int64, opts UpdateNote
 	if err != nil {
 		return MessageDTO{}, err
 	}
-	createdFiles, err := s.addAttachments(ctx, tx, id, opts.Attachments)
+	createdFiles, err := s.addAttachments(ctx, tx, id, opts.Attachments, encryptionKey)
+	if err != nil {
+		s.discardStoredFiles(tx, createdFiles)
+		return MessageDTO{}, err
+	}
+	events, err := recordChanges(ctx, tx, ChangeUpdated, []int64{id})
 	if err != nil {
-		s.removeStoredFiles(createdFiles)
+		s.discardStoredFiles(tx, createdFiles)
 		return MessageDTO{}, err
 	}
-	if !contentChanged && (len(opts.Attachments) > 0 || len(opts.DeleteAttachmentIDs) > 0) {
-		if _, err := tx.ExecContext(ctx, "UPDATE messages SET updated_at = CURRENT_TIMESTAMP WHERE id = ?", id); err != nil {
-			s.removeStoredFiles(createdFiles)
+	if key != "" {
+		if err := storeIdempotencyKey(ctx, tx, key, idempotentUpdate, requestHash, idempotentResult{NoteID: id}); err != nil {
+			s.discardStoredFiles(tx, createdFiles)
 			return MessageDTO{}, err
 		}
 	}
 	if err := tx.Commit(); err != nil {
-		s.removeStoredFiles(createdFiles)
+		s.discardStoredFiles(tx, createdFiles)
 		return MessageDTO{}, err
 	}
+	s.publish(events)
 	s.removeStoredFiles(filesToDelete)
+	s.removeUploadSessionFiles(opts.Attachments)
 	return s.GetNote(ctx, id)
 }
 
 func (s *NotesService) MoveToTrash(ctx context.Context, ids []int64) (int64, error) {
-	return s.updateIDs(ctx, ids, "UPDATE messages SET is_deleted = 1 WHERE is_deleted = 0 AND id IN (%s)")
+	return s.updateIDs(ctx, ids, ChangeTrashed, "UPDATE messages SET is_deleted = 1 WHERE is_deleted = 0 AND id IN (%s)")
 }
 
 // TrashOrDelete preserves the web API's two-stage delete contract: notes not
 // yet in trash are moved there, while notes already in trash are permanently
-// deleted together with their attachment files.
-func (s *NotesService) TrashOrDelete(ctx context.Context, ids []int64) (int64, error) {
+// deleted together with their attachment files. Because a repeated call
+// deletes what the first one trashed, clients that retry should pass an
+// idempotency key; a replay then returns the original count and does nothing.
+func (s *NotesService) TrashOrDelete(ctx context.Context, ids []int64, idempotencyKey string) (int64, error) {
 	ids, args, err := prepareIDs(ids)
 	if err != nil {
 		return 0, err
 	}
+	key, err := normalizeIdempotencyKey(idempotencyKey)
+	if err != nil {
+		return 0, err
+	}
+	var requestHash string
+	if key != "" {
+		if requestHash, err = idempotencyRequestHash(slices.Sorted(slices.Values(ids))); err != nil {
+			return 0, err
+		}
+	}
 	tx, err := s.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return 0, err
 	}
 	defer tx.Rollback()
 
+	if key != "" {
+		replay, found, err := lookupIdempotencyKey(ctx, tx, key, idempotentDelete, requestHash)
+		if err != nil || found {
+			return replay.Processed, err
+		}
+	}
+
+	filter, filterArgs := noteFilter(ctx, "")
 	rows, err := tx.QueryContext(ctx,
-		fmt.Sprintf("SELECT id, is_deleted FROM messages WHERE id IN (%s)", generatePlaceholders(len(ids))),
-		args...,
+		fmt.Sprintf("SELECT id, is_deleted FROM messages WHERE %s AND id IN (%s)", filter, generatePlaceholders(len(ids))),
+		append(filterArgs, args...)...,
 	)
 	if err != nil {
 		return 0, err
@@ -386,12 +845,18 @@ func (s *NotesService) TrashOrDelete(ctx context.Context, ids []int64) (int64, e
 	}
 
 	var files []string
+	var events []NoteEvent
 	if len(toDelete) > 0 {
 		deletedFiles, _, err := deleteMessageRecords(ctx, tx, toDelete)
 		if err != nil {
 			return 0, err
 		}
 		files = append(files, deletedFiles...)
+		deleted, err := recordChanges(ctx, tx, ChangeDeleted, toDelete)
+		if err != nil {
+			return 0, err
+		}
+		events = append(events, deleted...)
 	}
 	if len(toTrash) > 0 {
 		trashArgs := idsToArgs(toTrash)
@@ -401,16 +866,28 @@ func (s *NotesService) TrashOrDelete(ctx context.Context, ids []int64) (int64, e
 		); err != nil {
 			return 0, err
 		}
+		trashed, err := recordChanges(ctx, tx, ChangeTrashed, toTrash)
+		if err != nil {
+			return 0, err
+		}
+		events = append(events, trashed...)
+	}
+	processed := int64(len(toTrash) + len(toDelete))
+	if key != "" {
+		if err := storeIdempotencyKey(ctx, tx, key, idempotentDelete, requestHash, idempotentResult{Processed: processed}); err != nil {
+			return 0, err
+		}
 	}
 	if err := tx.Commit(); err != nil {
 		return 0, err
 	}
+	s.publish(events)
 	s.removeStoredFiles(files)
-	return int64(len(toTrash) + len(toDelete)), nil
+	return processed, nil
 }
 
 func (s *NotesService) Restore(ctx context.Context, ids []int64) (int64, error) {
-	return s.updateIDs(ctx, ids, "UPDATE messages SET is_deleted = 0 WHERE is_deleted = 1 AND id IN (%s)")
+	return s.updateIDs(ctx, ids, ChangeRestored, "UPDATE messages SET is_deleted = 0 WHERE is_deleted = 1 AND id IN (%s)")
 }
 
 func (s *NotesService) SetArchived(ctx context.Context, ids []int64, archived bool) (int64, error) {
@@ -419,16 +896,31 @@ func (s *NotesService) SetArchived(ctx context.Context, ids []int64, archived bo
 		return 0, err
 	}
 	flag := 0
+	action := ChangeUnarchived
 	if archived {
 		flag = 1
+		action = ChangeArchived
 	}
-	query := fmt.Sprintf("UPDATE messages SET is_archived = ? WHERE id IN (%s)", generatePlaceholders(len(ids)))
-	args = append([]any{flag}, args...)
-	res, err := s.DB.ExecContext(ctx, query, args...)
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	filter, filterArgs := noteFilter(ctx, "")
+	query := fmt.Sprintf("UPDATE messages SET is_archived = ? WHERE %s AND id IN (%s) RETURNING id", filter, generatePlaceholders(len(ids)))
+	changed, err := queryIDs(ctx, tx, query, append(append([]any{flag}, filterArgs...), args...)...)
 	if err != nil {
 		return 0, err
 	}
-	return res.RowsAffected()
+	events, err := recordChanges(ctx, tx, action, changed)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	s.publish(events)
+	return int64(len(changed)), nil
 }
 
 func (s *NotesService) DeletePermanently(ctx context.Context, ids []int64) (int64, error) {
@@ -442,9 +934,10 @@ func (s *NotesService) DeletePermanently(ctx context.Context, ids []int64) (int6
 	}
 	defer tx.Rollback()
 	var deletable int
+	filter, filterArgs := noteFilter(ctx, "")
 	if err := tx.QueryRowContext(ctx,
-		fmt.Sprintf("SELECT COUNT(*) FROM messages WHERE is_deleted = 1 AND id IN (%s)", generatePlaceholders(len(ids))),
-		args...,
+		fmt.Sprintf("SELECT COUNT(*) FROM messages WHERE is_deleted = 1 AND %s AND id IN (%s)", filter, generatePlaceholders(len(ids))),
+		append(filterArgs, args...)...,
 	).Scan(&deletable); err != nil {
 		return 0, err
 	}
@@ -456,9 +949,14 @@ func (s *NotesService) DeletePermanently(ctx context.Context, ids []int64) (int6
 	if err != nil {
 		return 0, err
 	}
+	events, err := recordChanges(ctx, tx, ChangeDeleted, ids)
+	if err != nil {
+		return 0, err
+	}
 	if err := tx.Commit(); err != nil {
 		return 0, err
 	}
+	s.publish(events)
 	s.removeStoredFiles(files)
 	return affected, nil
 }
@@ -481,9 +979,10 @@ func (s *NotesService) AddTags(ctx context.Context, ids []int64, rawTags []strin
 		return 0, err
 	}
 	defer tx.Rollback()
+	filter, filterArgs := noteFilter(ctx, "")
 	rows, err := tx.QueryContext(ctx,
-		fmt.Sprintf("SELECT id, COALESCE(content, '') FROM messages WHERE id IN (%s)", generatePlaceholders(len(ids))),
-		args...,
+		fmt.Sprintf("SELECT id, COALESCE(content, '') FROM messages WHERE %s AND is_encrypted = 0 AND id IN (%s)", filter, generatePlaceholders(len(ids))),
+		append(filterArgs, args...)...,
 	)
 	if err != nil {
 		return 0, err
@@ -509,23 +1008,39 @@ func (s *NotesService) AddTags(ctx context.Context, ids []int64, rawTags []strin
 		return 0, err
 	}
 
+	var changed []int64
 	for _, note := range notes {
 		content := addTagsToContent(note.content, tags)
 		if content != note.content {
+			changed = append(changed, note.id)
 			if _, err := tx.ExecContext(ctx,
-				"UPDATE messages SET content = ?, content_lower = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+				"UPDATE messages SET content = ?, content_lower = ?, updated_at = CURRENT_TIMESTAMP, version = version + 1 WHERE id = ?",
 				content, strings.ToLower(content), note.id,
 			); err != nil {
 				return 0, err
 			}
+			if err := syncSearchIndex(ctx, tx, note.id, content); err != nil {
+				return 0, err
+			}
+			if err := recordRevision(ctx, tx, note.id, note.content, content); err != nil {
+				return 0, err
+			}
 		}
 		if err := syncMessageTags(ctx, tx, note.id, content); err != nil {
 			return 0, err
 		}
+		if err := syncMessageLinks(ctx, tx, ownerID(ctx), note.id, content); err != nil {
+			return 0, err
+		}
+	}
+	events, err := recordChanges(ctx, tx, ChangeUpdated, changed)
+	if err != nil {
+		return 0, err
 	}
 	if err := tx.Commit(); err != nil {
 		return 0, err
 	}
+	s.publish(events)
 	return len(notes), nil
 }
 
@@ -555,9 +1070,10 @@ func (s *NotesService) ReorderNotes(ctx context.Context, ids []int64) error {
 		return err
 	}
 	defer tx.Rollback()
+	filter, filterArgs := noteFilter(ctx, "")
 	rows, err := tx.QueryContext(ctx,
-		fmt.Sprintf("SELECT sort_order FROM messages WHERE id IN (%s) ORDER BY sort_order DESC", generatePlaceholders(len(ids))),
-		args...,
+		fmt.Sprintf("SELECT sort_order FROM messages WHERE %s AND id IN (%s) ORDER BY sort_order DESC", filter, generatePlaceholders(len(ids))),
+		append(filterArgs, args...)...,
 	)
 	if err != nil {
 		return err
@@ -582,14 +1098,24 @@ func (s *NotesService) ReorderNotes(ctx context.Context, ids []int64) error {
 			return err
 		}
 	}
-	return tx.Commit()
+	events, err := recordChanges(ctx, tx, ChangeReordered, ids)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.publish(events)
+	return nil
 }
 
 func (s *NotesService) ListTags(ctx context.Context) ([]string, error) {
+	filter, args := noteFilter(ctx, "m.")
 	rows, err := s.DB.QueryContext(ctx, `
 		SELECT DISTINCT t.name
-		FROM tags t JOIN message_tags mt ON t.id = mt.tag_id
-		ORDER BY t.sort_order DESC, t.name ASC`)
+		FROM tags t JOIN message_tags mt ON t.id = mt.tag_id JOIN messages m ON m.id = mt.message_id
+		WHERE `+filter+`
+		ORDER BY t.sort_order DESC, t.name ASC`, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -609,6 +1135,9 @@ func (s *NotesService) ReorderTags(ctx context.Context, names []string) error {
 	if len(names) == 0 {
 		return errors.New("at least one tag is required")
 	}
+	if len(restrictedTags(ctx)) > 0 {
+		return errors.New("a tag-restricted access token cannot reorder tags")
+	}
 	tags, err := normalizeTagNames(names)
 	if err != nil {
 		return err
@@ -622,7 +1151,7 @@ func (s *NotesService) ReorderTags(ctx context.Context, names []string) error {
 	}
 	defer tx.Rollback()
 	for i, tag := range tags {
-		res, err := tx.ExecContext(ctx, "UPDATE tags SET sort_order = ? WHERE name = ?", len(tags)-i, tag)
+		res, err := tx.ExecContext(ctx, "UPDATE tags SET sort_order = ? WHERE owner_id = ? AND name = ?", len(tags)-i, ownerID(ctx), tag)
 		if err != nil {
 			return err
 		}
@@ -630,7 +1159,15 @@ func (s *NotesService) ReorderTags(ctx context.Context, names []string) error {
 			return fmt.Errorf("tag %q not found", tag)
 		}
 	}
-	return tx.Commit()
+	events, err := recordChanges(ctx, tx, ChangeTagsReordered, []int64{0})
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.publish(events)
+	return nil
 }
 
 func (s *NotesService) populateRelations(ctx context.Context, notes []MessageDTO, ids []int64) error {
@@ -671,10 +1208,44 @@ func (s *NotesService) populateRelations(ctx context.Context, notes []MessageDTO
 		return err
 	}
 
+	linkRows, err := s.DB.QueryContext(ctx, fmt.Sprintf(`
+		SELECT ml.message_id, ml.target_id, 0 FROM message_links ml
+		WHERE ml.message_id IN (%[1]s)
+		UNION ALL
+		SELECT ml.target_id, ml.message_id, 1 FROM message_links ml
+		JOIN messages m ON m.id = ml.message_id
+		WHERE ml.target_id IN (%[1]s) AND m.is_deleted = 0
+		ORDER BY 1, 2`, generatePlaceholders(len(ids))), append(args, args...)...)
+	if err != nil {
+		return err
+	}
+	for linkRows.Next() {
+		var id, linkedID int64
+		var backlink bool
+		if err := linkRows.Scan(&id, &linkedID, &backlink); err != nil {
+			linkRows.Close()
+			return err
+		}
+		if i, ok := index[id]; ok {
+			if backlink {
+				notes[i].Backlinks = append(notes[i].Backlinks, linkedID)
+			} else {
+				notes[i].Links = append(notes[i].Links, linkedID)
+			}
+		}
+	}
+	if err := linkRows.Err(); err != nil {
+		linkRows.Close()
+		return err
+	}
+	if err := linkRows.Close(); err != nil {
+		return err
+	}
+
 	attachmentRows, err := s.DB.QueryContext(ctx, fmt.Sprintf(`
-		SELECT message_id, id, file_path, thumbnail_path, file_type
-		FROM attachments WHERE message_id IN (%s)
-		ORDER BY id`, generatePlaceholders(len(ids))), args...)
+		SELECT a.message_id, `+attachmentColumns+`
+		FROM attachments a WHERE a.message_id IN (%s)
+		ORDER BY a.id`, generatePlaceholders(len(ids))), args...)
 	if err != nil {
 		return err
 	}
@@ -682,9 +1253,7 @@ func (s *NotesService) populateRelations(ctx context.Context, notes []MessageDTO
 	for attachmentRows.Next() {
 		var id int64
 		var attachment AttachmentDTO
-		if err := attachmentRows.Scan(
-			&id, &attachment.ID, &attachment.FilePath, &attachment.ThumbnailPath, &attachment.FileType,
-		); err != nil {
+		if err := attachmentRows.Scan(scanAttachment(&attachment, &id)...); err != nil {
 			return err
 		}
 		if i, ok := index[id]; ok {
@@ -694,7 +1263,9 @@ func (s *NotesService) populateRelations(ctx context.Context, notes []MessageDTO
 	return attachmentRows.Err()
 }
 
-func (s *NotesService) addAttachments(ctx context.Context, tx *sql.Tx, noteID int64, attachments []NewAttachment) ([]string, error) {
+// addAttachments stores new files of a note. With a key the files are
+// encrypted and get no thumbnail, as they belong to an encrypted note.
+func (s *NotesService) addAttachments(ctx context.Context, tx *sql.Tx, noteID int64, attachments []NewAttachment, key []byte) ([]string, error) {
 	if len(attachments) == 0 {
 		return nil, nil
 	}
@@ -703,41 +1274,51 @@ func (s *NotesService) addAttachments(ctx context.Context, tx *sql.Tx, noteID in
 	}
 	var created []string
 	for _, attachment := range attachments {
-		source, err := attachment.open()
+		if attachment.Upload != "" {
+			var err error
+			if attachment, err = s.claimUploadSession(ctx, tx, attachment); err != nil {
+				return created, err
+			}
+		}
+		name, err := attachmentName(attachment.Filename)
+		if err != nil {
+			return created, err
+		}
+		opened, err := attachment.open()
 		if err != nil {
 			return created, fmt.Errorf("attachment %q: %w", attachment.Filename, err)
 		}
-		storedName, saveErr := saveReader(source, attachment.Filename, s.UploadsDir)
+		counted := &countingReadCloser{ReadCloser: opened}
+		var source io.ReadCloser = counted
+		if key != nil {
+			if source, err = encryptedSource(key, source); err != nil {
+				return created, fmt.Errorf("attachment %q: %w", attachment.Filename, err)
+			}
+		}
+		file, saveErr := s.storeAttachmentFile(ctx, tx, source, name, key == nil, &created)
 		closeErr := source.Close()
 		if saveErr != nil {
 			return created, saveErr
 		}
-		created = append(created, storedName)
 		if closeErr != nil {
 			return created, closeErr
 		}
 
 		fileType := "document"
-		thumbnailName := ""
-		if isImage(storedName) {
+		if isImage(name) {
 			fileType = "image"
-			thumbnailName = "thumb_" + storedName
-			if err := generateThumbnail(
-				filepath.Join(s.UploadsDir, storedName),
-				filepath.Join(s.UploadsDir, thumbnailName),
-			); err != nil {
-				thumbnailName = ""
-			} else {
-				created = append(created, thumbnailName)
-			}
-		} else if isAudio(storedName) {
+		} else if isAudio(name) {
 			fileType = "audio"
-		} else if isVideo(storedName) {
+		} else if isVideo(name) {
 			fileType = "video"
 		}
-		if _, err := tx.ExecContext(ctx,
-			"INSERT INTO attachments (message_id, file_path, thumbnail_path, file_type) VALUES (?, ?, ?, ?)",
-			noteID, storedName, thumbnailName, fileType,
+		meta := file.meta
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO attachments (message_id, file_path, thumbnail_path, file_type, blob_hash, thumbnail_hash, original_name, size,
+				mime_type, width, height, taken_at, duration, inspected)
+			VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), ?, ?, ?, ?, ?, ?, ?, ?)`,
+			noteID, file.filePath, file.thumbnailPath, fileType, file.blobHash, file.thumbnailHash, name, counted.n,
+			meta.mimeType, meta.width, meta.height, meta.takenAt, meta.duration, key == nil,
 		); err != nil {
 			return created, err
 		}
@@ -745,6 +1326,48 @@ func (s *NotesService) addAttachments(ctx context.Context, tx *sql.Tx, noteID in
 	return created, nil
 }
 
+// linkAttachmentRefs replaces attachment refs in the content of a note that
+// was just created with the URLs of the stored files. Attachments are inserted
+// in order, so their IDs line up with the attachments slice.
+func linkAttachmentRefs(ctx context.Context, tx *sql.Tx, noteID int64, content string, attachments []NewAttachment) (string, error) {
+	if !slices.ContainsFunc(attachments, func(a NewAttachment) bool { return a.Ref != "" }) {
+		return content, nil
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT file_path FROM attachments WHERE message_id = ? ORDER BY id", noteID)
+	if err != nil {
+		return "", err
+	}
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return "", err
+		}
+		paths = append(paths, path)
+	}
+	if err := rows.Close(); err != nil {
+		return "", err
+	}
+	var replacements []string
+	for i, attachment := range attachments {
+		if attachment.Ref != "" && i < len(paths) {
+			replacements = append(replacements, attachment.Ref, "/files/"+paths[i])
+		}
+	}
+	content = strings.NewReplacer(replacements...).Replace(content)
+	_, err = tx.ExecContext(ctx, "UPDATE messages SET content = ?, content_lower = ? WHERE id = ?",
+		content, strings.ToLower(content), noteID)
+	return content, err
+}
+
+func dbTimeOrNil(value time.Time) any {
+	if value.IsZero() {
+		return nil
+	}
+	return value.UTC().Format(time.DateTime)
+}
+
 func (s *NotesService) removeAttachmentRecords(ctx context.Context, tx *sql.Tx, noteID int64, ids []int64) ([]string, error) {
 	if len(ids) == 0 {
 		return nil, nil
@@ -755,7 +1378,7 @@ func (s *NotesService) removeAttachmentRecords(ctx context.Context, tx *sql.Tx,
 	}
 	queryArgs := append([]any{noteID}, args...)
 	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`
-		SELECT file_path, thumbnail_path FROM attachments
+		SELECT COALESCE(blob_hash, file_path), COALESCE(thumbnail_hash, thumbnail_path, '') FROM attachments
 		WHERE message_id = ? AND id IN (%s)`, generatePlaceholders(len(ids))), queryArgs...)
 	if err != nil {
 		return nil, err
@@ -789,19 +1412,15 @@ func (s *NotesService) removeAttachmentRecords(ctx context.Context, tx *sql.Tx,
 	return files, nil
 }
 
-func (s *NotesService) removeStoredFiles(names []string) {
-	for _, name := range names {
-		if name == "" {
-			continue
-		}
-		_ = os.Remove(filepath.Join(s.UploadsDir, filepath.Base(name)))
-	}
-}
-
+// deleteMessageRecords permanently removes notes, which access tokens may
+// only do with the delete scope.
 func deleteMessageRecords(ctx context.Context, tx *sql.Tx, ids []int64) ([]string, int64, error) {
+	if err := requireScope(ctx, ScopeDelete); err != nil {
+		return nil, 0, err
+	}
 	args := idsToArgs(ids)
 	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`
-		SELECT file_path, thumbnail_path FROM attachments
+		SELECT COALESCE(blob_hash, file_path), COALESCE(thumbnail_hash, thumbnail_path, '') FROM attachments
 		WHERE message_id IN (%s)`, generatePlaceholders(len(ids))), args...)
 	if err != nil {
 		return nil, 0, err
@@ -825,6 +1444,9 @@ func deleteMessageRecords(ctx context.Context, tx *sql.Tx, ids []int64) ([]strin
 	if err := rows.Close(); err != nil {
 		return nil, 0, err
 	}
+	if err := removeFromSearchIndex(ctx, tx, ids); err != nil {
+		return nil, 0, err
+	}
 	result, err := tx.ExecContext(ctx,
 		fmt.Sprintf("DELETE FROM messages WHERE id IN (%s)", generatePlaceholders(len(ids))),
 		args...,
@@ -839,33 +1461,102 @@ func deleteMessageRecords(ctx context.Context, tx *sql.Tx, ids []int64) ([]strin
 	return files, affected, nil
 }
 
-func (s *NotesService) updateIDs(ctx context.Context, ids []int64, queryTemplate string) (int64, error) {
+func (s *NotesService) updateIDs(ctx context.Context, ids []int64, action, queryTemplate string) (int64, error) {
 	ids, args, err := prepareIDs(ids)
 	if err != nil {
 		return 0, err
 	}
-	res, err := s.DB.ExecContext(ctx, fmt.Sprintf(queryTemplate, generatePlaceholders(len(ids))), args...)
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	filter, filterArgs := noteFilter(ctx, "")
+	query := fmt.Sprintf(queryTemplate+" AND "+filter+" RETURNING id", generatePlaceholders(len(ids)))
+	changed, err := queryIDs(ctx, tx, query, append(args, filterArgs...)...)
+	if err != nil {
+		return 0, err
+	}
+	events, err := recordChanges(ctx, tx, action, changed)
 	if err != nil {
 		return 0, err
 	}
-	return res.RowsAffected()
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	s.publish(events)
+	return int64(len(changed)), nil
 }
 
 func (s *NotesService) updateOne(ctx context.Context, id int64, query string, args ...any) error {
 	if id <= 0 {
 		return errors.New("note id must be positive")
 	}
-	args = append(args, id)
-	res, err := s.DB.ExecContext(ctx, query, args...)
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	filter, filterArgs := noteFilter(ctx, "")
+	args = append(append(args, id), filterArgs...)
+	res, err := tx.ExecContext(ctx, query+" AND "+filter, args...)
 	if err != nil {
 		return err
 	}
 	if affected, _ := res.RowsAffected(); affected == 0 {
 		return fmt.Errorf("note %d not found", id)
 	}
+	events, err := recordChanges(ctx, tx, ChangeUpdated, []int64{id})
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.publish(events)
 	return nil
 }
 
+// queryIDs collects the single id column of a query, typically an UPDATE
+// with RETURNING id.
+func queryIDs(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]int64, error) {
+	return queryValues[int64](ctx, tx, query, args...)
+}
+
+// queryValues returns the single column of the rows of query.
+func queryValues[T any](ctx context.Context, tx *sql.Tx, query string, args ...any) ([]T, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var values []T
+	for rows.Next() {
+		var value T
+		if err := rows.Scan(&value); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, err
+	}
+	return values, rows.Close()
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanNote(row rowScanner, note *MessageDTO) error {
+	return row.Scan(
+		&note.ID, &note.Content, &note.CreatedAt, &note.UpdatedAt, &note.UsedAt,
+		&note.IsArchived, &note.IsDeleted, &note.IsExpanded, &note.SortOrder, &note.Color, &note.Version,
+		&note.IsEncrypted,
+	)
+}
+
 func prepareIDs(ids []int64) ([]int64, []any, error) {
 	if len(ids) == 0 {
 		return nil, nil, errors.New("at least one note id is required")
@@ -936,11 +1627,16 @@ func syncMessageTags(ctx context.Context, tx *sql.Tx, noteID int64, content stri
 		return err
 	}
 	for _, tag := range extractHashtags(content) {
-		if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO tags (name) VALUES (?)", tag); err != nil {
+		if _, err := tx.ExecContext(ctx,
+			"INSERT OR IGNORE INTO tags (owner_id, name) SELECT owner_id, ? FROM messages WHERE id = ?",
+			tag, noteID,
+		); err != nil {
 			return err
 		}
-		if _, err := tx.ExecContext(ctx,
-			"INSERT INTO message_tags (message_id, tag_id) SELECT ?, id FROM tags WHERE name = ?",
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO message_tags (message_id, tag_id)
+			SELECT m.id, t.id FROM messages m JOIN tags t ON t.owner_id = m.owner_id
+			WHERE m.id = ? AND t.name = ?`,
 			noteID, tag,
 		); err != nil {
 			return err
@@ -3,49 +3,16 @@ package internal
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 
 	_ "modernc.org/sqlite"
 )
 
-const notesServiceTestSchema = `
-CREATE TABLE messages (
-    id INTEGER PRIMARY KEY AUTOINCREMENT,
-    content TEXT,
-    content_lower TEXT,
-    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-    used_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-    is_archived INTEGER DEFAULT 0,
-    is_deleted INTEGER DEFAULT 0,
-    is_expanded INTEGER DEFAULT 0,
-    color TEXT DEFAULT '',
-    sort_order INTEGER DEFAULT 0
-);
-CREATE TABLE attachments (
-    id INTEGER PRIMARY KEY AUTOINCREMENT,
-    message_id INTEGER NOT NULL,
-    file_path TEXT NOT NULL,
-    thumbnail_path TEXT DEFAULT '',
-    file_type TEXT,
-    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
-);
-CREATE TABLE tags (
-    id INTEGER PRIMARY KEY AUTOINCREMENT,
-    name TEXT UNIQUE,
-    sort_order INTEGER DEFAULT 0
-);
-CREATE TABLE message_tags (
-    message_id INTEGER,
-    tag_id INTEGER,
-    PRIMARY KEY (message_id, tag_id),
-    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
-    FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
-);`
-
 func newTestNotesService(t *testing.T) *NotesService {
 	t.Helper()
 	database, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "notes.db")+"?_pragma=foreign_keys(ON)")
@@ -53,7 +20,7 @@ func newTestNotesService(t *testing.T) *NotesService {
 		t.Fatal(err)
 	}
 	t.Cleanup(func() { _ = database.Close() })
-	if _, err := database.Exec(notesServiceTestSchema); err != nil {
+	if err := MigrateDB(database); err != nil {
 		t.Fatal(err)
 	}
 	return NewNotesService(database, filepath.Join(t.TempDir(), "uploads"))
@@ -63,10 +30,10 @@ func TestNotesServiceLifecycle(t *testing.T) {
 	ctx := context.Background()
 	service := newTestNotesService(t)
 
-	created, err := service.CreateNote(ctx, "Plan #Work", []NewAttachment{{
+	created, err := service.CreateNote(ctx, CreateNoteOptions{Content: "Plan #Work", Attachments: []NewAttachment{{
 		Filename: "plan.txt",
 		Data:     []byte("first attachment"),
-	}})
+	}}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -77,7 +44,7 @@ func TestNotesServiceLifecycle(t *testing.T) {
 		t.Fatalf("attachments = %d, want 1", len(created.Attachments))
 	}
 	originalAttachment := created.Attachments[0]
-	originalPath := filepath.Join(service.UploadsDir, originalAttachment.FilePath)
+	originalPath := filepath.Join(service.UploadsDir, originalAttachment.storedFile)
 	if data, err := os.ReadFile(originalPath); err != nil || string(data) != "first attachment" {
 		t.Fatalf("stored attachment = %q, %v", data, err)
 	}
@@ -132,7 +99,7 @@ func TestNotesServiceLifecycle(t *testing.T) {
 	if err != nil || trashed.IsDeleted != 1 {
 		t.Fatalf("trashed note = %+v, %v", trashed, err)
 	}
-	storedPath := filepath.Join(service.UploadsDir, trashed.Attachments[0].FilePath)
+	storedPath := filepath.Join(service.UploadsDir, trashed.Attachments[0].storedFile)
 	if affected, err := service.DeletePermanently(ctx, []int64{created.ID}); err != nil || affected != 1 {
 		t.Fatalf("DeletePermanently affected %d: %v", affected, err)
 	}
@@ -147,7 +114,7 @@ func TestNotesServiceLifecycle(t *testing.T) {
 func TestDeletePermanentlyRequiresTrash(t *testing.T) {
 	ctx := context.Background()
 	service := newTestNotesService(t)
-	note, err := service.CreateNote(ctx, "keep me", nil)
+	note, err := service.CreateNote(ctx, CreateNoteOptions{Content: "keep me"})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -158,3 +125,76 @@ func TestDeletePermanentlyRequiresTrash(t *testing.T) {
 		t.Fatalf("active note disappeared: %v", err)
 	}
 }
+
+func TestUpdateNoteRejectsStaleVersion(t *testing.T) {
+	ctx := context.Background()
+	service := newTestNotesService(t)
+	note, err := service.CreateNote(ctx, CreateNoteOptions{Content: "shared draft"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone := "edited on phone"
+	updated, err := service.UpdateNote(ctx, note.ID, UpdateNoteOptions{Content: &phone, ExpectedVersion: note.Version})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Version != note.Version+1 {
+		t.Fatalf("version after update = %d, want %d", updated.Version, note.Version+1)
+	}
+
+	desktop := "edited on desktop"
+	_, err = service.UpdateNote(ctx, note.ID, UpdateNoteOptions{Content: &desktop, ExpectedVersion: note.Version})
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("stale update error = %v, want *ConflictError", err)
+	}
+	if conflict.Note.Content != phone || conflict.Note.Version != updated.Version {
+		t.Fatalf("conflict carries %+v, want current server note", conflict.Note)
+	}
+	if current, err := service.GetNote(ctx, note.ID); err != nil || current.Content != phone {
+		t.Fatalf("stale update overwrote note: %+v, %v", current, err)
+	}
+}
+
+func TestConcurrentUpdatesOfOneVersion(t *testing.T) {
+	ctx := context.Background()
+	database, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "notes.db")+"?"+DatabasePragmas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if err := MigrateDB(database); err != nil {
+		t.Fatal(err)
+	}
+	service := NewNotesService(database, filepath.Join(t.TempDir(), "uploads"))
+	note, err := service.CreateNote(ctx, CreateNoteOptions{Content: "shared draft"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const writers = 8
+	errs := make(chan error, writers)
+	for i := range writers {
+		go func() {
+			content := "edit " + strconv.Itoa(i)
+			_, err := service.UpdateNote(ctx, note.ID, UpdateNoteOptions{Content: &content, ExpectedVersion: note.Version})
+			errs <- err
+		}()
+	}
+	var applied int
+	for range writers {
+		err := <-errs
+		var conflict *ConflictError
+		switch {
+		case err == nil:
+			applied++
+		case !errors.As(err, &conflict):
+			t.Errorf("concurrent update error = %v, want *ConflictError", err)
+		}
+	}
+	if applied != 1 {
+		t.Fatalf("%d concurrent updates of one version applied, want 1", applied)
+	}
+	if current, err := service.GetNote(ctx, note.ID); err != nil || current.Version != note.Version+1 {
+		t.Fatalf("note after concurrent updates = %+v, %v", current, err)
+	}
+}
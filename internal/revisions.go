@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Every content change stores the new content as a revision in the same
+// transaction, so the newest revision always equals the current content.
+// Notes created before revisions existed get their previous content saved
+// first, dated with the note's last update.
+
+type RevisionDiff struct {
+	NoteID         int64      `json:"note_id"`
+	FromRevisionID int64      `json:"from_revision_id"`
+	ToRevisionID   int64      `json:"to_revision_id"`
+	Lines          []DiffLine `json:"lines"`
+}
+
+func (s *NotesService) ListRevisions(ctx context.Context, noteID int64) ([]RevisionDTO, error) {
+	if noteID <= 0 {
+		return nil, errors.New("note id must be positive")
+	}
+	if err := s.requireNote(ctx, noteID); err != nil {
+		return nil, err
+	}
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT id, message_id, created_at, LENGTH(content)
+		FROM message_revisions WHERE message_id = ?
+		ORDER BY id DESC`, noteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	revisions := []RevisionDTO{}
+	for rows.Next() {
+		var revision RevisionDTO
+		if err := rows.Scan(&revision.ID, &revision.NoteID, &revision.CreatedAt, &revision.Length); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, rows.Err()
+}
+
+func (s *NotesService) GetRevision(ctx context.Context, noteID, revisionID int64) (RevisionDTO, error) {
+	if noteID <= 0 || revisionID <= 0 {
+		return RevisionDTO{}, errors.New("note id and revision id must be positive")
+	}
+	var revision RevisionDTO
+	filter, filterArgs := noteFilter(ctx, "m.")
+	err := s.DB.QueryRowContext(ctx, `
+		SELECT r.id, r.message_id, r.created_at, r.content, LENGTH(r.content)
+		FROM message_revisions r JOIN messages m ON m.id = r.message_id
+		WHERE r.id = ? AND r.message_id = ? AND `+filter, append([]any{revisionID, noteID}, filterArgs...)...).Scan(
+		&revision.ID, &revision.NoteID, &revision.CreatedAt, &revision.Content, &revision.Length,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RevisionDTO{}, fmt.Errorf("revision %d not found on note %d", revisionID, noteID)
+	}
+	return revision, err
+}
+
+// DiffRevisions compares two revisions of a note. A zero toRevisionID compares
+// against the current note content.
+func (s *NotesService) DiffRevisions(ctx context.Context, noteID, fromRevisionID, toRevisionID int64) (RevisionDiff, error) {
+	from, err := s.GetRevision(ctx, noteID, fromRevisionID)
+	if err != nil {
+		return RevisionDiff{}, err
+	}
+	var toContent string
+	if toRevisionID == 0 {
+		note, err := s.GetNote(ctx, noteID)
+		if err != nil {
+			return RevisionDiff{}, err
+		}
+		toContent = note.Content
+	} else {
+		to, err := s.GetRevision(ctx, noteID, toRevisionID)
+		if err != nil {
+			return RevisionDiff{}, err
+		}
+		toContent = to.Content
+	}
+	return RevisionDiff{
+		NoteID: noteID, FromRevisionID: fromRevisionID, ToRevisionID: toRevisionID,
+		Lines: diffLines(from.Content, toContent),
+	}, nil
+}
+
+// RestoreRevision replaces the note content with a stored revision. The
+// restore itself is recorded as a new revision, so it can be undone.
+func (s *NotesService) RestoreRevision(ctx context.Context, noteID, revisionID int64) (MessageDTO, error) {
+	revision, err := s.GetRevision(ctx, noteID, revisionID)
+	if err != nil {
+		return MessageDTO{}, err
+	}
+	return s.UpdateNote(ctx, noteID, UpdateNoteOptions{Content: &revision.Content})
+}
+
+func (s *NotesService) requireNote(ctx context.Context, id int64) error {
+	var exists int
+	filter, filterArgs := noteFilter(ctx, "")
+	if err := s.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM messages WHERE id = ? AND "+filter, append([]any{id}, filterArgs...)...).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		return fmt.Errorf("note %d not found", id)
+	}
+	return nil
+}
+
+// recordRevision stores content as the newest revision of a note whose
+// previous content was previousContent.
+func recordRevision(ctx context.Context, tx *sql.Tx, noteID int64, previousContent, content string) error {
+	if previousContent == content {
+		return nil
+	}
+	var count int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM message_revisions WHERE message_id = ?", noteID).Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO message_revisions (message_id, content, created_at)
+			SELECT id, ?, updated_at FROM messages WHERE id = ?`, previousContent, noteID,
+		); err != nil {
+			return err
+		}
+	}
+	return insertRevision(ctx, tx, noteID, content)
+}
+
+func insertRevision(ctx context.Context, tx *sql.Tx, noteID int64, content string) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO message_revisions (message_id, content) VALUES (?, ?)", noteID, content)
+	return err
+}
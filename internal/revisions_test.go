@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	lines := diffLines("a\nb\nc", "a\nx\nc\nd")
+	want := []DiffLine{
+		{Op: DiffEqual, Text: "a"},
+		{Op: DiffDelete, Text: "b"},
+		{Op: DiffInsert, Text: "x"},
+		{Op: DiffEqual, Text: "c"},
+		{Op: DiffInsert, Text: "d"},
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Fatalf("diffLines = %+v, want %+v", lines, want)
+	}
+	if lines := diffLines("", ""); len(lines) != 0 {
+		t.Fatalf("diff of empty texts = %+v", lines)
+	}
+}
+
+func TestNoteRevisionsHistoryAndRestore(t *testing.T) {
+	ctx := context.Background()
+	service := newTestNotesService(t)
+	note, err := service.CreateNote(ctx, CreateNoteOptions{Content: "first draft"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	replacement := "accidental replace"
+	if _, err := service.UpdateNote(ctx, note.ID, UpdateNoteOptions{Content: &replacement}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.AddTags(ctx, []int64{note.ID}, []string{"tagged"}); err != nil {
+		t.Fatal(err)
+	}
+
+	revisions, err := service.ListRevisions(ctx, note.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 3 || revisions[0].Content != "" {
+		t.Fatalf("revisions = %+v, want 3 entries without content", revisions)
+	}
+	first := revisions[2]
+	if revision, err := service.GetRevision(ctx, note.ID, first.ID); err != nil || revision.Content != "first draft" {
+		t.Fatalf("GetRevision = %+v, %v", revision, err)
+	}
+	diff, err := service.DiffRevisions(ctx, note.ID, first.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDiff := []DiffLine{
+		{Op: DiffDelete, Text: "first draft"},
+		{Op: DiffInsert, Text: "accidental replace"},
+		{Op: DiffInsert, Text: "#tagged"},
+	}
+	if !reflect.DeepEqual(diff.Lines, wantDiff) {
+		t.Fatalf("diff = %+v, want %+v", diff.Lines, wantDiff)
+	}
+
+	restored, err := service.RestoreRevision(ctx, note.ID, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Content != "first draft" || len(restored.Tags) != 0 {
+		t.Fatalf("restored note = %+v", restored)
+	}
+	if revisions, err := service.ListRevisions(ctx, note.ID); err != nil || len(revisions) != 4 {
+		t.Fatalf("restore was not recorded as a revision: %+v, %v", revisions, err)
+	}
+	if _, err := service.GetRevision(ctx, note.ID+1, first.ID); err == nil {
+		t.Fatal("GetRevision returned a revision of another note")
+	}
+}
+
+func TestRevisionsSnapshotContentWrittenBeforeHistory(t *testing.T) {
+	ctx := context.Background()
+	service := newTestNotesService(t)
+	res, err := service.DB.Exec("INSERT INTO messages (content, content_lower, sort_order) VALUES ('legacy text', 'legacy text', 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	if _, err := service.UpdateNote(ctx, id, UpdateNoteOptions{AppendContent: "more"}); err != nil {
+		t.Fatal(err)
+	}
+	revisions, err := service.ListRevisions(ctx, id)
+	if err != nil || len(revisions) != 2 {
+		t.Fatalf("revisions = %+v, %v", revisions, err)
+	}
+	if legacy, err := service.GetRevision(ctx, id, revisions[1].ID); err != nil || legacy.Content != "legacy text" {
+		t.Fatalf("legacy revision = %+v, %v", legacy, err)
+	}
+}
@@ -60,6 +60,14 @@ func (s *Router) Delete(path string, handlers ...RouteHandler) {
 	s.Custom([]string{http.MethodDelete}, []string{path}, handlers...)
 }
 
+func (s *Router) Patch(path string, handlers ...RouteHandler) {
+	s.Custom([]string{http.MethodPatch}, []string{path}, handlers...)
+}
+
+func (s *Router) Options(path string, handlers ...RouteHandler) {
+	s.Custom([]string{http.MethodOptions}, []string{path}, handlers...)
+}
+
 func (s *Router) All(path string, handlers ...RouteHandler) {
 	s.Custom([]string{}, []string{path}, handlers...)
 }
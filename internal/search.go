@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	SortRecent    = "recent"
+	SortRelevance = "relevance"
+)
+
+// searchQuery is a parsed full-text query. Included terms must all match,
+// while a note matching any excluded term is dropped.
+type searchQuery struct {
+	Include []searchTerm
+	Exclude []searchTerm
+}
+
+type searchTerm struct {
+	Text   string
+	Prefix bool
+}
+
+// parseSearchQuery understands bare words, "exact phrases", prefix* words and
+// -excluded words or phrases. Terms without letters or digits are ignored
+// because the FTS tokenizer would turn them into empty phrases.
+func parseSearchQuery(query string) searchQuery {
+	var result searchQuery
+	runes := []rune(strings.TrimSpace(query))
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+		exclude := false
+		if runes[i] == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) {
+			exclude = true
+			i++
+		}
+		var text string
+		if runes[i] == '"' {
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			text = string(runes[i+1 : end])
+			i = end + 1
+		} else {
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) {
+				end++
+			}
+			text = string(runes[i:end])
+			i = end
+		}
+		prefix := false
+		if i < len(runes) && runes[i] == '*' {
+			prefix = true
+			i++
+		}
+		if strings.HasSuffix(text, "*") {
+			prefix = true
+			text = strings.TrimRight(text, "*")
+		}
+		if !strings.ContainsFunc(text, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) {
+			continue
+		}
+		term := searchTerm{Text: strings.ToLower(strings.Join(strings.Fields(text), " ")), Prefix: prefix}
+		if exclude {
+			result.Exclude = append(result.Exclude, term)
+		} else {
+			result.Include = append(result.Include, term)
+		}
+	}
+	return result
+}
+
+func (t searchTerm) matchExpr() string {
+	expr := `"` + strings.ReplaceAll(t.Text, `"`, `""`) + `"`
+	if t.Prefix {
+		expr += "*"
+	}
+	return expr
+}
+
+func joinMatchExprs(terms []searchTerm, operator string) string {
+	exprs := make([]string, len(terms))
+	for i, term := range terms {
+		exprs[i] = term.matchExpr()
+	}
+	return strings.Join(exprs, operator)
+}
+
+// includeMatch returns the FTS5 MATCH expression every result must satisfy.
+func (q searchQuery) includeMatch() string {
+	return joinMatchExprs(q.Include, " ")
+}
+
+// excludeMatch returns the FTS5 MATCH expression no result may satisfy.
+func (q searchQuery) excludeMatch() string {
+	return joinMatchExprs(q.Exclude, " OR ")
+}
+
+func syncSearchIndex(ctx context.Context, tx *sql.Tx, noteID int64, content string) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM messages_fts WHERE rowid = ?", noteID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO messages_fts (rowid, content) VALUES (?, ?)", noteID, content)
+	return err
+}
+
+func removeFromSearchIndex(ctx context.Context, tx *sql.Tx, ids []int64) error {
+	_, err := tx.ExecContext(ctx,
+		fmt.Sprintf("DELETE FROM messages_fts WHERE rowid IN (%s)", generatePlaceholders(len(ids))),
+		idsToArgs(ids)...,
+	)
+	return err
+}
+
+const (
+	snippetContextRunes = 60
+	maxSnippets         = 3
+)
+
+type searchToken struct {
+	text       string
+	start, end int
+}
+
+// tokenizeForSearch splits content into lowercase words with rune offsets,
+// approximating the unicode61 tokenizer used by messages_fts.
+func tokenizeForSearch(content []rune) []searchToken {
+	var tokens []searchToken
+	start := -1
+	for i := 0; i <= len(content); i++ {
+		isWord := i < len(content) && (unicode.IsLetter(content[i]) || unicode.IsDigit(content[i]))
+		if isWord && start < 0 {
+			start = i
+		} else if !isWord && start >= 0 {
+			tokens = append(tokens, searchToken{text: strings.ToLower(string(content[start:i])), start: start, end: i})
+			start = -1
+		}
+	}
+	return tokens
+}
+
+// findMatches returns rune ranges in content matched by the included terms of
+// the query, ordered by position.
+func findMatches(content []rune, query searchQuery) []MatchRange {
+	tokens := tokenizeForSearch(content)
+	var matches []MatchRange
+	for _, term := range query.Include {
+		words := tokenizeForSearch([]rune(term.Text))
+		if len(words) == 0 {
+			continue
+		}
+		for i := 0; i+len(words) <= len(tokens); i++ {
+			matched := true
+			for j, word := range words {
+				token := tokens[i+j].text
+				last := j == len(words)-1
+				if token != word.text && !(last && term.Prefix && strings.HasPrefix(token, word.text)) {
+					matched = false
+					break
+				}
+			}
+			if matched {
+				matches = append(matches, MatchRange{Start: tokens[i].start, End: tokens[i+len(words)-1].end})
+			}
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Start < matches[j].Start })
+	return matches
+}
+
+// buildSnippets cuts short excerpts around query matches. Notes without a
+// visible match, for example when only exclusions were searched, get their
+// leading text as a single snippet.
+func buildSnippets(content string, query searchQuery) []SearchSnippet {
+	runes := []rune(content)
+	matches := findMatches(runes, query)
+	if len(matches) == 0 {
+		end := min(len(runes), 2*snippetContextRunes)
+		return []SearchSnippet{{Text: string(runes[:end]), Start: 0, Matches: []MatchRange{}}}
+	}
+	var snippets []SearchSnippet
+	var windowStart, windowEnd int
+	var windowMatches []MatchRange
+	flush := func() {
+		snippet := SearchSnippet{Text: string(runes[windowStart:windowEnd]), Start: windowStart}
+		for _, match := range windowMatches {
+			snippet.Matches = append(snippet.Matches, MatchRange{Start: match.Start - windowStart, End: match.End - windowStart})
+		}
+		snippets = append(snippets, snippet)
+	}
+	for _, match := range matches {
+		start := max(0, match.Start-snippetContextRunes)
+		end := min(len(runes), match.End+snippetContextRunes)
+		if windowMatches != nil && start <= windowEnd {
+			windowEnd = max(windowEnd, end)
+			windowMatches = append(windowMatches, match)
+			continue
+		}
+		if windowMatches != nil {
+			flush()
+			if len(snippets) == maxSnippets {
+				return snippets
+			}
+		}
+		windowStart, windowEnd, windowMatches = start, end, []MatchRange{match}
+	}
+	flush()
+	return snippets
+}
@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		query   string
+		include string
+		exclude string
+	}{
+		{query: "Plan next", include: `"plan" "next"`},
+		{query: `"Exact   Phrase" word`, include: `"exact phrase" "word"`},
+		{query: "pref* -skip", include: `"pref"*`, exclude: `"skip"`},
+		{query: `-"two words" -one`, exclude: `"two words" OR "one"`},
+		{query: `quo"te - !!! #tag`, include: `"quo""te" "#tag"`},
+		{query: `"unterminated phrase`, include: `"unterminated phrase"`},
+	}
+	for _, test := range tests {
+		parsed := parseSearchQuery(test.query)
+		if include := parsed.includeMatch(); include != test.include {
+			t.Errorf("parseSearchQuery(%q) include = %s, want %s", test.query, include, test.include)
+		}
+		if exclude := parsed.excludeMatch(); exclude != test.exclude {
+			t.Errorf("parseSearchQuery(%q) exclude = %s, want %s", test.query, exclude, test.exclude)
+		}
+	}
+}
+
+func TestListNotesFullTextSearch(t *testing.T) {
+	ctx := context.Background()
+	service := newTestNotesService(t)
+	create := func(content string) int64 {
+		t.Helper()
+		note, err := service.CreateNote(ctx, CreateNoteOptions{Content: content})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return note.ID
+	}
+	recipe := create("Pancake recipe: milk, eggs, flour")
+	shopping := create("Shopping list: milk and bread")
+	phrase := create("Buy bread and milk tomorrow")
+	ranked := create("milk milk milk")
+
+	search := func(opts ListNotesOptions) []int64 {
+		t.Helper()
+		result, err := service.ListNotes(ctx, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []int64{}
+		for _, note := range result.Notes {
+			ids = append(ids, note.ID)
+		}
+		return ids
+	}
+
+	if ids := search(ListNotesOptions{Query: `"milk and bread"`}); !reflect.DeepEqual(ids, []int64{shopping}) {
+		t.Fatalf("phrase search = %v, want [%d]", ids, shopping)
+	}
+	if ids := search(ListNotesOptions{Query: "panc*"}); !reflect.DeepEqual(ids, []int64{recipe}) {
+		t.Fatalf("prefix search = %v, want [%d]", ids, recipe)
+	}
+	if ids := search(ListNotesOptions{Query: "milk -bread -eggs"}); !reflect.DeepEqual(ids, []int64{ranked}) {
+		t.Fatalf("exclusion search = %v, want [%d]", ids, ranked)
+	}
+	if ids := search(ListNotesOptions{Query: "-milk"}); len(ids) != 0 {
+		t.Fatalf("exclusion-only search = %v, want none", ids)
+	}
+
+	if _, err := service.UpdateNote(ctx, phrase, UpdateNoteOptions{AppendContent: "#groceries"}); err != nil {
+		t.Fatal(err)
+	}
+	if ids := search(ListNotesOptions{Query: "groceries"}); !reflect.DeepEqual(ids, []int64{phrase}) {
+		t.Fatalf("search after update = %v, want [%d]", ids, phrase)
+	}
+	if _, err := service.AddTags(ctx, []int64{recipe}, []string{"breakfast"}); err != nil {
+		t.Fatal(err)
+	}
+	if ids := search(ListNotesOptions{Query: "breakfast"}); !reflect.DeepEqual(ids, []int64{recipe}) {
+		t.Fatalf("search after AddTags = %v, want [%d]", ids, recipe)
+	}
+
+	result, err := service.ListNotes(ctx, ListNotesOptions{Query: "milk", Sort: SortRelevance, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Notes) != 1 || result.Notes[0].ID != ranked || result.NextOffset == nil || *result.NextOffset != 1 {
+		t.Fatalf("relevance first page = %+v", result)
+	}
+	if ids := search(ListNotesOptions{Query: "milk", Sort: SortRelevance, Offset: *result.NextOffset, Limit: 10}); len(ids) != 3 {
+		t.Fatalf("relevance second page = %v, want 3 notes", ids)
+	}
+	if _, err := service.ListNotes(ctx, ListNotesOptions{Sort: "oldest"}); err == nil {
+		t.Fatal("ListNotes accepted an invalid sort")
+	}
+
+	if _, err := service.MoveToTrash(ctx, []int64{shopping}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.DeletePermanently(ctx, []int64{shopping}); err != nil {
+		t.Fatal(err)
+	}
+	var indexed int
+	if err := service.DB.QueryRow("SELECT COUNT(*) FROM messages_fts WHERE rowid = ?", shopping).Scan(&indexed); err != nil || indexed != 0 {
+		t.Fatalf("deleted note still indexed: %d, %v", indexed, err)
+	}
+}
+
+func TestBuildSnippets(t *testing.T) {
+	content := "Привет, Мир! " + strings.Repeat("filler ", 30) + "the World peace plan"
+	snippets := buildSnippets(content, parseSearchQuery(`мир "world peace" pla*`))
+	if len(snippets) != 2 {
+		t.Fatalf("snippets = %+v, want 2 windows", snippets)
+	}
+	runes := []rune(content)
+	for _, snippet := range snippets {
+		if snippet.Text != string(runes[snippet.Start:snippet.Start+len([]rune(snippet.Text))]) {
+			t.Fatalf("snippet %+v does not match content offsets", snippet)
+		}
+	}
+	var highlighted []string
+	for _, snippet := range snippets {
+		text := []rune(snippet.Text)
+		for _, match := range snippet.Matches {
+			highlighted = append(highlighted, string(text[match.Start:match.End]))
+		}
+	}
+	if want := []string{"Мир", "World peace", "plan"}; !reflect.DeepEqual(highlighted, want) {
+		t.Fatalf("highlighted = %q, want %q", highlighted, want)
+	}
+
+	leading := buildSnippets("just text", parseSearchQuery("-other"))
+	if len(leading) != 1 || leading[0].Text != "just text" || len(leading[0].Matches) != 0 {
+		t.Fatalf("snippet without matches = %+v", leading)
+	}
+}
+
+func TestListNotesSnippetMode(t *testing.T) {
+	ctx := context.Background()
+	service := newTestNotesService(t)
+	note, err := service.CreateNote(ctx, CreateNoteOptions{Content: strings.Repeat("long body ", 100) + "needle"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := service.ListNotes(ctx, ListNotesOptions{Query: "needle", Snippets: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Notes) != 1 || result.Notes[0].ID != note.ID || result.Notes[0].Content != "" {
+		t.Fatalf("snippet mode returned full content: %+v", result.Notes)
+	}
+	snippets := result.Notes[0].Snippets
+	if len(snippets) != 1 || len(snippets[0].Matches) != 1 || !strings.HasSuffix(snippets[0].Text, "needle") {
+		t.Fatalf("unexpected snippets: %+v", snippets)
+	}
+}
@@ -0,0 +1,366 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+const shareCookiePrefix = "gonotes_share_"
+
+// Every password attempt runs a full PBKDF2, so attempts are limited per
+// share and per client address.
+const (
+	shareAttemptWindow   = time.Minute
+	shareAttemptsPerLink = 20
+	shareAttemptsPerAddr = 10
+)
+
+// HandleShares serves public share links: /s/<token> renders the note, asking
+// for the password first when the share has one, and /s/<token>/files/<name>
+// serves the attachments of that note only. The routes need no account.
+func HandleShares(router *Router, service *NotesService) {
+	links := newAttemptLimiter(shareAttemptsPerLink, shareAttemptWindow)
+	addrs := newAttemptLimiter(shareAttemptsPerAddr, shareAttemptWindow)
+	router.Custom([]string{http.MethodGet, http.MethodHead, http.MethodPost}, []string{"^/s/"}, func(w http.ResponseWriter, r *http.Request) {
+		// The token is a secret; keep it out of the Referer of links in the note.
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+		w.Header().Set("Cache-Control", "private, no-cache")
+
+		token, file, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/s/"), "/files/")
+		share, note, err := service.OpenShare(r.Context(), token)
+		if errors.Is(err, ErrShareNotFound) {
+			http.Error(w, "Share link not found or expired", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Share %s error: %v", r.URL.Path, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			now := time.Now()
+			// A client over its own limit does not use up the attempts of the link.
+			wait, ok := addrs.allow(now, clientKey(r))
+			if ok {
+				wait, ok = links.allow(now, token)
+			}
+			if !ok {
+				log.Printf("Too many password attempts for share %d from %s", share.ID, r.RemoteAddr)
+				w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+				w.WriteHeader(http.StatusTooManyRequests)
+				renderSharePage(w, sharePage{Locked: true, Throttled: true})
+				return
+			}
+			password := r.PostFormValue("password")
+			if !share.Unlocks(password) {
+				log.Printf("Wrong password for share %d from %s", share.ID, r.RemoteAddr)
+				w.WriteHeader(http.StatusUnauthorized)
+				renderSharePage(w, sharePage{Locked: true, Failed: true})
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     shareCookiePrefix + token,
+				Value:    shareUnlockValue(share),
+				Path:     share.Path,
+				HttpOnly: true,
+				Secure:   isSecureRequest(r),
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, r, share.Path, http.StatusSeeOther)
+			return
+		}
+		unlocked := share.Unlocks("")
+		if cookie, err := r.Cookie(shareCookiePrefix + token); err == nil && cookie.Value == shareUnlockValue(share) {
+			unlocked = true
+		}
+
+		if file != "" {
+			stored, ok := noteFile(note, file)
+			if !unlocked || !ok {
+				http.Error(w, "File not found", http.StatusNotFound)
+				return
+			}
+			source, err := service.openUpload(r.Context(), stored)
+			if err != nil {
+				http.Error(w, "File not found", http.StatusNotFound)
+				return
+			}
+			defer source.Close()
+			http.ServeContent(w, r, file, source.ModTime, source)
+			return
+		}
+		if !unlocked {
+			renderSharePage(w, sharePage{Locked: true})
+			return
+		}
+		page, err := newSharePage(share, note)
+		if err != nil {
+			log.Printf("Share %d render error: %v", share.ID, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		renderSharePage(w, page)
+	})
+}
+
+// clientKey identifies the client of r for rate limits: its address, or the
+// /64 network of an IPv6 address, as one host usually holds a whole one.
+func clientKey(r *http.Request) string {
+	addr, ok := remoteAddr(r)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if addr.Is6() {
+		prefix, _ := addr.Prefix(64)
+		return prefix.String()
+	}
+	return addr.String()
+}
+
+// attemptLimiter allows limit attempts per key within each window.
+type attemptLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu       sync.Mutex
+	attempts map[string]attemptWindow
+}
+
+type attemptWindow struct {
+	start time.Time
+	count int
+}
+
+func newAttemptLimiter(limit int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{limit: limit, window: window, attempts: make(map[string]attemptWindow)}
+}
+
+// allow records an attempt for key at now. When key has used up its
+// attempts, the attempt is refused and allow returns how long to wait.
+func (l *attemptLimiter) allow(now time.Time, key string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	current := l.attempts[key]
+	if now.Sub(current.start) >= l.window {
+		if len(l.attempts) >= attemptLimiterPruneSize {
+			l.prune(now)
+		}
+		current = attemptWindow{start: now}
+	}
+	if current.count >= l.limit {
+		return current.start.Add(l.window).Sub(now), false
+	}
+	current.count++
+	l.attempts[key] = current
+	return 0, true
+}
+
+// attemptLimiterPruneSize is the number of keys from which allow drops the
+// expired ones, so one-off clients do not pile up.
+const attemptLimiterPruneSize = 1024
+
+func (l *attemptLimiter) prune(now time.Time) {
+	for key, attempts := range l.attempts {
+		if now.Sub(attempts.start) >= l.window {
+			delete(l.attempts, key)
+		}
+	}
+}
+
+// shareUnlockValue is the cookie value that proves the password of a share
+// was entered. It changes with the password and cannot be made without it.
+func shareUnlockValue(share Share) string {
+	return hashSessionToken(share.Token + "\x00" + share.passwordHash)
+}
+
+// noteFile returns the stored file behind name when it is an attachment or
+// preview of note.
+func noteFile(note MessageDTO, name string) (string, bool) {
+	if name != filepath.Base(name) {
+		return "", false
+	}
+	for _, attachment := range note.Attachments {
+		if attachment.FilePath == name {
+			return attachment.storedFile, true
+		}
+		if attachment.ThumbnailPath != "" && attachment.ThumbnailPath == name {
+			return attachment.storedThumbnail, true
+		}
+	}
+	return "", false
+}
+
+type shareAttachment struct {
+	URL, Name, FileType string
+}
+
+type sharePage struct {
+	Locked, Failed bool
+	Throttled      bool
+	Title          string
+	Content        template.HTML
+	Tags           []string
+	UpdatedAt      string
+	Attachments    []shareAttachment
+}
+
+func newSharePage(share Share, note MessageDTO) (sharePage, error) {
+	content, err := renderShareMarkdown(note.Content)
+	if err != nil {
+		return sharePage{}, err
+	}
+	page := sharePage{
+		Title:     noteTitle(note.Content),
+		Content:   content,
+		Tags:      note.Tags,
+		UpdatedAt: parseDBTime(note.UpdatedAt).Format("2006-01-02 15:04"),
+	}
+	for _, attachment := range note.Attachments {
+		name := attachment.OriginalName
+		if name == "" {
+			name = attachment.FilePath
+		}
+		page.Attachments = append(page.Attachments, shareAttachment{
+			URL:      share.Path + "/files/" + attachment.FilePath,
+			Name:     name,
+			FileType: attachment.FileType,
+		})
+	}
+	return page, nil
+}
+
+func renderSharePage(w http.ResponseWriter, page sharePage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src 'self' https:; media-src 'self'; style-src 'unsafe-inline'; form-action 'self'")
+	if err := sharePageTemplate.Execute(w, page); err != nil {
+		log.Printf("Share page error: %v", err)
+	}
+}
+
+// shareMarkdown renders notes like the web UI: GitHub-flavoured Markdown
+// with ||spoilers||. Raw HTML and dangerous link schemes are dropped.
+var shareMarkdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM, spoilerExtension{}),
+)
+
+func renderShareMarkdown(content string) (template.HTML, error) {
+	var buf bytes.Buffer
+	if err := shareMarkdown.Convert([]byte(content), &buf); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
+var kindSpoiler = ast.NewNodeKind("Spoiler")
+
+// spoilerNode is ||hidden text||, shown blurred until it is focused.
+type spoilerNode struct {
+	ast.BaseInline
+}
+
+func (n *spoilerNode) Kind() ast.NodeKind { return kindSpoiler }
+
+func (n *spoilerNode) Dump(source []byte, level int) { ast.DumpHelper(n, source, level, nil, nil) }
+
+type spoilerParser struct{}
+
+func (spoilerParser) Trigger() []byte { return []byte{'|'} }
+
+func (spoilerParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, segment := block.PeekLine()
+	if len(line) < 4 || line[1] != '|' {
+		return nil
+	}
+	end := bytes.Index(line[2:], []byte("||"))
+	if end <= 0 {
+		return nil
+	}
+	node := &spoilerNode{}
+	node.AppendChild(node, ast.NewTextSegment(text.NewSegment(segment.Start+2, segment.Start+2+end)))
+	block.Advance(end + 4)
+	return node
+}
+
+type spoilerRenderer struct{}
+
+func (spoilerRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindSpoiler, func(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering {
+			w.WriteString(`<span class="spoiler" tabindex="0">`)
+		} else {
+			w.WriteString(`</span>`)
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+type spoilerExtension struct{}
+
+func (spoilerExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithInlineParsers(util.Prioritized(spoilerParser{}, 500)))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(spoilerRenderer{}, 500)))
+}
+
+var sharePageTemplate = template.Must(template.New("share").Parse(`<!DOCTYPE html>
+<html lang="ru">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex, nofollow">
+<title>{{if .Locked}}Заметка защищена паролем{{else}}{{.Title}}{{end}}</title>
+<style>
+  :root { color-scheme: light dark; }
+  body { max-width: 760px; margin: 0 auto; padding: 24px 16px; font: 16px/1.6 system-ui, sans-serif; }
+  img, video { max-width: 100%; height: auto; border-radius: 8px; }
+  pre { overflow-x: auto; padding: 12px; border-radius: 8px; background: rgba(127, 127, 127, 0.12); }
+  code { font-size: 0.9em; }
+  table { border-collapse: collapse; }
+  th, td { border: 1px solid rgba(127, 127, 127, 0.4); padding: 4px 8px; }
+  blockquote { margin-left: 0; padding-left: 12px; border-left: 3px solid rgba(127, 127, 127, 0.4); }
+  .spoiler:not(:focus) { filter: blur(5px); cursor: pointer; user-select: none; }
+  .meta, .tags { color: GrayText; font-size: 0.85em; }
+  .attachments { display: grid; gap: 12px; margin-top: 16px; }
+  form { display: flex; gap: 8px; margin-top: 16px; }
+  .error { color: #d32f2f; }
+</style>
+</head>
+<body>
+{{if .Locked}}
+<p>Заметка защищена паролем.</p>
+{{if .Failed}}<p class="error">Неверный пароль.</p>{{end}}
+{{if .Throttled}}<p class="error">Слишком много попыток. Попробуйте через минуту.</p>{{end}}
+<form method="post">
+  <input type="password" name="password" placeholder="Пароль" autofocus required>
+  <button type="submit">Открыть</button>
+</form>
+{{else}}
+<article>{{.Content}}</article>
+{{if .Attachments}}<div class="attachments">
+{{range .Attachments}}{{if eq .FileType "image"}}<a href="{{.URL}}"><img src="{{.URL}}" alt="{{.Name}}" loading="lazy"></a>
+{{else if eq .FileType "video"}}<video src="{{.URL}}" controls preload="metadata"></video>
+{{else}}<a href="{{.URL}}">{{.Name}}</a>
+{{end}}{{end}}</div>{{end}}
+{{if .Tags}}<p class="tags">{{range .Tags}}#{{.}} {{end}}</p>{{end}}
+<p class="meta">Обновлено {{.UpdatedAt}} UTC · goNotes</p>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const shareTokenBytes = 16
+
+// ErrShareNotFound is returned for unknown, expired and trashed share links
+// alike, so a visitor cannot tell them apart.
+var ErrShareNotFound = errors.New("share link not found or expired")
+
+// Share is a public read-only link to one note. Anyone with the link, and the
+// password if one is set, can read the note and its attachments.
+type Share struct {
+	ID          int64   `json:"id"`
+	NoteID      int64   `json:"note_id"`
+	Token       string  `json:"token"`
+	Path        string  `json:"path"`
+	HasPassword bool    `json:"has_password"`
+	CreatedAt   string  `json:"created_at"`
+	ExpiresAt   *string `json:"expires_at"`
+
+	ownerID      int64
+	passwordHash string
+}
+
+type CreateShareOptions struct {
+	NoteID int64
+	// Password, when set, must be entered before the note is shown.
+	Password string
+	// ExpiresIn is the link lifetime; zero means the link never expires.
+	ExpiresIn time.Duration
+}
+
+// Unlocks reports whether password opens the share.
+func (sh Share) Unlocks(password string) bool {
+	return sh.passwordHash == "" || verifyPassword(sh.passwordHash, password)
+}
+
+// CreateShare publishes a note of the calling user under a new random link.
+func (s *NotesService) CreateShare(ctx context.Context, opts CreateShareOptions) (Share, error) {
+	if err := s.requireNote(ctx, opts.NoteID); err != nil {
+		return Share{}, err
+	}
+	var encrypted bool
+	if err := s.DB.QueryRowContext(ctx, "SELECT is_encrypted FROM messages WHERE id = ?", opts.NoteID).Scan(&encrypted); err != nil {
+		return Share{}, err
+	}
+	if encrypted {
+		return Share{}, fmt.Errorf("note %d is encrypted and cannot be shared", opts.NoteID)
+	}
+	if opts.ExpiresIn < 0 {
+		return Share{}, errors.New("share lifetime must not be negative")
+	}
+	var expiresAt any
+	if opts.ExpiresIn > 0 {
+		expiresAt = time.Now().Add(opts.ExpiresIn).UTC().Format(time.DateTime)
+	}
+	passwordHash := ""
+	if opts.Password != "" {
+		var err error
+		if passwordHash, err = hashPassword(opts.Password); err != nil {
+			return Share{}, err
+		}
+	}
+	raw := make([]byte, shareTokenBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return Share{}, err
+	}
+	return scanShare(s.DB.QueryRowContext(ctx, `
+		INSERT INTO shares (message_id, token, password_hash, expires_at)
+		VALUES (?, ?, ?, ?)
+		RETURNING `+shareColumns+`, ?`,
+		opts.NoteID, base64.RawURLEncoding.EncodeToString(raw), passwordHash, expiresAt, ownerID(ctx),
+	))
+}
+
+// ListShares returns the share links of the calling user, newest first,
+// limited to one note when noteID is set. Expired links are listed until
+// they are revoked.
+func (s *NotesService) ListShares(ctx context.Context, noteID int64) ([]Share, error) {
+	filter, args := noteFilter(ctx, "m.")
+	if noteID != 0 {
+		filter += " AND m.id = ?"
+		args = append(args, noteID)
+	}
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT `+shareColumnsWithAlias+`, m.owner_id
+		FROM shares s JOIN messages m ON m.id = s.message_id
+		WHERE `+filter+`
+		ORDER BY s.id DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	shares := []Share{}
+	for rows.Next() {
+		share, err := scanShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, rows.Err()
+}
+
+// RevokeShare deletes a share link of the calling user; the link stops
+// working at once.
+func (s *NotesService) RevokeShare(ctx context.Context, id int64) error {
+	filter, args := noteFilter(ctx, "")
+	res, err := s.DB.ExecContext(ctx,
+		"DELETE FROM shares WHERE id = ? AND message_id IN (SELECT id FROM messages WHERE "+filter+")",
+		append([]any{id}, args...)...,
+	)
+	if err != nil {
+		return err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return fmt.Errorf("share %d not found", id)
+	}
+	return nil
+}
+
+// OpenShare finds the share for a public link and the note it shows. It does
+// not check the password; callers use Share.Unlocks before showing the note.
+func (s *NotesService) OpenShare(ctx context.Context, token string) (Share, MessageDTO, error) {
+	share, err := scanShare(s.DB.QueryRowContext(ctx, `
+		SELECT `+shareColumnsWithAlias+`, m.owner_id
+		FROM shares s JOIN messages m ON m.id = s.message_id
+		WHERE s.token = ? AND (s.expires_at IS NULL OR s.expires_at > ?)`,
+		token, time.Now().UTC().Format(time.DateTime),
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Share{}, MessageDTO{}, ErrShareNotFound
+	}
+	if err != nil {
+		return Share{}, MessageDTO{}, err
+	}
+	// Shared notes cannot be encrypted; should one be anyway, visitors must
+	// not get it decrypted with the owner's unlocked key.
+	note, err := s.GetNote(withoutDecryption(WithUser(ctx, share.ownerID)), share.NoteID)
+	if errors.Is(err, ErrNoteLocked) {
+		return Share{}, MessageDTO{}, ErrShareNotFound
+	}
+	if err != nil {
+		return Share{}, MessageDTO{}, err
+	}
+	if note.IsDeleted != 0 {
+		return Share{}, MessageDTO{}, ErrShareNotFound
+	}
+	return share, note, nil
+}
+
+const (
+	shareColumns          = "id, message_id, token, password_hash, created_at, expires_at"
+	shareColumnsWithAlias = "s.id, s.message_id, s.token, s.password_hash, s.created_at, s.expires_at"
+)
+
+// scanShare reads shareColumns followed by the owner of the shared note.
+func scanShare(row rowScanner) (Share, error) {
+	var share Share
+	err := row.Scan(&share.ID, &share.NoteID, &share.Token, &share.passwordHash,
+		&share.CreatedAt, &share.ExpiresAt, &share.ownerID)
+	share.Path = "/s/" + share.Token
+	share.HasPassword = share.passwordHash != ""
+	return share, err
+}
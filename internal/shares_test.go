@@ -0,0 +1,241 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestShareRouter(t *testing.T) (*Router, *NotesService) {
+	t.Helper()
+	service := newTestNotesService(t)
+	router := NewRouter()
+	HandleShares(router, service)
+	return router, service
+}
+
+func getShare(t *testing.T, router *Router, path string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	for _, cookie := range cookies {
+		request.AddCookie(cookie)
+	}
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response
+}
+
+func TestSharePageRendersOnlyTheSharedNote(t *testing.T) {
+	router, service := newTestShareRouter(t)
+	ctx := context.Background()
+	note, err := service.CreateNote(ctx, CreateNoteOptions{
+		Content:     "Recipe\n\n**Bake** for ||40|| minutes <script>alert(1)</script>\n\n[x](javascript:alert(1)) #cooking",
+		Attachments: []NewAttachment{{Filename: "steps.txt", Data: []byte("step one")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := service.CreateNote(ctx, CreateNoteOptions{
+		Content:     "Private",
+		Attachments: []NewAttachment{{Filename: "secret.txt", Data: []byte("secret")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	share, err := service.CreateShare(ctx, CreateShareOptions{NoteID: note.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := getShare(t, router, share.Path)
+	body := response.Body.String()
+	if response.Code != http.StatusOK {
+		t.Fatalf("share page: status %d, body %s", response.Code, body)
+	}
+	for _, want := range []string{"<strong>Bake</strong>", `<span class="spoiler" tabindex="0">40</span>`, "#cooking", "steps.txt"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("share page lacks %q: %s", want, body)
+		}
+	}
+	if strings.Contains(body, "<script>") || strings.Contains(body, "javascript:") {
+		t.Errorf("share page kept unsafe markup: %s", body)
+	}
+	if response.Header().Get("Referrer-Policy") != "no-referrer" {
+		t.Errorf("Referrer-Policy = %q", response.Header().Get("Referrer-Policy"))
+	}
+
+	file := getShare(t, router, share.Path+"/files/"+note.Attachments[0].FilePath)
+	if file.Code != http.StatusOK || file.Body.String() != "step one" {
+		t.Fatalf("shared attachment: status %d, body %q", file.Code, file.Body.String())
+	}
+	if response := getShare(t, router, share.Path+"/files/"+other.Attachments[0].FilePath); response.Code != http.StatusNotFound {
+		t.Fatalf("attachment of another note: status %d", response.Code)
+	}
+	if response := getShare(t, router, "/s/unknown"); response.Code != http.StatusNotFound {
+		t.Fatalf("unknown share: status %d", response.Code)
+	}
+
+	if _, err := service.TrashOrDelete(ctx, []int64{note.ID}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if response := getShare(t, router, share.Path); response.Code != http.StatusNotFound {
+		t.Fatalf("share of a trashed note: status %d", response.Code)
+	}
+}
+
+func TestSharePassword(t *testing.T) {
+	router, service := newTestShareRouter(t)
+	ctx := context.Background()
+	note, err := service.CreateNote(ctx, CreateNoteOptions{Content: "Wi-Fi: guest-network"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	share, err := service.CreateShare(ctx, CreateShareOptions{NoteID: note.ID, Password: "open sesame"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !share.HasPassword {
+		t.Fatal("share has no password")
+	}
+
+	response := getShare(t, router, share.Path)
+	if response.Code != http.StatusOK || strings.Contains(response.Body.String(), "guest-network") {
+		t.Fatalf("locked share showed the note: status %d", response.Code)
+	}
+	post := func(password string) *httptest.ResponseRecorder {
+		t.Helper()
+		request := httptest.NewRequest(http.MethodPost, share.Path, strings.NewReader(url.Values{"password": {password}}.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response
+	}
+	if response := post("wrong password"); response.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: status %d", response.Code)
+	}
+	response = post("open sesame")
+	if response.Code != http.StatusSeeOther {
+		t.Fatalf("right password: status %d", response.Code)
+	}
+	cookies := response.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Path != share.Path || !cookies[0].HttpOnly {
+		t.Fatalf("unlock cookies = %+v", cookies)
+	}
+	if response := getShare(t, router, share.Path, cookies[0]); !strings.Contains(response.Body.String(), "guest-network") {
+		t.Fatalf("unlocked share: %s", response.Body.String())
+	}
+	forged := &http.Cookie{Name: cookies[0].Name, Value: "forged"}
+	if response := getShare(t, router, share.Path, forged); strings.Contains(response.Body.String(), "guest-network") {
+		t.Fatal("forged cookie unlocked the share")
+	}
+}
+
+func TestSharePasswordAttemptsAreLimited(t *testing.T) {
+	router, service := newTestShareRouter(t)
+	ctx := context.Background()
+	note, err := service.CreateNote(ctx, CreateNoteOptions{Content: "locked"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	share, err := service.CreateShare(ctx, CreateShareOptions{NoteID: note.ID, Password: "open sesame"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(addr, password string) *httptest.ResponseRecorder {
+		t.Helper()
+		request := httptest.NewRequest(http.MethodPost, share.Path, strings.NewReader(url.Values{"password": {password}}.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.RemoteAddr = addr
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response
+	}
+	for range shareAttemptsPerAddr {
+		if response := post("192.0.2.1:1234", "wrong"); response.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong password: status %d", response.Code)
+		}
+	}
+	response := post("192.0.2.1:1234", "open sesame")
+	if response.Code != http.StatusTooManyRequests || response.Header().Get("Retry-After") == "" {
+		t.Fatalf("attempt over the address limit: status %d, Retry-After %q", response.Code, response.Header().Get("Retry-After"))
+	}
+	if response := post("192.0.2.2:1234", "open sesame"); response.Code != http.StatusSeeOther {
+		t.Fatalf("another address: status %d", response.Code)
+	}
+	// Attempts from many addresses still run into the limit of the link.
+	for i := range shareAttemptsPerLink {
+		post(fmt.Sprintf("198.51.100.%d:1234", i), "wrong")
+	}
+	if response := post("203.0.113.1:1234", "open sesame"); response.Code != http.StatusTooManyRequests {
+		t.Fatalf("attempt over the link limit: status %d", response.Code)
+	}
+}
+
+func TestAttemptLimiterWindow(t *testing.T) {
+	limiter := newAttemptLimiter(2, time.Minute)
+	now := time.Now()
+	for range 2 {
+		if _, ok := limiter.allow(now, "key"); !ok {
+			t.Fatal("attempt within the limit refused")
+		}
+	}
+	if wait, ok := limiter.allow(now.Add(20*time.Second), "key"); ok || wait != 40*time.Second {
+		t.Fatalf("attempt over the limit: wait %v, allowed %v", wait, ok)
+	}
+	if _, ok := limiter.allow(now.Add(time.Minute), "key"); !ok {
+		t.Fatal("attempt in the next window refused")
+	}
+}
+
+func TestShareManagement(t *testing.T) {
+	router, service := newTestShareRouter(t)
+	ctx := context.Background()
+	if _, err := service.CreateUser(ctx, "alice", "alice-password"); err != nil {
+		t.Fatal(err)
+	}
+	bob, err := service.CreateUser(ctx, "bob", "bob-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	note, err := service.CreateNote(ctx, CreateNoteOptions{Content: "Alice's note"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobCtx := WithUser(ctx, bob.ID)
+	if _, err := service.CreateShare(bobCtx, CreateShareOptions{NoteID: note.ID}); err == nil {
+		t.Fatal("bob shared alice's note")
+	}
+
+	share, err := service.CreateShare(ctx, CreateShareOptions{NoteID: note.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shares, err := service.ListShares(bobCtx, 0); err != nil || len(shares) != 0 {
+		t.Fatalf("bob's shares = %+v, %v", shares, err)
+	}
+	if err := service.RevokeShare(bobCtx, share.ID); err == nil {
+		t.Fatal("bob revoked alice's share")
+	}
+	shares, err := service.ListShares(ctx, note.ID)
+	if err != nil || len(shares) != 1 || shares[0].Token != share.Token {
+		t.Fatalf("alice's shares = %+v, %v", shares, err)
+	}
+
+	if _, err := service.DB.Exec("UPDATE shares SET expires_at = '2000-01-01 00:00:00'"); err != nil {
+		t.Fatal(err)
+	}
+	if response := getShare(t, router, share.Path); response.Code != http.StatusNotFound {
+		t.Fatalf("expired share: status %d", response.Code)
+	}
+	if err := service.RevokeShare(ctx, share.ID); err != nil {
+		t.Fatal(err)
+	}
+	if shares, err := service.ListShares(ctx, 0); err != nil || len(shares) != 0 {
+		t.Fatalf("shares after revoke = %+v, %v", shares, err)
+	}
+}
@@ -0,0 +1,232 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage keeps the stored files of attachments: blobs, previews and files
+// of attachments uploaded before blobs. Names are flat; files are written
+// to a local temporary file first, which Put then moves into the storage.
+type Storage interface {
+	// Open opens a stored file. A missing file is reported as os.ErrNotExist.
+	Open(ctx context.Context, name string) (StorageObject, error)
+	// Put moves the local file at path into the storage as name, replacing
+	// any file with that name. The local file is gone once Put succeeds.
+	Put(ctx context.Context, name, path string) error
+	Exists(ctx context.Context, name string) (bool, error)
+	// Delete removes a stored file; a missing file is not an error.
+	Delete(ctx context.Context, name string) error
+	// List calls fn with the name of every stored file.
+	List(ctx context.Context, fn func(name string) error) error
+}
+
+// StorageObject is an opened stored file.
+type StorageObject interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+	ModTime() time.Time
+}
+
+// LocalStorage keeps the files in a directory, by default the uploads
+// directory of the profile.
+type LocalStorage struct {
+	Dir string
+}
+
+func NewLocalStorage(dir string) *LocalStorage {
+	return &LocalStorage{Dir: dir}
+}
+
+func (l *LocalStorage) path(name string) string {
+	return filepath.Join(l.Dir, filepath.Base(name))
+}
+
+type localObject struct {
+	*os.File
+	info os.FileInfo
+}
+
+func (o localObject) Size() int64        { return o.info.Size() }
+func (o localObject) ModTime() time.Time { return o.info.ModTime() }
+
+func (l *LocalStorage) Open(ctx context.Context, name string) (StorageObject, error) {
+	file, err := os.Open(l.path(name))
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return localObject{File: file, info: info}, nil
+}
+
+// Put renames path into the directory, falling back to a copy when it is on
+// another file system.
+func (l *LocalStorage) Put(ctx context.Context, name, path string) error {
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	target := l.path(name)
+	if err := os.Rename(path, target); err == nil {
+		return nil
+	}
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	temp, err := os.CreateTemp(l.Dir, ".put-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(temp, source)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), target)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (l *LocalStorage) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := os.Stat(l.path(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *LocalStorage) Delete(ctx context.Context, name string) error {
+	if err := os.Remove(l.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List skips hidden files, which are temporary files and the uploads key.
+func (l *LocalStorage) List(ctx context.Context, fn func(name string) error) error {
+	entries, err := os.ReadDir(l.Dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if err := fn(entry.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// objectReader reads a StorageObject from the start, as a plain upload is
+// served.
+type objectReader struct {
+	*io.SectionReader
+	io.Closer
+}
+
+func newObjectReader(object StorageObject) objectReader {
+	return objectReader{SectionReader: io.NewSectionReader(object, 0, object.Size()), Closer: object}
+}
+
+// spoolFile copies src into a new temporary file in dir for Storage.Put.
+// The caller removes the file if it is not put.
+func spoolFile(dir string, src io.Reader) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	temp, err := os.CreateTemp(dir, ".spool-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(temp, src)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return "", err
+	}
+	return temp.Name(), nil
+}
+
+// CopyStorage copies every file of from that to does not have yet, so an
+// interrupted copy can be run again. With remove the files are deleted from
+// from once all of them are copied. spoolDir holds the files in transit.
+func CopyStorage(ctx context.Context, from, to Storage, spoolDir string, remove bool) (int, error) {
+	var names []string
+	if err := from.List(ctx, func(name string) error {
+		names = append(names, name)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	copied := 0
+	for _, name := range names {
+		exists, err := to.Exists(ctx, name)
+		if err != nil {
+			return copied, err
+		}
+		if exists {
+			continue
+		}
+		if err := copyStorageFile(ctx, from, to, spoolDir, name); err != nil {
+			return copied, fmt.Errorf("%s: %w", name, err)
+		}
+		copied++
+	}
+	if !remove {
+		return copied, nil
+	}
+	for _, name := range names {
+		if err := from.Delete(ctx, name); err != nil {
+			return copied, fmt.Errorf("remove %s: %w", name, err)
+		}
+	}
+	return copied, nil
+}
+
+func copyStorageFile(ctx context.Context, from, to Storage, spoolDir, name string) error {
+	object, err := from.Open(ctx, name)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("Skipping %s, it was removed during the copy", name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	path, err := spoolFile(spoolDir, newObjectReader(object))
+	object.Close()
+	if err != nil {
+		return err
+	}
+	if err := to.Put(ctx, name, path); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,545 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3Options configure an S3-compatible bucket: AWS S3, MinIO, Ceph RGW and
+// the like. Without PathStyle the bucket is addressed as a subdomain of the
+// endpoint.
+type S3Options struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	PathStyle       bool
+	Client          *http.Client
+}
+
+// Files larger than s3PartSize are uploaded in parts of that size, or larger
+// ones when a file would need more than s3MaxParts; S3 takes single PUTs of
+// up to 5 GiB and parts of at least 5 MiB.
+const (
+	s3PartSize = 64 << 20
+	s3MaxParts = 10000
+)
+
+// S3Storage keeps the files as objects of a bucket, signing requests with
+// AWS Signature Version 4.
+type S3Storage struct {
+	options  S3Options
+	base     *url.URL
+	client   *http.Client
+	now      func() time.Time
+	partSize int64
+}
+
+func NewS3Storage(options S3Options) (*S3Storage, error) {
+	if options.Endpoint == "" || options.Bucket == "" {
+		return nil, errors.New("S3 storage needs an endpoint and a bucket")
+	}
+	if options.AccessKeyID == "" || options.SecretAccessKey == "" {
+		return nil, errors.New("S3 storage needs an access key")
+	}
+	if options.Region == "" {
+		options.Region = "us-east-1"
+	}
+	if !strings.Contains(options.Endpoint, "://") {
+		options.Endpoint = "https://" + options.Endpoint
+	}
+	base, err := url.Parse(options.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("S3 endpoint: %w", err)
+	}
+	if options.PathStyle {
+		base.Path = strings.TrimSuffix(base.Path, "/") + "/" + options.Bucket
+	} else {
+		base.Host = options.Bucket + "." + base.Host
+	}
+	options.Prefix = strings.Trim(options.Prefix, "/")
+	if options.Prefix != "" {
+		options.Prefix += "/"
+	}
+	client := options.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &S3Storage{options: options, base: base, client: client, now: time.Now, partSize: s3PartSize}, nil
+}
+
+func (s *S3Storage) objectURL(name string) *url.URL {
+	target := *s.base
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + s.options.Prefix + name
+	// Send the path encoded exactly as it is signed.
+	target.RawPath = s3EscapePath(target.Path)
+	return &target
+}
+
+// emptyPayloadHash is the SHA-256 of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// do signs and sends a request. payloadHash is the hex SHA-256 of body.
+func (s *S3Storage) do(ctx context.Context, method string, target *url.URL, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	if body != nil {
+		request.ContentLength = size
+	}
+	s.sign(request, payloadHash)
+	return s.client.Do(request)
+}
+
+// sign adds the AWS Signature Version 4 Authorization header to request,
+// signing the host, the range and the x-amz-* headers.
+func (s *S3Storage) sign(request *http.Request, payloadHash string) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": request.URL.Host}
+	for key, values := range request.Header {
+		lower := strings.ToLower(key)
+		if lower == "range" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		s3EscapePath(request.URL.Path),
+		s3CanonicalQuery(request.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.options.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.options.SecretAccessKey), day)
+	key = hmacSHA256(key, s.options.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	request.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.options.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape encodes s as SigV4 expects: everything but unreserved characters.
+func s3Escape(s string, keepSlash bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', keepSlash && b == '/':
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+func s3EscapePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return s3Escape(path, true)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Error turns an unexpected response into an error, os.ErrNotExist for a
+// missing object.
+func s3Error(response *http.Response, name string) error {
+	if response.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+	return fmt.Errorf("S3 %s %s: %s %s", response.Request.Method, name, response.Status, strings.TrimSpace(string(message)))
+}
+
+func (s *S3Storage) head(ctx context.Context, name string) (*http.Response, error) {
+	response, err := s.do(ctx, http.MethodHead, s.objectURL(name), nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+	return response, nil
+}
+
+func (s *S3Storage) Open(ctx context.Context, name string) (StorageObject, error) {
+	response, err := s.head(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, s3Error(response, name)
+	}
+	modTime, _ := http.ParseTime(response.Header.Get("Last-Modified"))
+	return &s3Object{storage: s, ctx: ctx, name: name, size: response.ContentLength, modTime: modTime}, nil
+}
+
+// Put uploads the file in a single PUT, or as a multipart upload when it is
+// larger than one part.
+func (s *S3Storage) Put(ctx context.Context, name, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > s.partSize {
+		err = s.putMultipart(ctx, name, file, info.Size())
+	} else {
+		_, err = s.upload(ctx, s.objectURL(name), name, io.NewSectionReader(file, 0, info.Size()))
+	}
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(path)
+}
+
+// upload sends body to target with a PUT, hashing it first for the
+// signature, and returns the ETag of the stored object or part.
+func (s *S3Storage) upload(ctx context.Context, target *url.URL, name string, body *io.SectionReader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return "", err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	response, err := s.do(ctx, http.MethodPut, target, header, body, body.Size(), hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", s3Error(response, name)
+	}
+	return response.Header.Get("ETag"), nil
+}
+
+// uploadURL returns the URL of name with a query for the multipart API.
+func (s *S3Storage) uploadURL(name string, query url.Values) *url.URL {
+	target := s.objectURL(name)
+	target.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+	return target
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// putMultipart uploads file in parts, each signed with the hash of its own
+// bytes, so no request carries more than one part. A failed upload is
+// aborted, which frees the parts already stored.
+func (s *S3Storage) putMultipart(ctx context.Context, name string, file *os.File, size int64) error {
+	uploadID, err := s.createMultipart(ctx, name)
+	if err != nil {
+		return err
+	}
+	partSize := max(s.partSize, (size+s3MaxParts-1)/s3MaxParts)
+	var parts []s3CompletedPart
+	for offset := int64(0); offset < size; offset += partSize {
+		number := len(parts) + 1
+		target := s.uploadURL(name, url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}})
+		etag, err := s.upload(ctx, target, name, io.NewSectionReader(file, offset, min(partSize, size-offset)))
+		if err != nil {
+			s.abortMultipart(ctx, name, uploadID)
+			return fmt.Errorf("upload part %d: %w", number, err)
+		}
+		parts = append(parts, s3CompletedPart{PartNumber: number, ETag: etag})
+	}
+	if err := s.completeMultipart(ctx, name, uploadID, parts); err != nil {
+		s.abortMultipart(ctx, name, uploadID)
+		return err
+	}
+	return nil
+}
+
+func (s *S3Storage) createMultipart(ctx context.Context, name string) (string, error) {
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	response, err := s.do(ctx, http.MethodPost, s.uploadURL(name, url.Values{"uploads": {""}}), header, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", s3Error(response, name)
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(response.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("S3 create multipart upload %s: %w", name, err)
+	}
+	if result.UploadID == "" {
+		return "", fmt.Errorf("S3 create multipart upload %s: no upload ID", name)
+	}
+	return result.UploadID, nil
+}
+
+func (s *S3Storage) completeMultipart(ctx context.Context, name, uploadID string, parts []s3CompletedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(body)
+	header := http.Header{"Content-Type": {"application/xml"}}
+	response, err := s.do(ctx, http.MethodPost, s.uploadURL(name, url.Values{"uploadId": {uploadID}}), header,
+		bytes.NewReader(body), int64(len(body)), hex.EncodeToString(hash[:]))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return s3Error(response, name)
+	}
+	// S3 reports a failure to assemble the parts in the body of a 200
+	// response.
+	var result struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(response.Body).Decode(&result); err != nil {
+		return fmt.Errorf("S3 complete multipart upload %s: %w", name, err)
+	}
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("S3 complete multipart upload %s: %s %s", name, result.Code, result.Message)
+	}
+	return nil
+}
+
+// abortMultipart discards an upload, even when ctx is already cancelled.
+func (s *S3Storage) abortMultipart(ctx context.Context, name, uploadID string) {
+	response, err := s.do(context.WithoutCancel(ctx), http.MethodDelete, s.uploadURL(name, url.Values{"uploadId": {uploadID}}), nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		log.Printf("S3 abort multipart upload %s: %v", name, err)
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusOK {
+		log.Printf("S3 abort multipart upload %s: %v", name, s3Error(response, name))
+	}
+}
+
+func (s *S3Storage) Exists(ctx context.Context, name string) (bool, error) {
+	response, err := s.head(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	switch response.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, s3Error(response, name)
+}
+
+func (s *S3Storage) Delete(ctx context.Context, name string) error {
+	response, err := s.do(ctx, http.MethodDelete, s.objectURL(name), nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusOK && response.StatusCode != http.StatusNotFound {
+		return s3Error(response, name)
+	}
+	return nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List pages through ListObjectsV2 under the prefix, skipping objects in
+// deeper "directories".
+func (s *S3Storage) List(ctx context.Context, fn func(name string) error) error {
+	token := ""
+	for {
+		target := *s.base
+		if target.Path == "" {
+			target.Path = "/"
+		}
+		query := url.Values{"list-type": {"2"}, "prefix": {s.options.Prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		target.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+		response, err := s.do(ctx, http.MethodGet, &target, nil, nil, 0, emptyPayloadHash)
+		if err != nil {
+			return err
+		}
+		var result s3ListResult
+		if response.StatusCode != http.StatusOK {
+			err = s3Error(response, "list")
+		} else {
+			err = xml.NewDecoder(response.Body).Decode(&result)
+		}
+		response.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, s.options.Prefix)
+			if name == "" || strings.Contains(name, "/") {
+				continue
+			}
+			if err := fn(name); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// s3Object reads an object with ranged GETs. Reads that continue where the
+// last one stopped reuse its response, so reading a file from start to end
+// takes one request.
+type s3Object struct {
+	storage *S3Storage
+	ctx     context.Context
+	name    string
+	size    int64
+	modTime time.Time
+
+	mu     sync.Mutex
+	body   io.ReadCloser
+	offset int64
+}
+
+func (o *s3Object) Size() int64        { return o.size }
+func (o *s3Object) ModTime() time.Time { return o.modTime }
+
+func (o *s3Object) ReadAt(p []byte, off int64) (int, error) {
+	if off >= o.size {
+		return 0, io.EOF
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.body == nil || off != o.offset {
+		if err := o.get(off); err != nil {
+			return 0, err
+		}
+	}
+	want := p
+	if remaining := o.size - off; int64(len(want)) > remaining {
+		want = want[:remaining]
+	}
+	n, err := io.ReadFull(o.body, want)
+	o.offset += int64(n)
+	if err != nil {
+		o.body.Close()
+		o.body = nil
+		return n, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (o *s3Object) get(off int64) error {
+	if o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	header := http.Header{"Range": {"bytes=" + strconv.FormatInt(off, 10) + "-"}}
+	response, err := o.storage.do(o.ctx, http.MethodGet, o.storage.objectURL(o.name), header, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusPartialContent && !(response.StatusCode == http.StatusOK && off == 0) {
+		defer response.Body.Close()
+		return s3Error(response, o.name)
+	}
+	o.body, o.offset = response.Body, off
+	return nil
+}
+
+func (o *s3Object) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const defaultSyncLimit = 1000
+
+type SyncOptions struct {
+	// Since is the cursor returned by the previous sync. Zero requests a full
+	// snapshot of every note, including notes in trash.
+	Since int64
+	// Snapshot continues a snapshot with the token of its previous page.
+	Snapshot string
+	// Limit caps how many change log rows one incremental sync consumes and
+	// how many notes one snapshot page returns.
+	Limit int
+}
+
+// SyncResult carries everything a replica needs to catch up: the current
+// state of changed notes, tombstones for permanently deleted notes, and the
+// full tag order whenever tags may have changed.
+type SyncResult struct {
+	Cursor     int64        `json:"cursor"`
+	Notes      []MessageDTO `json:"notes"`
+	DeletedIDs []int64      `json:"deleted_ids"`
+	Tags       []string     `json:"tags,omitempty"`
+	HasMore    bool         `json:"has_more"`
+	// Snapshot is set with HasMore while a snapshot has pages left; the
+	// next page is requested with it instead of a cursor.
+	Snapshot string `json:"snapshot,omitempty"`
+}
+
+// Sync returns changes after opts.Since. Delivery is at-least-once: a note
+// changed while the sync runs may be returned again by the next call.
+// Encrypted notes are always returned locked, so replicas never keep a
+// plaintext copy that would outlive locking.
+func (s *NotesService) Sync(ctx context.Context, opts SyncOptions) (SyncResult, error) {
+	ctx = withoutDecryption(ctx)
+	if opts.Since < 0 {
+		return SyncResult{}, fmt.Errorf("invalid sync cursor %d", opts.Since)
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = defaultSyncLimit
+	}
+	if opts.Since == 0 || opts.Snapshot != "" {
+		return s.syncSnapshot(ctx, opts)
+	}
+	result := SyncResult{Cursor: opts.Since, Notes: []MessageDTO{}, DeletedIDs: []int64{}}
+
+	changes, err := s.ChangesSince(ctx, opts.Since, opts.Limit+1)
+	if err != nil {
+		return SyncResult{}, err
+	}
+	if len(changes) > opts.Limit {
+		changes = changes[:opts.Limit]
+		result.HasMore = true
+	}
+	if len(changes) == 0 {
+		return result, nil
+	}
+	result.Cursor = changes[len(changes)-1].ID
+
+	// Note IDs are never reused, so a changed note that no longer exists was
+	// permanently deleted and becomes a tombstone.
+	seen := make(map[int64]struct{})
+	var changedIDs []int64
+	for _, change := range changes {
+		if change.NoteID == 0 {
+			continue
+		}
+		if _, ok := seen[change.NoteID]; !ok {
+			seen[change.NoteID] = struct{}{}
+			changedIDs = append(changedIDs, change.NoteID)
+		}
+	}
+	if len(changedIDs) > 0 {
+		filter, filterArgs := noteFilter(ctx, "")
+		notes, err := s.loadNotes(ctx,
+			fmt.Sprintf("SELECT %s FROM messages WHERE %s AND id IN (%s) ORDER BY id", noteColumns, filter, generatePlaceholders(len(changedIDs))),
+			append(filterArgs, idsToArgs(changedIDs)...)...,
+		)
+		if err != nil {
+			return SyncResult{}, err
+		}
+		found := make(map[int64]struct{}, len(notes))
+		for _, note := range notes {
+			found[note.ID] = struct{}{}
+		}
+		result.Notes = notes
+		for _, id := range changedIDs {
+			if _, ok := found[id]; !ok {
+				result.DeletedIDs = append(result.DeletedIDs, id)
+			}
+		}
+	}
+	if result.Tags, err = s.ListTags(ctx); err != nil {
+		return SyncResult{}, err
+	}
+	return result, nil
+}
+
+// syncSnapshot returns one page of notes in ID order. The change cursor is
+// taken before the first page and carried in the snapshot token, so changes
+// made while the pages are fetched are returned by the incremental syncs
+// that follow. The tags come with the last page.
+func (s *NotesService) syncSnapshot(ctx context.Context, opts SyncOptions) (SyncResult, error) {
+	result := SyncResult{Notes: []MessageDTO{}, DeletedIDs: []int64{}}
+	var afterID int64
+	var err error
+	if opts.Snapshot != "" {
+		if result.Cursor, afterID, err = parseSnapshotToken(opts.Snapshot); err != nil {
+			return SyncResult{}, err
+		}
+	} else if result.Cursor, err = s.lastChangeID(ctx); err != nil {
+		return SyncResult{}, err
+	}
+	filter, filterArgs := noteFilter(ctx, "")
+	notes, err := s.loadNotes(ctx,
+		"SELECT "+noteColumns+" FROM messages WHERE "+filter+" AND id > ? ORDER BY id LIMIT ?",
+		append(filterArgs, afterID, opts.Limit+1)...,
+	)
+	if err != nil {
+		return SyncResult{}, err
+	}
+	if len(notes) > opts.Limit {
+		notes = notes[:opts.Limit]
+		result.HasMore = true
+		result.Snapshot = fmt.Sprintf("%d.%d", result.Cursor, notes[len(notes)-1].ID)
+	}
+	result.Notes = notes
+	if !result.HasMore {
+		if result.Tags, err = s.ListTags(ctx); err != nil {
+			return SyncResult{}, err
+		}
+	}
+	return result, nil
+}
+
+func parseSnapshotToken(token string) (cursor, afterID int64, err error) {
+	cursorPart, afterPart, ok := strings.Cut(token, ".")
+	if ok {
+		cursor, err = strconv.ParseInt(cursorPart, 10, 64)
+	}
+	if ok && err == nil {
+		afterID, err = strconv.ParseInt(afterPart, 10, 64)
+	}
+	if !ok || err != nil || cursor < 0 || afterID < 0 {
+		return 0, 0, fmt.Errorf("invalid snapshot token %q", token)
+	}
+	return cursor, afterID, nil
+}
+
+// loadNotes runs a query selecting noteColumns and fills tags, attachments
+// and links for the returned notes. Encrypted notes are decrypted when the
+// call may do so and returned locked otherwise.
+func (s *NotesService) loadNotes(ctx context.Context, query string, args ...any) ([]MessageDTO, error) {
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	notes := []MessageDTO{}
+	var ids []int64
+	for rows.Next() {
+		var note MessageDTO
+		if err := scanNote(rows, &note); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		note.Tags = []string{}
+		note.Attachments = []AttachmentDTO{}
+		note.Links = []int64{}
+		note.Backlinks = []int64{}
+		notes = append(notes, note)
+		ids = append(ids, note.ID)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, err
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := s.populateRelations(ctx, notes, ids); err != nil {
+		return nil, err
+	}
+	s.revealNotes(ctx, notes)
+	return notes, nil
+}
@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestSyncReturnsChangesAndTombstones(t *testing.T) {
+	ctx := context.Background()
+	service := newTestNotesService(t)
+	kept, err := service.CreateNote(ctx, CreateNoteOptions{Content: "kept #a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doomed, err := service.CreateNote(ctx, CreateNoteOptions{Content: "doomed #b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := service.Sync(ctx, SyncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Notes) != 2 || snapshot.Cursor == 0 || len(snapshot.Tags) != 2 {
+		t.Fatalf("snapshot = %+v", snapshot)
+	}
+	if empty, err := service.Sync(ctx, SyncOptions{Since: snapshot.Cursor}); err != nil || len(empty.Notes) != 0 || empty.Cursor != snapshot.Cursor {
+		t.Fatalf("sync without changes = %+v, %v", empty, err)
+	}
+
+	content := "kept and edited #a"
+	if _, err := service.UpdateNote(ctx, kept.ID, UpdateNoteOptions{Content: &content}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.MoveToTrash(ctx, []int64{doomed.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.DeletePermanently(ctx, []int64{doomed.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.ReorderTags(ctx, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := service.Sync(ctx, SyncOptions{Since: snapshot.Cursor, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !page.HasMore || len(page.Notes) != 1 || page.Notes[0].Content != content {
+		t.Fatalf("first incremental page = %+v", page)
+	}
+	rest, err := service.Sync(ctx, SyncOptions{Since: page.Cursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rest.HasMore || len(rest.Notes) != 0 || len(rest.DeletedIDs) != 1 || rest.DeletedIDs[0] != doomed.ID {
+		t.Fatalf("second incremental page = %+v", rest)
+	}
+	if len(rest.Tags) != 1 || rest.Tags[0] != "a" {
+		t.Fatalf("tags after reorder and delete = %v", rest.Tags)
+	}
+}
+
+func TestSyncSnapshotPages(t *testing.T) {
+	ctx := context.Background()
+	service := newTestNotesService(t)
+	var ids []int64
+	for _, content := range []string{"one #a", "two", "three"} {
+		note, err := service.CreateNote(ctx, CreateNoteOptions{Content: content})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, note.ID)
+	}
+
+	first, err := service.Sync(ctx, SyncOptions{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.HasMore || first.Snapshot == "" || len(first.Notes) != 2 || first.Notes[1].ID != ids[1] || first.Tags != nil {
+		t.Fatalf("first snapshot page = %+v", first)
+	}
+	// A note already paged through changes before the snapshot ends.
+	content := "one edited #a"
+	if _, err := service.UpdateNote(ctx, ids[0], UpdateNoteOptions{Content: &content}); err != nil {
+		t.Fatal(err)
+	}
+	last, err := service.Sync(ctx, SyncOptions{Snapshot: first.Snapshot, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.HasMore || last.Snapshot != "" || len(last.Notes) != 1 || last.Notes[0].ID != ids[2] || len(last.Tags) != 1 {
+		t.Fatalf("last snapshot page = %+v", last)
+	}
+	if last.Cursor != first.Cursor {
+		t.Fatalf("snapshot cursor moved from %d to %d", first.Cursor, last.Cursor)
+	}
+	next, err := service.Sync(ctx, SyncOptions{Since: last.Cursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next.Notes) != 1 || next.Notes[0].Content != content {
+		t.Fatalf("sync after snapshot = %+v", next)
+	}
+
+	if _, err := service.Sync(ctx, SyncOptions{Snapshot: "bogus"}); err == nil {
+		t.Fatal("Sync accepted an invalid snapshot token")
+	}
+}
+
+func TestHTTPAPISync(t *testing.T) {
+	router, service := newTestAPIRouter(t)
+	note, err := service.CreateNote(t.Context(), CreateNoteOptions{Content: "replicated"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := decodeAPIResult[SyncResult](t, callAPI(t, router, httptest.NewRequest(http.MethodGet, "/api/sync", nil)))
+	if len(snapshot.Notes) != 1 || snapshot.Notes[0].ID != note.ID {
+		t.Fatalf("snapshot = %+v", snapshot)
+	}
+	if _, err := service.SetArchived(t.Context(), []int64{note.ID}, true); err != nil {
+		t.Fatal(err)
+	}
+	next := decodeAPIResult[SyncResult](t, callAPI(t, router,
+		httptest.NewRequest(http.MethodGet, "/api/sync?since="+strconv.FormatInt(snapshot.Cursor, 10), nil)))
+	if len(next.Notes) != 1 || next.Notes[0].IsArchived != 1 || next.Cursor <= snapshot.Cursor {
+		t.Fatalf("incremental sync = %+v", next)
+	}
+}
@@ -0,0 +1,255 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Token scopes. Each scope includes the ones before it: write tokens read,
+// and delete tokens also write.
+const (
+	ScopeRead   = "read"
+	ScopeWrite  = "write"
+	ScopeDelete = "delete"
+)
+
+const (
+	tokenPrefix     = "gnt_"
+	tokenBytes      = 32
+	maxTokenName    = 64
+	tokenTouchDelay = time.Minute
+)
+
+var scopeLevels = map[string]int{ScopeRead: 1, ScopeWrite: 2, ScopeDelete: 3}
+
+// APIToken is a personal access token for scripts and agents. Only a hash of
+// the secret is stored; the secret itself is shown once, on creation.
+type APIToken struct {
+	ID      int64  `json:"id"`
+	OwnerID int64  `json:"-"`
+	Name    string `json:"name"`
+	Scope   string `json:"scope"`
+	// Tags, when set, limit the token to notes carrying one of them.
+	Tags       []string `json:"tags"`
+	CreatedAt  string   `json:"created_at"`
+	ExpiresAt  *string  `json:"expires_at"`
+	LastUsedAt *string  `json:"last_used_at"`
+}
+
+type CreateTokenOptions struct {
+	Name  string
+	Scope string
+	Tags  []string
+	// ExpiresIn is the token lifetime; zero means the token never expires.
+	ExpiresIn time.Duration
+}
+
+// Allows reports whether the token grants scope.
+func (t APIToken) Allows(scope string) bool {
+	return scopeLevels[t.Scope] >= scopeLevels[scope]
+}
+
+type tokenKey struct{}
+
+func withToken(ctx context.Context, token APIToken) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// tokenFrom returns the access token a call is made with. Calls without one
+// come from a signed-in user, the CLI or the legacy MCP token and may do
+// anything within their notebook.
+func tokenFrom(ctx context.Context) (APIToken, bool) {
+	token, ok := ctx.Value(tokenKey{}).(APIToken)
+	return token, ok
+}
+
+// requireScope fails when the call is made with a token that lacks scope.
+func requireScope(ctx context.Context, scope string) error {
+	if token, ok := tokenFrom(ctx); ok && !token.Allows(scope) {
+		return fmt.Errorf("the access token %q has %s scope, %s is required", token.Name, token.Scope, scope)
+	}
+	return nil
+}
+
+// restrictedTags returns the tags a tag-restricted token is limited to.
+func restrictedTags(ctx context.Context) []string {
+	token, _ := tokenFrom(ctx)
+	return token.Tags
+}
+
+// noteFilter returns the SQL condition matching the notes a call may touch:
+// those of its user, narrowed to the tags of a tag-restricted token. alias
+// prefixes the messages columns, such as "m.".
+func noteFilter(ctx context.Context, alias string) (string, []any) {
+	clause := alias + "owner_id = ?"
+	args := []any{ownerID(ctx)}
+	if tags := restrictedTags(ctx); len(tags) > 0 {
+		clause += fmt.Sprintf(` AND %sid IN (
+			SELECT mt.message_id FROM message_tags mt JOIN tags t ON t.id = mt.tag_id
+			WHERE t.name IN (%s))`, alias, generatePlaceholders(len(tags)))
+		for _, tag := range tags {
+			args = append(args, tag)
+		}
+	}
+	return clause, args
+}
+
+// requireRestrictedTag keeps a tag-restricted token from writing notes it
+// could not read back.
+func requireRestrictedTag(ctx context.Context, content string) error {
+	tags := restrictedTags(ctx)
+	if len(tags) == 0 {
+		return nil
+	}
+	for _, tag := range extractHashtags(content) {
+		for _, allowed := range tags {
+			if tag == allowed {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("the access token only allows notes tagged #%s", strings.Join(tags, ", #"))
+}
+
+// requireSignedIn keeps access tokens from managing access tokens.
+func requireSignedIn(ctx context.Context) error {
+	if _, ok := tokenFrom(ctx); ok {
+		return errors.New("access tokens cannot manage access tokens")
+	}
+	return nil
+}
+
+// CreateToken issues an access token for the calling user and returns it
+// with its secret.
+func (s *NotesService) CreateToken(ctx context.Context, opts CreateTokenOptions) (APIToken, string, error) {
+	if err := requireSignedIn(ctx); err != nil {
+		return APIToken{}, "", err
+	}
+	name := strings.TrimSpace(opts.Name)
+	if name == "" || len(name) > maxTokenName {
+		return APIToken{}, "", fmt.Errorf("token name must be 1 to %d bytes", maxTokenName)
+	}
+	if opts.Scope == "" {
+		opts.Scope = ScopeRead
+	}
+	if scopeLevels[opts.Scope] == 0 {
+		return APIToken{}, "", fmt.Errorf("invalid scope %q: use read, write, or delete", opts.Scope)
+	}
+	tags, err := normalizeTagNames(opts.Tags)
+	if err != nil {
+		return APIToken{}, "", err
+	}
+	if opts.ExpiresIn < 0 {
+		return APIToken{}, "", errors.New("token lifetime must not be negative")
+	}
+	var expiresAt any
+	if opts.ExpiresIn > 0 {
+		expiresAt = time.Now().Add(opts.ExpiresIn).UTC().Format(time.DateTime)
+	}
+
+	raw := make([]byte, tokenBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return APIToken{}, "", err
+	}
+	secret := tokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	token, err := scanToken(s.DB.QueryRowContext(ctx, `
+		INSERT INTO api_tokens (owner_id, name, token_hash, scope, tags, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING `+tokenColumns,
+		ownerID(ctx), name, hashSessionToken(secret), opts.Scope, strings.Join(tags, " "), expiresAt,
+	))
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return APIToken{}, "", fmt.Errorf("token %q already exists", name)
+	}
+	if err != nil {
+		return APIToken{}, "", err
+	}
+	return token, secret, nil
+}
+
+func (s *NotesService) ListTokens(ctx context.Context) ([]APIToken, error) {
+	if err := requireSignedIn(ctx); err != nil {
+		return nil, err
+	}
+	rows, err := s.DB.QueryContext(ctx, "SELECT "+tokenColumns+" FROM api_tokens WHERE owner_id = ? ORDER BY id", ownerID(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []APIToken{}
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeToken deletes an access token of the calling user, found by ID or
+// name.
+func (s *NotesService) RevokeToken(ctx context.Context, idOrName string) error {
+	if err := requireSignedIn(ctx); err != nil {
+		return err
+	}
+	res, err := s.DB.ExecContext(ctx,
+		"DELETE FROM api_tokens WHERE owner_id = ? AND (CAST(id AS TEXT) = ? OR name = ?)",
+		ownerID(ctx), idOrName, idOrName,
+	)
+	if err != nil {
+		return err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return fmt.Errorf("token %q not found", idOrName)
+	}
+	return nil
+}
+
+// TokenAuth checks an access token secret and records its use, at most once
+// a minute.
+func (s *NotesService) TokenAuth(ctx context.Context, secret string) (APIToken, error) {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return APIToken{}, ErrInvalidCredentials
+	}
+	now := time.Now().UTC()
+	hash := hashSessionToken(secret)
+	token, err := scanToken(s.DB.QueryRowContext(ctx,
+		"SELECT "+tokenColumns+" FROM api_tokens WHERE token_hash = ? AND (expires_at IS NULL OR expires_at > ?)",
+		hash, now.Format(time.DateTime),
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIToken{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return APIToken{}, err
+	}
+	if token.LastUsedAt == nil || now.Sub(parseDBTime(*token.LastUsedAt)) > tokenTouchDelay {
+		if _, err := s.DB.ExecContext(ctx, "UPDATE api_tokens SET last_used_at = ? WHERE token_hash = ?",
+			now.Format(time.DateTime), hash,
+		); err != nil {
+			return APIToken{}, err
+		}
+	}
+	return token, nil
+}
+
+const tokenColumns = "id, owner_id, name, scope, tags, created_at, expires_at, last_used_at"
+
+func scanToken(row rowScanner) (APIToken, error) {
+	var token APIToken
+	var tags string
+	err := row.Scan(&token.ID, &token.OwnerID, &token.Name, &token.Scope, &tags,
+		&token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt)
+	token.Tags = strings.Fields(tags)
+	if token.Tags == nil {
+		token.Tags = []string{}
+	}
+	return token, err
+}
@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createTestToken(t *testing.T, service *NotesService, ctx context.Context, opts CreateTokenOptions) string {
+	t.Helper()
+	_, secret, err := service.CreateToken(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+func TestTokenScopesOverHTTPAPI(t *testing.T) {
+	router, service := newTestAuthRouter(t, AuthOptions{Mode: AuthSession})
+	alice, err := service.CreateUser(context.Background(), "alice", "alice-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithUser(context.Background(), alice.ID)
+	note, err := service.CreateNote(ctx, CreateNoteOptions{Content: "Alice's note"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := createTestToken(t, service, ctx, CreateTokenOptions{Name: "reader"})
+	write := createTestToken(t, service, ctx, CreateTokenOptions{Name: "writer", Scope: ScopeWrite})
+
+	call := func(method, path, body, secret string) *httptest.ResponseRecorder {
+		t.Helper()
+		request := jsonAPIRequest(t, method, path, body)
+		request.RemoteAddr = "203.0.113.7:5000"
+		request.Header.Set("Authorization", "Bearer "+secret)
+		return callAPI(t, router, request)
+	}
+	notes := decodeAPIResult[[]MessageDTO](t, call(http.MethodGet, "/api/messages/list", "", read))
+	if len(notes) != 1 || notes[0].ID != note.ID {
+		t.Fatalf("read token listed %+v", notes)
+	}
+	if response := call(http.MethodPost, "/api/messages/use", `{"id":1}`, read); response.Code != http.StatusForbidden {
+		t.Fatalf("read token posted: status %d", response.Code)
+	}
+	if response := call(http.MethodGet, "/api/messages/list", "", "gnt_unknown"); response.Code != http.StatusUnauthorized {
+		t.Fatalf("unknown token: status %d", response.Code)
+	}
+
+	// The second delete would remove the trashed note for good.
+	body := fmt.Sprintf(`{"ids":[%d]}`, note.ID)
+	decodeAPIResult[string](t, call(http.MethodPost, "/api/messages/batch-delete", body, write))
+	response := call(http.MethodPost, "/api/messages/batch-delete", body, write)
+	if !strings.Contains(response.Body.String(), "delete is required") {
+		t.Fatalf("write token deleted permanently: %s", response.Body.String())
+	}
+	if _, err := service.GetNote(ctx, note.ID); err != nil {
+		t.Fatalf("note gone after a write token delete: %v", err)
+	}
+
+	// Tokens cannot issue more tokens.
+	response = call(http.MethodPost, "/api/tokens/create", `{"name":"escalated","scope":"delete"}`, write)
+	if !strings.Contains(response.Body.String(), "cannot manage") {
+		t.Fatalf("token created a token: %s", response.Body.String())
+	}
+	tokens, err := service.ListTokens(ctx)
+	if err != nil || len(tokens) != 2 || tokens[0].LastUsedAt == nil {
+		t.Fatalf("tokens = %+v, %v", tokens, err)
+	}
+}
+
+func TestTagRestrictedToken(t *testing.T) {
+	service := newTestNotesService(t)
+	ctx := context.Background()
+	work, err := service.CreateNote(ctx, CreateNoteOptions{Content: "Standup #work"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := service.CreateNote(ctx, CreateNoteOptions{Content: "Diary #private"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := service.CreateToken(ctx, CreateTokenOptions{Name: "work", Scope: ScopeWrite, Tags: []string{"work"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenCtx := withToken(ctx, token)
+
+	result, err := service.ListNotes(tokenCtx, ListNotesOptions{})
+	if err != nil || len(result.Notes) != 1 || result.Notes[0].ID != work.ID {
+		t.Fatalf("restricted list = %+v, %v", result.Notes, err)
+	}
+	if _, err := service.GetNote(tokenCtx, private.ID); err == nil {
+		t.Fatal("restricted token read an untagged note")
+	}
+	if tags, err := service.ListTags(tokenCtx); err != nil || len(tags) != 1 || tags[0] != "work" {
+		t.Fatalf("restricted tags = %v, %v", tags, err)
+	}
+	if _, err := service.CreateNote(tokenCtx, CreateNoteOptions{Content: "Elsewhere #private"}); err == nil {
+		t.Fatal("restricted token created a note outside its tags")
+	}
+	if _, err := service.CreateNote(tokenCtx, CreateNoteOptions{Content: "Retro #work"}); err != nil {
+		t.Fatalf("restricted token could not create a tagged note: %v", err)
+	}
+	if err := service.ReorderTags(tokenCtx, []string{"work"}); err == nil {
+		t.Fatal("restricted token reordered tags")
+	}
+}
+
+func TestTokenExpiryAndRevocation(t *testing.T) {
+	service := newTestNotesService(t)
+	ctx := context.Background()
+	secret := createTestToken(t, service, ctx, CreateTokenOptions{Name: "short", ExpiresIn: time.Hour})
+	if _, err := service.TokenAuth(ctx, secret); err != nil {
+		t.Fatalf("fresh token rejected: %v", err)
+	}
+	if _, err := service.DB.Exec("UPDATE api_tokens SET expires_at = '2000-01-01 00:00:00'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.TokenAuth(ctx, secret); err != ErrInvalidCredentials {
+		t.Fatalf("expired token: %v", err)
+	}
+
+	secret = createTestToken(t, service, ctx, CreateTokenOptions{Name: "revoked"})
+	if err := service.RevokeToken(ctx, "revoked"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.TokenAuth(ctx, secret); err != ErrInvalidCredentials {
+		t.Fatalf("revoked token: %v", err)
+	}
+	if _, _, err := service.CreateToken(ctx, CreateTokenOptions{Name: "bad", Scope: "admin"}); err == nil {
+		t.Fatal("unknown scope accepted")
+	}
+}
+
+func mcpRequest(t *testing.T, router *Router, secret, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	request := httptest.NewRequest(http.MethodPost, "/mcp", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "application/json, text/event-stream")
+	request.Header.Set("Authorization", "Bearer "+secret)
+	request.Header.Set("MCP-Protocol-Version", "2025-06-18")
+	return callAPI(t, router, request)
+}
+
+func TestMCPToolsFollowTokenScope(t *testing.T) {
+	service := newTestNotesService(t)
+	router := NewRouter()
+	HandleMCP(router, service, "", "test")
+	ctx := context.Background()
+	if _, err := service.CreateUser(ctx, "alice", "alice-password"); err != nil {
+		t.Fatal(err)
+	}
+	bob, err := service.CreateUser(ctx, "bob", "bob-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobCtx := WithUser(ctx, bob.ID)
+	if _, err := service.CreateNote(bobCtx, CreateNoteOptions{Content: "Bob's plan"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.CreateNote(ctx, CreateNoteOptions{Content: "Alice's plan"}); err != nil {
+		t.Fatal(err)
+	}
+
+	const listTools = `{"jsonrpc":"2.0","id":1,"method":"tools/list","params":{}}`
+	if response := mcpRequest(t, router, "anything", listTools); response.Code != http.StatusUnauthorized {
+		t.Fatalf("unknown token: status %d", response.Code)
+	}
+	read := createTestToken(t, service, bobCtx, CreateTokenOptions{Name: "agent"})
+	body := mcpRequest(t, router, read, listTools).Body.String()
+	if !strings.Contains(body, `"name":"notes_list"`) {
+		t.Fatalf("read token tools lack notes_list: %s", body)
+	}
+	for name := range mcpToolScopes {
+		if strings.Contains(body, `"name":"`+name+`"`) {
+			t.Errorf("read token sees %s", name)
+		}
+	}
+	write := createTestToken(t, service, bobCtx, CreateTokenOptions{Name: "writer", Scope: ScopeWrite})
+	body = mcpRequest(t, router, write, listTools).Body.String()
+	if !strings.Contains(body, `"name":"note_create"`) || strings.Contains(body, `"name":"notes_delete_permanently"`) {
+		t.Fatalf("write token tools: %s", body)
+	}
+
+	body = mcpRequest(t, router, read, `{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{
+		"name":"notes_list","arguments":{}
+	}}`).Body.String()
+	if !strings.Contains(body, "Bob's plan") || strings.Contains(body, "Alice's plan") {
+		t.Fatalf("bob's token listed: %s", body)
+	}
+}
+
+func TestMCPToolScopesCoverEveryWriteTool(t *testing.T) {
+	router := NewRouter()
+	HandleMCP(router, newTestNotesService(t), "test-secret", "test")
+	response := mcpRequest(t, router, "test-secret", `{"jsonrpc":"2.0","id":1,"method":"tools/list","params":{}}`)
+	var envelope struct {
+		Result struct {
+			Tools []struct {
+				Name        string `json:"name"`
+				Annotations struct {
+					ReadOnlyHint bool `json:"readOnlyHint"`
+				} `json:"annotations"`
+			} `json:"tools"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &envelope); err != nil || len(envelope.Result.Tools) == 0 {
+		t.Fatalf("tools/list: %v, body = %s", err, response.Body.String())
+	}
+	for _, tool := range envelope.Result.Tools {
+		if _, scoped := mcpToolScopes[tool.Name]; !tool.Annotations.ReadOnlyHint && !scoped {
+			t.Errorf("%s changes notes but has no scope in mcpToolScopes", tool.Name)
+		}
+	}
+}
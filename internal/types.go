@@ -12,7 +12,16 @@ type MessageDTO struct {
 	IsExpanded  int             `json:"is_expanded"`
 	Tags        []string        `json:"tags"`
 	Attachments []AttachmentDTO `json:"attachments"`
+	Links       []int64         `json:"links"`
+	Backlinks   []int64         `json:"backlinks"`
 	Color       string          `json:"color"`
+	Version     int64           `json:"version"`
+	IsEncrypted int             `json:"is_encrypted"`
+	// Locked marks an encrypted note returned without its content because
+	// the call cannot decrypt it.
+	Locked bool `json:"locked,omitempty"`
+	// Snippets is only filled in snippet mode, where Content is left empty.
+	Snippets []SearchSnippet `json:"snippets,omitempty"`
 }
 
 type AttachmentDTO struct {
@@ -20,4 +29,41 @@ type AttachmentDTO struct {
 	FilePath      string `json:"file_path"`
 	FileType      string `json:"file_type"`
 	ThumbnailPath string `json:"thumbnail_path"`
+	OriginalName  string `json:"original_name"`
+	Size          int64  `json:"size"`
+	MimeType      string `json:"mime_type"`
+	// Width and Height of images, TakenAt from their EXIF data and Duration
+	// in seconds of audio and video are read from the content when it is
+	// known; encrypted notes have none of them.
+	Width    *int     `json:"width,omitempty"`
+	Height   *int     `json:"height,omitempty"`
+	TakenAt  *string  `json:"taken_at,omitempty"`
+	Duration *float64 `json:"duration,omitempty"`
+
+	// storedFile and storedThumbnail name the files in the uploads
+	// directory: blob hashes, or file_path for attachments stored before
+	// blobs.
+	storedFile, storedThumbnail string
+}
+
+type RevisionDTO struct {
+	ID        int64  `json:"id"`
+	NoteID    int64  `json:"note_id"`
+	CreatedAt string `json:"created_at"`
+	Length    int    `json:"length"`
+	Content   string `json:"content,omitempty"`
+}
+
+// SearchSnippet is an excerpt of note content around search hits. Start and
+// the match ranges are rune offsets; Start is relative to the note content and
+// match ranges are relative to Text.
+type SearchSnippet struct {
+	Text    string       `json:"text"`
+	Start   int          `json:"start"`
+	Matches []MatchRange `json:"matches"`
+}
+
+type MatchRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
 }
@@ -0,0 +1,353 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const uploadSessionIDBytes = 16
+
+// defaultMaxUploadSize is the MaxUploadSize of NewNotesService.
+const defaultMaxUploadSize = 4 << 30
+
+// uploadSessionTTL is how long an upload may go without a new chunk before
+// CollectUploadSessions removes it.
+const uploadSessionTTL = 24 * time.Hour
+
+// ErrUploadNotFound is returned for upload sessions that do not exist, were
+// attached to a note already or belong to another user.
+var ErrUploadNotFound = errors.New("upload not found")
+
+// ErrUploadSize is returned for a chunk that runs past the declared size of
+// the upload.
+var ErrUploadSize = errors.New("chunk exceeds the size of the upload")
+
+// ErrUploadTooLarge is returned for an upload larger than MaxUploadSize.
+var ErrUploadTooLarge = errors.New("upload exceeds the maximum size")
+
+// ErrUploadOffset is returned for a chunk that does not start where the
+// upload stands; the client reads the offset again and resumes from there.
+var ErrUploadOffset = errors.New("chunk offset does not match the upload")
+
+// UploadSession is a file sent in chunks, so large files need not fit into
+// one request and an interrupted transfer resumes at Offset. Once Offset
+// reaches Size the file is attached to a note by passing ID as
+// NewAttachment.Upload.
+type UploadSession struct {
+	ID        string `json:"id"`
+	Filename  string `json:"filename"`
+	Size      int64  `json:"size"`
+	Offset    int64  `json:"offset"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+
+	// parts counts the chunk files of the upload in UploadsDir.
+	parts int
+}
+
+const uploadSessionColumns = "id, filename, size, received, created_at, updated_at, parts"
+
+func scanUploadSession(row rowScanner) (UploadSession, error) {
+	var session UploadSession
+	err := row.Scan(&session.ID, &session.Filename, &session.Size, &session.Offset,
+		&session.CreatedAt, &session.UpdatedAt, &session.parts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UploadSession{}, ErrUploadNotFound
+	}
+	return session, err
+}
+
+// CreateUploadSession starts an upload of size bytes for the calling user.
+func (s *NotesService) CreateUploadSession(ctx context.Context, filename string, size int64) (UploadSession, error) {
+	if _, err := attachmentName(filename); err != nil {
+		return UploadSession{}, err
+	}
+	if size < 0 {
+		return UploadSession{}, errors.New("upload size must not be negative")
+	}
+	if s.MaxUploadSize > 0 && size > s.MaxUploadSize {
+		return UploadSession{}, fmt.Errorf("%w of %d bytes", ErrUploadTooLarge, s.MaxUploadSize)
+	}
+	raw := make([]byte, uploadSessionIDBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return UploadSession{}, err
+	}
+	return scanUploadSession(s.DB.QueryRowContext(ctx, `
+		INSERT INTO upload_sessions (id, owner_id, filename, size)
+		VALUES (?, ?, ?, ?)
+		RETURNING `+uploadSessionColumns,
+		hex.EncodeToString(raw), ownerID(ctx), filename, size,
+	))
+}
+
+// GetUploadSession returns an upload of the calling user.
+func (s *NotesService) GetUploadSession(ctx context.Context, id string) (UploadSession, error) {
+	return scanUploadSession(s.DB.QueryRowContext(ctx,
+		"SELECT "+uploadSessionColumns+" FROM upload_sessions WHERE id = ? AND owner_id = ?", id, ownerID(ctx),
+	))
+}
+
+// AppendUploadSession adds the bytes of src to an upload, which must stand
+// at offset. Each chunk is kept in its own file in UploadsDir, encrypted
+// like stored files, and counts only once it is read completely: a chunk
+// that fails midway leaves the upload as it was.
+func (s *NotesService) AppendUploadSession(ctx context.Context, id string, offset int64, src io.Reader) (UploadSession, error) {
+	session, err := s.GetUploadSession(ctx, id)
+	if err != nil {
+		return UploadSession{}, err
+	}
+	if offset != session.Offset {
+		return session, fmt.Errorf("%w: upload %s has %d of %d bytes", ErrUploadOffset, id, session.Offset, session.Size)
+	}
+	if err := os.MkdirAll(s.UploadsDir, 0755); err != nil {
+		return session, err
+	}
+	temp, err := os.CreateTemp(s.UploadsDir, ".chunk-*")
+	if err != nil {
+		return session, err
+	}
+	defer os.Remove(temp.Name())
+	remaining := session.Size - offset
+	counter := new(byteCounter)
+	err = copyUpload(temp, io.TeeReader(io.LimitReader(src, remaining+1), counter), s.UploadsKey)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return session, err
+	}
+	if int64(*counter) > remaining {
+		return session, fmt.Errorf("%w: upload %s has %d bytes left", ErrUploadSize, id, remaining)
+	}
+	if *counter == 0 {
+		return session, nil
+	}
+
+	// The update takes the database write lock, so a concurrent chunk for
+	// the same offset waits for the commit and then finds the offset moved.
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return session, err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `
+		UPDATE upload_sessions SET received = received + ?, parts = parts + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND received = ?`, int64(*counter), id, offset)
+	if err != nil {
+		return session, err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		if err := tx.Rollback(); err != nil {
+			return session, err
+		}
+		if session, err = s.GetUploadSession(ctx, id); err != nil {
+			return UploadSession{}, err
+		}
+		return session, fmt.Errorf("%w: upload %s has %d of %d bytes", ErrUploadOffset, id, session.Offset, session.Size)
+	}
+	part := s.uploadSessionPart(id, session.parts)
+	if err := os.Rename(temp.Name(), part); err != nil {
+		return session, err
+	}
+	if err := tx.Commit(); err != nil {
+		os.Remove(part)
+		return session, err
+	}
+	return s.GetUploadSession(ctx, id)
+}
+
+func (s *NotesService) uploadSessionPart(id string, index int) string {
+	return filepath.Join(s.UploadsDir, ".session-"+id+"-"+strconv.Itoa(index))
+}
+
+// claimUploadSession turns a finished upload into the file of attachment
+// within tx. The upload is deleted with tx; its chunk files stay until
+// removeUploadSessionFiles runs after the commit.
+func (s *NotesService) claimUploadSession(ctx context.Context, tx *sql.Tx, attachment NewAttachment) (NewAttachment, error) {
+	session, err := scanUploadSession(tx.QueryRowContext(ctx,
+		"SELECT "+uploadSessionColumns+" FROM upload_sessions WHERE id = ? AND owner_id = ?", attachment.Upload, ownerID(ctx),
+	))
+	if err != nil {
+		return attachment, fmt.Errorf("upload %q: %w", attachment.Upload, err)
+	}
+	if session.Offset < session.Size {
+		return attachment, fmt.Errorf("upload %s is incomplete: %d of %d bytes", session.ID, session.Offset, session.Size)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM upload_sessions WHERE id = ?", session.ID); err != nil {
+		return attachment, err
+	}
+	attachment.Filename = session.Filename
+	attachment.Open = func() (io.ReadCloser, error) {
+		return &uploadSessionReader{service: s, id: session.ID, parts: session.parts}, nil
+	}
+	return attachment, nil
+}
+
+// DeleteUploadSession cancels an upload of the calling user and removes the
+// chunks it received.
+func (s *NotesService) DeleteUploadSession(ctx context.Context, id string) error {
+	res, err := s.DB.ExecContext(ctx, "DELETE FROM upload_sessions WHERE id = ? AND owner_id = ?", id, ownerID(ctx))
+	if err != nil {
+		return err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return ErrUploadNotFound
+	}
+	s.removeUploadSessionParts(id)
+	return nil
+}
+
+// CollectUploadSessions removes uploads of every user that received no
+// chunk for maxAge, and chunk files left behind by interrupted requests or
+// uploads that no longer exist.
+func (s *NotesService) CollectUploadSessions(ctx context.Context, maxAge time.Duration) (int, error) {
+	cutoff := time.Now().Add(-maxAge)
+	rows, err := s.DB.QueryContext(ctx,
+		"DELETE FROM upload_sessions WHERE updated_at < ? RETURNING id", cutoff.UTC().Format(time.DateTime),
+	)
+	if err != nil {
+		return 0, err
+	}
+	var expired []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		expired = append(expired, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, id := range expired {
+		s.removeUploadSessionParts(id)
+	}
+
+	entries, err := os.ReadDir(s.UploadsDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return len(expired), err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, ".chunk-") && !strings.HasPrefix(name, ".session-") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(name, ".session-"); ok {
+			id, _, _ := strings.Cut(rest, "-")
+			var exists bool
+			if err := s.DB.QueryRowContext(ctx,
+				"SELECT EXISTS (SELECT 1 FROM upload_sessions WHERE id = ?)", id,
+			).Scan(&exists); err != nil || exists {
+				continue
+			}
+		}
+		os.Remove(filepath.Join(s.UploadsDir, name))
+	}
+	return len(expired), nil
+}
+
+// RunUploadSessionCleanup collects stale uploads now and every interval
+// until ctx is done.
+func (s *NotesService) RunUploadSessionCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if removed, err := s.CollectUploadSessions(ctx, uploadSessionTTL); err != nil {
+			log.Printf("Upload cleanup error: %v", err)
+		} else if removed > 0 {
+			log.Printf("Removed %d stale uploads", removed)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// removeUploadSessionFiles removes the chunk files of the uploads attached
+// by a committed change.
+func (s *NotesService) removeUploadSessionFiles(attachments []NewAttachment) {
+	for _, attachment := range attachments {
+		if attachment.Upload != "" {
+			s.removeUploadSessionParts(attachment.Upload)
+		}
+	}
+}
+
+func (s *NotesService) removeUploadSessionParts(id string) {
+	parts, _ := filepath.Glob(filepath.Join(s.UploadsDir, ".session-"+id+"-*"))
+	for _, part := range parts {
+		os.Remove(part)
+	}
+}
+
+// uploadSessionReader reads the chunk files of an upload in order, opening
+// one at a time.
+type uploadSessionReader struct {
+	service *NotesService
+	id      string
+	parts   int
+	next    int
+	current io.ReadCloser
+}
+
+func (r *uploadSessionReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.next == r.parts {
+				return 0, io.EOF
+			}
+			file, err := os.Open(r.service.uploadSessionPart(r.id, r.next))
+			if err != nil {
+				return 0, err
+			}
+			info, err := file.Stat()
+			if err != nil {
+				file.Close()
+				return 0, err
+			}
+			reader, err := r.service.UploadsKey.open(localObject{File: file, info: info})
+			if err != nil {
+				file.Close()
+				return 0, fmt.Errorf("upload %s: %w", r.id, err)
+			}
+			r.current = reader
+			r.next++
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			err = r.current.Close()
+			r.current = nil
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *uploadSessionReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Close()
+}
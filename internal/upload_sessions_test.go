@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadSessions(t *testing.T) {
+	service := newTestNotesService(t)
+	key, err := OpenUploadsKey(service.UploadsDir, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.UploadsKey = key
+	ctx := context.Background()
+	video := bytes.Repeat([]byte("frame "), 50000)
+
+	service.MaxUploadSize = int64(len(video))
+	if _, err := service.CreateUploadSession(ctx, "holiday.mp4", int64(len(video))+1); !errors.Is(err, ErrUploadTooLarge) {
+		t.Fatalf("upload over the maximum size: %v", err)
+	}
+	session, err := service.CreateUploadSession(ctx, "holiday.mp4", int64(len(video)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.GetUploadSession(WithUser(ctx, 2), session.ID); !errors.Is(err, ErrUploadNotFound) {
+		t.Fatalf("upload of another user: %v", err)
+	}
+	if session, err = service.AppendUploadSession(ctx, session.ID, 0, bytes.NewReader(video[:100000])); err != nil || session.Offset != 100000 {
+		t.Fatalf("offset = %d, %v", session.Offset, err)
+	}
+	// A retried chunk whose result was lost is rejected, and the client
+	// resumes at the offset the upload reports.
+	if _, err := service.AppendUploadSession(ctx, session.ID, 0, bytes.NewReader(video[:100000])); !errors.Is(err, ErrUploadOffset) {
+		t.Fatalf("repeated chunk: %v", err)
+	}
+	if _, err := service.AppendUploadSession(ctx, session.ID, 100000, bytes.NewReader(append(video[100000:], '!'))); err == nil {
+		t.Fatal("chunk past the size was accepted")
+	}
+	if _, err := service.CreateNote(ctx, CreateNoteOptions{Content: "Too early", Attachments: []NewAttachment{{Upload: session.ID}}}); err == nil {
+		t.Fatal("incomplete upload was attached")
+	}
+	if session, err = service.AppendUploadSession(ctx, session.ID, 100000, bytes.NewReader(video[100000:])); err != nil || session.Offset != session.Size {
+		t.Fatalf("offset = %d, %v", session.Offset, err)
+	}
+	parts, _ := filepath.Glob(filepath.Join(service.UploadsDir, ".session-*"))
+	if len(parts) != 2 {
+		t.Fatalf("chunk files = %v", parts)
+	}
+	if data, _ := os.ReadFile(parts[0]); bytes.Contains(data, []byte("frame frame")) {
+		t.Fatal("chunk is stored in plaintext")
+	}
+
+	note, err := service.CreateNote(ctx, CreateNoteOptions{Content: "Holiday", Attachments: []NewAttachment{{Upload: session.ID}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attachment := note.Attachments[0]
+	if attachment.OriginalName != "holiday.mp4" || attachment.Size != int64(len(video)) {
+		t.Fatalf("attachment = %+v", attachment)
+	}
+	if _, err := service.GetUploadSession(ctx, session.ID); !errors.Is(err, ErrUploadNotFound) {
+		t.Fatalf("attached upload: %v", err)
+	}
+	if parts, _ := filepath.Glob(filepath.Join(service.UploadsDir, ".session-*")); len(parts) != 0 {
+		t.Fatalf("chunk files left = %v", parts)
+	}
+
+	chunk, err := service.ReadAttachmentChunk(ctx, note.ID, attachment.ID, 299990, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunk.Size != int64(len(video)) || !bytes.Equal(chunk.Data, video[299990:]) {
+		t.Fatalf("chunk = %q of %d bytes", chunk.Data, chunk.Size)
+	}
+	if _, err := service.ReadAttachmentChunk(ctx, note.ID, attachment.ID, chunk.Size+1, 10); err == nil ||
+		!strings.Contains(err.Error(), "past the end") {
+		t.Fatalf("read past the end: %v", err)
+	}
+}
+
+func TestCollectUploadSessions(t *testing.T) {
+	service := newTestNotesService(t)
+	ctx := context.Background()
+	stale, err := service.CreateUploadSession(ctx, "stale.mov", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.AppendUploadSession(ctx, stale.ID, 0, strings.NewReader("12345")); err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := service.CreateUploadSession(ctx, "fresh.mov", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.AppendUploadSession(ctx, fresh.ID, 0, strings.NewReader("12345")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.DB.Exec("UPDATE upload_sessions SET updated_at = datetime('now', '-2 days') WHERE id = ?", stale.ID); err != nil {
+		t.Fatal(err)
+	}
+	// A chunk file of an upload that no longer exists, and one of a request
+	// that never finished.
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{".session-0123-0", ".chunk-42"} {
+		path := filepath.Join(service.UploadsDir, name)
+		if err := os.WriteFile(path, []byte("left over"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first chunk of the fresh upload is as old, but the upload lives.
+	if err := os.Chtimes(service.uploadSessionPart(fresh.ID, 0), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if removed, err := service.CollectUploadSessions(ctx, uploadSessionTTL); err != nil || removed != 1 {
+		t.Fatalf("removed = %d, %v", removed, err)
+	}
+	if _, err := service.GetUploadSession(ctx, stale.ID); !errors.Is(err, ErrUploadNotFound) {
+		t.Fatalf("stale upload: %v", err)
+	}
+	parts, _ := filepath.Glob(filepath.Join(service.UploadsDir, ".[cs]*"))
+	if len(parts) != 1 || parts[0] != service.uploadSessionPart(fresh.ID, 0) {
+		t.Fatalf("files left = %v", parts)
+	}
+}
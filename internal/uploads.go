@@ -0,0 +1,602 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Encrypted uploads start with uploadMagic, the ID of the data key and a
+// random nonce prefix, followed by the file in uploadChunkSize chunks, each
+// sealed with AES-256-GCM. The nonce of a chunk is the prefix, the chunk
+// index and a flag marking the last chunk, so chunks cannot be reordered or
+// the file truncated unnoticed, and any range can be decrypted on its own.
+const (
+	uploadMagic        = "GNUPLD1\n"
+	uploadKeyIDBytes   = 8
+	uploadPrefixBytes  = 7
+	uploadHeaderBytes  = len(uploadMagic) + uploadKeyIDBytes + uploadPrefixBytes
+	uploadChunkSize    = 64 << 10
+	uploadTagBytes     = 16
+	uploadSealedChunk  = uploadChunkSize + uploadTagBytes
+	UploadsKeyFileName = ".uploads-key.json"
+)
+
+var ErrWrongUploadsSecret = errors.New("wrong uploads passphrase or key file")
+
+// UploadsKey encrypts new uploads with the current data key and decrypts
+// files written with any key it holds. A nil *UploadsKey stores files as
+// they are.
+type UploadsKey struct {
+	current string
+	aeads   map[string]cipher.AEAD
+	names   []byte
+}
+
+// uploadsKeyFile is stored in the uploads directory so backups carry it with
+// the files. Data keys are random and wrapped with a key derived from the
+// passphrase or key file; the first one encrypts new files. The name key,
+// wrapped the same way, names blobs and is kept by rekey.
+type uploadsKeyFile struct {
+	Salt       string              `json:"salt"`
+	Iterations int                 `json:"iterations"`
+	Keys       []wrappedUploadsKey `json:"keys"`
+	NameKey    string              `json:"name_key,omitempty"`
+}
+
+// uploadsKeys are the unwrapped keys of a key file.
+type uploadsKeys struct {
+	dataKeys map[string][]byte
+	current  string
+	nameKey  []byte
+}
+
+type wrappedUploadsKey struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+}
+
+// OpenUploadsKey unlocks the uploads key of dir with secret, creating a new
+// key when dir has none.
+func OpenUploadsKey(dir string, secret []byte) (*UploadsKey, error) {
+	keys, err := loadUploadsKey(dir, secret)
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		id, data, err := newUploadsDataKey()
+		if err != nil {
+			return nil, err
+		}
+		keys = &uploadsKeys{dataKeys: map[string][]byte{id: data}, current: id}
+	}
+	// Key files written before blobs were named with a key get one now.
+	if keys.nameKey == nil {
+		if keys.nameKey, err = newUploadsNameKey(); err != nil {
+			return nil, err
+		}
+		if err := saveUploadsKey(dir, secret, keys); err != nil {
+			return nil, err
+		}
+	}
+	return newUploadsKey(keys)
+}
+
+// RekeyUploads rewrites every file in storage under a new data key wrapped
+// with next, or decrypts them all and removes the key when next is nil. The
+// key is kept in dir. current unlocks the existing key, if there is one;
+// plaintext files are encrypted too. The new key file is written first and
+// keeps the old data keys until every file is rewritten, so an interrupted
+// rekey can be run again with next as the current secret. An encrypted
+// database at database is rewritten the same way before the old keys are
+// dropped; pass "" to leave it alone. The server must not be running.
+func RekeyUploads(ctx context.Context, dir string, storage Storage, database string, current, next []byte) (int, error) {
+	loaded, err := loadUploadsKey(dir, current)
+	if err != nil {
+		return 0, err
+	}
+	if loaded == nil {
+		if next == nil {
+			return 0, nil
+		}
+		loaded = &uploadsKeys{dataKeys: map[string][]byte{}}
+	}
+	if loaded.nameKey == nil {
+		if loaded.nameKey, err = newUploadsNameKey(); err != nil {
+			return 0, err
+		}
+	}
+	keys, err := newUploadsKey(loaded)
+	if err != nil {
+		return 0, err
+	}
+	var target *UploadsKey
+	if next != nil {
+		id, data, err := newUploadsDataKey()
+		if err != nil {
+			return 0, err
+		}
+		loaded.dataKeys[id] = data
+		loaded.current = id
+		if err := saveUploadsKey(dir, next, loaded); err != nil {
+			return 0, err
+		}
+		if target, err = newUploadsKey(loaded); err != nil {
+			return 0, err
+		}
+		keys = target
+	}
+
+	rewritten := 0
+	if err := storage.List(ctx, func(name string) error {
+		changed, err := rekeyUpload(ctx, dir, storage, name, keys, target)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if changed {
+			rewritten++
+		}
+		return nil
+	}); err != nil {
+		return rewritten, err
+	}
+	if database != "" {
+		encrypted, err := IsEncryptedDatabase(database)
+		if err != nil {
+			return rewritten, err
+		}
+		if encrypted {
+			if err := RekeyDatabase(database, keys, target); err != nil {
+				return rewritten, err
+			}
+		}
+	}
+
+	if target == nil {
+		return rewritten, os.Remove(filepath.Join(dir, UploadsKeyFileName))
+	}
+	final := &uploadsKeys{
+		dataKeys: map[string][]byte{target.current: loaded.dataKeys[target.current]},
+		current:  target.current,
+		nameKey:  loaded.nameKey,
+	}
+	return rewritten, saveUploadsKey(dir, next, final)
+}
+
+// rekeyUpload rewrites one file with target, or as plaintext when target is
+// nil, unless it is stored that way already. The file is written to dir
+// first and keeps its modification time in local storage.
+func rekeyUpload(ctx context.Context, dir string, storage Storage, name string, keys, target *UploadsKey) (bool, error) {
+	object, err := storage.Open(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	defer object.Close()
+	id, encrypted, err := readUploadHeader(object)
+	if err != nil {
+		return false, err
+	}
+	if (target == nil && !encrypted) || (target != nil && encrypted && id == target.current) {
+		return false, nil
+	}
+	source, err := keys.open(object)
+	if err != nil {
+		return false, err
+	}
+	temp, err := os.CreateTemp(dir, ".rekey-*")
+	if err != nil {
+		return false, err
+	}
+	err = copyUpload(temp, source, target)
+	if syncErr := temp.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(temp.Name(), object.ModTime(), object.ModTime())
+	}
+	if err == nil {
+		err = storage.Put(ctx, name, temp.Name())
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return false, err
+	}
+	return true, nil
+}
+
+// loadUploadsKey returns the keys of dir, or nil when dir has no key yet.
+func loadUploadsKey(dir string, secret []byte) (*uploadsKeys, error) {
+	data, err := os.ReadFile(filepath.Join(dir, UploadsKeyFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keyFile uploadsKeyFile
+	if err := json.Unmarshal(data, &keyFile); err != nil {
+		return nil, fmt.Errorf("read %s: %w", UploadsKeyFileName, err)
+	}
+	if len(keyFile.Keys) == 0 {
+		return nil, fmt.Errorf("%s has no keys", UploadsKeyFileName)
+	}
+	return unwrapUploadsKeys(&keyFile, secret)
+}
+
+func unwrapUploadsKeys(keyFile *uploadsKeyFile, secret []byte) (*uploadsKeys, error) {
+	salt, err := base64.RawStdEncoding.DecodeString(keyFile.Salt)
+	if err != nil {
+		return nil, err
+	}
+	wrappingKey, err := pbkdf2.Key(sha256.New, string(secret), salt, keyFile.Iterations, noteKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	unwrap := func(wrapped string) ([]byte, error) {
+		sealed, err := base64.RawStdEncoding.DecodeString(wrapped)
+		if err != nil {
+			return nil, err
+		}
+		data, err := decryptBytes(wrappingKey, sealed)
+		if err != nil {
+			return nil, ErrWrongUploadsSecret
+		}
+		return data, nil
+	}
+	keys := &uploadsKeys{dataKeys: make(map[string][]byte, len(keyFile.Keys)), current: keyFile.Keys[0].ID}
+	for _, wrapped := range keyFile.Keys {
+		if keys.dataKeys[wrapped.ID], err = unwrap(wrapped.Key); err != nil {
+			return nil, err
+		}
+	}
+	if keyFile.NameKey != "" {
+		if keys.nameKey, err = unwrap(keyFile.NameKey); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// saveUploadsKey atomically replaces the key file with keys wrapped under
+// secret, the current data key first.
+func saveUploadsKey(dir string, secret []byte, keys *uploadsKeys) error {
+	if len(secret) == 0 {
+		return errors.New("uploads passphrase or key file is empty")
+	}
+	salt := make([]byte, passwordSaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	wrappingKey, err := pbkdf2.Key(sha256.New, string(secret), salt, passwordIterations, noteKeyBytes)
+	if err != nil {
+		return err
+	}
+	wrap := func(key []byte) (string, error) {
+		sealed, err := encryptBytes(wrappingKey, key)
+		return base64.RawStdEncoding.EncodeToString(sealed), err
+	}
+	keyFile := uploadsKeyFile{Salt: base64.RawStdEncoding.EncodeToString(salt), Iterations: passwordIterations}
+	ids := []string{keys.current}
+	for id := range keys.dataKeys {
+		if id != keys.current {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range ids {
+		wrapped, err := wrap(keys.dataKeys[id])
+		if err != nil {
+			return err
+		}
+		keyFile.Keys = append(keyFile.Keys, wrappedUploadsKey{ID: id, Key: wrapped})
+	}
+	if keyFile.NameKey, err = wrap(keys.nameKey); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(keyFile, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(dir, ".uploads-key-*")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(data)
+	if syncErr := temp.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), filepath.Join(dir, UploadsKeyFileName))
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+	return err
+}
+
+func newUploadsDataKey() (string, []byte, error) {
+	id := make([]byte, uploadKeyIDBytes)
+	data := make([]byte, noteKeyBytes)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	if _, err := rand.Read(data); err != nil {
+		return "", nil, err
+	}
+	return hex.EncodeToString(id), data, nil
+}
+
+func newUploadsNameKey() ([]byte, error) {
+	key := make([]byte, noteKeyBytes)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func newUploadsKey(keys *uploadsKeys) (*UploadsKey, error) {
+	key := &UploadsKey{current: keys.current, aeads: make(map[string]cipher.AEAD, len(keys.dataKeys)), names: keys.nameKey}
+	for id, data := range keys.dataKeys {
+		aead, err := newAEAD(data)
+		if err != nil {
+			return nil, err
+		}
+		key.aeads[id] = aead
+	}
+	return key, nil
+}
+
+// blobHasher returns the hash that names blobs: the SHA-256 of the content,
+// or with a key its HMAC-SHA256 under the name key, so that listing the
+// uploads does not tell whether a known file is stored.
+func (k *UploadsKey) blobHasher() hash.Hash {
+	if k == nil {
+		return sha256.New()
+	}
+	return hmac.New(sha256.New, k.names)
+}
+
+// readUploadHeader reports whether file is an encrypted upload and the ID of
+// its data key.
+func readUploadHeader(file io.ReaderAt) (string, bool, error) {
+	header := make([]byte, len(uploadMagic)+uploadKeyIDBytes)
+	n, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return "", false, err
+	}
+	if n < len(header) || !bytes.HasPrefix(header, []byte(uploadMagic)) {
+		return "", false, nil
+	}
+	return hex.EncodeToString(header[len(uploadMagic):]), true, nil
+}
+
+// open returns a reader of the plaintext of a stored file. Files stored
+// without encryption are returned as they are.
+func (k *UploadsKey) open(file StorageObject) (io.ReadSeekCloser, error) {
+	id, encrypted, err := readUploadHeader(file)
+	if err != nil {
+		return nil, err
+	}
+	if !encrypted {
+		return newObjectReader(file), nil
+	}
+	if k == nil {
+		return nil, errors.New("file is encrypted, but no uploads key is configured")
+	}
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("file is encrypted with unknown uploads key %s", id)
+	}
+	return newUploadReader(file, aead, uploadHeaderBytes)
+}
+
+// newUploadReader decrypts file, which holds chunks sealed with aead after
+// a header of header bytes ending in the nonce prefix.
+func newUploadReader(file StorageObject, aead cipher.AEAD, header int) (*uploadReader, error) {
+	sealed := file.Size() - int64(header)
+	chunks := (sealed + uploadSealedChunk - 1) / uploadSealedChunk
+	if chunks == 0 || sealed-chunks*uploadTagBytes < 0 {
+		return nil, errors.New("encrypted file is truncated")
+	}
+	reader := &uploadReader{file: file, aead: aead, header: int64(header), chunks: chunks, size: sealed - chunks*uploadTagBytes, index: -1}
+	if _, err := file.ReadAt(reader.prefix[:], int64(header-uploadPrefixBytes)); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// encrypt returns a writer that encrypts into w; Close writes the last chunk.
+func (k *UploadsKey) encrypt(w io.Writer) (io.WriteCloser, error) {
+	id, err := hex.DecodeString(k.current)
+	if err != nil {
+		return nil, err
+	}
+	return newUploadWriter(w, k.aeads[k.current], append([]byte(uploadMagic), id...))
+}
+
+// newUploadWriter writes header and a random nonce prefix to w and returns a
+// writer that encrypts into w in chunks sealed with aead.
+func newUploadWriter(w io.Writer, aead cipher.AEAD, header []byte) (*uploadWriter, error) {
+	writer := &uploadWriter{w: w, aead: aead, buf: make([]byte, 0, uploadChunkSize)}
+	if _, err := rand.Read(writer.prefix[:]); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(header, writer.prefix[:]...)); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+func uploadNonce(prefix [uploadPrefixBytes]byte, index int64, last bool) []byte {
+	nonce := make([]byte, 0, uploadPrefixBytes+5)
+	nonce = append(nonce, prefix[:]...)
+	nonce = binary.BigEndian.AppendUint32(nonce, uint32(index))
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+type uploadWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix [uploadPrefixBytes]byte
+	index  int64
+	buf    []byte
+}
+
+func (u *uploadWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is sealed only once more data follows, so the last
+		// chunk is never empty unless the whole file is.
+		if len(u.buf) == uploadChunkSize {
+			if err := u.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := min(len(p), uploadChunkSize-len(u.buf))
+		u.buf = append(u.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (u *uploadWriter) Close() error {
+	return u.seal(true)
+}
+
+func (u *uploadWriter) seal(last bool) error {
+	if u.index > int64(^uint32(0)) {
+		return errors.New("file is too large to encrypt")
+	}
+	sealed := u.aead.Seal(nil, uploadNonce(u.prefix, u.index, last), u.buf, nil)
+	u.index++
+	u.buf = u.buf[:0]
+	_, err := u.w.Write(sealed)
+	return err
+}
+
+type uploadReader struct {
+	file   StorageObject
+	aead   cipher.AEAD
+	prefix [uploadPrefixBytes]byte
+	header int64
+	chunks int64
+	size   int64
+	pos    int64
+	index  int64
+	plain  []byte
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	if u.pos >= u.size {
+		return 0, io.EOF
+	}
+	index := u.pos / uploadChunkSize
+	if index != u.index {
+		if err := u.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, u.plain[u.pos-index*uploadChunkSize:])
+	u.pos += int64(n)
+	return n, nil
+}
+
+func (u *uploadReader) load(index int64) error {
+	sealed := make([]byte, uploadSealedChunk)
+	n, err := u.file.ReadAt(sealed, u.header+index*uploadSealedChunk)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	plain, err := u.aead.Open(u.plain[:0], uploadNonce(u.prefix, index, index == u.chunks-1), sealed[:n], nil)
+	if err != nil {
+		return fmt.Errorf("decrypt file: %w", err)
+	}
+	u.plain, u.index = plain, index
+	return nil
+}
+
+func (u *uploadReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += u.pos
+	case io.SeekEnd:
+		offset += u.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	u.pos = offset
+	return offset, nil
+}
+
+func (u *uploadReader) Close() error {
+	return u.file.Close()
+}
+
+// copyUpload copies src to dst, encrypting it when key is set.
+func copyUpload(dst io.Writer, src io.Reader, key *UploadsKey) error {
+	if key == nil {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+	writer, err := key.encrypt(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, src); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// openUpload opens a stored file for reading its plaintext.
+func (s *NotesService) openUpload(ctx context.Context, name string) (StoredFile, error) {
+	file, err := s.Storage.Open(ctx, name)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	reader, err := s.UploadsKey.open(file)
+	if err != nil {
+		file.Close()
+		return StoredFile{}, fmt.Errorf("file %s: %w", name, err)
+	}
+	return StoredFile{ReadSeekCloser: reader, ModTime: file.ModTime()}, nil
+}
+
+func (s *NotesService) readUpload(ctx context.Context, name string) ([]byte, error) {
+	file, err := s.openUpload(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadStreamRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewLocalStorage(dir)
+	ctx := context.Background()
+	key, err := OpenUploadsKey(dir, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, uploadChunkSize, uploadChunkSize + 1, 3*uploadChunkSize - 5} {
+		plain := make([]byte, size)
+		for i := range plain {
+			plain[i] = byte(i * 7)
+		}
+		path := filepath.Join(dir, "file.bin")
+		var sealed bytes.Buffer
+		if err := copyUpload(&sealed, bytes.NewReader(plain), key); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, sealed.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		file, err := storage.Open(ctx, "file.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := key.open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(reader)
+		if err != nil || !bytes.Equal(data, plain) {
+			t.Fatalf("size %d: read %d bytes, %v", size, len(data), err)
+		}
+		if end, err := reader.Seek(0, io.SeekEnd); err != nil || end != int64(size) {
+			t.Fatalf("size %d: end = %d, %v", size, end, err)
+		}
+		if size > 10 {
+			offset := int64(size - 10)
+			if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			tail, err := io.ReadAll(reader)
+			if err != nil || !bytes.Equal(tail, plain[offset:]) {
+				t.Fatalf("size %d: tail = %v, %v", size, tail, err)
+			}
+		}
+		reader.Close()
+	}
+
+	var sealed bytes.Buffer
+	if err := copyUpload(&sealed, bytes.NewReader(make([]byte, 2*uploadChunkSize)), key); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "truncated.bin")
+	truncated := sealed.Bytes()[:uploadHeaderBytes+uploadSealedChunk]
+	if err := os.WriteFile(path, truncated, 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := storage.Open(ctx, "truncated.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := key.open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(reader); err == nil {
+		t.Fatal("truncated file decrypted")
+	}
+}
+
+func TestEncryptedUploads(t *testing.T) {
+	service := newTestNotesService(t)
+	key, err := OpenUploadsKey(service.UploadsDir, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.UploadsKey = key
+	var picture bytes.Buffer
+	if err := png.Encode(&picture, image.NewGray(image.Rect(0, 0, 800, 600))); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	note, err := service.CreateNote(ctx, CreateNoteOptions{
+		Content: "Scans",
+		Attachments: []NewAttachment{
+			{Filename: "passport.txt", Data: []byte("passport number")},
+			{Filename: "photo.png", Data: picture.Bytes()},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	document, photo := note.Attachments[0], note.Attachments[1]
+	if photo.ThumbnailPath == "" {
+		t.Fatal("encrypted image got no thumbnail")
+	}
+	for _, name := range []string{document.storedFile, photo.storedFile, photo.storedThumbnail} {
+		onDisk, err := os.ReadFile(filepath.Join(service.UploadsDir, name))
+		if err != nil || !bytes.HasPrefix(onDisk, []byte(uploadMagic)) || bytes.Contains(onDisk, []byte("passport")) {
+			t.Fatalf("%s on disk is not encrypted: %v", name, err)
+		}
+	}
+	plainHash := sha256.Sum256([]byte("passport number"))
+	if document.storedFile == hex.EncodeToString(plainHash[:]) {
+		t.Fatal("encrypted upload is named by the SHA-256 of its content")
+	}
+	again, err := service.CreateNote(ctx, CreateNoteOptions{
+		Content:     "Copy",
+		Attachments: []NewAttachment{{Filename: "copy.txt", Data: []byte("passport number")}},
+	})
+	if err != nil || again.Attachments[0].storedFile != document.storedFile {
+		t.Fatalf("identical encrypted upload stored as %q, want %q: %v", again.Attachments[0].storedFile, document.storedFile, err)
+	}
+	if _, err := RekeyUploads(ctx, service.UploadsDir, service.Storage, "", []byte("correct horse"), []byte("battery staple")); err != nil {
+		t.Fatal(err)
+	}
+	if service.UploadsKey, err = OpenUploadsKey(service.UploadsDir, []byte("battery staple")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(service.UploadsKey.names, key.names) {
+		t.Fatal("rekey changed the name key")
+	}
+
+	_, data, err := service.GetAttachment(ctx, note.ID, document.ID)
+	if err != nil || string(data) != "passport number" {
+		t.Fatalf("attachment = %q, %v", data, err)
+	}
+	thumbnail, err := service.OpenFile(ctx, photo.ThumbnailPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	preview, err := jpeg.Decode(thumbnail)
+	thumbnail.Close()
+	if err != nil || preview.Bounds().Dx() != 640 {
+		t.Fatalf("thumbnail = %v, %v", preview, err)
+	}
+
+	service.UploadsKey = nil
+	if _, _, err := service.GetAttachment(ctx, note.ID, document.ID); err == nil {
+		t.Fatal("encrypted upload read without a key")
+	}
+}
+
+func TestRekeyUploads(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "old_note.txt"), []byte("plaintext from before"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	storage := NewLocalStorage(dir)
+	service := &NotesService{UploadsDir: dir, Storage: storage}
+	ctx := context.Background()
+	read := func(secret string) string {
+		t.Helper()
+		key, err := OpenUploadsKey(dir, []byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		service.UploadsKey = key
+		data, err := service.readUpload(ctx, "old_note.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	if rewritten, err := RekeyUploads(ctx, dir, storage, "", nil, []byte("first secret")); err != nil || rewritten != 1 {
+		t.Fatalf("encrypt = %d, %v", rewritten, err)
+	}
+	onDisk, err := os.ReadFile(filepath.Join(dir, "old_note.txt"))
+	if err != nil || !bytes.HasPrefix(onDisk, []byte(uploadMagic)) {
+		t.Fatalf("file on disk = %q, %v", onDisk, err)
+	}
+	if _, err := OpenUploadsKey(dir, []byte("wrong secret")); !errors.Is(err, ErrWrongUploadsSecret) {
+		t.Fatalf("wrong secret: %v", err)
+	}
+	if data := read("first secret"); data != "plaintext from before" {
+		t.Fatalf("after encrypting = %q", data)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "new_note.txt"), []byte("plaintext written later"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RekeyUploads(ctx, dir, storage, "", []byte("wrong secret"), []byte("second secret")); !errors.Is(err, ErrWrongUploadsSecret) {
+		t.Fatalf("rekey with a wrong secret: %v", err)
+	}
+	if rewritten, err := RekeyUploads(ctx, dir, storage, "", []byte("first secret"), []byte("second secret")); err != nil || rewritten != 2 {
+		t.Fatalf("rekey = %d, %v", rewritten, err)
+	}
+	if _, err := OpenUploadsKey(dir, []byte("first secret")); !errors.Is(err, ErrWrongUploadsSecret) {
+		t.Fatalf("old secret after rekey: %v", err)
+	}
+	if data := read("second secret"); data != "plaintext from before" {
+		t.Fatalf("after rekey = %q", data)
+	}
+
+	if rewritten, err := RekeyUploads(ctx, dir, storage, "", []byte("second secret"), nil); err != nil || rewritten != 2 {
+		t.Fatalf("decrypt = %d, %v", rewritten, err)
+	}
+	onDisk, err = os.ReadFile(filepath.Join(dir, "new_note.txt"))
+	if err != nil || string(onDisk) != "plaintext written later" {
+		t.Fatalf("decrypted file = %q, %v", onDisk, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, UploadsKeyFileName)); !os.IsNotExist(err) {
+		t.Fatalf("uploads key left after decrypting: %v", err)
+	}
+}
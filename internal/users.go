@@ -0,0 +1,366 @@
+package internal
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// DefaultOwnerID owns every note while the server has no accounts, and the
+// first account created takes over that notebook.
+const DefaultOwnerID int64 = 1
+
+const (
+	SessionLifetime     = 30 * 24 * time.Hour
+	minPasswordLength   = 8
+	maxUserNameLength   = 64
+	passwordHashScheme  = "pbkdf2-sha256"
+	passwordSaltBytes   = 16
+	passwordKeyBytes    = 32
+	sessionTokenBytes   = 32
+	sessionTouchTimeout = 24 * time.Hour
+)
+
+// passwordIterations is the PBKDF2 work factor for new hashes. Stored hashes
+// carry their own count, so raising it does not invalidate passwords.
+var passwordIterations = 600_000
+
+var ErrInvalidCredentials = errors.New("invalid user name or password")
+
+type User struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	CreatedAt string `json:"created_at"`
+}
+
+type userKey struct{}
+
+// WithUser scopes every NotesService call made with the returned context to
+// the notebook of userID.
+func WithUser(ctx context.Context, userID int64) context.Context {
+	return context.WithValue(ctx, userKey{}, userID)
+}
+
+// ownerID returns the user a call is made for. Calls without a user, such as
+// those of a server without accounts, act on the default notebook.
+func ownerID(ctx context.Context) int64 {
+	if id, ok := ctx.Value(userKey{}).(int64); ok && id > 0 {
+		return id
+	}
+	return DefaultOwnerID
+}
+
+// HasUsers reports whether any account exists. Until one does, the server
+// runs as a single-user notebook without login.
+func (s *NotesService) HasUsers(ctx context.Context) (bool, error) {
+	var exists bool
+	err := s.DB.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users)").Scan(&exists)
+	return exists, err
+}
+
+// CreateUser adds an account. An account created while there are none gets
+// DefaultOwnerID and with it the notebook used without accounts.
+func (s *NotesService) CreateUser(ctx context.Context, name, password string) (User, error) {
+	name, err := normalizeUserName(name)
+	if err != nil {
+		return User{}, err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+	var user User
+	err = s.DB.QueryRowContext(ctx, `
+		INSERT INTO users (id, name, password_hash)
+		VALUES (CASE WHEN EXISTS (SELECT 1 FROM users) THEN NULL ELSE ? END, ?, ?)
+		RETURNING id, name, created_at`, DefaultOwnerID, name, hash,
+	).Scan(&user.ID, &user.Name, &user.CreatedAt)
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return User{}, fmt.Errorf("user %q already exists", name)
+	}
+	return user, err
+}
+
+func (s *NotesService) ListUsers(ctx context.Context) ([]User, error) {
+	rows, err := s.DB.QueryContext(ctx, "SELECT id, name, created_at FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := []User{}
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Name, &user.CreatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// userByName returns sql.ErrNoRows for unknown names.
+func (s *NotesService) userByName(ctx context.Context, name string) (User, error) {
+	var user User
+	err := s.DB.QueryRowContext(ctx, "SELECT id, name, created_at FROM users WHERE name = ?", name).Scan(
+		&user.ID, &user.Name, &user.CreatedAt,
+	)
+	return user, err
+}
+
+// SetPassword replaces a user's password and signs out all their sessions.
+func (s *NotesService) SetPassword(ctx context.Context, name, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var id int64
+	if err := tx.QueryRowContext(ctx,
+		"UPDATE users SET password_hash = ? WHERE name = ? RETURNING id", hash, name,
+	).Scan(&id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("user %q not found", name)
+		}
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM sessions WHERE user_id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteUser removes an account together with all of its notes, tags,
+// attachment files and unfinished uploads. It returns the number of deleted
+// notes.
+func (s *NotesService) DeleteUser(ctx context.Context, name string) (int64, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var id int64
+	if err := tx.QueryRowContext(ctx, "DELETE FROM users WHERE name = ? RETURNING id", name).Scan(&id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("user %q not found", name)
+		}
+		return 0, err
+	}
+	ids, err := queryIDs(ctx, tx, "SELECT id FROM messages WHERE owner_id = ?", id)
+	if err != nil {
+		return 0, err
+	}
+	var files []string
+	var deleted int64
+	if len(ids) > 0 {
+		if files, deleted, err = deleteMessageRecords(ctx, tx, ids); err != nil {
+			return 0, err
+		}
+	}
+	for _, query := range []string{
+		"DELETE FROM tags WHERE owner_id = ?",
+		"DELETE FROM changes WHERE owner_id = ?",
+		"DELETE FROM idempotency_keys WHERE owner_id = ?",
+		"DELETE FROM api_tokens WHERE owner_id = ?",
+		"DELETE FROM note_keys WHERE owner_id = ?",
+	} {
+		if _, err := tx.ExecContext(ctx, query, id); err != nil {
+			return 0, err
+		}
+	}
+	uploads, err := queryValues[string](ctx, tx, "DELETE FROM upload_sessions WHERE owner_id = ? RETURNING id", id)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	s.keys.remove(id)
+	s.removeStoredFiles(files)
+	for _, upload := range uploads {
+		s.removeUploadSessionParts(upload)
+	}
+	return deleted, nil
+}
+
+// Authenticate checks a user name and password. Unknown names cost as much
+// as wrong passwords, so the response time does not reveal which accounts
+// exist.
+func (s *NotesService) Authenticate(ctx context.Context, name, password string) (User, error) {
+	user, _, err := s.authenticate(ctx, name, password)
+	return user, err
+}
+
+// authenticate is Authenticate that also returns the password hash the
+// password was checked against.
+func (s *NotesService) authenticate(ctx context.Context, name, password string) (User, string, error) {
+	var user User
+	var hash string
+	err := s.DB.QueryRowContext(ctx,
+		"SELECT id, name, created_at, password_hash FROM users WHERE name = ?", strings.TrimSpace(name),
+	).Scan(&user.ID, &user.Name, &user.CreatedAt, &hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		verifyPassword(dummyPasswordHash(), password)
+		return User{}, "", ErrInvalidCredentials
+	}
+	if err != nil {
+		return User{}, "", err
+	}
+	if !verifyPassword(hash, password) {
+		return User{}, "", ErrInvalidCredentials
+	}
+	return user, hash, nil
+}
+
+// passwordHash returns the stored password hash of a user, or an empty
+// string for a deleted account.
+func (s *NotesService) passwordHash(ctx context.Context, userID int64) (string, error) {
+	var hash string
+	err := s.DB.QueryRowContext(ctx, "SELECT password_hash FROM users WHERE id = ?", userID).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return hash, err
+}
+
+// CreateSession starts a login session and returns the token for the session
+// cookie. Only a hash of the token is stored.
+func (s *NotesService) CreateSession(ctx context.Context, userID int64) (string, time.Time, error) {
+	raw := make([]byte, sessionTokenBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	expires := time.Now().Add(SessionLifetime).UTC()
+	if _, err := s.DB.ExecContext(ctx, "DELETE FROM sessions WHERE expires_at < ?", time.Now().UTC().Format(time.DateTime)); err != nil {
+		return "", time.Time{}, err
+	}
+	if _, err := s.DB.ExecContext(ctx,
+		"INSERT INTO sessions (token_hash, user_id, expires_at) VALUES (?, ?, ?)",
+		hashSessionToken(token), userID, expires.Format(time.DateTime),
+	); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expires, nil
+}
+
+// SessionUser returns the user of a live session. Sessions in use are
+// extended, at most once a day, so active users stay signed in.
+func (s *NotesService) SessionUser(ctx context.Context, token string) (User, error) {
+	if token == "" {
+		return User{}, ErrInvalidCredentials
+	}
+	var user User
+	var expiresAt string
+	err := s.DB.QueryRowContext(ctx, `
+		SELECT u.id, u.name, u.created_at, s.expires_at
+		FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = ? AND s.expires_at > ?`,
+		hashSessionToken(token), time.Now().UTC().Format(time.DateTime),
+	).Scan(&user.ID, &user.Name, &user.CreatedAt, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if expires := parseDBTime(expiresAt); time.Until(expires) < SessionLifetime-sessionTouchTimeout {
+		if _, err := s.DB.ExecContext(ctx, "UPDATE sessions SET expires_at = ? WHERE token_hash = ?",
+			time.Now().Add(SessionLifetime).UTC().Format(time.DateTime), hashSessionToken(token),
+		); err != nil {
+			return User{}, err
+		}
+	}
+	return user, nil
+}
+
+func (s *NotesService) DeleteSession(ctx context.Context, token string) error {
+	_, err := s.DB.ExecContext(ctx, "DELETE FROM sessions WHERE token_hash = ?", hashSessionToken(token))
+	return err
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func normalizeUserName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("user name is required")
+	}
+	if len(name) > maxUserNameLength {
+		return "", fmt.Errorf("user name is longer than %d bytes", maxUserNameLength)
+	}
+	if strings.ContainsFunc(name, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) {
+		return "", errors.New("user name must not contain spaces")
+	}
+	return name, nil
+}
+
+// hashPassword encodes a salted PBKDF2-SHA256 hash as
+// pbkdf2-sha256$iterations$salt$key with base64 salt and key.
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	salt := make([]byte, passwordSaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, passwordKeyBytes)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join([]string{
+		passwordHashScheme,
+		strconv.Itoa(passwordIterations),
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	}, "$"), nil
+}
+
+func verifyPassword(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != passwordHashScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	return err == nil && subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// dummyPasswordHash is verified against for unknown user names.
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, err := hashPassword("goNotes timing guard")
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
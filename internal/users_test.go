@@ -0,0 +1,260 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func init() {
+	// Keep password hashing fast in tests; verification reads the count from
+	// each stored hash.
+	passwordIterations = 1000
+}
+
+func TestPasswordHashing(t *testing.T) {
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, passwordHashScheme+"$1000$") {
+		t.Fatalf("hash = %q", hash)
+	}
+	if !verifyPassword(hash, "correct horse") || verifyPassword(hash, "correct horsE") {
+		t.Fatal("password verification is wrong")
+	}
+	if other, _ := hashPassword("correct horse"); other == hash {
+		t.Fatal("hashes are not salted")
+	}
+	if _, err := hashPassword("short"); err == nil {
+		t.Fatal("short password accepted")
+	}
+}
+
+func TestUsersHavePrivateNotebooks(t *testing.T) {
+	service := newTestNotesService(t)
+	legacy, err := service.CreateNote(context.Background(), CreateNoteOptions{Content: "Written before accounts #family"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, err := service.CreateUser(context.Background(), "alice", "alice-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := service.CreateUser(context.Background(), "bob", "bob-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.ID != DefaultOwnerID || bob.ID == DefaultOwnerID {
+		t.Fatalf("alice = %d, bob = %d; the first account must own the existing notebook", alice.ID, bob.ID)
+	}
+	if _, err := service.CreateUser(context.Background(), "Alice", "another-password"); err == nil {
+		t.Fatal("duplicate user name accepted")
+	}
+	aliceCtx := WithUser(context.Background(), alice.ID)
+	bobCtx := WithUser(context.Background(), bob.ID)
+
+	if _, err := service.GetNote(aliceCtx, legacy.ID); err != nil {
+		t.Fatalf("alice cannot read the existing note: %v", err)
+	}
+	bobNote, err := service.CreateNote(bobCtx, CreateNoteOptions{Content: "Bob's plan #family\n\n[[Written before accounts]]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bobNote.Links) != 0 {
+		t.Fatalf("bob's title link resolved to another notebook: %v", bobNote.Links)
+	}
+
+	for _, check := range []struct {
+		name string
+		err  error
+	}{
+		{"get", func() error { _, err := service.GetNote(bobCtx, legacy.ID); return err }()},
+		{"update", func() error {
+			content := "hijacked"
+			_, err := service.UpdateNote(bobCtx, legacy.ID, UpdateNoteOptions{Content: &content})
+			return err
+		}()},
+		{"color", service.SetColor(bobCtx, legacy.ID, "red")},
+		{"revisions", func() error { _, err := service.ListRevisions(bobCtx, legacy.ID); return err }()},
+		{"reorder", service.ReorderNotes(bobCtx, []int64{legacy.ID, bobNote.ID})},
+	} {
+		if check.err == nil {
+			t.Errorf("bob could %s alice's note", check.name)
+		}
+	}
+	if affected, err := service.TrashOrDelete(bobCtx, []int64{legacy.ID}, ""); err != nil || affected != 0 {
+		t.Fatalf("bob trashed alice's note: affected = %d, err = %v", affected, err)
+	}
+	if affected, err := service.SetArchived(bobCtx, []int64{legacy.ID}, true); err != nil || affected != 0 {
+		t.Fatalf("bob archived alice's note: affected = %d, err = %v", affected, err)
+	}
+
+	for _, c := range []struct {
+		ctx  context.Context
+		want int64
+	}{{aliceCtx, legacy.ID}, {bobCtx, bobNote.ID}} {
+		listed, err := service.ListNotes(c.ctx, ListNotesOptions{Query: "family", Tags: []string{"family"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(listed.Notes) != 1 || listed.Notes[0].ID != c.want {
+			t.Fatalf("search = %+v, want only note %d", listed.Notes, c.want)
+		}
+		changes, err := service.ChangesSince(c.ctx, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, change := range changes {
+			if change.NoteID != c.want {
+				t.Fatalf("change log leaks note %d", change.NoteID)
+			}
+		}
+	}
+	if err := service.ReorderTags(bobCtx, []string{"family"}); err != nil {
+		t.Fatalf("bob cannot reorder his own tag: %v", err)
+	}
+
+	upload, err := service.CreateUploadSession(bobCtx, "holiday.mp4", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.AppendUploadSession(bobCtx, upload.ID, 0, strings.NewReader("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := service.DeleteUser(context.Background(), "bob")
+	if err != nil || deleted != 1 {
+		t.Fatalf("DeleteUser = %d, %v", deleted, err)
+	}
+	var uploads int
+	if err := service.DB.QueryRow("SELECT count(*) FROM upload_sessions").Scan(&uploads); err != nil || uploads != 0 {
+		t.Fatalf("upload sessions left after DeleteUser = %d, %v", uploads, err)
+	}
+	if parts, _ := filepath.Glob(filepath.Join(service.UploadsDir, ".session-*")); len(parts) != 0 {
+		t.Fatalf("upload chunks left after DeleteUser: %v", parts)
+	}
+	if _, err := service.GetNote(aliceCtx, legacy.ID); err != nil {
+		t.Fatalf("removing bob touched alice's notes: %v", err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	ctx := context.Background()
+	service := newTestNotesService(t)
+	user, err := service.CreateUser(ctx, "alice", "alice-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Authenticate(ctx, "alice", "wrong-password"); err != ErrInvalidCredentials {
+		t.Fatalf("wrong password: %v", err)
+	}
+	if _, err := service.Authenticate(ctx, "nobody", "alice-password"); err != ErrInvalidCredentials {
+		t.Fatalf("unknown user: %v", err)
+	}
+	if _, err := service.Authenticate(ctx, "ALICE", "alice-password"); err != nil {
+		t.Fatalf("user names are case-insensitive: %v", err)
+	}
+
+	token, _, err := service.CreateSession(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := service.SessionUser(ctx, token); err != nil || got.ID != user.ID {
+		t.Fatalf("SessionUser = %+v, %v", got, err)
+	}
+	if err := service.SetPassword(ctx, "alice", "new-password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.SessionUser(ctx, token); err != ErrInvalidCredentials {
+		t.Fatalf("session survived a password change: %v", err)
+	}
+
+	token, _, err = service.CreateSession(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := service.DeleteSession(ctx, token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.SessionUser(ctx, token); err != ErrInvalidCredentials {
+		t.Fatalf("session survived logout: %v", err)
+	}
+	if _, err := service.DB.Exec("INSERT INTO sessions (token_hash, user_id, expires_at) VALUES (?, ?, '2000-01-01 00:00:00')",
+		hashSessionToken("expired"), user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.SessionUser(ctx, "expired"); err != ErrInvalidCredentials {
+		t.Fatalf("expired session accepted: %v", err)
+	}
+}
+
+func TestAPIRequiresLoginOnceAccountsExist(t *testing.T) {
+	router, service := newTestAPIRouter(t)
+
+	status := decodeAPIResult[authStatus](t, callAPI(t, router, jsonAPIRequest(t, http.MethodGet, "/api/auth/me", "")))
+	if status.AccountsEnabled {
+		t.Fatal("accounts enabled without users")
+	}
+	callAPI(t, router, multipartAPIRequest(t, "/api/messages/send", map[string]string{"content": "Before accounts"}, nil))
+
+	if _, err := service.CreateUser(context.Background(), "alice", "alice-password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.CreateUser(context.Background(), "bob", "bob-password"); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/api/messages/list", "/api/tags/list", "/api/export", "/api/events"} {
+		if response := callAPI(t, router, jsonAPIRequest(t, http.MethodGet, path, "")); response.Code != http.StatusUnauthorized {
+			t.Fatalf("%s without a session: status %d", path, response.Code)
+		}
+	}
+	if response := callAPI(t, router, jsonAPIRequest(t, http.MethodPost, "/api/auth/login", `{"name":"alice","password":"nope-nope"}`)); response.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: status %d", response.Code)
+	}
+
+	login := func(name, password string) *http.Cookie {
+		t.Helper()
+		response := callAPI(t, router, jsonAPIRequest(t, http.MethodPost, "/api/auth/login", `{"name":"`+name+`","password":"`+password+`"}`))
+		decodeAPIResult[User](t, response)
+		for _, cookie := range response.Result().Cookies() {
+			if cookie.Name == sessionCookieName && cookie.HttpOnly {
+				return cookie
+			}
+		}
+		t.Fatal("login did not set an HttpOnly session cookie")
+		return nil
+	}
+	listNotes := func(cookie *http.Cookie) []MessageDTO {
+		t.Helper()
+		request := jsonAPIRequest(t, http.MethodGet, "/api/messages/list", "")
+		request.AddCookie(cookie)
+		return decodeAPIResult[[]MessageDTO](t, callAPI(t, router, request))
+	}
+
+	alice := login("alice", "alice-password")
+	if notes := listNotes(alice); len(notes) != 1 || notes[0].Content != "Before accounts" {
+		t.Fatalf("alice sees %+v", notes)
+	}
+	bob := login("bob", "bob-password")
+	if notes := listNotes(bob); len(notes) != 0 {
+		t.Fatalf("bob sees alice's notes: %+v", notes)
+	}
+
+	request := jsonAPIRequest(t, http.MethodGet, "/api/auth/me", "")
+	request.AddCookie(bob)
+	if status := decodeAPIResult[authStatus](t, callAPI(t, router, request)); !status.AccountsEnabled || status.User == nil || status.User.Name != "bob" {
+		t.Fatalf("me = %+v", status)
+	}
+	request = jsonAPIRequest(t, http.MethodPost, "/api/auth/logout", "")
+	request.AddCookie(bob)
+	decodeAPIResult[string](t, callAPI(t, router, request))
+	request = jsonAPIRequest(t, http.MethodGet, "/api/messages/list", "")
+	request.AddCookie(bob)
+	if response := callAPI(t, router, request); response.Code != http.StatusUnauthorized {
+		t.Fatalf("session works after logout: status %d", response.Code)
+	}
+}
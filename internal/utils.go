@@ -1,14 +1,9 @@
 package internal
 
 import (
-	"crypto/rand"
-	"encoding/hex"
-	"errors"
 	"image"
 	"image/jpeg"
 	"io"
-	"mime/multipart"
-	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -25,14 +20,18 @@ func generatePlaceholders(n int) string {
 	return strings.Join(p, ",")
 }
 
-func extractHashtags(text string) []string {
+func stripCode(text string) string {
 	// 1. Удаляем многострочные блоки кода: ```любой контент```
 	reCodeBlock := regexp.MustCompile("(?s)```.*?```")
 	cleanText := reCodeBlock.ReplaceAllString(text, "")
 
 	// 2. Удаляем инлайновые блоки кода: `контент`
 	reInlineCode := regexp.MustCompile("`.*?`")
-	cleanText = reInlineCode.ReplaceAllString(cleanText, "")
+	return reInlineCode.ReplaceAllString(cleanText, "")
+}
+
+func extractHashtags(text string) []string {
+	cleanText := stripCode(text)
 
 	// 3. Извлекаем хештеги из оставшегося "чистого" текста
 	// Используем обновленную регулярку, которая не берет знаки пунктуации в конце
@@ -55,56 +54,6 @@ func extractHashtags(text string) []string {
 	return result
 }
 
-func saveFile(fileHeader *multipart.FileHeader, destDir string) (string, error) {
-	src, err := fileHeader.Open()
-	if err != nil {
-		return "", err
-	}
-	defer src.Close()
-
-	originalName := filepath.Base(strings.ReplaceAll(fileHeader.Filename, "\\", "/"))
-	return saveReader(src, originalName, destDir)
-}
-
-func saveReader(src io.Reader, originalName, destDir string) (string, error) {
-	originalName = filepath.Base(strings.ReplaceAll(originalName, "\\", "/"))
-	if originalName == "" || originalName == "." {
-		return "", errors.New("invalid attachment filename")
-	}
-
-	for range 10 {
-		randomBytes := make([]byte, 16)
-		if _, err := rand.Read(randomBytes); err != nil {
-			return "", err
-		}
-
-		fileName := hex.EncodeToString(randomBytes) + "_" + originalName
-		destPath := filepath.Join(destDir, fileName)
-		dst, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
-		if errors.Is(err, os.ErrExist) {
-			continue
-		}
-		if err != nil {
-			return "", err
-		}
-
-		_, copyErr := io.Copy(dst, src)
-		closeErr := dst.Close()
-		if copyErr != nil {
-			_ = os.Remove(destPath)
-			return "", copyErr
-		}
-		if closeErr != nil {
-			_ = os.Remove(destPath)
-			return "", closeErr
-		}
-
-		return fileName, nil
-	}
-
-	return "", errors.New("could not allocate a unique attachment filename")
-}
-
 func isImage(name string) bool {
 	ext := strings.ToLower(filepath.Ext(name))
 	return ext == ".jpg" || ext == ".jpeg" || ext == ".png" || ext == ".gif" || ext == ".webp"
@@ -165,13 +114,7 @@ func applyOrientation(img image.Image, orientation string) image.Image {
 	return img
 }
 
-func generateThumbnail(originalPath string, thumbPath string) error {
-	file, err := os.Open(originalPath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
+func generateThumbnail(file io.ReadSeeker, out io.Writer) error {
 	var orientation = "1"
 	x, err := exif.Decode(file)
 	if err == nil {
@@ -192,11 +135,5 @@ func generateThumbnail(originalPath string, thumbPath string) error {
 
 	m := resize.Resize(640, 0, img, resize.Bilinear)
 
-	out, err := os.Create(thumbPath)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
 	return jpeg.Encode(out, m, &jpeg.Options{Quality: 90})
 }
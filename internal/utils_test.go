@@ -2,11 +2,10 @@ package internal
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"mime/multipart"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -44,51 +43,57 @@ func multipartFileHeader(t *testing.T, filename, content string) *multipart.File
 	return req.MultipartForm.File["attachments"][0]
 }
 
-func TestSaveFileDoesNotOverwriteSameFilename(t *testing.T) {
-	uploadsDir := t.TempDir()
-	firstHeader := multipartFileHeader(t, "report.txt", "first")
-	secondHeader := multipartFileHeader(t, "report.txt", "second")
-
-	firstName, err := saveFile(firstHeader, uploadsDir)
-	if err != nil {
-		t.Fatal(err)
-	}
-	secondName, err := saveFile(secondHeader, uploadsDir)
+func TestMultipartUploadsDoNotOverwriteSameFilename(t *testing.T) {
+	service := newTestNotesService(t)
+	ctx := context.Background()
+	note, err := service.CreateNote(ctx, CreateNoteOptions{
+		Content: "Reports",
+		Attachments: newMultipartAttachments([]*multipart.FileHeader{
+			multipartFileHeader(t, "report.txt", "first"),
+			multipartFileHeader(t, "report.txt", "second"),
+		}),
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if firstName == secondName {
-		t.Fatalf("same original filename was stored at the same path: %q", firstName)
+	first, second := note.Attachments[0], note.Attachments[1]
+	if first.FilePath == second.FilePath {
+		t.Fatalf("same original filename was stored at the same path: %q", first.FilePath)
 	}
-	for _, name := range []string{firstName, secondName} {
-		parts := strings.SplitN(name, "_", 2)
-		if len(parts) != 2 || parts[1] != "report.txt" {
-			t.Errorf("stored filename %q does not preserve the original filename", name)
+	for _, attachment := range note.Attachments {
+		parts := strings.SplitN(attachment.FilePath, "_", 2)
+		if len(parts) != 2 || parts[1] != "report.txt" || attachment.OriginalName != "report.txt" {
+			t.Errorf("stored filename %q does not preserve the original filename", attachment.FilePath)
 		}
 	}
 
-	firstContent, err := os.ReadFile(filepath.Join(uploadsDir, firstName))
-	if err != nil {
-		t.Fatal(err)
-	}
-	secondContent, err := os.ReadFile(filepath.Join(uploadsDir, secondName))
-	if err != nil {
-		t.Fatal(err)
-	}
-	if string(firstContent) != "first" || string(secondContent) != "second" {
-		t.Fatalf("stored contents = %q and %q, want %q and %q", firstContent, secondContent, "first", "second")
+	for i, want := range []string{"first", "second"} {
+		_, content, err := service.GetAttachment(ctx, note.ID, note.Attachments[i].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != want {
+			t.Fatalf("attachment %d content = %q, want %q", i, content, want)
+		}
 	}
 }
 
-func TestSaveFileUsesBaseFilename(t *testing.T) {
-	header := multipartFileHeader(t, `C:\\fakepath\\photo.jpg`, "image")
-
-	name, err := saveFile(header, t.TempDir())
+func TestMultipartUploadsUseBaseFilename(t *testing.T) {
+	service := newTestNotesService(t)
+	note, err := service.CreateNote(context.Background(), CreateNoteOptions{
+		Content:     "Photo",
+		Attachments: newMultipartAttachments([]*multipart.FileHeader{multipartFileHeader(t, `C:\\fakepath\\photo.jpg`, "image")}),
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !strings.HasSuffix(name, "_photo.jpg") {
-		t.Fatalf("stored filename = %q, want it to end with _photo.jpg", name)
+	attachment := note.Attachments[0]
+	if !strings.HasSuffix(attachment.FilePath, "_photo.jpg") || attachment.OriginalName != "photo.jpg" {
+		t.Fatalf("stored filename = %q, original name %q, want photo.jpg", attachment.FilePath, attachment.OriginalName)
+	}
+	// The MIME type comes from the content, which is text despite the name.
+	if attachment.Size != int64(len("image")) || attachment.MimeType != "text/plain; charset=utf-8" {
+		t.Fatalf("size = %d, MIME type = %q", attachment.Size, attachment.MimeType)
 	}
 }
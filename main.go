@@ -2,8 +2,10 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"goNotes/assets"
@@ -18,8 +20,6 @@ import (
 	"strings"
 	"time"
 
-	_ "embed"
-
 	"github.com/NYTimes/gziphandler"
 	_ "modernc.org/sqlite"
 )
@@ -28,9 +28,6 @@ var Version = "1.0.0-dev"
 
 var DEBUG_UI = os.Getenv("DEBUG_UI") == "1"
 
-//go:embed db.sql
-var schemaSQL string
-
 var db *sql.DB
 
 func main() {
@@ -46,31 +43,47 @@ func main() {
 
 	var config = cfg.LoadConfig()
 
-	db, err = sql.Open("sqlite", filepath.Join(cfg.GetProfilePath(), "notes.db?_pragma=journal_mode(WAL)&_pragma=foreign_keys(ON)"))
-	if err != nil {
-		log.Fatal(err)
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	internal.MigrateDB(db)
+	notesService := openNotesService()
+	go notesService.RunUploadSessionCleanup(context.Background(), time.Hour)
+	go notesService.RunChangeLogCleanup(context.Background(), time.Hour)
+	go backfillAttachmentMetadata(notesService)
 
-	if _, err := db.Exec(schemaSQL); err != nil {
-		log.Fatalf("Init DB error: %v", err)
+	if config.BackupIntervalHours > 0 {
+		interval := time.Duration(config.BackupIntervalHours) * time.Hour
+		go notesService.RunScheduledBackups(context.Background(), config.GetBackupDir(), interval, config.BackupKeep)
+		log.Printf("Scheduled backups every %s into %s", interval, config.GetBackupDir())
 	}
 
-	os.Mkdir(filepath.Join(cfg.GetProfilePath(), "uploads"), 0755)
+	auth, err := internal.NewAuth(notesService, internal.AuthOptions{
+		Mode:           config.AuthMode,
+		ProxyHeader:    config.AuthProxyHeader,
+		TrustedProxies: config.AuthTrustedProxies,
+	})
+	if err != nil {
+		log.Fatalf("Auth config error: %v", err)
+	}
+	if auth.Mode() == internal.AuthNone {
+		log.Printf("Authentication is disabled, anyone who can reach %s can read and change the notes", config.GetAddress())
+	} else {
+		log.Printf("Authentication mode: %s", auth.Mode())
+	}
 
 	router := internal.NewRouter()
-	notesService := internal.NewNotesService(db, filepath.Join(cfg.GetProfilePath(), "uploads"))
 
-	internal.HandleApi(router, notesService)
-	if config.MCPToken != "" {
-		internal.HandleMCP(router, notesService, config.MCPToken, Version)
-		log.Printf("MCP endpoint enabled at /mcp")
-	}
+	internal.HandleApi(router, notesService, auth)
+	internal.HandleMCP(router, notesService, config.MCPToken, Version)
+	internal.HandleShares(router, notesService)
 
-	router.Get("^/files/", handleGetFile)
+	router.Get("^/files/", auth.RequireFiles(handleGetFile(notesService)))
 
-	handleWww(router, &config)
+	handleWww(router, &config, auth)
 
 	address := config.GetAddress()
 
@@ -86,20 +99,157 @@ func main() {
 	}
 }
 
-func handleGetFile(w http.ResponseWriter, r *http.Request) {
+// openNotesService opens and migrates the profile database shared by the
+// server and the CLI subcommands.
+func openNotesService() *internal.NotesService {
+	uploadsDir := filepath.Join(cfg.GetProfilePath(), "uploads")
+	os.Mkdir(uploadsDir, 0755)
 
-	fileName := filepath.Base(r.URL.Path)
-	fullPath := filepath.Join(cfg.GetProfilePath(), "uploads", fileName)
+	config := cfg.LoadConfig()
+	key := openUploadsKey(config, uploadsDir)
+	db = openDB(config, key)
 
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-		http.Error(w, "File not found", http.StatusNotFound)
-		return
+	if err := internal.MigrateDB(db); err != nil {
+		log.Fatalf("Migrate DB error: %v", err)
 	}
 
-	http.ServeFile(w, r, fullPath)
+	service := internal.NewNotesService(db, uploadsDir)
+	service.Storage = openStorage(config, uploadsDir)
+	service.UploadsKey = key
+	service.MaxUploadSize = int64(config.MaxUploadMB) << 20
+	if moved, err := service.MigrateLegacyUploads(context.Background()); err != nil {
+		log.Printf("Move attachments into the blob store: %v", err)
+	} else if moved > 0 {
+		log.Printf("Moved %d attachments into the blob store.", moved)
+	}
+	return service
+}
+
+// backfillAttachmentMetadata reads the metadata of attachments stored by
+// older versions. It opens every such file, so the server runs it in the
+// background and `goNotes migrate up` runs it to the end.
+func backfillAttachmentMetadata(service *internal.NotesService) {
+	if inspected, err := service.BackfillAttachmentMetadata(context.Background()); err != nil {
+		log.Printf("Read attachment metadata: %v", err)
+	} else if inspected > 0 {
+		log.Printf("Read the metadata of %d attachments.", inspected)
+	}
+}
+
+// openUploadsKey unlocks the key of encrypted uploads, or returns nil when
+// they are stored as they are.
+func openUploadsKey(config cfg.Config, uploadsDir string) *internal.UploadsKey {
+	if !config.EncryptUploads {
+		if _, err := os.Stat(filepath.Join(uploadsDir, internal.UploadsKeyFileName)); err == nil {
+			log.Fatal("Uploads are encrypted: set EncryptUploads in the config, or run goNotes rekey -decrypt")
+		}
+		return nil
+	}
+	secret, err := config.GetUploadsSecret()
+	if err != nil {
+		log.Fatalf("Uploads key error: %v", err)
+	}
+	key, err := internal.OpenUploadsKey(uploadsDir, secret)
+	if err != nil {
+		log.Fatalf("Uploads key error: %v", err)
+	}
+	return key
+}
+
+// openStorage returns the attachment storage selected in the config.
+func openStorage(config cfg.Config, uploadsDir string) internal.Storage {
+	storage, err := newStorage(config, config.Storage, uploadsDir)
+	if err != nil {
+		log.Fatalf("Storage config error: %v", err)
+	}
+	return storage
+}
+
+func newStorage(config cfg.Config, backend, uploadsDir string) (internal.Storage, error) {
+	switch backend {
+	case "local":
+		return internal.NewLocalStorage(uploadsDir), nil
+	case "s3":
+		return internal.NewS3Storage(internal.S3Options{
+			Endpoint:        config.S3Endpoint,
+			Region:          config.S3Region,
+			Bucket:          config.S3Bucket,
+			Prefix:          config.S3Prefix,
+			AccessKeyID:     config.S3AccessKeyID,
+			SecretAccessKey: config.GetS3SecretAccessKey(),
+			PathStyle:       config.S3PathStyle,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage %q, use local or s3", backend)
+	}
+}
+
+// openDB opens notes.db, through the encrypting VFS when EncryptDatabase is
+// set. A plain database is encrypted with key the first time.
+func openDB(config cfg.Config, key *internal.UploadsKey) *sql.DB {
+	path := filepath.Join(cfg.GetProfilePath(), "notes.db")
+	encrypted, err := internal.IsEncryptedDatabase(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dsn := path + "?" + internal.DatabasePragmas
+	switch {
+	case !config.EncryptDatabase:
+		if encrypted {
+			log.Fatal("The database is encrypted: set EncryptDatabase in the config, or run goNotes rekey -decrypt")
+		}
+	case key == nil:
+		log.Fatal("EncryptDatabase needs EncryptUploads")
+	default:
+		if !encrypted {
+			if _, err := os.Stat(path); err == nil {
+				if err := internal.RekeyDatabase(path, nil, key); err != nil {
+					log.Fatalf("Encrypt database error: %v", err)
+				}
+				log.Println("Encrypted the database.")
+			}
+		}
+		vfs, err := internal.RegisterDatabaseVFS(key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dsn += "&vfs=" + vfs
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return db
+}
+
+// handleGetFile serves an uploaded file to the owner of its note.
+func handleGetFile(notesService *internal.NotesService) internal.RouteHandler {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		fileName := filepath.Base(r.URL.Path)
+
+		file, err := notesService.OpenFile(r.Context(), fileName)
+		if errors.Is(err, internal.ErrNoteLocked) {
+			http.Error(w, "Note is locked", http.StatusLocked)
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				log.Printf("File %s error: %v", fileName, err)
+			}
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		defer file.Close()
+
+		if file.Encrypted {
+			w.Header().Set("Cache-Control", "private, no-store")
+		}
+		http.ServeContent(w, r, fileName, file.ModTime, file)
+	}
 }
 
-func handleWww(router *internal.Router, config *cfg.Config) {
+func handleWww(router *internal.Router, config *cfg.Config, auth *internal.Auth) {
 	binTime := time.Now()
 	if binPath, err := os.Executable(); err == nil {
 		if binStat, err := os.Stat(binPath); err == nil {
@@ -157,5 +307,5 @@ func handleWww(router *internal.Router, config *cfg.Config) {
 		http.ServeContent(w, r, name, mTime, reader)
 	}))
 
-	router.Custom([]string{http.MethodGet, http.MethodHead}, []string{"^/"}, gzipHandler.ServeHTTP)
+	router.Custom([]string{http.MethodGet, http.MethodHead}, []string{"^/"}, auth.RequireUI(gzipHandler.ServeHTTP))
 }
@@ -17,6 +17,7 @@ import NotesHeader from './components/NotesHeader/NotesHeader';
 import TagsNavigation from './components/TagsNavigation/TagsNavigation';
 import {DESKTOP_NOTE_CARD_WIDTH} from './constants';
 import {SnackCtx} from './ctx/SnackCtx';
+import {useLiveUpdates} from './hooks/useLiveUpdates';
 import {useNotes} from './hooks/useNotes';
 import {api} from './tools/api';
 import {ArchiveNoteRequest, ReorderNotesRequest, RestoreNoteRequest} from './tools/types';
@@ -140,6 +141,7 @@ function App() {
     archived: showArchived,
     deleted: showTrash,
   });
+  useLiveUpdates();
   const isFetchingNextPageRef = useRef(isFetchingNextPage);
   isFetchingNextPageRef.current = isFetchingNextPage;
 
@@ -18,10 +18,12 @@ import {editor} from 'monaco-editor';
 
 import {SnackCtx} from '../../ctx/SnackCtx';
 import {useAppTheme} from '../../ctx/ThemeCtx';
-import {api} from '../../tools/api';
+import {NoteConflictError, api} from '../../tools/api';
 import {CreateNoteRequest, CreateNoteResponse, UpdateNoteRequest} from '../../tools/types';
 import {Attachment, Note} from '../../types';
+import {newClientId} from '../../utils/clientId';
 import EditorAttachments from '../EditorAttachments/EditorAttachments';
+import NoteConflictAlert from '../NoteConflictAlert/NoteConflictAlert';
 
 const MonacoEditor = lazy(() => import('@monaco-editor/react'));
 
@@ -132,9 +134,15 @@ const AdvancedNoteEditor: FC<AdvancedNoteEditorProps> = ({
 
   const [hasUnsavedChanges, setHasUnsavedChanges] = useState(false);
   const [hasRemoteChanges, setHasRemoteChanges] = useState(false);
+  const [conflictNote, setConflictNote] = useState<Note | null>(null);
   const autoSaveTimerRef = useRef<NodeJS.Timeout | null>(null);
   const changesTimerRef = useRef<NodeJS.Timeout | null>(null);
   const lastSavedContentRef = useRef<null | string>(editingNote?.content ?? '');
+  // versionRef is the version of the note the editor text is based on; the
+  // server rejects a save when the note has changed since.
+  const versionRef = useRef(editingNote?.version);
+  const conflictNoteRef = useRef(conflictNote);
+  conflictNoteRef.current = conflictNote;
 
   const editorRef = useRef<editor.IStandaloneCodeEditor>(null);
 
@@ -169,9 +177,11 @@ const AdvancedNoteEditor: FC<AdvancedNoteEditorProps> = ({
       } else {
         inputTextRef.current = content;
         editorRef.current?.setValue(content);
+        versionRef.current = editingNote.version;
         setHasRemoteChanges(false);
       }
     } else {
+      versionRef.current = Math.max(versionRef.current ?? 0, editingNote.version);
       setHasRemoteChanges(false);
     }
 
@@ -199,6 +209,7 @@ const AdvancedNoteEditor: FC<AdvancedNoteEditorProps> = ({
 
   const createNoteMutation = useMutation({
     mutationFn: (params: CreateNoteRequest) => api.notes.create(params),
+    retry: 3,
     onSuccess: (response: CreateNoteResponse) => {
       queryClient.invalidateQueries({queryKey: ['notes']});
       queryClient.invalidateQueries({queryKey: ['tags']});
@@ -216,24 +227,30 @@ const AdvancedNoteEditor: FC<AdvancedNoteEditorProps> = ({
 
   const updateNoteMutation = useMutation({
     mutationFn: (params: UpdateNoteRequest) => api.notes.update(params),
-    onSuccess: () => {
+    onSuccess: (_, params) => {
       queryClient.invalidateQueries({queryKey: ['notes']});
       queryClient.invalidateQueries({queryKey: ['tags']});
       if (editingNote) {
         queryClient.invalidateQueries({queryKey: ['note', editingNote.id]});
       }
+      // Every accepted update raises the version by one.
+      versionRef.current = Number(params.get('version')) + 1;
       lastSavedContentRef.current = inputTextRef.current;
       setFiles([]);
       setDeletedAttachIds([]);
       setHasUnsavedChanges(false);
     },
-    onError: () => {
+    onError: (error) => {
+      if (error instanceof NoteConflictError) {
+        setConflictNote(error.current);
+        return;
+      }
       showSnackbar('Ошибка при сохранении заметки', 'error');
     },
   });
 
   const saveNote = useCallback(() => {
-    if (!getHasChanges()) return;
+    if (!getHasChanges() || conflictNoteRef.current) return;
 
     const formData = new FormData();
     formData.append('content', inputTextRef.current);
@@ -243,6 +260,7 @@ const AdvancedNoteEditor: FC<AdvancedNoteEditorProps> = ({
     const editingNote = editingNoteRef.current;
     if (editingNote) {
       formData.append('id', String(editingNote.id));
+      formData.append('version', String(versionRef.current ?? editingNote.version));
 
       if (deletedAttachIds.length > 0) {
         formData.append('delete_attachments', deletedAttachIds.join(','));
@@ -250,6 +268,7 @@ const AdvancedNoteEditor: FC<AdvancedNoteEditorProps> = ({
 
       updateNoteMutation.mutate(formData);
     } else {
+      formData.append('client_id', newClientId());
       createNoteMutation.mutate(formData);
     }
   }, [
@@ -316,11 +335,36 @@ const AdvancedNoteEditor: FC<AdvancedNoteEditorProps> = ({
 
     inputTextRef.current = content;
     lastSavedContentRef.current = content;
+    versionRef.current = editingNote.version;
     editorRef.current?.setValue(content);
     setHasRemoteChanges(false);
     setHasUnsavedChanges(getHasChanges());
   }, [inputTextRef, getHasChanges]);
 
+  const handleUseServerVersion = useCallback(() => {
+    const current = conflictNoteRef.current;
+    if (!current) return;
+
+    inputTextRef.current = current.content;
+    lastSavedContentRef.current = current.content;
+    versionRef.current = current.version;
+    editorRef.current?.setValue(current.content);
+    setInputText(current.content);
+    setConflictNote(null);
+    setHasRemoteChanges(false);
+    setHasUnsavedChanges(getHasChanges());
+  }, [inputTextRef, setInputText, getHasChanges]);
+
+  const handleOverwrite = useCallback(() => {
+    const current = conflictNoteRef.current;
+    if (!current) return;
+
+    versionRef.current = current.version;
+    conflictNoteRef.current = null;
+    setConflictNote(null);
+    saveNote();
+  }, [saveNote]);
+
   const handleClose = useCallback(() => {
     if (hasUnsavedChanges) {
       if (window.confirm('У вас есть несохраненные изменения. Закрыть без сохранения?')) {
@@ -409,7 +453,14 @@ const AdvancedNoteEditor: FC<AdvancedNoteEditorProps> = ({
             содержимое.
           </Alert>
         )}
-        {(updateNoteMutation.isError || createNoteMutation.isError) && (
+        {conflictNote && (
+          <NoteConflictAlert
+            current={conflictNote}
+            onUseServer={handleUseServerVersion}
+            onOverwrite={handleOverwrite}
+          />
+        )}
+        {((updateNoteMutation.isError && !conflictNote) || createNoteMutation.isError) && (
           <Alert severity="error">
             {editingNote ? 'Ошибка при сохранении заметки' : 'Ошибка при создании заметки'}
           </Alert>
@@ -0,0 +1,76 @@
+import React, {FC, PropsWithChildren, useCallback, useContext, useEffect, useMemo} from 'react';
+
+import {Box, CircularProgress} from '@mui/material';
+import {useMutation, useQuery, useQueryClient} from '@tanstack/react-query';
+
+import {AuthCtx} from '../../ctx/AuthCtx';
+import {SnackCtx} from '../../ctx/SnackCtx';
+import {api, setUnauthorizedHandler} from '../../tools/api';
+import LoginPage from '../LoginPage/LoginPage';
+
+const loaderSx = {
+  display: 'flex',
+  alignItems: 'center',
+  justifyContent: 'center',
+  minHeight: '100vh',
+};
+
+// AuthGate shows the login page instead of the app while the server rejects
+// the browser for lack of a session.
+const AuthGate: FC<PropsWithChildren> = ({children}) => {
+  const queryClient = useQueryClient();
+  const showSnackbar = useContext(SnackCtx);
+
+  const {data: status, isLoading} = useQuery({
+    queryKey: ['auth'],
+    queryFn: () => api.auth.me(),
+    staleTime: Infinity,
+  });
+
+  useEffect(() => {
+    setUnauthorizedHandler(() => {
+      queryClient.invalidateQueries({queryKey: ['auth']});
+    });
+    return () => setUnauthorizedHandler(undefined);
+  }, [queryClient]);
+
+  const logoutMutation = useMutation({
+    mutationFn: () => api.auth.logout(),
+    onSuccess: () => {
+      queryClient.clear();
+    },
+    onError: (error: Error) => {
+      showSnackbar(error.message, 'error');
+    },
+  });
+
+  const {mutate: logout} = logoutMutation;
+
+  const handleLogin = useCallback(() => {
+    queryClient.clear();
+  }, [queryClient]);
+
+  const authValue = useMemo(
+    () => ({
+      user: status?.user ?? null,
+      logout: status?.mode === 'session' ? logout : undefined,
+    }),
+    [status, logout],
+  );
+
+  if (isLoading) {
+    return (
+      <Box sx={loaderSx}>
+        <CircularProgress />
+      </Box>
+    );
+  }
+
+  if (status?.mode === 'session' && status.login_required) {
+    return <LoginPage accountsEnabled={status.accounts_enabled} onLogin={handleLogin} />;
+  }
+
+  return <AuthCtx.Provider value={authValue}>{children}</AuthCtx.Provider>;
+};
+
+export default AuthGate;
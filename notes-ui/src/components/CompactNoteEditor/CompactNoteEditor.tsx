@@ -14,11 +14,13 @@ import {Box, Container, IconButton, Paper, TextField, Theme, alpha, useTheme} fr
 import {useMutation, useQueryClient} from '@tanstack/react-query';
 
 import {SnackCtx} from '../../ctx/SnackCtx';
-import {api} from '../../tools/api';
+import {NoteConflictError, api} from '../../tools/api';
 import {CreateNoteRequest, UpdateNoteRequest} from '../../tools/types';
 import {Attachment, Note} from '../../types';
+import {newClientId} from '../../utils/clientId';
 import {getNoteBackgroundColor, getNoteBorderColor} from '../../utils/noteColors';
 import EditorAttachments from '../EditorAttachments/EditorAttachments';
+import NoteConflictAlert from '../NoteConflictAlert/NoteConflictAlert';
 
 import EditingBanner from './EditingBanner';
 
@@ -111,6 +113,10 @@ const CompactNoteEditor: FC<CompactNoteEditorProps> = (props) => {
   const theme = useTheme();
   const inputRef = useRef<HTMLTextAreaElement>(null);
   const [isDragging, setIsDragging] = useState(false);
+  const [conflictNote, setConflictNote] = useState<Note | null>(null);
+  // baseVersionRef replaces the version of editingNote once the user resolved
+  // a conflict with the note saved elsewhere.
+  const baseVersionRef = useRef<number | undefined>(undefined);
   const inputTextRef = useRef(inputText);
   inputTextRef.current = inputText;
 
@@ -127,6 +133,11 @@ const CompactNoteEditor: FC<CompactNoteEditorProps> = (props) => {
     }
   }, [isDialogMode, editingNote]);
 
+  useEffect(() => {
+    setConflictNote(null);
+    baseVersionRef.current = undefined;
+  }, [editingNote]);
+
   useEffect(() => {
     if (isDialogMode && editingNote) {
       inputRef.current?.scrollIntoView(false);
@@ -160,11 +171,18 @@ const CompactNoteEditor: FC<CompactNoteEditorProps> = (props) => {
       queryClient.invalidateQueries({queryKey: ['tags']});
       onFinish();
     },
-    onError: () => showSnackbar('Ошибка при сохранении заметки', 'error'),
+    onError: (error) => {
+      if (error instanceof NoteConflictError) {
+        setConflictNote(error.current);
+        return;
+      }
+      showSnackbar('Ошибка при сохранении заметки', 'error');
+    },
   });
 
   const createNoteMutation = useMutation({
     mutationFn: (params: CreateNoteRequest) => api.notes.create(params),
+    retry: 3,
     onSuccess: () => {
       queryClient.invalidateQueries({queryKey: ['notes']});
       queryClient.invalidateQueries({queryKey: ['tags']});
@@ -191,6 +209,7 @@ const CompactNoteEditor: FC<CompactNoteEditorProps> = (props) => {
     let finalContent = inputTextRef.current;
     if (editingNote) {
       formData.append('id', String(editingNote.id));
+      formData.append('version', String(baseVersionRef.current ?? editingNote.version));
       formData.append('content', finalContent);
       formData.append('delete_attachments', deletedAttachIds.join(','));
       updateNoteMutation.mutate(formData);
@@ -201,6 +220,7 @@ const CompactNoteEditor: FC<CompactNoteEditorProps> = (props) => {
         .join(' ');
       if (addTags) finalContent += `\n ${addTags}`;
       formData.append('content', finalContent);
+      formData.append('client_id', newClientId());
       createNoteMutation.mutate(formData);
     }
   }, [
@@ -213,6 +233,20 @@ const CompactNoteEditor: FC<CompactNoteEditorProps> = (props) => {
     createNoteMutation,
   ]);
 
+  const handleUseServerVersion = useCallback(() => {
+    if (!conflictNote) return;
+    setInputText(conflictNote.content);
+    baseVersionRef.current = conflictNote.version;
+    setConflictNote(null);
+  }, [conflictNote, setInputText]);
+
+  const handleOverwrite = useCallback(() => {
+    if (!conflictNote) return;
+    baseVersionRef.current = conflictNote.version;
+    setConflictNote(null);
+    saveNote();
+  }, [conflictNote, saveNote]);
+
   const handleKeyDown = useCallback(
     (e: React.KeyboardEvent) => {
       if (e.key === 'Enter' && (e.ctrlKey || e.metaKey)) {
@@ -333,6 +367,13 @@ const CompactNoteEditor: FC<CompactNoteEditorProps> = (props) => {
     >
       <Container maxWidth={isDialogMode ? false : 'sm'} disableGutters sx={containerSx}>
         {!isDialogMode && editingNote && <EditingBanner onCancel={cancelEditing} />}
+        {conflictNote && (
+          <NoteConflictAlert
+            current={conflictNote}
+            onUseServer={handleUseServerVersion}
+            onOverwrite={handleOverwrite}
+          />
+        )}
 
         <Box sx={isDialogMode ? dialogScrollableContentSx : undefined}>
           <Box
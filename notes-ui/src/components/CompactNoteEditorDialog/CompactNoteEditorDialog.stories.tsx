@@ -40,6 +40,7 @@ const meta = {
       is_deleted: 0,
       is_expanded: 0,
       sort_order: 1,
+      version: 3,
     },
     files: [],
     setFiles: () => undefined,
@@ -0,0 +1,231 @@
+import React, {FC, useContext, useState} from 'react';
+
+import {
+  Box,
+  Button,
+  CircularProgress,
+  Dialog,
+  DialogActions,
+  DialogContent,
+  DialogContentText,
+  DialogTitle,
+  TextField,
+} from '@mui/material';
+import {useMutation, useQuery, useQueryClient} from '@tanstack/react-query';
+
+import {SnackCtx} from '../../ctx/SnackCtx';
+import {api} from '../../tools/api';
+
+const buttonSx = {
+  borderRadius: '6px',
+  textTransform: 'none',
+  '&:hover': {
+    bgcolor: 'action.hover',
+  },
+};
+
+const formSx = {display: 'flex', flexDirection: 'column', gap: 1.5, mt: 2};
+
+const MIN_PASSPHRASE_LENGTH = 8;
+
+interface EncryptionDialogProps {
+  open: boolean;
+  onClose: () => void;
+}
+
+const EncryptionDialog: FC<EncryptionDialogProps> = ({open, onClose}) => {
+  const showSnackbar = useContext(SnackCtx);
+  const queryClient = useQueryClient();
+  const [passphrase, setPassphrase] = useState('');
+  const [newPassphrase, setNewPassphrase] = useState('');
+
+  const {data: status, isLoading} = useQuery({
+    queryKey: ['encryption'],
+    queryFn: () => api.encryption.status(),
+    enabled: open,
+  });
+
+  const resetAndRefresh = () => {
+    setPassphrase('');
+    setNewPassphrase('');
+    queryClient.invalidateQueries({queryKey: ['encryption']});
+    queryClient.invalidateQueries({queryKey: ['notes']});
+  };
+
+  const onError = (err: Error) => {
+    console.error(err);
+    showSnackbar(`Ошибка: ${err.message}`, 'error');
+  };
+
+  const setupMutation = useMutation({
+    mutationFn: () => api.encryption.setup({passphrase}),
+    onSuccess: () => {
+      resetAndRefresh();
+      showSnackbar('Шифрование включено', 'success');
+    },
+    onError,
+  });
+
+  const unlockMutation = useMutation({
+    mutationFn: () => api.encryption.unlock({passphrase}),
+    onSuccess: () => {
+      resetAndRefresh();
+      onClose();
+    },
+    onError,
+  });
+
+  const lockMutation = useMutation({
+    mutationFn: () => api.encryption.lock(),
+    onSuccess: () => {
+      resetAndRefresh();
+      onClose();
+    },
+    onError,
+  });
+
+  const changeMutation = useMutation({
+    mutationFn: () => api.encryption.changePassphrase({passphrase, new_passphrase: newPassphrase}),
+    onSuccess: () => {
+      resetAndRefresh();
+      showSnackbar('Парольная фраза изменена', 'success');
+    },
+    onError,
+  });
+
+  const handleClose = () => {
+    setPassphrase('');
+    setNewPassphrase('');
+    onClose();
+  };
+
+  const passphraseField = (label: string, value: string, onChange: (value: string) => void) => (
+    <TextField
+      label={label}
+      type="password"
+      size="small"
+      autoComplete="off"
+      value={value}
+      onChange={(e) => onChange(e.target.value)}
+    />
+  );
+
+  const renderContent = () => {
+    if (isLoading || !status) {
+      return (
+        <Box sx={{display: 'flex', justifyContent: 'center', py: 2}}>
+          <CircularProgress size={24} />
+        </Box>
+      );
+    }
+    if (!status.configured) {
+      return (
+        <>
+          <DialogContentText>
+            Зашифрованные заметки и их вложения хранятся на сервере только в зашифрованном виде.
+            Без парольной фразы их не восстановить, а MCP и токены доступа их не читают.
+          </DialogContentText>
+          <Box sx={formSx}>
+            {passphraseField(
+              `Парольная фраза (от ${MIN_PASSPHRASE_LENGTH} символов)`,
+              passphrase,
+              setPassphrase,
+            )}
+            {passphraseField('Повторите парольную фразу', newPassphrase, setNewPassphrase)}
+          </Box>
+        </>
+      );
+    }
+    if (!status.unlocked) {
+      return (
+        <>
+          <DialogContentText>
+            Введите парольную фразу, чтобы читать и изменять зашифрованные заметки.
+          </DialogContentText>
+          <Box sx={formSx}>{passphraseField('Парольная фраза', passphrase, setPassphrase)}</Box>
+        </>
+      );
+    }
+    return (
+      <>
+        <DialogContentText>
+          Зашифрованные заметки открыты и закроются сами после 30 минут без обращений.
+        </DialogContentText>
+        <Box sx={formSx}>
+          {passphraseField('Текущая парольная фраза', passphrase, setPassphrase)}
+          {passphraseField('Новая парольная фраза', newPassphrase, setNewPassphrase)}
+        </Box>
+      </>
+    );
+  };
+
+  const renderActions = () => {
+    if (!status) return null;
+    if (!status.configured) {
+      return (
+        <Button
+          onClick={() => setupMutation.mutate()}
+          loading={setupMutation.isPending}
+          disabled={passphrase.length < MIN_PASSPHRASE_LENGTH || passphrase !== newPassphrase}
+          fullWidth
+          variant="text"
+          sx={buttonSx}
+        >
+          Включить шифрование
+        </Button>
+      );
+    }
+    if (!status.unlocked) {
+      return (
+        <Button
+          onClick={() => unlockMutation.mutate()}
+          loading={unlockMutation.isPending}
+          disabled={!passphrase}
+          fullWidth
+          variant="text"
+          sx={buttonSx}
+        >
+          Разблокировать
+        </Button>
+      );
+    }
+    return (
+      <>
+        <Button
+          onClick={() => changeMutation.mutate()}
+          loading={changeMutation.isPending}
+          disabled={!passphrase || newPassphrase.length < MIN_PASSPHRASE_LENGTH}
+          fullWidth
+          variant="text"
+          sx={buttonSx}
+        >
+          Сменить фразу
+        </Button>
+        <Button
+          onClick={() => lockMutation.mutate()}
+          loading={lockMutation.isPending}
+          fullWidth
+          variant="text"
+          sx={buttonSx}
+        >
+          Заблокировать
+        </Button>
+      </>
+    );
+  };
+
+  return (
+    <Dialog open={open} onClose={handleClose} fullWidth maxWidth="xs" transitionDuration={250}>
+      <DialogTitle>Зашифрованные заметки</DialogTitle>
+      <DialogContent>{renderContent()}</DialogContent>
+      <DialogActions>
+        {renderActions()}
+        <Button onClick={handleClose} fullWidth variant="text" sx={buttonSx}>
+          Закрыть
+        </Button>
+      </DialogActions>
+    </Dialog>
+  );
+};
+
+export default EncryptionDialog;
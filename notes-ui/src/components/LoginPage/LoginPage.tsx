@@ -0,0 +1,88 @@
+import React, {FC, FormEvent, useCallback, useState} from 'react';
+
+import {Alert, Box, Button, Paper, TextField, Typography} from '@mui/material';
+import {useMutation} from '@tanstack/react-query';
+
+import {api} from '../../tools/api';
+
+const containerSx = {
+  display: 'flex',
+  alignItems: 'center',
+  justifyContent: 'center',
+  minHeight: '100vh',
+  p: 2,
+};
+
+const paperSx = {
+  width: '100%',
+  maxWidth: 360,
+  p: 3,
+  display: 'flex',
+  flexDirection: 'column',
+  gap: 2,
+};
+
+interface LoginPageProps {
+  // accountsEnabled is false when the server has no accounts yet and only
+  // serves the machine it runs on.
+  accountsEnabled: boolean;
+  onLogin: () => void;
+}
+
+const LoginPage: FC<LoginPageProps> = ({accountsEnabled, onLogin}) => {
+  const [name, setName] = useState('');
+  const [password, setPassword] = useState('');
+
+  const loginMutation = useMutation({
+    mutationFn: () => api.auth.login({name, password}),
+    onSuccess: onLogin,
+  });
+
+  const handleSubmit = useCallback(
+    (event: FormEvent) => {
+      event.preventDefault();
+      loginMutation.mutate();
+    },
+    [loginMutation],
+  );
+
+  return (
+    <Box sx={containerSx}>
+      <Paper component="form" onSubmit={handleSubmit} sx={paperSx}>
+        <Typography variant="h6">Вход в goNotes</Typography>
+        {!accountsEnabled && (
+          <Alert severity="info">
+            Учётных записей пока нет, поэтому goNotes открывается только на компьютере, где он
+            запущен. Создайте учётную запись командой <code>goNotes user add</code>.
+          </Alert>
+        )}
+        {loginMutation.isError && <Alert severity="error">Неверное имя или пароль</Alert>}
+        <TextField
+          label="Имя"
+          value={name}
+          onChange={(e) => setName(e.target.value)}
+          autoComplete="username"
+          autoFocus
+          size="small"
+        />
+        <TextField
+          label="Пароль"
+          type="password"
+          value={password}
+          onChange={(e) => setPassword(e.target.value)}
+          autoComplete="current-password"
+          size="small"
+        />
+        <Button
+          type="submit"
+          variant="contained"
+          disabled={!name || !password || loginMutation.isPending}
+        >
+          Войти
+        </Button>
+      </Paper>
+    </Box>
+  );
+};
+
+export default LoginPage;
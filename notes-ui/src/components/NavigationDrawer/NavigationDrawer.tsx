@@ -1,4 +1,4 @@
-import React, {FC, PropsWithChildren, memo, useMemo} from 'react';
+import React, {FC, PropsWithChildren, memo, useContext, useMemo, useState} from 'react';
 
 import {
   Add as AddIcon,
@@ -6,6 +6,8 @@ import {
   DarkMode,
   DeleteOutlined,
   LightMode,
+  LockOutlined,
+  Logout,
 } from '@mui/icons-material';
 import {
   Box,
@@ -20,7 +22,9 @@ import {
 } from '@mui/material';
 
 import {HEADER_HEIGHT, SIDE_PANEL_WIDTH} from '../../constants';
+import {AuthCtx} from '../../ctx/AuthCtx';
 import {useAppTheme} from '../../ctx/ThemeCtx';
+import EncryptionDialog from '../EncryptionDialog/EncryptionDialog';
 
 const drawerSx = {
   width: SIDE_PANEL_WIDTH,
@@ -56,6 +60,8 @@ const NavigationDrawer: FC<NavigationDrawerProps> = ({
   const theme = useTheme();
   const isDesktop = useMediaQuery(theme.breakpoints.up('md'));
   const {mode, toggleTheme} = useAppTheme();
+  const {user, logout} = useContext(AuthCtx);
+  const [encryptionOpen, setEncryptionOpen] = useState(false);
 
   const drawerSlotProps = useMemo(
     () =>
@@ -121,6 +127,12 @@ const NavigationDrawer: FC<NavigationDrawerProps> = ({
           </ListItemIcon>
           <ListItemText primary="Корзина" slotProps={{primary: {sx: {fontSize: '0.85rem'}}}} />
         </ListItemButton>
+        <ListItemButton onClick={() => setEncryptionOpen(true)}>
+          <ListItemIcon sx={{minWidth: 40}}>
+            <LockOutlined sx={{fontSize: 18, color: 'text.secondary'}} />
+          </ListItemIcon>
+          <ListItemText primary="Шифрование" slotProps={{primary: {sx: {fontSize: '0.85rem'}}}} />
+        </ListItemButton>
         <ListItemButton onClick={toggleTheme}>
           <ListItemIcon sx={{minWidth: 40}}>
             {mode === 'dark' ? <DarkMode fontSize="small" /> : <LightMode fontSize="small" />}
@@ -131,7 +143,19 @@ const NavigationDrawer: FC<NavigationDrawerProps> = ({
           />
           <Switch edge="end" checked={mode === 'dark'} size="small" />
         </ListItemButton>
+        {user && logout && (
+          <ListItemButton onClick={logout}>
+            <ListItemIcon sx={{minWidth: 40}}>
+              <Logout fontSize="small" />
+            </ListItemIcon>
+            <ListItemText
+              primary={`Выйти (${user.name})`}
+              slotProps={{primary: {sx: {fontSize: '0.85rem'}}}}
+            />
+          </ListItemButton>
+        )}
       </Box>
+      <EncryptionDialog open={encryptionOpen} onClose={() => setEncryptionOpen(false)} />
     </SwipeableDrawer>
   );
 };
@@ -79,6 +79,7 @@ const meta = {
       is_deleted: 0,
       is_expanded: 0,
       sort_order: 1,
+      version: 1,
     },
     onTagClick: () => undefined,
     onOpenMenu: () => undefined,
@@ -113,6 +114,7 @@ export const Markdown: Story = {
       is_deleted: 0,
       is_expanded: 1,
       sort_order: 2,
+      version: 4,
       color: '#2196f3',
     },
     disableContentCollapse: true,
@@ -10,7 +10,7 @@ import React, {
 
 import {useSortable} from '@dnd-kit/sortable';
 import {CSS} from '@dnd-kit/utilities';
-import {ExpandLess, ExpandMore, MoreVert, Restore} from '@mui/icons-material';
+import {ExpandLess, ExpandMore, LockOutlined, MoreVert, Restore} from '@mui/icons-material';
 import {
   Box,
   Card,
@@ -78,6 +78,14 @@ const selectCheckboxSx = {
 
 const cardContentSx = {'&:last-child': {pb: 1.5}, p: 1.5};
 const contentContainerSx = {position: 'relative'};
+const lockedContentSx = {
+  display: 'flex',
+  alignItems: 'center',
+  gap: 1,
+  color: 'text.secondary',
+  py: 1,
+};
+const encryptedMarkSx = {fontSize: 14, color: 'text.secondary'};
 const expandOverlayButtonSx = {
   position: 'absolute',
   left: '50%',
@@ -418,9 +426,18 @@ const NoteCard: FC<NoteCardProps> = ({
           )}
           <Box sx={contentContainerSx}>
             <Box id={`note-content-${note.id}`} ref={contentRef} sx={contentBoxSx}>
-              <ReactMarkdown remarkPlugins={remarkPlugins} components={remarkComponents}>
-                {note.content}
-              </ReactMarkdown>
+              {note.locked ? (
+                <Box sx={lockedContentSx}>
+                  <LockOutlined fontSize="small" />
+                  <Typography variant="body2">
+                    Зашифрованная заметка. Разблокируйте заметки, чтобы прочитать её.
+                  </Typography>
+                </Box>
+              ) : (
+                <ReactMarkdown remarkPlugins={remarkPlugins} components={remarkComponents}>
+                  {note.content}
+                </ReactMarkdown>
+              )}
             </Box>
             {isContentCollapsed && (
               <Tooltip title="Развернуть" arrow>
@@ -438,7 +455,7 @@ const NoteCard: FC<NoteCardProps> = ({
               </Tooltip>
             )}
           </Box>
-          {note.attachments && note.attachments.length > 0 && (
+          {!note.locked && note.attachments && note.attachments.length > 0 && (
             <NoteAttachments attachments={note.attachments} />
           )}
           <Box sx={[bottomSx, {display: 'flex', alignItems: 'center'}]}>
@@ -481,6 +498,11 @@ const NoteCard: FC<NoteCardProps> = ({
                 </>
               )}
 
+              {note.is_encrypted === 1 && (
+                <Tooltip title="Зашифрована" arrow>
+                  <LockOutlined sx={encryptedMarkSx} />
+                </Tooltip>
+              )}
               <Tooltip title={fullDate} arrow>
                 <Typography variant="caption" sx={dateSx}>
                   <Link color="inherit" underline="none" href={dateLink}>
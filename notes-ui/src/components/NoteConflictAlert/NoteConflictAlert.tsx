@@ -0,0 +1,43 @@
+import React, {FC, memo} from 'react';
+
+import {Alert, AlertTitle, Box, Button} from '@mui/material';
+
+import {Note} from '../../types';
+
+const serverContentSx = {
+  maxHeight: 160,
+  overflowY: 'auto',
+  my: 1,
+  whiteSpace: 'pre-wrap',
+  wordBreak: 'break-word',
+  fontSize: '0.8rem',
+};
+
+const actionsSx = {display: 'flex', gap: 1, flexWrap: 'wrap'};
+
+interface NoteConflictAlertProps {
+  current: Note;
+  onUseServer: () => void;
+  onOverwrite: () => void;
+}
+
+// NoteConflictAlert shows the note as another device saved it after the
+// server rejected an update made on an older version, and lets the user keep
+// either text.
+const NoteConflictAlert: FC<NoteConflictAlertProps> = ({current, onUseServer, onOverwrite}) => (
+  <Alert severity="warning">
+    <AlertTitle>Заметка изменена на другом устройстве</AlertTitle>
+    Ваши изменения не сохранены. Сейчас на сервере:
+    <Box sx={serverContentSx}>{current.content}</Box>
+    <Box sx={actionsSx}>
+      <Button size="small" color="inherit" variant="outlined" onClick={onUseServer}>
+        Взять с сервера
+      </Button>
+      <Button size="small" color="inherit" onClick={onOverwrite}>
+        Сохранить мою версию
+      </Button>
+    </Box>
+  </Alert>
+);
+
+export default memo(NoteConflictAlert);
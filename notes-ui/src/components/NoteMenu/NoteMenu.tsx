@@ -7,7 +7,10 @@ import {
   Delete,
   Edit,
   LocalOfferOutlined,
+  LockOpenOutlined,
+  LockOutlined,
   RestoreFromTrash,
+  Share as ShareIcon,
   Sort,
   Unarchive,
 } from '@mui/icons-material';
@@ -27,10 +30,11 @@ import {useMutation, useQueryClient} from '@tanstack/react-query';
 import {NOTE_COLORS} from '../../constants';
 import {SnackCtx} from '../../ctx/SnackCtx';
 import {useTags} from '../../hooks/useTags';
-import {api} from '../../tools/api';
+import {NoteConflictError, api} from '../../tools/api';
 import {UpdateNoteRequest} from '../../tools/types';
 import {Note} from '../../types';
 import {addTagToNoteContent, removeTagFromNoteContent} from '../../utils/noteTags';
+import ShareDialog from '../ShareDialog/ShareDialog';
 import TagSelectionDialog from '../TagSelectionDialog/TagSelectionDialog';
 
 import ColorItem from './ColorItem';
@@ -102,6 +106,7 @@ const NoteMenu: FC<NoteMenuProps> = ({
   const theme = useTheme();
   const {data: allTags = []} = useTags();
   const [tagDialogNote, setTagDialogNote] = useState<Note | null>(null);
+  const [shareDialogNote, setShareDialogNote] = useState<Note | null>(null);
 
   const setColorMutation = useMutation({
     mutationFn: (color: string) => api.notes.setColor({id: note!.id, color}),
@@ -115,6 +120,20 @@ const NoteMenu: FC<NoteMenuProps> = ({
     },
   });
 
+  const setEncryptedMutation = useMutation({
+    mutationFn: (encrypted: boolean) => api.notes.setEncrypted({id: note!.id, encrypted}),
+    onSuccess: () => {
+      queryClient.invalidateQueries({queryKey: ['notes']});
+      queryClient.invalidateQueries({queryKey: ['tags']});
+      onClose();
+    },
+    onError: (err) => {
+      console.error(err);
+      showSnackbar(`Не удалось изменить шифрование: ${err.message}`, 'error');
+      onClose();
+    },
+  });
+
   const handleCopy = useCallback(() => {
     if (note) {
       navigator.clipboard.writeText(note.content);
@@ -130,6 +149,14 @@ const NoteMenu: FC<NoteMenuProps> = ({
       setTagDialogNote(null);
     },
     onError: (err) => {
+      if (err instanceof NoteConflictError) {
+        // Keep the dialog open on the note as it is now, so the tags can be
+        // picked again on top of the changes made elsewhere.
+        setTagDialogNote(err.current);
+        queryClient.invalidateQueries({queryKey: ['notes']});
+        showSnackbar('Заметка изменена на другом устройстве, выберите теги заново', 'warning');
+        return;
+      }
       console.error(err);
       showSnackbar('Ошибка при изменении тегов', 'error');
     },
@@ -153,6 +180,7 @@ const NoteMenu: FC<NoteMenuProps> = ({
       );
       const formData = new FormData();
       formData.append('id', String(tagDialogNote.id));
+      formData.append('version', String(tagDialogNote.version));
       formData.append('content', content);
       toggleTagMutation.mutate(formData);
     },
@@ -167,12 +195,50 @@ const NoteMenu: FC<NoteMenuProps> = ({
 
   const handleCloseTagDialog = useCallback(() => setTagDialogNote(null), []);
 
+  const handleOpenShareDialog = useCallback(() => {
+    if (!note) return;
+    setShareDialogNote(note);
+    onClose();
+  }, [onClose, note]);
+
+  const handleCloseShareDialog = useCallback(() => setShareDialogNote(null), []);
+
   const handleSelect = useCallback(() => {
     if (note) onEnterSelectionMode(note);
   }, [note, onEnterSelectionMode]);
 
   const menuActions = useMemo(() => {
     const isArchived = note?.is_archived;
+    const isEncrypted = note?.is_encrypted === 1;
+    // A locked note has no content here, so only actions that do not need it
+    // are offered.
+    const contentActions = note?.locked
+      ? []
+      : [
+          {
+            icon: <ContentCopy />,
+            text: 'Копировать',
+            onClick: handleCopy,
+            color: 'text.secondary',
+          },
+          {icon: <Edit />, text: 'Изменить', onClick: onEdit, color: 'primary.main'},
+          ...(isEncrypted
+            ? []
+            : [
+                {
+                  icon: <LocalOfferOutlined />,
+                  text: 'Изменить тег',
+                  onClick: handleOpenTagDialog,
+                  color: 'text.secondary',
+                },
+              ]),
+          {
+            icon: isEncrypted ? <LockOpenOutlined /> : <LockOutlined />,
+            text: isEncrypted ? 'Расшифровать' : 'Зашифровать',
+            onClick: () => setEncryptedMutation.mutate(!isEncrypted),
+            color: 'text.secondary',
+          },
+        ];
     return [
       {
         icon: <CheckCircleOutlined />,
@@ -180,19 +246,7 @@ const NoteMenu: FC<NoteMenuProps> = ({
         onClick: handleSelect,
         color: 'text.secondary',
       },
-      {
-        icon: <ContentCopy />,
-        text: 'Копировать',
-        onClick: handleCopy,
-        color: 'text.secondary',
-      },
-      {icon: <Edit />, text: 'Изменить', onClick: onEdit, color: 'primary.main'},
-      {
-        icon: <LocalOfferOutlined />,
-        text: 'Изменить тег',
-        onClick: handleOpenTagDialog,
-        color: 'text.secondary',
-      },
+      ...contentActions,
       ...(showTrash
         ? [
             {
@@ -215,10 +269,23 @@ const NoteMenu: FC<NoteMenuProps> = ({
               onClick: onEnterReorderMode,
               color: 'text.secondary',
             },
+            ...(note?.is_encrypted === 1
+              ? []
+              : [
+                  {
+                    icon: <ShareIcon />,
+                    text: 'Поделиться',
+                    onClick: handleOpenShareDialog,
+                    color: 'text.secondary',
+                  },
+                ]),
           ]),
     ];
   }, [
     note?.is_archived,
+    note?.is_encrypted,
+    note?.locked,
+    setEncryptedMutation,
     handleSelect,
     handleCopy,
     onEdit,
@@ -226,6 +293,7 @@ const NoteMenu: FC<NoteMenuProps> = ({
     onToggleArchive,
     onRestore,
     onEnterReorderMode,
+    handleOpenShareDialog,
     showTrash,
   ]);
 
@@ -280,6 +348,7 @@ const NoteMenu: FC<NoteMenuProps> = ({
         onClose={handleCloseTagDialog}
         onSubmit={handleUpdateTags}
       />
+      <ShareDialog note={shareDialogNote} onClose={handleCloseShareDialog} />
     </>
   );
 };
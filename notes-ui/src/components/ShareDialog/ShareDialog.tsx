@@ -0,0 +1,193 @@
+import React, {FC, useCallback, useContext, useState} from 'react';
+
+import {ContentCopy, Delete, LockOutlined} from '@mui/icons-material';
+import {
+  Box,
+  Button,
+  CircularProgress,
+  Dialog,
+  DialogActions,
+  DialogContent,
+  DialogContentText,
+  DialogTitle,
+  IconButton,
+  List,
+  ListItem,
+  ListItemText,
+  MenuItem,
+  TextField,
+  Tooltip,
+} from '@mui/material';
+import {useMutation, useQuery, useQueryClient} from '@tanstack/react-query';
+
+import {SnackCtx} from '../../ctx/SnackCtx';
+import {api} from '../../tools/api';
+import {Note, Share} from '../../types';
+
+const buttonSx = {
+  borderRadius: '6px',
+  textTransform: 'none',
+  '&:hover': {
+    bgcolor: 'action.hover',
+  },
+};
+
+const formSx = {display: 'flex', flexDirection: 'column', gap: 1.5, mt: 1};
+
+const EXPIRY_OPTIONS = [
+  {days: 0, label: 'Бессрочно'},
+  {days: 1, label: '1 день'},
+  {days: 7, label: '7 дней'},
+  {days: 30, label: '30 дней'},
+];
+
+const shareUrl = (share: Share) => new URL(share.path, window.location.origin).toString();
+
+const shareDescription = (share: Share) => {
+  const expiry = share.expires_at ? `до ${share.expires_at}` : 'бессрочно';
+  return share.has_password ? `${expiry}, с паролем` : expiry;
+};
+
+interface ShareDialogProps {
+  note: Note | null;
+  onClose: () => void;
+}
+
+const ShareDialog: FC<ShareDialogProps> = ({note, onClose}) => {
+  const showSnackbar = useContext(SnackCtx);
+  const queryClient = useQueryClient();
+  const [password, setPassword] = useState('');
+  const [expiresInDays, setExpiresInDays] = useState(0);
+  const noteId = note?.id ?? 0;
+
+  const {data: shares = [], isLoading} = useQuery({
+    queryKey: ['shares', noteId],
+    queryFn: () => api.shares.list({note_id: noteId}),
+    enabled: Boolean(note),
+  });
+
+  const copyLink = useCallback(
+    (share: Share) => {
+      navigator.clipboard.writeText(shareUrl(share));
+      showSnackbar('Ссылка скопирована', 'success');
+    },
+    [showSnackbar],
+  );
+
+  const createMutation = useMutation({
+    mutationFn: () =>
+      api.shares.create({note_id: noteId, password, expires_in_days: expiresInDays}),
+    onSuccess: (share) => {
+      queryClient.invalidateQueries({queryKey: ['shares', noteId]});
+      setPassword('');
+      copyLink(share);
+    },
+    onError: (err) => {
+      console.error(err);
+      showSnackbar(`Не удалось создать ссылку: ${err.message}`, 'error');
+    },
+  });
+
+  const revokeMutation = useMutation({
+    mutationFn: (id: number) => api.shares.revoke({id}),
+    onSuccess: () => {
+      queryClient.invalidateQueries({queryKey: ['shares', noteId]});
+    },
+    onError: (err) => {
+      console.error(err);
+      showSnackbar('Ошибка при отзыве ссылки', 'error');
+    },
+  });
+
+  return (
+    <Dialog open={Boolean(note)} onClose={onClose} fullWidth maxWidth="xs" transitionDuration={250}>
+      <DialogTitle>Поделиться заметкой</DialogTitle>
+      <DialogContent>
+        <DialogContentText>
+          Любой, у кого есть ссылка, сможет прочитать заметку и её вложения без входа.
+        </DialogContentText>
+        {isLoading ? (
+          <Box sx={{display: 'flex', justifyContent: 'center', py: 2}}>
+            <CircularProgress size={24} />
+          </Box>
+        ) : (
+          shares.length > 0 && (
+            <List dense>
+              {shares.map((share) => (
+                <ListItem
+                  key={share.id}
+                  disableGutters
+                  secondaryAction={
+                    <>
+                      <Tooltip title="Скопировать ссылку">
+                        <IconButton size="small" onClick={() => copyLink(share)}>
+                          <ContentCopy fontSize="small" />
+                        </IconButton>
+                      </Tooltip>
+                      <Tooltip title="Отозвать">
+                        <IconButton
+                          size="small"
+                          color="error"
+                          disabled={revokeMutation.isPending}
+                          onClick={() => revokeMutation.mutate(share.id)}
+                        >
+                          <Delete fontSize="small" />
+                        </IconButton>
+                      </Tooltip>
+                    </>
+                  }
+                >
+                  {share.has_password && <LockOutlined fontSize="small" sx={{mr: 1}} />}
+                  <ListItemText
+                    primary={share.path}
+                    secondary={shareDescription(share)}
+                    slotProps={{primary: {noWrap: true, sx: {pr: 8}}}}
+                  />
+                </ListItem>
+              ))}
+            </List>
+          )
+        )}
+        <Box sx={formSx}>
+          <TextField
+            select
+            label="Срок действия"
+            size="small"
+            value={expiresInDays}
+            onChange={(e) => setExpiresInDays(Number(e.target.value))}
+          >
+            {EXPIRY_OPTIONS.map((option) => (
+              <MenuItem key={option.days} value={option.days}>
+                {option.label}
+              </MenuItem>
+            ))}
+          </TextField>
+          <TextField
+            label="Пароль (необязательно)"
+            type="password"
+            size="small"
+            autoComplete="new-password"
+            value={password}
+            onChange={(e) => setPassword(e.target.value)}
+          />
+        </Box>
+      </DialogContent>
+      <DialogActions>
+        <Button
+          onClick={() => createMutation.mutate()}
+          loading={createMutation.isPending}
+          fullWidth
+          variant="text"
+          sx={buttonSx}
+        >
+          Создать ссылку
+        </Button>
+        <Button onClick={onClose} fullWidth variant="text" sx={buttonSx}>
+          Закрыть
+        </Button>
+      </DialogActions>
+    </Dialog>
+  );
+};
+
+export default ShareDialog;
@@ -0,0 +1,14 @@
+import React from 'react';
+
+import {User} from '../types';
+
+interface AuthContextType {
+  // user is null while the server runs without accounts.
+  user: User | null;
+  // logout is unset when the browser or a proxy holds the credentials.
+  logout?: () => void;
+}
+
+export const AuthCtx = React.createContext<AuthContextType>({
+  user: null,
+});
@@ -0,0 +1,29 @@
+import {useEffect} from 'react';
+
+import {useQueryClient} from '@tanstack/react-query';
+
+import {API_BASE} from '../constants';
+
+// Подписка на /api/events: изменения с других устройств и из MCP сразу
+// обновляют ленту. EventSource сам переподключается и передает Last-Event-ID.
+export const useLiveUpdates = () => {
+  const queryClient = useQueryClient();
+
+  useEffect(() => {
+    if (typeof EventSource === 'undefined') return;
+
+    const source = new EventSource(`${API_BASE}/api/events`);
+    source.onmessage = (event) => {
+      const change = JSON.parse(event.data) as {note_id: number};
+      queryClient.invalidateQueries({queryKey: ['notes']});
+      queryClient.invalidateQueries({queryKey: ['tags']});
+      queryClient.invalidateQueries({queryKey: ['note', change.note_id]});
+    };
+    // Пропущенные изменения уже удалены из журнала: перечитываем все.
+    source.addEventListener('resync', () => {
+      queryClient.invalidateQueries();
+    });
+
+    return () => source.close();
+  }, [queryClient]);
+};
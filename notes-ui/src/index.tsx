@@ -5,6 +5,7 @@ import {QueryClient, QueryClientProvider} from '@tanstack/react-query';
 import ReactDOM from 'react-dom/client';
 
 import App from './App';
+import AuthGate from './components/AuthGate/AuthGate';
 import SnackProvider from './components/SnackProvider/SnackProvider';
 import {AppThemeProvider} from './ctx/ThemeCtx';
 
@@ -32,7 +33,9 @@ root.render(
         <SnackProvider>
           <CssBaseline />
           <GlobalStyles styles={globalStyles} />
-          <App />
+          <AuthGate>
+            <App />
+          </AuthGate>
         </SnackProvider>
       </QueryClientProvider>
     </AppThemeProvider>
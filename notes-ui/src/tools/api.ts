@@ -1,10 +1,12 @@
 import axios, {AxiosRequestConfig, AxiosResponse} from 'axios';
 
 import {API_BASE} from '../constants';
+import {Note} from '../types';
 
 import {
   ArchiveNoteRequest,
   ArchiveNoteResponse,
+  AuthStatus,
   BatchArchiveRequest,
   BatchArchiveResponse,
   BatchDeleteRequest,
@@ -13,23 +15,40 @@ import {
   BatchRestoreResponse,
   BatchTagsRequest,
   BatchTagsResponse,
+  ChangePassphraseRequest,
+  ChangePassphraseResponse,
   CreateNoteRequest,
   CreateNoteResponse,
+  CreateShareRequest,
+  CreateShareResponse,
   DeleteNoteRequest,
   DeleteNoteResponse,
+  EncryptionStatusResponse,
   ListNotesRequest,
   ListNotesResponse,
+  ListSharesRequest,
+  ListSharesResponse,
   ListTagsResponse,
+  LockNotesResponse,
+  LoginRequest,
+  LoginResponse,
+  LogoutResponse,
   MarkNoteUsedRequest,
   MarkNoteUsedResponse,
+  PassphraseRequest,
+  PassphraseResponse,
   ReorderNotesRequest,
   ReorderNotesResponse,
   ReorderTagsRequest,
   ReorderTagsResponse,
   RestoreNoteRequest,
   RestoreNoteResponse,
+  RevokeShareRequest,
+  RevokeShareResponse,
   SetColorRequest,
   SetColorResponse,
+  SetEncryptedRequest,
+  SetEncryptedResponse,
   SetExpandedRequest,
   SetExpandedResponse,
   UpdateNoteRequest,
@@ -41,6 +60,45 @@ const client = axios.create({
   headers: {
     'Content-Type': 'application/json',
   },
+  // The server rejects browser changes that do not echo its CSRF cookie.
+  xsrfCookieName: 'gonotes_csrf',
+  xsrfHeaderName: 'X-CSRF-Token',
+});
+
+// NoteConflictError rejects an update sent with a stale note version; current
+// is the note as it is stored now.
+export class NoteConflictError extends Error {
+  current: Note;
+
+  constructor(message: string, current: Note) {
+    super(message);
+    this.current = current;
+  }
+}
+
+let unauthorizedHandler: (() => void) | undefined;
+
+// setUnauthorizedHandler is called whenever the server rejects a request
+// because the session is missing or has expired.
+export function setUnauthorizedHandler(handler: (() => void) | undefined) {
+  unauthorizedHandler = handler;
+}
+
+client.interceptors.response.use(undefined, (error) => {
+  if (axios.isAxiosError(error) && error.response?.status === 401) {
+    unauthorizedHandler?.();
+    const message = (error.response.data as {error?: string} | undefined)?.error;
+    if (message) {
+      return Promise.reject(new Error(message));
+    }
+  }
+  if (axios.isAxiosError(error) && error.response?.status === 409) {
+    const body = error.response.data as {error?: string; current?: Note} | undefined;
+    if (body?.current) {
+      return Promise.reject(new NoteConflictError(body.error ?? 'Conflict', body.current));
+    }
+  }
+  return Promise.reject(error);
 });
 
 async function handleResponse<T>(
@@ -88,19 +146,108 @@ function action<RequestParams = unknown, ResponseData = unknown>({
   };
 }
 
+// Files from this size up are sent in chunks through the resumable
+// /api/uploads endpoint before the note is saved, so a dropped connection on
+// a phone resumes the upload instead of starting it over.
+const RESUMABLE_UPLOAD_MIN_SIZE = 8 << 20;
+const UPLOAD_CHUNK_SIZE = 4 << 20;
+const UPLOAD_RETRIES = 5;
+
+const tusHeaders = {'Tus-Resumable': '1.0.0'};
+
+function encodeMetadata(value: string) {
+  return btoa(String.fromCharCode(...new TextEncoder().encode(value)));
+}
+
+async function uploadOffset(location: string) {
+  const response = await client.head(location, {headers: tusHeaders});
+  return Number(response.headers['upload-offset']);
+}
+
+async function uploadFile(file: File): Promise<string> {
+  const created = await client.post('/api/uploads', null, {
+    headers: {
+      ...tusHeaders,
+      'Upload-Length': String(file.size),
+      'Upload-Metadata': `filename ${encodeMetadata(file.name)}`,
+    },
+  });
+  const location: string = created.headers['location'];
+  let offset = 0;
+  let failures = 0;
+  while (offset < file.size) {
+    try {
+      const chunk = file.slice(offset, offset + UPLOAD_CHUNK_SIZE);
+      const response = await client.patch(location, chunk, {
+        headers: {
+          ...tusHeaders,
+          'Content-Type': 'application/offset+octet-stream',
+          'Upload-Offset': String(offset),
+        },
+      });
+      offset = Number(response.headers['upload-offset']);
+      failures = 0;
+    } catch (error) {
+      const status = axios.isAxiosError(error) ? error.response?.status : undefined;
+      if (++failures > UPLOAD_RETRIES || (status && status !== 409 && status < 500)) {
+        throw error;
+      }
+      await new Promise((resolve) => setTimeout(resolve, failures * 1000));
+      offset = await uploadOffset(location);
+    }
+  }
+  return location.slice(location.lastIndexOf('/') + 1);
+}
+
+// withUploads sends the large attachments of a note form as resumable
+// uploads and replaces them with the upload IDs before the form is posted.
+function withUploads<ResponseData>(send: (params: FormData) => Promise<ResponseData>) {
+  return async (params: FormData): Promise<ResponseData> => {
+    const files = params.getAll('attachments');
+    if (files.some((file) => file instanceof File && file.size >= RESUMABLE_UPLOAD_MIN_SIZE)) {
+      params.delete('attachments');
+      for (const file of files) {
+        if (file instanceof File && file.size >= RESUMABLE_UPLOAD_MIN_SIZE) {
+          params.append('uploads', await uploadFile(file));
+        } else {
+          params.append('attachments', file);
+        }
+      }
+    }
+    return send(params);
+  };
+}
+
 export const api = {
-  notes: {
-    list: action<ListNotesRequest, ListNotesResponse>({
-      path: '/api/messages/list',
+  auth: {
+    me: action<void, AuthStatus>({
+      path: '/api/auth/me',
     }),
-    create: action<CreateNoteRequest, CreateNoteResponse>({
+    login: action<LoginRequest, LoginResponse>({
       method: 'POST',
-      path: '/api/messages/send',
+      path: '/api/auth/login',
     }),
-    update: action<UpdateNoteRequest, UpdateNoteResponse>({
+    logout: action<void, LogoutResponse>({
       method: 'POST',
-      path: '/api/messages/update',
+      path: '/api/auth/logout',
+    }),
+  },
+  notes: {
+    list: action<ListNotesRequest, ListNotesResponse>({
+      path: '/api/messages/list',
     }),
+    create: withUploads(
+      action<CreateNoteRequest, CreateNoteResponse>({
+        method: 'POST',
+        path: '/api/messages/send',
+      }),
+    ),
+    update: withUploads(
+      action<UpdateNoteRequest, UpdateNoteResponse>({
+        method: 'POST',
+        path: '/api/messages/update',
+      }),
+    ),
     markUsed: action<MarkNoteUsedRequest, MarkNoteUsedResponse>({
       method: 'POST',
       path: '/api/messages/use',
@@ -145,6 +292,10 @@ export const api = {
       method: 'POST',
       path: '/api/messages/reorder',
     }),
+    setEncrypted: action<SetEncryptedRequest, SetEncryptedResponse>({
+      method: 'POST',
+      path: '/api/messages/set-encrypted',
+    }),
   },
   tags: {
     list: action<void, ListTagsResponse>({
@@ -155,4 +306,38 @@ export const api = {
       path: '/api/tags/reorder',
     }),
   },
+  shares: {
+    list: action<ListSharesRequest, ListSharesResponse>({
+      path: '/api/shares/list',
+    }),
+    create: action<CreateShareRequest, CreateShareResponse>({
+      method: 'POST',
+      path: '/api/shares/create',
+    }),
+    revoke: action<RevokeShareRequest, RevokeShareResponse>({
+      method: 'POST',
+      path: '/api/shares/revoke',
+    }),
+  },
+  encryption: {
+    status: action<void, EncryptionStatusResponse>({
+      path: '/api/encryption/status',
+    }),
+    setup: action<PassphraseRequest, PassphraseResponse>({
+      method: 'POST',
+      path: '/api/encryption/setup',
+    }),
+    unlock: action<PassphraseRequest, PassphraseResponse>({
+      method: 'POST',
+      path: '/api/encryption/unlock',
+    }),
+    lock: action<void, LockNotesResponse>({
+      method: 'POST',
+      path: '/api/encryption/lock',
+    }),
+    changePassphrase: action<ChangePassphraseRequest, ChangePassphraseResponse>({
+      method: 'POST',
+      path: '/api/encryption/passphrase',
+    }),
+  },
 };
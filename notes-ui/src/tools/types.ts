@@ -1,4 +1,4 @@
-import {Note} from '../types';
+import {EncryptionStatus, Note, Share, User} from '../types';
 
 export interface ListNotesRequest {
   id?: number;
@@ -87,3 +87,58 @@ export interface SetExpandedRequest {
   expanded: number;
 }
 export type SetExpandedResponse = 'ok';
+
+export type AuthMode = 'session' | 'basic' | 'proxy' | 'none';
+
+export interface AuthStatus {
+  mode: AuthMode;
+  accounts_enabled: boolean;
+  login_required: boolean;
+  user: User | null;
+}
+
+export interface LoginRequest {
+  name: string;
+  password: string;
+}
+export type LoginResponse = User;
+
+export type LogoutResponse = 'ok';
+
+export interface ListSharesRequest {
+  note_id?: number;
+}
+export type ListSharesResponse = Share[];
+
+export interface CreateShareRequest {
+  note_id: number;
+  password?: string;
+  expires_in_days?: number;
+}
+export type CreateShareResponse = Share;
+
+export interface RevokeShareRequest {
+  id: number;
+}
+export type RevokeShareResponse = 'ok';
+
+export interface SetEncryptedRequest {
+  id: number;
+  encrypted: boolean;
+}
+export type SetEncryptedResponse = Note;
+
+export type EncryptionStatusResponse = EncryptionStatus;
+
+export interface PassphraseRequest {
+  passphrase: string;
+}
+export type PassphraseResponse = 'ok';
+
+export interface ChangePassphraseRequest {
+  passphrase: string;
+  new_passphrase: string;
+}
+export type ChangePassphraseResponse = 'ok';
+
+export type LockNotesResponse = 'ok';
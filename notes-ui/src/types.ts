@@ -3,6 +3,13 @@ export interface Attachment {
   file_path: string;
   file_type: string;
   id: number;
+  original_name?: string;
+  size?: number;
+  mime_type?: string;
+  width?: number;
+  height?: number;
+  taken_at?: string;
+  duration?: number;
 }
 
 export interface Note {
@@ -17,4 +24,28 @@ export interface Note {
   is_expanded: number;
   sort_order: number;
   color?: string;
+  is_encrypted?: number;
+  locked?: boolean;
+  version: number;
+}
+
+export interface User {
+  id: number;
+  name: string;
+  created_at: string;
+}
+
+export interface Share {
+  id: number;
+  note_id: number;
+  token: string;
+  path: string;
+  has_password: boolean;
+  created_at: string;
+  expires_at: string | null;
+}
+
+export interface EncryptionStatus {
+  configured: boolean;
+  unlocked: boolean;
 }
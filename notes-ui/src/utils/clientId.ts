@@ -0,0 +1,7 @@
+// Identifies one write for the server's idempotency check, so a retried
+// request does not create the note twice. crypto.randomUUID is missing outside
+// secure contexts, e.g. when the app is opened over plain HTTP on a LAN.
+export const newClientId = () =>
+  typeof crypto.randomUUID === 'function'
+    ? crypto.randomUUID()
+    : `${Date.now().toString(36)}-${Math.random().toString(36).slice(2)}`;